@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/ikitiki/logical_backup/pkg/config"
 	"github.com/ikitiki/logical_backup/pkg/logicalbackup"
@@ -15,16 +17,31 @@ import (
 func main() {
 	ctx, done := context.WithCancel(context.Background())
 
-	if len(os.Args) < 2 {
-		fmt.Printf("usage:\n\t%s {config file}\n", os.Args[0])
+	recreateSlot := flag.Bool("recreate-slot", false, "Drop the replication slot and create it again, taking new base backups of all tables")
+	confirm := flag.Bool("discard-deltas", false, "Confirm -recreate-slot, which discards the changes not streamed from the old slot")
+	force := flag.Bool("force", false, "Terminate the process holding the replication slot, i.e. a stale connection of the previous run")
+	once := flag.Bool("once", false, "Take the base backups of all tables, print the outcome and exit, with a non-zero code if any failed")
+	catchUp := flag.Duration("catch-up", 0, "With -once, keep streaming the deltas after the base backups for up to this long")
+
+	config.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage:\n\t%s [flags] [config file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	cfg, err := config.New(os.Args[1])
+	cfg, err := config.New(flag.Arg(0), flag.CommandLine)
 	if err != nil {
 		log.Fatalf("could not init config: %v", err)
 	}
 
+	log.Printf("Effective config:\n%v", cfg)
+
 	log.Printf("Backup directory: %q", cfg.TempDir)
 	log.Printf("Archive directory: %q", cfg.ArchiveDir)
 	log.Printf("BackupThreshold: %v", cfg.BackupThreshold)
@@ -37,6 +54,23 @@ func main() {
 	log.Printf("Fsync: %t", cfg.Fsync)
 	log.Printf("SendStatusOnCommit: %t", cfg.SendStatusOnCommit)
 
+	if *force {
+		if err := logicalbackup.TakeOverSlot(ctx, cfg); err != nil {
+			log.Fatalf("could not take over replication slot: %v", err)
+		}
+	}
+
+	if *recreateSlot {
+		if !*confirm {
+			log.Fatalf("-recreate-slot breaks the continuity of the deltas: the changes between the old and the new slot position are lost; " +
+				"restoring before the new base backups complete would miss them. Add -discard-deltas to proceed")
+		}
+
+		if _, err := logicalbackup.RecreateSlot(ctx, cfg); err != nil {
+			log.Fatalf("could not recreate replication slot: %v", err)
+		}
+	}
+
 	lb, err := logicalbackup.New(ctx, cfg)
 	if err != nil {
 		log.Fatalf("could not create backup instance: %v", err)
@@ -47,9 +81,20 @@ func main() {
 
 	lb.Run()
 
-	if cfg.InitialBasebackup {
+	if *once {
+		go func() {
+			<-sigs
+			done()
+		}()
+		os.Exit(backupOnce(lb, *catchUp, done))
+	}
+
+	if cfg.InitialBasebackup || *recreateSlot && !cfg.DeltasOnly {
 		log.Printf("Queueing tables for the initial backup")
 		lb.QueueBasebackupTables()
+	} else if cfg.DeltasOnly {
+		log.Printf("Queueing tables to save their deltas-only info")
+		lb.QueueBasebackupTables()
 	}
 
 loop:
@@ -60,6 +105,9 @@ loop:
 		case syscall.SIGTERM:
 			break loop
 		case syscall.SIGHUP:
+			if err := cfg.Secrets().Reload(); err != nil {
+				log.Printf("could not reload credentials: %v", err)
+			}
 		default:
 			log.Printf("unhandled signal: %v", sig)
 		}
@@ -68,3 +116,30 @@ loop:
 	done()
 	lb.Wait()
 }
+
+// backupOnce runs the one-shot mode, returning the exit code
+func backupOnce(lb *logicalbackup.LogicalBackup, catchUp time.Duration, done func()) int {
+	results, err := lb.BackupOnce(catchUp)
+	done()
+	lb.Wait()
+
+	code := 0
+	for _, r := range results {
+		if r.Table == "" {
+			continue
+		}
+		if r.Outcome == logicalbackup.OnceFailed {
+			code = 1
+			fmt.Printf("%s\t%s\t%s\n", r.Table, r.Outcome, r.Error)
+		} else {
+			fmt.Printf("%s\t%s\n", r.Table, r.Outcome)
+		}
+	}
+
+	if err != nil {
+		log.Printf("one-shot backup interrupted: %v", err)
+		return 1
+	}
+
+	return code
+}
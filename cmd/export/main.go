@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/cdc"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+func main() {
+	dir := flag.String("dir", "", "Backups dir")
+	pgTable := flag.String("table", "", "Table name")
+	fromLSN := flag.String("from-lsn", "", "Export the transactions committed after this LSN")
+	toLSN := flag.String("to-lsn", "", "Export the transactions committed up to this LSN")
+	offsetFile := flag.String("offset-file", "", "File with the LSN of the last exported transaction, read on start and written on success")
+	envelope := flag.String("envelope", cdc.EnvelopeDebezium, "Format of the events, debezium, json or sql")
+	withKey := flag.Bool("with-key", false, "Prefix each event with its replica identity key and a tab, i.e. for kcat -K")
+	schemas := flag.Bool("schemas", false, "Store the JSON Schema of the events in the table archive dir and reference it in each event")
+	schemaDir := flag.String("schema-dir", "", "Store the JSON Schema of the events in this dir instead, implies -schemas")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *pgTable == "" || *dir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	table := message.Identifier{Namespace: "public"}
+	tableParts := strings.Split(*pgTable, ".")
+	switch len(tableParts) {
+	case 2:
+		table.Namespace, table.Name = tableParts[0], tableParts[1]
+	case 1:
+		table.Name = tableParts[0]
+	default:
+		log.Fatalf("invalid table name")
+	}
+
+	if *envelope != cdc.EnvelopeDebezium && *envelope != cdc.EnvelopeJSON && *envelope != cdc.EnvelopeSQL {
+		log.Fatalf("envelope must be one of %q, %q or %q", cdc.EnvelopeDebezium, cdc.EnvelopeJSON, cdc.EnvelopeSQL)
+	}
+	if *envelope == cdc.EnvelopeSQL && *withKey {
+		log.Fatalf("with-key can't be used with the sql envelope")
+	}
+	opts := cdc.Options{Envelope: *envelope, WithKey: *withKey, SchemaDir: *schemaDir}
+	if *schemas && opts.SchemaDir == "" {
+		opts.SchemaDir = path.Join(*dir, utils.TableDir(table), cdc.SchemasDir)
+	}
+
+	if *offsetFile != "" && *fromLSN == "" {
+		if data, err := ioutil.ReadFile(*offsetFile); err == nil {
+			*fromLSN = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			log.Fatalf("could not read offset file: %v", err)
+		}
+	}
+
+	if *fromLSN != "" {
+		lsn, err := pgx.ParseLSN(*fromLSN)
+		if err != nil {
+			log.Fatalf("invalid from-lsn: %v", err)
+		}
+		opts.FromLSN = lsn
+	}
+
+	if *toLSN != "" {
+		lsn, err := pgx.ParseLSN(*toLSN)
+		if err != nil {
+			log.Fatalf("invalid to-lsn: %v", err)
+		}
+		opts.ToLSN = lsn
+	}
+
+	if opts.FromLSN != 0 && opts.ToLSN != 0 && opts.FromLSN > opts.ToLSN {
+		log.Fatalf("from-lsn must not be greater than to-lsn")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	lastLSN, events, err := cdc.Export(*dir, table, opts, w)
+	if flushErr := w.Flush(); err == nil && flushErr != nil {
+		err = fmt.Errorf("could not write events: %v", flushErr)
+	}
+	if err != nil {
+		log.Fatalf("could not export %s: %v", table, err)
+	}
+	log.Printf("exported %d events of %s up to %s", events, table, pgx.FormatLSN(lastLSN))
+
+	if *offsetFile != "" {
+		if err := ioutil.WriteFile(*offsetFile+".new", []byte(pgx.FormatLSN(lastLSN)+"\n"), 0640); err != nil {
+			log.Fatalf("could not write offset file: %v", err)
+		}
+		if err := os.Rename(*offsetFile+".new", *offsetFile); err != nil {
+			log.Fatalf("could not move offset file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/ikitiki/logical_backup/pkg/gc"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+func main() {
+	dir := flag.String("dir", "", "Archive dir of the backups")
+	dryRun := flag.Bool("dry-run", false, "Only report the files which would be removed or merged")
+	compactBelow := flag.Int64("compact-below", 0, "Merge consecutive delta files smaller than this many bytes, 0 to disable")
+	retainFor := flag.Duration("retain-deltas-for", 0, "Keep the delta files preceding the latest base backup modified within this period")
+	retainFiles := flag.Int("retain-deltas", 0, "Keep this many latest delta files preceding the latest base backup")
+
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	stats, err := gc.Run(*dir, gc.Options{
+		DryRun:       *dryRun,
+		CompactBelow: *compactBelow,
+		Retention:    utils.DeltaRetention{Period: *retainFor, Files: *retainFiles},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("processed %d tables: removed %d files, merged %d delta files, reclaimed %d bytes",
+		stats.Tables, stats.FilesRemoved, stats.FilesCompacted, stats.BytesReclaimed)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/decoder"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+type summary struct {
+	format       string
+	relations    map[uint32]message.Relation
+	firstLSN     uint64
+	lastLSN      uint64
+	firstCommit  time.Time
+	lastCommit   time.Time
+	firstXID     int32
+	lastXID      int32
+	begin        message.Begin // of the current transaction
+	transactions int
+	counts       map[string]int
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "Print every change stored in the file")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] delta file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, filename := range flag.Args() {
+		if err := inspect(filename, *verbose); err != nil {
+			log.Fatalf("could not inspect %q: %v", filename, err)
+		}
+	}
+}
+
+func inspect(filename string, verbose bool) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	dr, err := decoder.NewDeltaReader(fp)
+	if err != nil {
+		return err
+	}
+
+	s := summary{
+		format:    dr.Format(),
+		relations: make(map[uint32]message.Relation),
+		counts:    make(map[string]int),
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		m, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read message: %v", err)
+		}
+
+		s.add(m)
+
+		if verbose {
+			var rel message.Relation
+			switch v := m.(type) {
+			case message.Insert:
+				rel = s.relations[v.RelationOID]
+			case message.Update:
+				rel = s.relations[v.RelationOID]
+			case message.Delete:
+				rel = s.relations[v.RelationOID]
+			}
+
+			if d := message.NewJSONDelta(m, rel); d != nil {
+				d.SetCommitInfo(s.begin)
+				if err := enc.Encode(d); err != nil {
+					return fmt.Errorf("could not print message: %v", err)
+				}
+			}
+		}
+	}
+
+	s.print(filename)
+
+	return nil
+}
+
+func (s *summary) add(m message.Message) {
+	switch v := m.(type) {
+	case message.Begin:
+		if s.firstLSN == 0 {
+			s.firstLSN = v.FinalLSN
+		}
+		s.lastLSN = v.FinalLSN
+		if s.firstXID == 0 {
+			s.firstXID = v.XID
+		}
+		s.lastXID = v.XID
+		s.begin = v
+		s.transactions++
+		s.counts[message.OpBegin]++
+	case message.Commit:
+		if s.firstCommit.IsZero() {
+			s.firstCommit = v.Timestamp
+		}
+		s.lastCommit = v.Timestamp
+		s.counts[message.OpCommit]++
+	case message.Relation:
+		s.relations[v.OID] = v
+		s.counts[message.OpRelation]++
+	case message.Insert:
+		s.counts[message.OpInsert]++
+	case message.Update:
+		s.counts[message.OpUpdate]++
+	case message.Delete:
+		s.counts[message.OpDelete]++
+	}
+}
+
+func (s *summary) print(filename string) {
+	fmt.Printf("file:         %s\n", filename)
+	fmt.Printf("format:       %s\n", s.format)
+	for oid, rel := range s.relations {
+		fmt.Printf("relation:     %s (oid %d, %d columns)\n", rel.Identifier, oid, len(rel.Columns))
+	}
+	fmt.Printf("lsn range:    %s - %s\n", pgx.FormatLSN(s.firstLSN), pgx.FormatLSN(s.lastLSN))
+	if !s.firstCommit.IsZero() {
+		fmt.Printf("commit times: %s - %s\n", s.firstCommit.Format(time.RFC3339), s.lastCommit.Format(time.RFC3339))
+	}
+	fmt.Printf("xid range:    %d - %d\n", s.firstXID, s.lastXID)
+	fmt.Printf("transactions: %d\n", s.transactions)
+	for _, op := range []string{message.OpInsert, message.OpUpdate, message.OpDelete, message.OpRelation} {
+		fmt.Printf("%-13s %d\n", op+":", s.counts[op])
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/jackc/pgx"
 
 	"github.com/ikitiki/logical_backup/pkg/logicalrestore"
+	"github.com/ikitiki/logical_backup/pkg/message"
 )
 
 func main() {
@@ -20,25 +24,148 @@ func main() {
 	pgHost := flag.String("host", "localhost", "Postgres server hostname")
 	pgPort := flag.Uint("port", 5432, "Postgres server port")
 	pgTable := flag.String("table", "", "Table name")
+	pgTables := flag.String("tables", "", "Comma-separated tables restored together, applying their deltas in the commit order across the tables")
+	hypertable := flag.String("hypertable", "", "TimescaleDB hypertable to restore all the chunks of, together as with tables")
 	dir := flag.String("dir", "", "Backups dir")
+	fromLSN := flag.String("from-lsn", "", "Use the base backup taken at or before this LSN")
+	toLSN := flag.String("to-lsn", "", "Replay deltas up to this LSN")
+	skipSequences := flag.Bool("skip-sequences", false, "Do not set the sequences owned by the table")
+	insertBatch := flag.Int("insert-batch", 100, "Apply up to this many consecutive inserts of the deltas with a single statement")
+	allowVersionMismatch := flag.Bool("allow-version-mismatch", false, "Load the binary base backup taken from another major version")
+	allowSchemaDrift := flag.Bool("allow-schema-drift", false, "Only log the differences of the target table from the schema embedded in the base backup")
+	createTable := flag.Bool("create-table", false, "Create the table from the ddl stored with the base backup")
+	subscription := flag.String("subscription", "", "Create the subscription of that name continuing from the base backup instead of applying the deltas")
+	publisher := flag.String("publisher", "", "Connection string of the publisher of the subscription")
+	publication := flag.String("publication", "", "Publication of the subscription")
+	subscriptionSlot := flag.String("subscription-slot", "", "Existing replication slot on the publisher, created before the base backup")
+	transforms := flag.String("transform", "", "Comma-separated column=transform pairs rewriting the restored values, the transform being one of hash, email or redact")
+	printMessages := flag.Bool("print-messages", false, "Log the logical decoding messages stored with logicalMessages along with the deltas")
+	printSubscription := flag.Bool("print-subscription", false, "Print the statements creating the subscription instead of running them")
+	archive := flag.String("archive", "", "Write the table as of to-lsn into this single gzip-compressed file instead, using the database as scratch space")
+	staging := flag.String("staging", "", "Restore into a new table of this name in the schema of the table, created like the table, checking its row count")
+	swap := flag.Bool("swap", false, "Rename the staging table to the table name once restored, keeping the table as <name>_old_<unix time>")
 
 	flag.Parse()
 
 	//TODO: switch to go-flags or similar
-	if *pgTable == "" || *dir == "" {
+	if *hypertable != "" && *pgTables == "" && *pgTable == "" {
+		*pgTables = *hypertable
+	} else if *hypertable != "" {
+		log.Fatalf("hypertable can't be used with table or tables")
+	}
+	if (*pgTable == "") == (*pgTables == "") || *dir == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	schemaName := "public"
-	tableParts := strings.Split(*pgTable, ".")
-	switch len(tableParts) {
-	case 2:
-		schemaName, tableName = tableParts[0], tableParts[1]
-	case 1:
-		tableName = tableParts[0]
-	default:
-		log.Fatalf("invalid table name")
+	names := []string{*pgTable}
+	if *pgTables != "" {
+		names = strings.Split(*pgTables, ",")
+	}
+
+	var tables []message.Identifier
+	for _, name := range names {
+		schemaName := "public"
+		tableParts := strings.Split(name, ".")
+		switch len(tableParts) {
+		case 2:
+			schemaName, tableName = tableParts[0], tableParts[1]
+		case 1:
+			tableName = tableParts[0]
+		default:
+			log.Fatalf("invalid table name")
+		}
+		tables = append(tables, message.Identifier{Namespace: schemaName, Name: tableName})
+	}
+
+	if *hypertable != "" {
+		chunks, err := logicalrestore.HypertableChunks(*dir, tables[0])
+		if err != nil {
+			log.Fatalf("could not find chunks: %v", err)
+		}
+		if len(chunks) == 0 {
+			log.Fatalf("no chunks of %s in %s", tables[0], *dir)
+		}
+		log.Printf("restoring %d chunks of %s", len(chunks), tables[0])
+		tables = chunks
+	}
+
+	opts := logicalrestore.Options{
+		SkipSequences:        *skipSequences,
+		CreateTable:          *createTable,
+		InsertBatchSize:      *insertBatch,
+		AllowVersionMismatch: *allowVersionMismatch,
+		AllowSchemaDrift:     *allowSchemaDrift,
+	}
+	if *fromLSN != "" {
+		lsn, err := pgx.ParseLSN(*fromLSN)
+		if err != nil {
+			log.Fatalf("invalid from-lsn: %v", err)
+		}
+		opts.FromLSN = lsn
+	}
+
+	if *toLSN != "" {
+		lsn, err := pgx.ParseLSN(*toLSN)
+		if err != nil {
+			log.Fatalf("invalid to-lsn: %v", err)
+		}
+		opts.ToLSN = lsn
+	}
+
+	if opts.FromLSN != 0 && opts.ToLSN != 0 && opts.FromLSN > opts.ToLSN {
+		log.Fatalf("from-lsn must not be greater than to-lsn")
+	}
+
+	if *subscription != "" {
+		if *pgTables != "" {
+			log.Fatalf("subscription can't be used with tables")
+		}
+		if *publisher == "" || *publication == "" || *subscriptionSlot == "" {
+			log.Fatalf("subscription requires publisher, publication and subscription-slot")
+		}
+		if opts.ToLSN != 0 {
+			log.Fatalf("subscription doesn't apply the deltas, to-lsn can't be used with it")
+		}
+
+		opts.Subscription = *subscription
+		opts.Publisher = *publisher
+		opts.Publication = *publication
+		opts.SubscriptionSlot = *subscriptionSlot
+		opts.PrintSubscription = *printSubscription
+	}
+
+	if *staging != "" {
+		if *pgTables != "" || *subscription != "" || *createTable || *archive != "" {
+			log.Fatalf("staging can't be used with tables, subscription, create-table or archive")
+		}
+
+		opts.Staging = *staging
+		opts.Swap = *swap
+	} else if *swap {
+		log.Fatalf("swap requires staging")
+	}
+
+	if *transforms != "" {
+		opts.Transforms = make(map[string]logicalrestore.Transform)
+		for _, pair := range strings.Split(*transforms, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid transform %q, must be column=transform", pair)
+			}
+			fn, ok := logicalrestore.BuiltinTransforms[parts[1]]
+			if !ok {
+				log.Fatalf("unknown transform %q", parts[1])
+			}
+			opts.Transforms[parts[0]] = fn
+		}
+	}
+
+	if *printMessages {
+		opts.MessageHook = func(m message.JSONLogicalMessage) error {
+			log.Printf("logical message at %s, prefix %q, transactional %t: %q", m.LSN, m.Prefix, m.Transactional, m.Content)
+			return nil
+		}
 	}
 
 	config := pgx.ConnConfig{
@@ -47,9 +174,60 @@ func main() {
 		Port:     uint16(*pgPort),
 		Password: *pgPass,
 		Host:     *pgHost}
-	r := logicalrestore.New(schemaName, tableName, *dir, config)
+	if *archive != "" {
+		if *pgTables != "" || *subscription != "" || *printMessages {
+			log.Fatalf("archive can't be used with tables, subscription or print-messages")
+		}
+
+		archiveTable(logicalrestore.New(tables[0].Namespace, tables[0].Name, *dir, config, opts), *archive)
+		return
+	}
+
+	if *pgTables != "" {
+		if *printMessages {
+			log.Fatalf("print-messages can't be used with tables")
+		}
+
+		if err := logicalrestore.NewMulti(tables, *dir, config, opts).Restore(); err != nil {
+			log.Fatalf("could not restore tables: %v", err)
+		}
+		return
+	}
+
+	r := logicalrestore.New(tables[0].Namespace, tables[0].Name, *dir, config, opts)
 
 	if err := r.Restore(); err != nil {
 		log.Fatalf("could not restore table: %v", err)
 	}
 }
+
+// archiveTable writes the archive file of the table along with its checksum
+// file, in the format of sha256sum
+func archiveTable(r *logicalrestore.LogicalRestore, filename string) {
+	fp, err := os.OpenFile(filename+".new", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		log.Fatalf("could not create archive file: %v", err)
+	}
+
+	manifest, checksum, err := r.Archive(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename + ".new")
+		log.Fatalf("could not archive table: %v", err)
+	}
+
+	if err := os.Rename(filename+".new", filename); err != nil {
+		log.Fatalf("could not move archive file: %v", err)
+	}
+	sum := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(filename))
+	if err := ioutil.WriteFile(filename+".sha256", []byte(sum), 0640); err != nil {
+		log.Fatalf("could not write checksum file: %v", err)
+	}
+
+	log.Printf("archived %s as of %s into %s, sha256 %s", manifest.Table, manifest.LSN, filename, checksum)
+}
@@ -0,0 +1,47 @@
+// Package alert posts the backup alerts to a webhook. The payload is the one
+// of the slack incoming webhooks, accepted by most chat services.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const sendTimeout = 10 * time.Second
+
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: sendTimeout},
+	}
+}
+
+// Send posts the text of the alert
+func (w *Webhook) Send(text string) error {
+	data, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{text})
+	if err != nil {
+		return fmt.Errorf("could not encode alert: %v", err)
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not post alert: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
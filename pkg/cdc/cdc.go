@@ -0,0 +1,391 @@
+// Package cdc exports the stored deltas of a table as change events for the
+// stream processors, in the envelope modelled after the one of Debezium or in
+// the JSON delta format, or as the sql statements applying them. Only the
+// complete transactions are exported, each once, in the commit order.
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/decoder"
+	"github.com/ikitiki/logical_backup/pkg/logicalrestore"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+const (
+	EnvelopeDebezium = "debezium" // Event, versioned with EnvelopeVersion
+	EnvelopeJSON     = "json"     // message.JSONDelta with the commit info
+	EnvelopeSQL      = "sql"      // the statements of the changes, each transaction in begin and commit
+
+	// EnvelopeVersion is bumped on the incompatible changes of Event
+	EnvelopeVersion = 1
+)
+
+// Source is the origin of the change
+type Source struct {
+	Version   int    `json:"version"`
+	Connector string `json:"connector"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	TxID      int32  `json:"txId"`
+	LSN       string `json:"lsn"`   // final lsn of the transaction
+	TsMs      int64  `json:"ts_ms"` // commit time
+}
+
+// Event is the change in the Debezium-like envelope. The values are in the
+// text format of PostgreSQL, nil for null; the unchanged toasted values are
+// left out of after.
+type Event struct {
+	Op     string             `json:"op"` // c, u, d or t
+	Before map[string]*string `json:"before"`
+	After  map[string]*string `json:"after"`
+	Source Source             `json:"source"`
+	TsMs   int64              `json:"ts_ms"` // of the export
+
+	SchemaID string `json:"schemaId,omitempty"` // of the JSONSchema of before and after
+}
+
+// Options of the export
+type Options struct {
+	Envelope string
+	FromLSN  uint64 // the transactions with the final lsn at or before it are skipped
+	ToLSN    uint64 // the export stops before the first transaction past it, if set
+	WithKey  bool   // prefix each event with its replica identity key and a tab
+
+	// SchemaDir is where the JSONSchema of the events are stored, each event
+	// referencing its schema by the id; no schemas if empty
+	SchemaDir string
+}
+
+type exporter struct {
+	Options
+	w io.Writer
+
+	table     message.Identifier
+	fallback  message.Relation // recorded with the base backup
+	relations map[uint32]message.Relation
+	schemaIDs map[uint32]string   // of the relations, 0 for the fallback
+	schemas   map[string]struct{} // stored in the schema dir
+	begin     message.Begin
+	skip      bool
+	pending   [][]byte // events of the current transaction
+	done      bool     // past ToLSN
+	lastLSN   uint64
+	events    int
+}
+
+// Export writes the events of the table found in the archive dir to w, one
+// per line. It returns the final lsn of the last exported transaction, to be
+// passed as FromLSN to resume, and the number of events.
+func Export(archiveDir string, table message.Identifier, opts Options, w io.Writer) (uint64, int, error) {
+	e := &exporter{
+		Options:   opts,
+		w:         w,
+		table:     table,
+		relations: make(map[uint32]message.Relation),
+		schemaIDs: make(map[uint32]string),
+		schemas:   make(map[string]struct{}),
+		skip:      true, // until the first begin
+		lastLSN:   opts.FromLSN,
+	}
+
+	tableDir := path.Join(archiveDir, utils.TableDir(table))
+	if err := e.loadRelation(path.Join(tableDir, "info.yaml")); err != nil {
+		return e.lastLSN, e.events, err
+	}
+
+	deltaDir := path.Join(tableDir, "deltas")
+	files, err := logicalrestore.DeltaFiles(deltaDir)
+	if err != nil {
+		return e.lastLSN, e.events, err
+	}
+
+	for _, f := range files {
+		if e.done {
+			break
+		}
+		if err := e.exportFile(path.Join(deltaDir, f)); err != nil {
+			return e.lastLSN, e.events, fmt.Errorf("could not export %q: %v", f, err)
+		}
+	}
+
+	return e.lastLSN, e.events, nil
+}
+
+func (e *exporter) loadRelation(filename string) error {
+	var info message.DumpInfo
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open info file: %v", err)
+	}
+	defer fp.Close()
+
+	if err := yaml.NewDecoder(fp).Decode(&info); err != nil {
+		return fmt.Errorf("could not decode info file: %v", err)
+	}
+	e.fallback = info.Relation.Replicated()
+
+	return e.updateSchema(0, e.fallback)
+}
+
+func (e *exporter) exportFile(filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	dr, err := decoder.NewDeltaReader(fp)
+	if err != nil {
+		return err
+	}
+
+	// a transaction may continue in the next file; the one interrupted by the
+	// restart of the backup is streamed again from its begin
+	for !e.done {
+		m, err := dr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read message: %v", err)
+		}
+
+		if err := e.export(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *exporter) export(m message.Message) error {
+	switch v := m.(type) {
+	case message.Relation:
+		e.relations[v.OID] = v
+		return e.updateSchema(v.OID, v)
+	case message.Begin:
+		if e.ToLSN != 0 && v.FinalLSN > e.ToLSN {
+			e.done = true
+			return nil
+		}
+		e.begin = v
+		e.skip = v.FinalLSN <= e.lastLSN
+		e.pending = e.pending[:0]
+		return nil
+	case message.Commit:
+		if e.skip {
+			return nil
+		}
+		if err := e.writeTx(); err != nil {
+			return err
+		}
+		e.events += len(e.pending)
+		e.pending = e.pending[:0]
+		e.lastLSN = e.begin.FinalLSN
+		e.skip = true
+		return nil
+	}
+
+	if e.skip {
+		return nil
+	}
+
+	var (
+		rel   message.Relation
+		relID uint32
+		key   []message.Tuple
+		ok    bool
+	)
+	switch v := m.(type) {
+	case message.Insert:
+		relID, key = v.RelationOID, v.NewRow
+	case message.Update:
+		relID, key = v.RelationOID, v.NewRow
+	case message.Delete:
+		relID, key = v.RelationOID, v.OldRow
+	case message.Truncate:
+		// the table is one of the truncated ones
+		for _, oid := range v.RelationOIDs {
+			if _, ok := e.relations[oid]; ok {
+				relID = oid
+			}
+		}
+	default:
+		return nil
+	}
+	if rel, ok = e.relations[relID]; !ok {
+		rel, relID = e.fallback, 0
+	}
+
+	// the statements are built by the position of the columns
+	if _, truncate := m.(message.Truncate); e.Envelope == EnvelopeSQL && !truncate && len(key) != len(rel.Columns) {
+		return fmt.Errorf("the change of %s has %d columns, its relation %d", rel.Identifier, len(key), len(rel.Columns))
+	}
+
+	line, err := e.encode(m, rel, e.schemaIDs[relID])
+	if err != nil || line == nil {
+		return err
+	}
+
+	if e.WithKey {
+		k, err := json.Marshal(keyColumns(key, rel))
+		if err != nil {
+			return fmt.Errorf("could not encode key: %v", err)
+		}
+		line = append(append(k, '\t'), line...)
+	}
+	e.pending = append(e.pending, line)
+
+	return nil
+}
+
+// updateSchema sets the schema id of the relation, if the schemas are stored
+func (e *exporter) updateSchema(oid uint32, rel message.Relation) error {
+	if e.SchemaDir == "" {
+		return nil
+	}
+
+	id, err := e.schemaID(rel)
+	if err != nil {
+		return fmt.Errorf("could not store schema of %s: %v", rel.Identifier, err)
+	}
+	e.schemaIDs[oid] = id
+
+	return nil
+}
+
+// writeTx writes the events of the transaction, the statements enclosed in
+// begin and commit
+func (e *exporter) writeTx() error {
+	lines := e.pending
+	if e.Envelope == EnvelopeSQL && len(e.pending) > 0 {
+		lines = make([][]byte, 0, len(e.pending)+2)
+		lines = append(lines, []byte(fmt.Sprintf("-- xid %d, lsn %s, committed %s\nbegin;\n",
+			e.begin.XID, pgx.FormatLSN(e.begin.FinalLSN), e.begin.Timestamp.Format(time.RFC3339Nano))))
+		lines = append(lines, e.pending...)
+		lines = append(lines, []byte("commit;\n"))
+	}
+
+	for _, line := range lines {
+		if _, err := e.w.Write(line); err != nil {
+			return fmt.Errorf("could not write event: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// encode returns the line of the event
+func (e *exporter) encode(m message.Message, rel message.Relation, schemaID string) ([]byte, error) {
+	var val interface{}
+
+	if e.Envelope == EnvelopeSQL {
+		var sql string
+		switch v := m.(type) {
+		case message.Insert:
+			sql = v.SQL(rel)
+		case message.Update:
+			sql = v.SQL(rel)
+		case message.Delete:
+			sql = v.SQL(rel)
+		case message.Truncate:
+			sql = v.SQL(rel)
+		}
+
+		return []byte(sql + "\n"), nil
+	} else if e.Envelope == EnvelopeJSON {
+		d := message.NewJSONDelta(m, rel)
+		if d == nil {
+			return nil, nil
+		}
+		d.SetCommitInfo(e.begin)
+		val = struct {
+			*message.JSONDelta
+			SchemaID string `json:"schemaId,omitempty"`
+		}{d, schemaID}
+	} else {
+		ev := Event{
+			SchemaID: schemaID,
+			Source: Source{
+				Version:   EnvelopeVersion,
+				Connector: "logical_backup",
+				Schema:    e.table.Namespace,
+				Table:     e.table.Name,
+				TxID:      e.begin.XID,
+				LSN:       pgx.FormatLSN(e.begin.FinalLSN),
+				TsMs:      e.begin.Timestamp.UnixNano() / int64(time.Millisecond),
+			},
+			TsMs: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+
+		switch v := m.(type) {
+		case message.Insert:
+			ev.Op, ev.After = "c", rowValues(v.NewRow, rel)
+		case message.Update:
+			ev.Op, ev.After = "u", rowValues(v.NewRow, rel)
+			if v.IsKey {
+				ev.Before = keyColumns(v.OldRow, rel)
+			} else if v.IsOld {
+				ev.Before = rowValues(v.OldRow, rel)
+			}
+		case message.Delete:
+			ev.Op = "d"
+			if v.IsKey {
+				ev.Before = keyColumns(v.OldRow, rel)
+			} else {
+				ev.Before = rowValues(v.OldRow, rel)
+			}
+		case message.Truncate:
+			ev.Op = "t"
+		}
+		val = ev
+	}
+
+	line, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode event: %v", err)
+	}
+
+	return append(line, '\n'), nil
+}
+
+// rowValues maps the column names to the values of the row
+func rowValues(row []message.Tuple, rel message.Relation) map[string]*string {
+	res := make(map[string]*string, len(row))
+	for i, t := range row {
+		if i >= len(rel.Columns) {
+			break
+		}
+
+		switch t.Kind {
+		case message.TextValue:
+			val := string(t.Value)
+			res[rel.Columns[i].Name] = &val
+		case message.NullValue:
+			res[rel.Columns[i].Name] = nil
+		}
+	}
+
+	return res
+}
+
+func keyColumns(row []message.Tuple, rel message.Relation) map[string]*string {
+	values := rowValues(row, rel)
+	for _, c := range rel.Columns {
+		if !c.IsKey {
+			delete(values, c.Name)
+		}
+	}
+
+	return values
+}
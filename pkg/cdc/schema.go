@@ -0,0 +1,119 @@
+package cdc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+const (
+	jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+	// SchemasDir is the dir of the schemas in the table archive dir
+	SchemasDir = "schemas"
+)
+
+// JSONSchema is the JSON Schema of the row values of the events of a table,
+// derived from its relation message. The values are in the text format of
+// PostgreSQL, so each column is a nullable string annotated with the oid and
+// the modifier of its type, the ones of the relation messages.
+// The id is the table name and the hash of the rest, so it changes with the
+// columns and their types only.
+type JSONSchema struct {
+	Schema     string                      `json:"$schema"`
+	ID         string                      `json:"$id"`
+	Title      string                      `json:"title"`
+	Type       string                      `json:"type"`
+	Properties map[string]JSONSchemaColumn `json:"properties"`
+	Columns    []string                    `json:"x-columns"`       // in the order of the relation
+	Key        []string                    `json:"x-key,omitempty"` // the replica identity columns
+}
+
+// JSONSchemaColumn is the schema of the column values
+type JSONSchemaColumn struct {
+	Type    []string `json:"type"`
+	TypeOID uint32   `json:"x-pg-type-oid"`
+	TypeMod int32    `json:"x-pg-typmod"`
+}
+
+// NewJSONSchema returns the schema of the events of the relation
+func NewJSONSchema(rel message.Relation) (*JSONSchema, error) {
+	s := &JSONSchema{
+		Schema:     jsonSchemaDraft,
+		Title:      rel.Identifier.String(),
+		Type:       "object",
+		Properties: make(map[string]JSONSchemaColumn, len(rel.Columns)),
+		Columns:    make([]string, 0, len(rel.Columns)),
+	}
+	for _, c := range rel.Columns {
+		s.Properties[c.Name] = JSONSchemaColumn{
+			Type:    []string{"string", "null"},
+			TypeOID: c.TypeOID,
+			TypeMod: c.Mode,
+		}
+		s.Columns = append(s.Columns, c.Name)
+		if c.IsKey {
+			s.Key = append(s.Key, c.Name)
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode schema: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	s.ID = fmt.Sprintf("%s-%s", rel.Identifier.String(), hex.EncodeToString(sum[:6]))
+
+	return s, nil
+}
+
+// schemaID returns the id of the schema of the relation, storing the schema in
+// the schema dir the first time it's seen
+func (e *exporter) schemaID(rel message.Relation) (string, error) {
+	s, err := NewJSONSchema(rel)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := e.schemas[s.ID]; ok {
+		return s.ID, nil
+	}
+
+	filename := path.Join(e.SchemaDir, s.ID+".json")
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := writeSchema(filename, s); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("could not stat schema file: %v", err)
+	}
+	e.schemas[s.ID] = struct{}{}
+
+	return s.ID, nil
+}
+
+func writeSchema(filename string, s *JSONSchema) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode schema: %v", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), 0750); err != nil {
+		return fmt.Errorf("could not create schema dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filename+".new", append(data, '\n'), 0640); err != nil {
+		os.Remove(filename + ".new")
+		return fmt.Errorf("could not write schema file: %v", err)
+	}
+	if err := os.Rename(filename+".new", filename); err != nil {
+		os.Remove(filename + ".new")
+		return fmt.Errorf("could not move schema file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// blackoutWindow is the daily period when the base backups are not taken, in
+// the local time; the window ending before it starts lasts past midnight.
+type blackoutWindow struct {
+	days       [7]bool // the window starts on
+	start, end time.Duration
+}
+
+// parseBlackoutWindow parses the window given as "[days] HH:MM-HH:MM", the days
+// being the comma-separated days of the week or their ranges, i.e. "mon-fri"
+// or "sat,sun"; without them the window applies to every day
+func parseBlackoutWindow(s string) (blackoutWindow, error) {
+	var w blackoutWindow
+
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, r := range strings.Split(strings.ToLower(fields[0]), ",") {
+			bounds := strings.SplitN(r, "-", 2)
+			from, ok := weekdays[bounds[0]]
+			if !ok {
+				return w, fmt.Errorf("unknown day %q", bounds[0])
+			}
+			to := from
+			if len(bounds) == 2 {
+				if to, ok = weekdays[bounds[1]]; !ok {
+					return w, fmt.Errorf("unknown day %q", bounds[1])
+				}
+			}
+
+			for d := from; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("must be in the form [days] HH:MM-HH:MM")
+	}
+
+	hours := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(hours) != 2 {
+		return w, fmt.Errorf("must be in the form [days] HH:MM-HH:MM")
+	}
+
+	var err error
+	if w.start, err = parseClock(hours[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(hours[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("the window is empty")
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// endsAt returns the end of the window containing now, zero if now is outside
+func (w blackoutWindow) endsAt(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	// the window of the previous day may last past midnight
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+
+		start, end := day.Add(w.start), day.Add(w.end)
+		if w.end < w.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return end
+		}
+	}
+
+	return time.Time{}
+}
+
+// BlackoutEnd returns the end of the basebackupBlackout window now falls
+// into, zero if none
+func (cfg *Config) BlackoutEnd(now time.Time) time.Time {
+	var end time.Time
+
+	for _, s := range cfg.BasebackupBlackout {
+		// validated on load
+		w, _ := parseBlackoutWindow(s)
+		if e := w.endsAt(now); e.After(end) {
+			end = e
+		}
+	}
+
+	return end
+}
@@ -1,43 +1,774 @@
 package config
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jackc/pgx"
 	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/message"
 )
 
 type Config struct {
-	TempDir               string         `yaml:"tempDir"`
-	Tables                []string       `yaml:"tables"`
-	DB                    pgx.ConnConfig `yaml:"db"`
-	Slotname              string         `yaml:"slotname"`
-	PublicationName       string         `yaml:"publication"`
-	TrackNewTables        bool           `yaml:"trackNewTables"`
-	DeltasPerFile         int            `yaml:"deltasPerFile"`
-	BackupThreshold       int            `yaml:"backupThreshold"`
-	ConcurrentBasebackups int            `yaml:"concurrentBasebackups"`
-	InitialBasebackup     bool           `yaml:"initialBasebackup"`
-	SendStatusOnCommit    bool           `yaml:"sendStatusOnCommit"`
-	Fsync                 bool           `yaml:"fsync"`
-	ArchiveDir            string         `yaml:"archiveDir"`
-	PeriodBetweenBackups  time.Duration  `yaml:"periodBetweenBackups"`
-	OldDeltaBackupTrigger time.Duration  `yaml:"oldDeltaBackupTrigger"`
-}
-
-func New(filename string) (*Config, error) {
-	var cfg Config
-
-	configFp, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("could not open config file: %v", err)
+	TempDir                  string              `yaml:"tempDir"`
+	Tables                   []string            `yaml:"tables"`
+	TableOIDs                []string            `yaml:"tableOIDs"`
+	TablesQuery              string              `yaml:"tablesQuery"`
+	TablesQueryInterval      time.Duration       `yaml:"tablesQueryInterval"`
+	DB                       pgx.ConnConfig      `yaml:"db"`
+	TLS                      TLSConfig           `yaml:"tls"`
+	PasswordFile             string              `yaml:"passwordFile"`
+	SecretsWatchInterval     time.Duration       `yaml:"secretsWatchInterval"`
+	Slotname                 string              `yaml:"slotname"`
+	PublicationName          string              `yaml:"publication"`
+	TrackNewTables           bool                `yaml:"trackNewTables"`
+	DeltasPerFile            int                 `yaml:"deltasPerFile"`
+	DeltaRetentionPeriod     time.Duration       `yaml:"deltaRetentionPeriod"`
+	DeltaRetentionFiles      int                 `yaml:"deltaRetentionFiles"`
+	DeltaShardPrefix         int                 `yaml:"deltaShardPrefix"`
+	BackupThreshold          int                 `yaml:"backupThreshold"`
+	DeltaCapMB               int                 `yaml:"deltaCapMB"`
+	DeltaCapsMB              map[string]string   `yaml:"deltaCapsMB"`
+	DeltaCapAction           string              `yaml:"deltaCapAction"`
+	ConcurrentBasebackups    int                 `yaml:"concurrentBasebackups"`
+	ArchiveConcurrency       int                 `yaml:"archiveConcurrency"`
+	BasebackupSessionAttrs   string              `yaml:"basebackupSessionAttrs"`
+	PauseDeltasDuringCopy    time.Duration       `yaml:"pauseDeltasDuringCopy"`
+	InitialBasebackup        bool                `yaml:"initialBasebackup"`
+	DeltasOnly               bool                `yaml:"deltasOnly"`
+	SendStatusOnCommit       bool                `yaml:"sendStatusOnCommit"`
+	Fsync                    bool                `yaml:"fsync"`
+	ArchiveDir               string              `yaml:"archiveDir"`
+	PeriodBetweenBackups     time.Duration       `yaml:"periodBetweenBackups"`
+	PeriodBetweenBackupsHigh time.Duration       `yaml:"periodBetweenBackupsHigh"`
+	PeriodBetweenBackupsLow  time.Duration       `yaml:"periodBetweenBackupsLow"`
+	BasebackupSchedule       string              `yaml:"basebackupSchedule"`
+	BasebackupSchedules      map[string]string   `yaml:"basebackupSchedules"`
+	Priorities               map[string]string   `yaml:"priorities"`
+	BasebackupBlackout       []string            `yaml:"basebackupBlackout"`
+	BlackoutInitialBackups   bool                `yaml:"blackoutInitialBackups"`
+	OldDeltaBackupTrigger    time.Duration       `yaml:"oldDeltaBackupTrigger"`
+	FileMode                 os.FileMode         `yaml:"fileMode"`
+	DirMode                  os.FileMode         `yaml:"dirMode"`
+	FileGroup                string              `yaml:"fileGroup"`
+	ParallelCopyJobs         int                 `yaml:"parallelCopyJobs"`
+	ParallelCopyMinSizeMB    int                 `yaml:"parallelCopyMinSizeMB"`
+	CopyThroughputMB         int                 `yaml:"copyThroughputMB"`
+	CopyBufferKB             int                 `yaml:"copyBufferKB"`
+	CopyCacheMode            string              `yaml:"copyCacheMode"`
+	CopyRetries              int                 `yaml:"copyRetries"`
+	CopyRetryInterval        time.Duration       `yaml:"copyRetryInterval"`
+	DroppedTableAction       string              `yaml:"droppedTableAction"`
+	ReplicaIdentityNothing   string              `yaml:"replicaIdentityNothing"`
+	UnsupportedColumns       string              `yaml:"unsupportedColumns"`
+	DeltaFormat              string              `yaml:"deltaFormat"`
+	DeltaCommitInfo          bool                `yaml:"deltaCommitInfo"`
+	BasebackupFormat         string              `yaml:"basebackupFormat"`
+	BasebackupFormats        map[string]string   `yaml:"basebackupFormats"`
+	BackupSequences          bool                `yaml:"backupSequences"`
+	CaptureDDL               bool                `yaml:"captureDDL"`
+	EmbedSchema              bool                `yaml:"embedSchema"`
+	ReconnectConcurrency     int                 `yaml:"reconnectConcurrency"`
+	ReconnectInterval        time.Duration       `yaml:"reconnectInterval"`
+	TCPKeepalive             time.Duration       `yaml:"tcpKeepalive"`
+	ReplicationTimeout       time.Duration       `yaml:"replicationTimeout"`
+	SlotStuckWindow          time.Duration       `yaml:"slotStuckWindow"`
+	SnapshotExportWindow     time.Duration       `yaml:"snapshotExportWindow"`
+	SlotSnapshotAction       string              `yaml:"slotSnapshotAction"`
+	SkipTableLock            bool                `yaml:"skipTableLock"`
+	SkipEmptyTables          bool                `yaml:"skipEmptyTables"`
+	LockTimeout              time.Duration       `yaml:"lockTimeout"`
+	DuplicateTempSlot        string              `yaml:"duplicateTempSlot"`
+	BreakerFailures          int                 `yaml:"breakerFailures"`
+	BreakerCooldown          time.Duration       `yaml:"breakerCooldown"`
+	SummaryInterval          time.Duration       `yaml:"summaryInterval"`
+	IdleTimeout              time.Duration       `yaml:"idleTimeout"`
+	IsolationLevel           string              `yaml:"isolationLevel"`
+	CopyOptions              message.CopyOptions `yaml:"copyOptions"`
+	AlertWebhook             string              `yaml:"alertWebhook"`
+	AlertLag                 time.Duration       `yaml:"alertLag"`
+	AlertMinFreeSpaceMB      int                 `yaml:"alertMinFreeSpaceMB"`
+	AlertFor                 time.Duration       `yaml:"alertFor"`
+	AlertRepeatInterval      time.Duration       `yaml:"alertRepeatInterval"`
+	StatsdAddress            string              `yaml:"statsdAddress"`
+	StatsdPrefix             string              `yaml:"statsdPrefix"`
+	StatsdInterval           time.Duration       `yaml:"statsdInterval"`
+	ApplicationName          string              `yaml:"applicationName"`
+	PluginOptions            map[string]string   `yaml:"pluginOptions"`
+	UnsupportedPluginOptions string              `yaml:"unsupportedPluginOptions"`
+	LogicalMessages          bool                `yaml:"logicalMessages"`
+	TimescaleHypertables     bool                `yaml:"timescaleHypertables"`
+	Operations               map[string]string   `yaml:"operations"`
+
+	secrets *Secrets
+	fileGID int // of FileGroup, see FileGID
+}
+
+const (
+	DroppedTableKeep  = "keep"  // stop backing up the dropped table, retain its files
+	DroppedTablePurge = "purge" // stop backing up the dropped table and remove its files
+
+	ReplicaIdentityNothingRefuse     = "refuse"     // fail to start if such tables are in the publication
+	ReplicaIdentityNothingInsertOnly = "insertOnly" // back up their inserts only
+
+	UnsupportedColumnsText = "text" // stored as their text, noted in the info file to be cast on restore
+	UnsupportedColumnsFail = "fail" // the base backup of the table fails
+	UnsupportedColumnsSkip = "skip" // not backed up, left to their defaults on restore
+
+	UnsupportedPluginOptionsRefuse  = "refuse"  // fail to start if the server or the decoder doesn't support an option
+	UnsupportedPluginOptionsDisable = "disable" // leave such options out
+
+	DeltaCapBasebackup = "basebackup" // queue a base backup of the table once it has deltaCapMB of deltas
+	DeltaCapLog        = "log"        // only log it
+
+	DeltaFormatBinary = "binary" // raw pgoutput messages prefixed with the length
+	DeltaFormatJSON   = "json"   // newline-delimited JSON objects, one per message
+
+	BasebackupFormatCopy   = "copy"   // raw COPY stream in the text format
+	BasebackupFormatBinary = "binary" // raw COPY stream in the binary format
+	BasebackupFormatCSV    = "csv"    // raw COPY stream in the csv format
+	BasebackupFormatSQL    = "sql"    // pg_dump-like sql file with the table ddl and a COPY block
+
+	DumpFormatDeltasOnly = "deltas-only" // info file format of the tables backed up without base backups
+
+	CopyCacheBuffered = "buffered" // base backups are written through the page cache
+	CopyCacheDontNeed = "dontneed" // the written pages are dropped from the page cache
+
+	PriorityHigh   = "high"   // backed up first and every periodBetweenBackupsHigh
+	PriorityNormal = "normal" // the default
+	PriorityLow    = "low"    // backed up after the others and every periodBetweenBackupsLow
+
+	SlotSnapshotUse      = "use"      // the temp slot is created in the base backup transaction, which gets its snapshot
+	SlotSnapshotExport   = "export"   // the snapshot exported by the temp slot is imported in the base backup transaction
+	SlotSnapshotNoExport = "noexport" // no snapshot, only with deltasOnly
+
+	DuplicateTempSlotRename = "rename" // the temp slot gets a fresh name
+	DuplicateTempSlotWait   = "wait"   // until the server drops the old temp slot
+	DuplicateTempSlotDrop   = "drop"   // the old temp slot, unless its backend is alive
+
+	IsolationRepeatableRead = "repeatableRead"
+	IsolationSerializable   = "serializable" // only with deltasOnly, see validate
+
+	OperationInsert   = "insert"
+	OperationUpdate   = "update"
+	OperationDelete   = "delete"
+	OperationTruncate = "truncate"
+
+	defaultFileMode os.FileMode = 0640
+	defaultDirMode  os.FileMode = 0750
+
+	defaultParallelCopyMinSizeMB = 1024
+	defaultCopyThroughputMB      = 50
+	defaultCopyBufferKB          = 1024
+	defaultCopyRetryInterval     = 30 * time.Second
+
+	defaultApplicationName = "logical_backup"
+
+	defaultReconnectConcurrency = 4
+	defaultReconnectInterval    = 100 * time.Millisecond
+
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Minute
+
+	defaultSummaryInterval = time.Hour
+
+	defaultSlotStuckWindow      = 15 * time.Minute
+	defaultSecretsWatchInterval = 30 * time.Second
+
+	defaultIdleTimeout = 3 * time.Hour
+
+	defaultAlertFor            = 5 * time.Minute
+	defaultAlertRepeatInterval = time.Hour
+
+	defaultStatsdPrefix   = "logical_backup"
+	defaultStatsdInterval = 10 * time.Second
+
+	defaultTablesQueryInterval = 5 * time.Minute
+)
+
+var (
+	pluginOptionRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	encodingRe     = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// New builds the configuration from the defaults, overridden by the config
+// file (if the filename is not empty), then by the LB_* environment variables
+// and finally by the command-line flags set in the flag set, if any. The flags
+// must be defined in advance with RegisterFlags.
+func New(filename string, flags *flag.FlagSet) (*Config, error) {
+	cfg := Config{
+		FileMode: defaultFileMode,
+		DirMode:  defaultDirMode,
+
+		ParallelCopyMinSizeMB:    defaultParallelCopyMinSizeMB,
+		CopyThroughputMB:         defaultCopyThroughputMB,
+		CopyBufferKB:             defaultCopyBufferKB,
+		CopyCacheMode:            CopyCacheBuffered,
+		CopyRetryInterval:        defaultCopyRetryInterval,
+		BasebackupSessionAttrs:   dbutils.SessionReadWrite,
+		SlotSnapshotAction:       SlotSnapshotUse,
+		DuplicateTempSlot:        DuplicateTempSlotRename,
+		DroppedTableAction:       DroppedTableKeep,
+		ReplicaIdentityNothing:   ReplicaIdentityNothingRefuse,
+		UnsupportedColumns:       UnsupportedColumnsText,
+		UnsupportedPluginOptions: UnsupportedPluginOptionsRefuse,
+		DeltaFormat:              DeltaFormatBinary,
+		DeltaCapAction:           DeltaCapBasebackup,
+		BasebackupFormat:         BasebackupFormatCopy,
+		ApplicationName:          defaultApplicationName,
+		ReconnectConcurrency:     defaultReconnectConcurrency,
+		ReconnectInterval:        defaultReconnectInterval,
+		BreakerFailures:          defaultBreakerFailures,
+		BreakerCooldown:          defaultBreakerCooldown,
+		SummaryInterval:          defaultSummaryInterval,
+		SlotStuckWindow:          defaultSlotStuckWindow,
+		SecretsWatchInterval:     defaultSecretsWatchInterval,
+		IdleTimeout:              defaultIdleTimeout,
+		IsolationLevel:           IsolationRepeatableRead,
+		AlertFor:                 defaultAlertFor,
+		AlertRepeatInterval:      defaultAlertRepeatInterval,
+		StatsdPrefix:             defaultStatsdPrefix,
+		StatsdInterval:           defaultStatsdInterval,
+		TablesQueryInterval:      defaultTablesQueryInterval,
+	}
+
+	if filename != "" {
+		configFp, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not open config file: %v", err)
+		}
+		defer configFp.Close()
+
+		if err := yaml.NewDecoder(configFp).Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("could not decode config file: %v", err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
 	}
 
-	if err := yaml.NewDecoder(configFp).Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("could not decode config file: %v", err)
+	if flags != nil {
+		if err := cfg.applyFlags(flags); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	cfg.secrets = newSecrets(&cfg)
+	if err := cfg.secrets.Reload(); err != nil {
+		return nil, err
+	}
+	cfg.DB = cfg.secrets.Apply(cfg.DB)
+	cfg.DB.TLSConfig = cfg.secrets.tlsConfig
+
+	// a negative period disables the keepalives, 0 keeps the pgx default
+	if cfg.TCPKeepalive != 0 {
+		cfg.DB.Dial = (&net.Dialer{KeepAlive: cfg.TCPKeepalive}).Dial
 	}
 
 	return &cfg, nil
 }
+
+// FileGID returns the group of the files and dirs created, -1 to keep the
+// default one
+func (cfg *Config) FileGID() int {
+	if cfg.FileGroup == "" {
+		return -1
+	}
+
+	return cfg.fileGID
+}
+
+// lookupGroup returns the gid of the group given by its name or gid
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+// Secrets returns the credentials of the config files, reloaded by Secrets.Watch
+func (cfg *Config) Secrets() *Secrets {
+	return cfg.secrets
+}
+
+func (cfg *Config) validate() error {
+	if cfg.FileMode&^os.ModePerm != 0 || cfg.DirMode&^os.ModePerm != 0 {
+		return fmt.Errorf("fileMode and dirMode may only contain permission bits")
+	}
+
+	if cfg.FileGroup != "" {
+		gid, err := lookupGroup(cfg.FileGroup)
+		if err != nil {
+			return fmt.Errorf("could not find fileGroup %q: %v", cfg.FileGroup, err)
+		}
+		cfg.fileGID = gid
+	}
+
+	if cfg.CopyThroughputMB <= 0 {
+		return fmt.Errorf("copyThroughputMB must be positive")
+	}
+
+	if cfg.ArchiveConcurrency < 0 {
+		return fmt.Errorf("archiveConcurrency must not be negative")
+	}
+
+	if cfg.ReconnectConcurrency <= 0 {
+		return fmt.Errorf("reconnectConcurrency must be positive")
+	}
+
+	if cfg.ReplicationTimeout < 0 {
+		return fmt.Errorf("replicationTimeout must not be negative")
+	}
+
+	if cfg.SlotStuckWindow < 0 {
+		return fmt.Errorf("slotStuckWindow must not be negative")
+	}
+
+	if cfg.PasswordFile != "" && cfg.DB.Password != "" {
+		return fmt.Errorf("only one of db.password and passwordFile may be set")
+	}
+
+	if cfg.SecretsWatchInterval < 0 {
+		return fmt.Errorf("secretsWatchInterval must not be negative")
+	}
+
+	if cfg.AlertWebhook != "" {
+		if u, err := url.Parse(cfg.AlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("alertWebhook must be an http or https url")
+		}
+	}
+
+	if cfg.AlertLag < 0 || cfg.AlertMinFreeSpaceMB < 0 || cfg.AlertFor < 0 || cfg.AlertRepeatInterval < 0 {
+		return fmt.Errorf("alert settings must not be negative")
+	}
+
+	if cfg.StatsdAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.StatsdAddress); err != nil {
+			return fmt.Errorf("statsdAddress must be host:port: %v", err)
+		}
+		if cfg.StatsdInterval <= 0 {
+			return fmt.Errorf("statsdInterval must be positive")
+		}
+	}
+
+	if cfg.TablesQuery != "" && (len(cfg.Tables) > 0 || len(cfg.TableOIDs) > 0) {
+		return fmt.Errorf("tablesQuery can't be combined with tables or tableOIDs")
+	}
+
+	for _, oid := range cfg.TableOIDs {
+		if n, err := strconv.ParseUint(oid, 10, 32); err != nil || n == 0 {
+			return fmt.Errorf("tableOIDs must be relation oids, not %q", oid)
+		}
+	}
+
+	if cfg.TablesQuery != "" && cfg.TablesQueryInterval <= 0 {
+		return fmt.Errorf("tablesQueryInterval must be positive")
+	}
+
+	if cfg.BreakerFailures > 0 && cfg.BreakerCooldown <= 0 {
+		return fmt.Errorf("breakerCooldown must be positive")
+	}
+
+	if cfg.DroppedTableAction != DroppedTableKeep && cfg.DroppedTableAction != DroppedTablePurge {
+		return fmt.Errorf("droppedTableAction must be either %q or %q", DroppedTableKeep, DroppedTablePurge)
+	}
+
+	for k, v := range cfg.PluginOptions {
+		if !pluginOptionRe.MatchString(k) {
+			return fmt.Errorf("invalid plugin option name %q", k)
+		}
+		if k == "proto_version" || k == "publication_names" || (k == "messages" && cfg.LogicalMessages) {
+			return fmt.Errorf("plugin option %q is set by the tool", k)
+		}
+		if strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("plugin option %q contains control characters", k)
+		}
+	}
+
+	switch cfg.UnsupportedColumns {
+	case UnsupportedColumnsText, UnsupportedColumnsFail, UnsupportedColumnsSkip:
+	default:
+		return fmt.Errorf("unsupportedColumns must be one of %q, %q or %q",
+			UnsupportedColumnsText, UnsupportedColumnsFail, UnsupportedColumnsSkip)
+	}
+
+	if cfg.UnsupportedPluginOptions != UnsupportedPluginOptionsRefuse && cfg.UnsupportedPluginOptions != UnsupportedPluginOptionsDisable {
+		return fmt.Errorf("unsupportedPluginOptions must be either %q or %q", UnsupportedPluginOptionsRefuse, UnsupportedPluginOptionsDisable)
+	}
+
+	if cfg.ReplicaIdentityNothing != ReplicaIdentityNothingRefuse && cfg.ReplicaIdentityNothing != ReplicaIdentityNothingInsertOnly {
+		return fmt.Errorf("replicaIdentityNothing must be either %q or %q", ReplicaIdentityNothingRefuse, ReplicaIdentityNothingInsertOnly)
+	}
+
+	if cfg.DeltaRetentionPeriod < 0 || cfg.DeltaRetentionFiles < 0 {
+		return fmt.Errorf("deltaRetentionPeriod and deltaRetentionFiles must not be negative")
+	}
+
+	if cfg.DeltaShardPrefix < 0 || cfg.DeltaShardPrefix > 15 {
+		return fmt.Errorf("deltaShardPrefix must be between 0 and 15")
+	}
+
+	if cfg.DeltaCapMB < 0 {
+		return fmt.Errorf("deltaCapMB must not be negative")
+	}
+
+	for table, capMB := range cfg.DeltaCapsMB {
+		if n, err := strconv.Atoi(capMB); err != nil || n < 0 {
+			return fmt.Errorf("invalid deltaCapsMB value %q of %q, must be a non-negative number", capMB, table)
+		}
+	}
+
+	if cfg.DeltaCapAction != DeltaCapBasebackup && cfg.DeltaCapAction != DeltaCapLog {
+		return fmt.Errorf("deltaCapAction must be either %q or %q", DeltaCapBasebackup, DeltaCapLog)
+	}
+
+	if cfg.DeltaFormat != DeltaFormatBinary && cfg.DeltaFormat != DeltaFormatJSON {
+		return fmt.Errorf("deltaFormat must be either %q or %q", DeltaFormatBinary, DeltaFormatJSON)
+	}
+
+	for table, ops := range cfg.Operations {
+		if len(strings.Fields(ops)) == 0 {
+			return fmt.Errorf("no operations of %q are captured", table)
+		}
+		for _, op := range strings.Fields(ops) {
+			switch op {
+			case OperationInsert, OperationUpdate, OperationDelete, OperationTruncate:
+			default:
+				return fmt.Errorf("invalid operation %q of %q, must be one of %q, %q, %q or %q",
+					op, table, OperationInsert, OperationUpdate, OperationDelete, OperationTruncate)
+			}
+		}
+	}
+
+	// the base backups take their snapshot from the temporary slot, which
+	// PostgreSQL creates only in a repeatable read transaction; the serializable
+	// ones couldn't import the snapshot either
+	switch cfg.IsolationLevel {
+	case IsolationRepeatableRead:
+	case IsolationSerializable:
+		if !cfg.DeltasOnly {
+			return fmt.Errorf("isolationLevel %q requires deltasOnly: base backups use the snapshot of a replication slot, only available in %q",
+				IsolationSerializable, IsolationRepeatableRead)
+		}
+	default:
+		return fmt.Errorf("isolationLevel must be either %q or %q", IsolationRepeatableRead, IsolationSerializable)
+	}
+
+	// the base backup must be consistent with the point the deltas start at
+	switch cfg.SlotSnapshotAction {
+	case SlotSnapshotUse, SlotSnapshotExport:
+	case SlotSnapshotNoExport:
+		if !cfg.DeltasOnly {
+			return fmt.Errorf("slotSnapshotAction %q requires deltasOnly: base backups need the snapshot of the slot", SlotSnapshotNoExport)
+		}
+	default:
+		return fmt.Errorf("slotSnapshotAction must be one of %q, %q or %q", SlotSnapshotUse, SlotSnapshotExport, SlotSnapshotNoExport)
+	}
+
+	switch cfg.DuplicateTempSlot {
+	case DuplicateTempSlotRename, DuplicateTempSlotWait, DuplicateTempSlotDrop:
+	default:
+		return fmt.Errorf("duplicateTempSlot must be one of %q, %q or %q",
+			DuplicateTempSlotRename, DuplicateTempSlotWait, DuplicateTempSlotDrop)
+	}
+
+	if !validBasebackupFormat(cfg.BasebackupFormat) {
+		return fmt.Errorf("basebackupFormat must be one of %q, %q, %q or %q",
+			BasebackupFormatCopy, BasebackupFormatBinary, BasebackupFormatCSV, BasebackupFormatSQL)
+	}
+
+	for table, format := range cfg.BasebackupFormats {
+		if !validBasebackupFormat(format) {
+			return fmt.Errorf("invalid basebackupFormats value %q of %q", format, table)
+		}
+	}
+
+	for table, priority := range cfg.Priorities {
+		switch priority {
+		case PriorityHigh, PriorityNormal, PriorityLow:
+		default:
+			return fmt.Errorf("invalid priority %q of %q, must be one of %q, %q or %q",
+				priority, table, PriorityHigh, PriorityNormal, PriorityLow)
+		}
+	}
+
+	for _, s := range cfg.BasebackupBlackout {
+		if _, err := parseBlackoutWindow(s); err != nil {
+			return fmt.Errorf("invalid basebackupBlackout window %q: %v", s, err)
+		}
+	}
+
+	if cfg.BasebackupSchedule != "" {
+		if _, err := parseCron(cfg.BasebackupSchedule); err != nil {
+			return fmt.Errorf("invalid basebackupSchedule %q: %v", cfg.BasebackupSchedule, err)
+		}
+	}
+	for table, schedule := range cfg.BasebackupSchedules {
+		if schedule == "" {
+			continue // periodBetweenBackups of the table
+		}
+		if _, err := parseCron(schedule); err != nil {
+			return fmt.Errorf("invalid basebackupSchedules of %q %q: %v", table, schedule, err)
+		}
+	}
+
+	if cfg.CopyBufferKB < 0 {
+		return fmt.Errorf("copyBufferKB must not be negative")
+	}
+
+	switch cfg.BasebackupSessionAttrs {
+	case dbutils.SessionReadWrite, dbutils.SessionPreferStandby, dbutils.SessionAny:
+	default:
+		return fmt.Errorf("basebackupSessionAttrs must be one of %q, %q or %q",
+			dbutils.SessionReadWrite, dbutils.SessionPreferStandby, dbutils.SessionAny)
+	}
+
+	if cfg.LockTimeout < 0 {
+		return fmt.Errorf("lockTimeout must not be negative")
+	}
+
+	if cfg.CopyRetries < 0 || cfg.CopyRetryInterval < 0 {
+		return fmt.Errorf("copyRetries and copyRetryInterval must not be negative")
+	}
+
+	if cfg.CopyCacheMode != CopyCacheBuffered && cfg.CopyCacheMode != CopyCacheDontNeed {
+		return fmt.Errorf("copyCacheMode must be either %q or %q", CopyCacheBuffered, CopyCacheDontNeed)
+	}
+
+	if cfg.PauseDeltasDuringCopy < 0 {
+		return fmt.Errorf("pauseDeltasDuringCopy must not be negative")
+	}
+
+	if cfg.PeriodBetweenBackupsHigh < 0 || cfg.PeriodBetweenBackupsLow < 0 {
+		return fmt.Errorf("periodBetweenBackupsHigh and periodBetweenBackupsLow must not be negative")
+	}
+
+	if err := cfg.validateCopyOptions(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validBasebackupFormat(format string) bool {
+	switch format {
+	case BasebackupFormatCopy, BasebackupFormatBinary, BasebackupFormatCSV, BasebackupFormatSQL:
+		return true
+	}
+
+	return false
+}
+
+// TxIsoLevel returns the isolation level of the read-only transactions
+// reading the tables and the catalog
+func (cfg *Config) TxIsoLevel() pgx.TxIsoLevel {
+	if cfg.IsolationLevel == IsolationSerializable {
+		return pgx.Serializable
+	}
+
+	return pgx.RepeatableRead
+}
+
+// TableBasebackupFormat returns the base backup format of the schema.name table
+func (cfg *Config) TableBasebackupFormat(table string) string {
+	if format, ok := cfg.BasebackupFormats[table]; ok {
+		return format
+	}
+
+	return cfg.BasebackupFormat
+}
+
+// TableDeltaCapMB returns the cap on the deltas written since the last base
+// backup of the schema.name table, 0 if there is none
+func (cfg *Config) TableDeltaCapMB(table string) int {
+	if capMB, ok := cfg.DeltaCapsMB[table]; ok {
+		n, _ := strconv.Atoi(capMB)
+		return n
+	}
+
+	return cfg.DeltaCapMB
+}
+
+// TablePriority returns the priority class of the schema.name table
+func (cfg *Config) TablePriority(table string) string {
+	if priority, ok := cfg.Priorities[table]; ok {
+		return priority
+	}
+
+	return PriorityNormal
+}
+
+// TablePeriodBetweenBackups returns the period between the base backups of
+// the schema.name table, depending on its priority
+func (cfg *Config) TablePeriodBetweenBackups(table string) time.Duration {
+	switch cfg.TablePriority(table) {
+	case PriorityHigh:
+		if cfg.PeriodBetweenBackupsHigh > 0 {
+			return cfg.PeriodBetweenBackupsHigh
+		}
+	case PriorityLow:
+		if cfg.PeriodBetweenBackupsLow > 0 {
+			return cfg.PeriodBetweenBackupsLow
+		}
+	}
+
+	return cfg.PeriodBetweenBackups
+}
+
+// TableOperations returns the operations captured for the schema.name table,
+// nil if all of them are
+func (cfg *Config) TableOperations(table string) []string {
+	ops, ok := cfg.Operations[table]
+	if !ok {
+		return nil
+	}
+
+	res := make([]string, 0)
+	for _, op := range []string{OperationInsert, OperationUpdate, OperationDelete, OperationTruncate} {
+		for _, o := range strings.Fields(ops) {
+			if o == op {
+				res = append(res, op)
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// CapturesOperation reports whether the operation on the schema.name table is backed up
+func (cfg *Config) CapturesOperation(table, op string) bool {
+	ops, ok := cfg.Operations[table]
+	if !ok {
+		return true
+	}
+
+	for _, o := range strings.Fields(ops) {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CopyOptions returns the options of the COPY command producing or loading the
+// base backup in the format; the dumps without the format are in the text one
+func CopyOptions(format string, opts *message.CopyOptions) string {
+	options := make([]string, 0)
+	switch format {
+	case BasebackupFormatBinary, BasebackupFormatCSV:
+		options = append(options, "format "+format)
+	}
+
+	if opts != nil && (format == BasebackupFormatCopy || format == BasebackupFormatCSV || format == "") {
+		for _, o := range []struct{ name, value string }{
+			{"delimiter", opts.Delimiter},
+			{"null", opts.Null},
+			{"quote", opts.Quote},
+			{"encoding", opts.Encoding},
+		} {
+			if o.value != "" {
+				options = append(options, fmt.Sprintf("%s %s", o.name, dbutils.QuoteLiteral(o.value)))
+			}
+		}
+	}
+
+	if len(options) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" with (%s)", strings.Join(options, ", "))
+}
+
+// TableCopyOptions returns the COPY options recorded in the info file of the
+// table base backup, nil for the defaults or the formats they don't apply to
+func (cfg *Config) TableCopyOptions(table string) *message.CopyOptions {
+	format := cfg.TableBasebackupFormat(table)
+	if cfg.CopyOptions == (message.CopyOptions{}) || (format != BasebackupFormatCopy && format != BasebackupFormatCSV) {
+		return nil
+	}
+
+	opts := cfg.CopyOptions
+	if format != BasebackupFormatCSV {
+		opts.Quote = ""
+	}
+
+	return &opts
+}
+
+// validateCopyOptions follows the checks of the COPY command, so that the base
+// backups don't start failing with the options PostgreSQL rejects
+func (cfg *Config) validateCopyOptions() error {
+	opts := cfg.CopyOptions
+
+	for _, o := range []struct{ name, value string }{{"delimiter", opts.Delimiter}, {"quote", opts.Quote}} {
+		if o.value != "" && len(o.value) != 1 {
+			return fmt.Errorf("copyOptions.%s must be a single one-byte character", o.name)
+		}
+		if strings.ContainsAny(o.value, "\r\n") {
+			return fmt.Errorf("copyOptions.%s cannot be newline or carriage return", o.name)
+		}
+	}
+
+	if strings.ContainsAny(opts.Null, "\r\n") {
+		return fmt.Errorf("copyOptions.null cannot contain newline or carriage return")
+	}
+
+	delimiter := opts.Delimiter
+	csv := false
+	text := cfg.BasebackupFormat == BasebackupFormatCopy
+	for _, format := range cfg.BasebackupFormats {
+		text = text || format == BasebackupFormatCopy
+		csv = csv || format == BasebackupFormatCSV
+	}
+	csv = csv || cfg.BasebackupFormat == BasebackupFormatCSV
+
+	if text && delimiter != "" && strings.Contains("\\.abcdefghijklmnopqrstuvwxyz0123456789", delimiter) {
+		return fmt.Errorf("copyOptions.delimiter %q is not allowed with the text format", delimiter)
+	}
+
+	if opts.Quote != "" && !csv {
+		return fmt.Errorf("copyOptions.quote is only used with the %q basebackupFormat", BasebackupFormatCSV)
+	}
+
+	if delimiter == "" && text {
+		delimiter = "\t"
+	} else if delimiter == "" {
+		delimiter = ","
+	}
+	if csv && delimiter == opts.Quote {
+		return fmt.Errorf("copyOptions.delimiter and copyOptions.quote must be different")
+	}
+	if opts.Null != "" && strings.Contains(opts.Null, delimiter) {
+		return fmt.Errorf("copyOptions.delimiter must not appear in copyOptions.null")
+	}
+
+	if opts.Encoding != "" && !encodingRe.MatchString(opts.Encoding) {
+		return fmt.Errorf("invalid copyOptions.encoding %q", opts.Encoding)
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const envPrefix = "LB_"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	fileModeType = reflect.TypeOf(os.FileMode(0))
+
+	// names of the fields never shown in the logs
+	secretFields = map[string]struct{}{
+		"db.password":  {},
+		"tls.keyPEM":   {},
+		"alertWebhook": {},
+	}
+)
+
+// field is a config value addressable by its name in the config file. Nested
+// structures are flattened with the dot, i.e. db.host
+type field struct {
+	name  string
+	value reflect.Value
+}
+
+// envName converts the field name to the environment variable name, i.e.
+// tempDir -> LB_TEMP_DIR, db.host -> LB_DB_HOST
+func (f field) envName() string {
+	var b strings.Builder
+
+	b.WriteString(envPrefix)
+	prev := rune(0)
+	for _, r := range f.name {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+
+	return b.String()
+}
+
+func (f field) isSecret() bool {
+	_, ok := secretFields[f.name]
+	return ok
+}
+
+// fields lists all the config values which could be set from a string
+func (cfg *Config) fields() []field {
+	return structFields("", reflect.ValueOf(cfg).Elem())
+}
+
+func structFields(prefix string, v reflect.Value) []field {
+	res := make([]field, 0)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" { // the way yaml names the untagged fields
+			name = strings.ToLower(sf.Name)
+		}
+		name = prefix + name
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			res = append(res, structFields(name+".", fv)...)
+			continue
+		}
+
+		if !settable(fv.Type()) {
+			continue
+		}
+
+		res = append(res, field{name: name, value: fv})
+	}
+
+	return res
+}
+
+func settable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.String
+	}
+
+	return false
+}
+
+func (f field) set(str string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Type() == fileModeType:
+		m, err := strconv.ParseUint(str, 8, 32)
+		if err != nil {
+			return err
+		}
+		v.SetUint(m)
+	case v.Kind() == reflect.String:
+		v.SetString(str)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(str, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		u, err := strconv.ParseUint(str, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case v.Kind() == reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case v.Kind() == reflect.Map:
+		items := make(map[string]string)
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			items[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+func (f field) String() string {
+	if f.isSecret() && f.value.String() != "" {
+		return "********"
+	}
+
+	switch {
+	case f.value.Type() == durationType:
+		return time.Duration(f.value.Int()).String()
+	case f.value.Type() == fileModeType:
+		return fmt.Sprintf("%#o", f.value.Uint())
+	case f.value.Kind() == reflect.Slice:
+		return strings.Join(f.value.Interface().([]string), ",")
+	case f.value.Kind() == reflect.Map:
+		m := f.value.Interface().(map[string]string)
+		items := make([]string, 0, len(m))
+		for k, v := range m {
+			items = append(items, k+"="+v)
+		}
+		sort.Strings(items)
+
+		return strings.Join(items, ",")
+	}
+
+	return fmt.Sprintf("%v", f.value.Interface())
+}
+
+func (cfg *Config) applyEnv() error {
+	for _, f := range cfg.fields() {
+		str, ok := os.LookupEnv(f.envName())
+		if !ok {
+			continue
+		}
+
+		if err := f.set(str); err != nil {
+			return fmt.Errorf("invalid value of %s: %v", f.envName(), err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) applyFlags(flags *flag.FlagSet) error {
+	var err error
+
+	fields := make(map[string]field)
+	for _, f := range cfg.fields() {
+		fields[f.name] = f
+	}
+
+	flags.Visit(func(fl *flag.Flag) {
+		f, ok := fields[fl.Name]
+		if !ok || err != nil {
+			return
+		}
+
+		if setErr := f.set(fl.Value.String()); setErr != nil {
+			err = fmt.Errorf("invalid value of -%s: %v", fl.Name, setErr)
+		}
+	})
+
+	return err
+}
+
+// RegisterFlags defines a string flag for every config field, named as the
+// field in the config file
+func RegisterFlags(flags *flag.FlagSet) {
+	var cfg Config
+
+	for _, f := range cfg.fields() {
+		flags.String(f.name, "", fmt.Sprintf("overrides %s (env %s)", f.name, f.envName()))
+	}
+}
+
+// String returns the configuration with the secrets masked, so that it's safe
+// to log
+func (cfg *Config) String() string {
+	return cfg.Redacted()
+}
+
+// Redacted returns the effective configuration, one "name: value" line per
+// field, with the secrets masked
+func (cfg *Config) Redacted() string {
+	lines := make([]string, 0)
+	for _, f := range cfg.fields() {
+		lines = append(lines, fmt.Sprintf("%s: %s", f.name, f))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronHorizon bounds the search of the next time matching the cron schedule
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// Scheduler decides when the next periodic base backup of the table fires
+type Scheduler interface {
+	// Next returns the time of the next base backup after the given one, zero
+	// if there is none
+	Next(after time.Time) time.Time
+}
+
+// intervalScheduler fires every periodBetweenBackups of the table
+type intervalScheduler time.Duration
+
+func (s intervalScheduler) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronScheduler fires at the times matching the standard five fields of
+// cron: the minute, the hour, the day of the month, the month and the day of
+// the week, in the local time
+type cronScheduler struct {
+	minute, hour, dom, month, dow uint64 // the bits of the matching values
+	domAny, dowAny                bool   // the day field is *
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{}} // 0 and 7 are sunday
+)
+
+func init() {
+	for name, d := range weekdays {
+		cronDow.names[name] = int(d)
+	}
+}
+
+// parseCron parses the cron expression, each field being *, a value, or a
+// range a-b, optionally followed by /step, or a comma-separated list of those;
+// the months and the days of the week may be given by their names
+func parseCron(expr string) (*cronScheduler, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("must have 5 fields: minute, hour, day of month, month and day of week")
+	}
+
+	s := &cronScheduler{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, p := range []struct {
+		bits  *uint64
+		field cronField
+	}{{&s.minute, cronMinute}, {&s.hour, cronHour}, {&s.dom, cronDom}, {&s.month, cronMonth}, {&s.dow, cronDow}} {
+		bits, err := p.field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %v", fields[i], err)
+		}
+		*p.bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("never fires")
+	}
+
+	return s, nil
+}
+
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		from, to := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				to = f.max
+			}
+			if to < from {
+				return 0, fmt.Errorf("range %q ends before it starts", part)
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %q is not between %d and %d", s, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+func (s *cronScheduler) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	// as in cron, either of the day fields matches unless one of them is *
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+func (s *cronScheduler) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for deadline := after.Add(cronHorizon); t.Before(deadline); {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// TableBasebackupSchedule returns the cron schedule of the base backups of the
+// schema.name table, empty if they fire every periodBetweenBackups
+func (cfg *Config) TableBasebackupSchedule(table string) string {
+	if schedule, ok := cfg.BasebackupSchedules[table]; ok {
+		return schedule
+	}
+
+	return cfg.BasebackupSchedule
+}
+
+// TableScheduler returns the scheduler of the periodic base backups of the
+// schema.name table
+func (cfg *Config) TableScheduler(table string) Scheduler {
+	if schedule := cfg.TableBasebackupSchedule(table); schedule != "" {
+		// validated on load
+		if s, err := parseCron(schedule); err == nil {
+			return s
+		}
+	}
+
+	return intervalScheduler(cfg.TablePeriodBetweenBackups(table))
+}
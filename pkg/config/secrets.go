@@ -0,0 +1,202 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Secrets holds the credentials read from the files, i.e. the kubernetes
+// secrets mounted into the pod, which are replaced in place on rotation. The
+// connections pick up the current ones when they connect, see Apply, so the
+// reloaded credentials are used from the next reconnect on.
+type Secrets struct {
+	passwordFile string
+	tls          TLSConfig
+	host         string
+
+	mu          sync.Mutex
+	loaded      bool
+	password    string
+	tlsConfig   *tls.Config
+	passwordSum string
+	tlsSum      string
+	pendingSum  string // the files changed, reloaded once they no longer do
+}
+
+func newSecrets(cfg *Config) *Secrets {
+	return &Secrets{
+		passwordFile: cfg.PasswordFile,
+		tls:          cfg.TLS,
+		host:         cfg.DB.Host,
+	}
+}
+
+// readPassword returns the password in the file, without the trailing newline
+func readPassword(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("could not read password file: %v", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// fileSum returns the hash of the contents of the files, empty names skipped,
+// empty if there are none
+func fileSum(filenames ...string) (string, error) {
+	h := sha256.New()
+	files := 0
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		files++
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %v", filename, err)
+		}
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+	if files == 0 {
+		return "", nil
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *Secrets) sums() (passwordSum, tlsSum string, err error) {
+	if passwordSum, err = fileSum(s.passwordFile); err != nil {
+		return "", "", err
+	}
+	if tlsSum, err = fileSum(s.tls.RootCert, s.tls.Cert, s.tls.Key); err != nil {
+		return "", "", err
+	}
+
+	return passwordSum, tlsSum, nil
+}
+
+// Reload reads the files again, keeping the credentials loaded before if
+// any of them is invalid
+func (s *Secrets) Reload() error {
+	if s == nil {
+		return nil
+	}
+
+	passwordSum, tlsSum, err := s.sums()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reloadPassword := s.passwordFile != "" && (!s.loaded || passwordSum != s.passwordSum)
+	reloadTLS := !s.loaded || tlsSum != s.tlsSum
+
+	var password string
+	if reloadPassword {
+		if password, err = readPassword(s.passwordFile); err != nil {
+			return err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if reloadTLS {
+		if tlsConfig, err = s.tls.build(s.host); err != nil {
+			return err
+		}
+	}
+
+	if reloadPassword {
+		if s.loaded {
+			log.Printf("reloaded the database password from %s", s.passwordFile)
+		}
+		s.password = password
+	}
+	if reloadTLS {
+		if s.loaded {
+			log.Printf("reloaded the tls certificates")
+		}
+		s.tlsConfig = tlsConfig
+	}
+	s.passwordSum, s.tlsSum, s.pendingSum = passwordSum, tlsSum, ""
+	s.loaded = true
+
+	return nil
+}
+
+// Apply returns the connection config with the current credentials
+func (s *Secrets) Apply(cfg pgx.ConnConfig) pgx.ConnConfig {
+	if s == nil {
+		return cfg
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.passwordFile != "" {
+		cfg.Password = s.password
+	}
+	// the server name is the one of the host connected to, see dbutils.ConnectTarget
+	if cfg.TLSConfig != nil && s.tlsConfig != nil && cfg.TLSConfig != s.tlsConfig {
+		serverName := cfg.TLSConfig.ServerName
+		cfg.TLSConfig = s.tlsConfig.Clone()
+		cfg.TLSConfig.ServerName = serverName
+	}
+
+	return cfg
+}
+
+// Watch polls the files every interval, reloading them once they changed and
+// stayed the same for another interval: the certificate and the key may be
+// rotated one after another
+func (s *Secrets) Watch(ctx context.Context, interval time.Duration) {
+	if s == nil || interval <= 0 || s.passwordFile == "" && s.tls.RootCert == "" && s.tls.Cert == "" && s.tls.Key == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		passwordSum, tlsSum, err := s.sums()
+		if err != nil {
+			log.Printf("could not check the credential files: %v", err)
+			continue
+		}
+		sum := passwordSum + tlsSum
+
+		s.mu.Lock()
+		changed := passwordSum != s.passwordSum || tlsSum != s.tlsSum
+		settled := sum == s.pendingSum
+		if !changed {
+			s.pendingSum = ""
+		} else if !settled {
+			s.pendingSum = sum
+		}
+		s.mu.Unlock()
+
+		if changed && settled {
+			if err := s.Reload(); err != nil {
+				log.Printf("could not reload credentials: %v", err)
+			}
+		}
+	}
+}
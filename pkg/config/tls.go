@@ -0,0 +1,139 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	TLSModeDisable    = "disable"     // plain connections
+	TLSModeRequire    = "require"     // encrypted, the server certificate is not checked
+	TLSModeVerifyCA   = "verify-ca"   // the server certificate must be signed by the root CA
+	TLSModeVerifyFull = "verify-full" // and must also match the host name
+)
+
+// TLSConfig is the TLS setup of the database connections. The root CA, the
+// client certificate and its key are each given either as a file or as the PEM
+// contents inline, i.e. passed from a secret manager without touching the disk.
+type TLSConfig struct {
+	Mode        string `yaml:"mode"`
+	RootCert    string `yaml:"rootCert"`
+	RootCertPEM string `yaml:"rootCertPEM"`
+	Cert        string `yaml:"cert"`
+	CertPEM     string `yaml:"certPEM"`
+	Key         string `yaml:"key"`
+	KeyPEM      string `yaml:"keyPEM"`
+}
+
+// pem returns the contents of either the file or the inline value
+func pem(name, filename, inline string) ([]byte, error) {
+	if filename != "" && inline != "" {
+		return nil, fmt.Errorf("only one of tls.%s and tls.%sPEM may be set", name, name)
+	}
+
+	if inline != "" {
+		return []byte(inline), nil
+	}
+
+	if filename == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tls.%s file: %v", name, err)
+	}
+
+	return data, nil
+}
+
+// build returns the tls config of the connections to the host, nil if TLS is disabled
+func (c TLSConfig) build(host string) (*tls.Config, error) {
+	rootCert, err := pem("rootCert", c.RootCert, c.RootCertPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := pem("cert", c.Cert, c.CertPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pem("key", c.Key, c.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Mode == TLSModeDisable || c.Mode == "" {
+		if rootCert != nil || cert != nil || key != nil {
+			return nil, fmt.Errorf("tls certificates are set, but tls.mode is %q", TLSModeDisable)
+		}
+
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+	switch c.Mode {
+	case TLSModeRequire:
+		cfg.InsecureSkipVerify = true
+	case TLSModeVerifyCA, TLSModeVerifyFull:
+	default:
+		return nil, fmt.Errorf("tls.mode must be one of %q, %q, %q or %q",
+			TLSModeDisable, TLSModeRequire, TLSModeVerifyCA, TLSModeVerifyFull)
+	}
+
+	if rootCert != nil {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(rootCert) {
+			return nil, fmt.Errorf("no certificates found in tls.rootCert")
+		}
+	}
+
+	if (cert == nil) != (key == nil) {
+		return nil, fmt.Errorf("both the tls client certificate and its key must be set")
+	}
+
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls client certificate and key: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	switch c.Mode {
+	case TLSModeVerifyFull:
+		cfg.ServerName = host
+	case TLSModeVerifyCA:
+		// the chain is verified without the host name check
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, cfg.RootCAs)
+		}
+	}
+
+	return cfg, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("could not parse server certificate: %v", err)
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+
+	_, err := leaf.Verify(opts)
+	return err
+}
@@ -3,6 +3,7 @@ package dbutils
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"log"
 
@@ -23,6 +24,9 @@ func QuoteLiteral(str string) string {
 		switch r1 {
 		case '\\':
 			res += `\\`
+			needsEscapeChar = true
+		case '\'':
+			res += `''`
 		case '\t':
 			res += `\t`
 			needsEscapeChar = true
@@ -44,6 +48,31 @@ func QuoteLiteral(str string) string {
 	}
 }
 
+// RedactPassword masks the password of the connection config if it occurs in
+// the error message, i.e. when the error comes from the connection attempt
+func RedactPassword(err error, cfg pgx.ConnConfig) error {
+	if err == nil || cfg.Password == "" || !strings.Contains(err.Error(), cfg.Password) {
+		return err
+	}
+
+	return &redactedError{err: err, password: cfg.Password}
+}
+
+// redactedError masks the password in the message of the error it wraps,
+// which is still there for errors.Is and errors.As
+type redactedError struct {
+	err      error
+	password string
+}
+
+func (e *redactedError) Error() string {
+	return strings.Replace(e.err.Error(), e.password, "********", -1)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
 func RepeatedlyTry(ctx context.Context, conn *pgx.Conn, timeoutSec, retries int, sql string, arguments ...interface{}) error {
 	for i := 0; i < retries; i++ {
 		log.Printf("try %d: %q", i, sql)
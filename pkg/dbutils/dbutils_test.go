@@ -0,0 +1,55 @@
+package dbutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+func TestRedactPassword(t *testing.T) {
+	const password = "s3cr3t-pa55"
+	cfg := pgx.ConnConfig{Host: "localhost", User: "backup", Password: password}
+	connErr := fmt.Errorf("dial tcp: connect to postgres://backup:%s@localhost/db: connection refused", password)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	redacted := RedactPassword(connErr, cfg)
+	log.Printf("could not connect: %v", redacted)
+	log.Printf("could not connect: %s", redacted)
+	log.Print(fmt.Errorf("could not start replication: %w", redacted))
+	log.Println(redacted)
+
+	if out := buf.String(); strings.Contains(out, password) {
+		t.Fatalf("the password is in the log:\n%s", out)
+	} else if strings.Count(out, "********") != 4 {
+		t.Fatalf("the password is not masked in every line of the log:\n%s", out)
+	}
+
+	if !errors.Is(redacted, connErr) {
+		t.Fatalf("the redacted error does not wrap the original one")
+	}
+	if !errors.Is(fmt.Errorf("could not connect: %w", redacted), connErr) {
+		t.Fatalf("the wrapped redacted error does not wrap the original one")
+	}
+}
+
+func TestRedactPasswordKeepsError(t *testing.T) {
+	err := errors.New("connection refused")
+
+	for _, cfg := range []pgx.ConnConfig{{}, {Password: "s3cr3t"}} {
+		if got := RedactPassword(err, cfg); got != err {
+			t.Errorf("RedactPassword(%q) with password %q = %v, expected the error itself", err, cfg.Password, got)
+		}
+	}
+	if got := RedactPassword(nil, pgx.ConnConfig{Password: "s3cr3t"}); got != nil {
+		t.Errorf("RedactPassword(nil) = %v, expected nil", got)
+	}
+}
@@ -0,0 +1,68 @@
+package dbutils
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+)
+
+// Reconnector staggers the connection attempts of all the tables, so that they
+// don't hit the server at once, e.g. after it comes back from a restart: no more
+// than the given number of attempts run concurrently and they start at least
+// the interval (plus a random jitter of up to the same interval) apart.
+type Reconnector struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewReconnector(concurrency int, interval time.Duration) *Reconnector {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Reconnector{
+		slots:    make(chan struct{}, concurrency),
+		interval: interval,
+	}
+}
+
+// Connect waits for its turn and calls connect
+func (r *Reconnector) Connect(ctx context.Context, connect func() error) error {
+	metrics.ReconnectQueueDepth.Add(1)
+	select {
+	case r.slots <- struct{}{}:
+	case <-ctx.Done():
+		metrics.ReconnectQueueDepth.Add(-1)
+		return ctx.Err()
+	}
+	defer func() { <-r.slots }()
+
+	r.mu.Lock()
+	start := time.Now()
+	if r.next.After(start) {
+		start = r.next
+	}
+	r.next = start.Add(r.interval)
+	if r.interval > 0 {
+		r.next = r.next.Add(time.Duration(rand.Int63n(int64(r.interval))))
+	}
+	r.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(start))
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		metrics.ReconnectQueueDepth.Add(-1)
+		return ctx.Err()
+	}
+	metrics.ReconnectQueueDepth.Add(-1)
+
+	return connect()
+}
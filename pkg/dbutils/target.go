@@ -0,0 +1,130 @@
+package dbutils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// The target session attrs, modelled after the ones of libpq, select the host
+// of a multi-host config to connect to
+const (
+	SessionReadWrite     = "read-write"     // the primary
+	SessionPreferStandby = "prefer-standby" // a standby if any is up, the primary otherwise
+	SessionAny           = "any"            // the first host accepting the connection
+)
+
+// Hosts splits the comma-separated host list of the config, each optionally
+// with its port, into the configs of the single hosts
+func Hosts(cfg pgx.ConnConfig) []pgx.ConnConfig {
+	list := strings.Split(cfg.Host, ",")
+	if len(list) == 1 {
+		return []pgx.ConnConfig{cfg}
+	}
+
+	res := make([]pgx.ConnConfig, 0, len(list))
+	for _, h := range list {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		hostCfg := cfg
+		hostCfg.Host = h
+		// the unix socket dirs have no port
+		if !strings.HasPrefix(h, "/") {
+			if host, port, err := net.SplitHostPort(h); err == nil {
+				if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+					hostCfg.Host, hostCfg.Port = host, uint16(p)
+				}
+			}
+		}
+		if cfg.TLSConfig != nil && cfg.TLSConfig.ServerName == cfg.Host {
+			hostCfg.TLSConfig = cfg.TLSConfig.Clone()
+			hostCfg.TLSConfig.ServerName = hostCfg.Host
+		}
+		res = append(res, hostCfg)
+	}
+
+	return res
+}
+
+// ConnectTarget connects to the first host of the config matching the target
+// session attrs, returning the config of that host for the other connections
+// to land on it too. A single host is connected to without the check.
+func ConnectTarget(cfg pgx.ConnConfig, attrs string) (*pgx.Conn, pgx.ConnConfig, error) {
+	hosts := Hosts(cfg)
+	if len(hosts) == 1 {
+		conn, err := pgx.Connect(cfg)
+		return conn, cfg, err
+	}
+
+	var (
+		fallback    *pgx.Conn
+		fallbackCfg pgx.ConnConfig
+		lastErr     error
+	)
+	for _, hostCfg := range hosts {
+		conn, err := pgx.Connect(hostCfg)
+		if err != nil {
+			lastErr = RedactPassword(err, hostCfg)
+			log.Printf("could not connect to %s: %v", hostDesc(hostCfg), lastErr)
+			continue
+		}
+
+		standby, err := IsStandby(conn)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			log.Printf("could not check %s: %v", hostDesc(hostCfg), err)
+			continue
+		}
+
+		switch {
+		case attrs == SessionAny,
+			attrs == SessionReadWrite && !standby,
+			attrs == SessionPreferStandby && standby:
+			if fallback != nil {
+				fallback.Close()
+			}
+			log.Printf("connected to %s for %s", hostDesc(hostCfg), attrs)
+			return conn, hostCfg, nil
+		case attrs == SessionPreferStandby && fallback == nil:
+			fallback, fallbackCfg = conn, hostCfg
+		default:
+			conn.Close()
+		}
+	}
+
+	if fallback != nil {
+		log.Printf("no standby is up, connected to the primary %s", hostDesc(fallbackCfg))
+		return fallback, fallbackCfg, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("none of them is the primary")
+	}
+
+	return nil, cfg, fmt.Errorf("no host of %q matches target session attrs %q: %v", cfg.Host, attrs, lastErr)
+}
+
+// IsStandby reports whether the server is in recovery
+func IsStandby(conn *pgx.Conn) (bool, error) {
+	var standby bool
+	if err := conn.QueryRow("select pg_is_in_recovery()").Scan(&standby); err != nil {
+		return false, fmt.Errorf("could not check recovery status: %v", err)
+	}
+
+	return standby, nil
+}
+
+func hostDesc(cfg pgx.ConnConfig) string {
+	if cfg.Port == 0 {
+		return cfg.Host
+	}
+
+	return fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+}
@@ -187,13 +187,34 @@ func Parse(src []byte) (message.Message, error) {
 		m.IsOld = d.rowInfo('O')
 		m.OldRow = d.tupledata()
 
+		return m, nil
+	case 'M':
+		m := message.LogicalMessage{
+			Raw: make([]byte, len(src)),
+		}
+		copy(m.Raw, src)
+
+		m.Transactional = d.uint8()&1 == 1
+		m.LSN = d.uint64()
+		m.Prefix = d.string()
+		m.Content = append([]byte(nil), d.buf.Next(int(d.uint32()))...)
+
 		return m, nil
 	case 'T':
 		m := message.Truncate{
 			Raw: make([]byte, len(src)),
 		}
 		copy(m.Raw, src)
-		//TODO
+
+		m.Relations = d.uint32()
+		options := d.uint8()
+		m.Cascade = options&1 == 1
+		m.RestartIdentity = options&2 == 2
+		m.RelationOIDs = make([]uint32, m.Relations)
+		for i := range m.RelationOIDs {
+			m.RelationOIDs[i] = d.uint32()
+		}
+
 		return m, nil
 	default:
 		return nil, fmt.Errorf("unknown message type for %s (%d)", []byte{msgType}, msgType)
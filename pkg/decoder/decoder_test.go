@@ -0,0 +1,158 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// insertMessage returns the pgoutput insert of the values, nil for null
+func insertMessage(relOID uint32, values ...*string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('I')
+	binary.Write(buf, binary.BigEndian, relOID)
+	buf.WriteByte('N')
+	binary.Write(buf, binary.BigEndian, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			buf.WriteByte('n')
+			continue
+		}
+		buf.WriteByte('t')
+		binary.Write(buf, binary.BigEndian, uint32(len(*v)))
+		buf.WriteString(*v)
+	}
+
+	return buf.Bytes()
+}
+
+// unquoteLiteral reads the sql string literal the way the server does
+func unquoteLiteral(t *testing.T, literal string) string {
+	t.Helper()
+
+	escaped := strings.HasPrefix(literal, "E'")
+	if escaped {
+		literal = literal[1:]
+	}
+	if len(literal) < 2 || literal[0] != '\'' || literal[len(literal)-1] != '\'' {
+		t.Fatalf("%s is not a string literal", literal)
+	}
+	literal = literal[1 : len(literal)-1]
+
+	var res strings.Builder
+	for i := 0; i < len(literal); i++ {
+		switch c := literal[i]; {
+		case c == '\'':
+			i++ // doubled
+			res.WriteByte('\'')
+		case c == '\\' && escaped:
+			i++
+			switch literal[i] {
+			case 't':
+				res.WriteByte('\t')
+			case 'n':
+				res.WriteByte('\n')
+			case 'r':
+				res.WriteByte('\r')
+			default:
+				res.WriteByte(literal[i])
+			}
+		default:
+			res.WriteByte(c)
+		}
+	}
+
+	return res.String()
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestArrayAndRangeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeOID  uint32
+		typeName string
+		value    *string
+	}{
+		{"int array", 1007, "integer[]", strPtr("{1,2,3}")},
+		{"int array with null", 1007, "integer[]", strPtr("{1,NULL,3}")},
+		{"int array of nulls", 1007, "integer[]", strPtr("{NULL,NULL}")},
+		{"two-dimensional int array", 1007, "integer[]", strPtr("{{1,2},{3,NULL}}")},
+		{"empty int array", 1007, "integer[]", strPtr("{}")},
+		{"text array", 1009, "text[]", strPtr(`{"a b",it's,"back\\slash","\"quoted\"","NULL",NULL}`)},
+		{"text array with newline", 1009, "text[]", strPtr("{\"line\nbreak\",\"tab\there\"}")},
+		{"int4range", 3904, "int4range", strPtr("[1,10)")},
+		{"unbounded int4range", 3904, "int4range", strPtr("[5,)")},
+		{"empty int4range", 3904, "int4range", strPtr("empty")},
+		{"null array", 1007, "integer[]", nil},
+	}
+
+	for _, tt := range tests {
+		rel := message.Relation{
+			Identifier: message.Identifier{Namespace: "public", Name: "test"},
+			OID:        16384,
+			Columns:    []message.Column{{Name: "v", TypeOID: tt.typeOID, FormattedType: tt.typeName}},
+		}
+		raw := insertMessage(rel.OID, tt.value)
+
+		// the binary and the json delta files
+		var binaryDeltas, jsonDeltas bytes.Buffer
+		binary.Write(&binaryDeltas, binary.BigEndian, uint64(len(raw)+8))
+		binaryDeltas.Write(raw)
+
+		m, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("%s: could not parse: %v", tt.name, err)
+		}
+		data, err := json.Marshal(message.NewJSONDelta(m, rel))
+		if err != nil {
+			t.Fatalf("%s: could not encode json delta: %v", tt.name, err)
+		}
+		jsonDeltas.Write(append(data, '\n'))
+
+		for _, deltas := range []*bytes.Buffer{&binaryDeltas, &jsonDeltas} {
+			dr, err := NewDeltaReader(deltas)
+			if err != nil {
+				t.Fatalf("%s: could not read deltas: %v", tt.name, err)
+			}
+			m, err := dr.Next()
+			if err != nil {
+				t.Fatalf("%s: could not read %s delta: %v", tt.name, dr.Format(), err)
+			}
+			ins, ok := m.(message.Insert)
+			if !ok {
+				t.Fatalf("%s: read %T from the %s delta, expected insert", tt.name, m, dr.Format())
+			}
+
+			tuple := ins.NewRow[0]
+			if tt.value == nil {
+				if tuple.Kind != message.NullValue {
+					t.Errorf("%s: %s delta has %c, expected null", tt.name, dr.Format(), tuple.Kind)
+				}
+			} else if tuple.Kind != message.TextValue || string(tuple.Value) != *tt.value {
+				t.Errorf("%s: %s delta has %c %q, expected %q", tt.name, dr.Format(), tuple.Kind, tuple.Value, *tt.value)
+			}
+
+			// the value the restore inserts
+			sql := message.InsertSQL(rel, []message.Insert{ins})
+			prefix, suffix := `insert into "public"."test" ("v") values (`, ");"
+			if !strings.HasPrefix(sql, prefix) || !strings.HasSuffix(sql, suffix) {
+				t.Fatalf("%s: unexpected insert %s", tt.name, sql)
+			}
+			literal := strings.TrimSuffix(strings.TrimPrefix(sql, prefix), suffix)
+			if tt.value == nil {
+				if literal != "null" {
+					t.Errorf("%s: inserted %s, expected null", tt.name, literal)
+				}
+			} else if got := unquoteLiteral(t, literal); got != *tt.value {
+				t.Errorf("%s: inserted %s, read as %q, expected %q", tt.name, literal, got, *tt.value)
+			}
+		}
+	}
+}
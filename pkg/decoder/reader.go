@@ -0,0 +1,103 @@
+package decoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// Delta file formats
+const (
+	FormatBinary = "binary"
+	FormatJSON   = "json"
+)
+
+// DeltaReader reads the messages stored in a delta file. The format of the
+// file is detected from its first byte: JSON deltas start with an object,
+// while the binary ones start with the big-endian length of the first message,
+// which never has the high byte set.
+type DeltaReader struct {
+	r      *bufio.Reader
+	format string
+	msgLen []byte
+}
+
+// NewDeltaReader creates the reader of the delta file contents
+func NewDeltaReader(r io.Reader) (*DeltaReader, error) {
+	dr := &DeltaReader{
+		r:      bufio.NewReader(r),
+		format: FormatBinary,
+		msgLen: make([]byte, 8),
+	}
+
+	first, err := dr.r.Peek(1)
+	if err == io.EOF {
+		return dr, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read delta header: %v", err)
+	}
+
+	if first[0] == '{' {
+		dr.format = FormatJSON
+	}
+
+	return dr, nil
+}
+
+// Format returns the detected format of the deltas
+func (dr *DeltaReader) Format() string {
+	return dr.format
+}
+
+// Next returns the next message from the file, io.EOF at the end of it and
+// io.ErrUnexpectedEOF if the last message is truncated
+func (dr *DeltaReader) Next() (message.Message, error) {
+	if dr.format == FormatJSON {
+		return dr.nextJSON()
+	}
+
+	return dr.nextBinary()
+}
+
+func (dr *DeltaReader) nextBinary() (message.Message, error) {
+	if _, err := io.ReadFull(dr.r, dr.msgLen); err != nil {
+		return nil, err
+	}
+
+	ln := binary.BigEndian.Uint64(dr.msgLen)
+	if ln <= 8 {
+		return nil, fmt.Errorf("invalid message length: %d", ln)
+	}
+
+	buf := make([]byte, ln-8)
+	if _, err := io.ReadFull(dr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return Parse(buf)
+}
+
+func (dr *DeltaReader) nextJSON() (message.Message, error) {
+	var d message.JSONDelta
+
+	line, err := dr.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(line, &d); err != nil {
+		return nil, fmt.Errorf("could not decode json delta: %v", err)
+	}
+
+	return d.Message()
+}
@@ -0,0 +1,434 @@
+// Package gc prunes and compacts the backups in the archive dir. It works on
+// the stored files only and may run while the backup process is streaming:
+// each table is processed holding the exclusive lock of its archive dir, which
+// the archiver of the backup process takes before copying a file there.
+package gc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+const (
+	infoFilename       = "info.yaml"
+	basebackupFilename = "basebackup.copy"
+	sqlDumpFilename    = "basebackup.sql"
+	deltasDir          = "deltas"
+	previousDir        = "previous" // the previous base backup, see tablebackup.PreviousDir
+)
+
+type Options struct {
+	DryRun       bool  // only report what would be done
+	CompactBelow int64 // merge consecutive delta files smaller than that; 0 disables the compaction
+	Retention    utils.DeltaRetention
+}
+
+// Stats is the outcome of the garbage collection
+type Stats struct {
+	Tables         int
+	FilesRemoved   int
+	FilesCompacted int
+	BytesReclaimed int64
+}
+
+type deltaFile struct {
+	name    string // relative to the deltas dir
+	lsn     uint64
+	postfix uint64
+	size    int64
+	modTime time.Time
+}
+
+// Run collects the garbage of every table found in the archive dir
+func Run(archiveDir string, opts Options) (Stats, error) {
+	var stats Stats
+
+	tableDirs := make([]string, 0)
+	err := filepath.Walk(archiveDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == previousDir {
+			return filepath.SkipDir // collected along with the table, see collectPrevious
+		}
+		if !info.IsDir() && info.Name() == infoFilename {
+			tableDirs = append(tableDirs, path.Dir(p))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("could not walk archive dir: %v", err)
+	}
+
+	for _, dir := range tableDirs {
+		reclaimed := stats.BytesReclaimed
+		if err := collectTable(dir, opts, &stats); err != nil {
+			log.Printf("could not collect garbage in %s: %v", dir, err)
+			continue
+		}
+		stats.Tables++
+
+		if reclaimed != stats.BytesReclaimed {
+			log.Printf("%s: reclaimed %d bytes", dir, stats.BytesReclaimed-reclaimed)
+		}
+	}
+
+	return stats, nil
+}
+
+func collectTable(dir string, opts Options, stats *Stats) error {
+	unlock, err := utils.LockDir(dir, true, 0640, -1)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	infoPath := path.Join(dir, infoFilename)
+	infoStat, err := os.Stat(infoPath)
+	if err != nil {
+		return fmt.Errorf("could not stat info file: %v", err)
+	}
+
+	info, err := loadInfo(infoPath)
+	if err != nil {
+		return err
+	}
+
+	startLSN, err := pgx.ParseLSN(info.StartLSN)
+	if err != nil {
+		return fmt.Errorf("could not parse lsn: %v", err)
+	}
+
+	if err := removeStaleBasebackups(dir, info, infoStat, opts, stats); err != nil {
+		return err
+	}
+
+	deltas, err := listDeltas(path.Join(dir, deltasDir))
+	if err != nil {
+		return err
+	}
+
+	// a delta file is not needed if the next one starts at or before the
+	// base backup, all its transactions are already in the dump
+	n := 0
+	for n < len(deltas)-1 && deltas[n+1].lsn <= startLSN {
+		n++
+	}
+
+	keep := 0
+	now := time.Now()
+	for keep < n && opts.Retention.Expired(keep, n, deltas[keep].modTime, now) {
+		if err := remove(path.Join(dir, deltasDir, deltas[keep].name), deltas[keep].size, opts, stats); err != nil {
+			return err
+		}
+		keep++
+	}
+	if err := collectPrevious(dir, deltas, keep, opts, stats); err != nil {
+		return err
+	}
+	if keep > 0 && !opts.DryRun {
+		if err := utils.RemoveEmptyShards(path.Join(dir, deltasDir)); err != nil {
+			return err
+		}
+	}
+
+	if opts.CompactBelow > 0 {
+		return compactDeltas(path.Join(dir, deltasDir), deltas[keep:], opts, stats)
+	}
+
+	return nil
+}
+
+// collectPrevious removes the previous base backup of the table once the
+// first of the delta files it needs is among the removed ones
+func collectPrevious(dir string, deltas []deltaFile, removed int, opts Options, stats *Stats) error {
+	prevDir := path.Join(dir, previousDir)
+	infoPath := path.Join(prevDir, infoFilename)
+	if _, err := os.Stat(infoPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	info, err := loadInfo(infoPath)
+	if err != nil {
+		return err
+	}
+	startLSN, err := pgx.ParseLSN(info.StartLSN)
+	if err != nil {
+		return fmt.Errorf("could not parse lsn: %v", err)
+	}
+
+	first := 0
+	for first < len(deltas)-1 && deltas[first+1].lsn <= startLSN {
+		first++
+	}
+	if removed <= first {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(prevDir)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+	for _, f := range files {
+		if err := remove(path.Join(prevDir, f.Name()), f.Size(), opts, stats); err != nil {
+			return err
+		}
+	}
+	if !opts.DryRun {
+		if err := os.Remove(prevDir); err != nil {
+			return fmt.Errorf("could not remove previous dir: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func loadInfo(infoPath string) (message.DumpInfo, error) {
+	var info message.DumpInfo
+
+	fp, err := os.Open(infoPath)
+	if err != nil {
+		return info, fmt.Errorf("could not open info file: %v", err)
+	}
+	defer fp.Close()
+
+	if err := yaml.NewDecoder(fp).Decode(&info); err != nil {
+		return info, fmt.Errorf("could not decode info file: %v", err)
+	}
+
+	return info, nil
+}
+
+// removeStaleBasebackups removes the files of the earlier base backups, i.e.
+// the parts of a parallel dump taken with more jobs or the dumps in another
+// format. Only the files older than the info file are touched: the newer ones
+// belong to a base backup which is being archived.
+func removeStaleBasebackups(dir string, info message.DumpInfo, infoStat os.FileInfo, opts Options, stats *Stats) error {
+	current := make(map[string]struct{})
+	switch {
+	case info.Format == config.DumpFormatDeltasOnly:
+	case info.Format == config.BasebackupFormatSQL:
+		current[sqlDumpFilename] = struct{}{}
+	case len(info.Parts) > 0:
+		for _, part := range info.Parts {
+			current[part] = struct{}{}
+		}
+	default:
+		current[basebackupFilename] = struct{}{}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "basebackup.") {
+			continue
+		}
+
+		if _, ok := current[f.Name()]; ok || !f.ModTime().Before(infoStat.ModTime()) {
+			continue
+		}
+
+		if err := remove(path.Join(dir, f.Name()), f.Size(), opts, stats); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listDeltas(dir string) ([]deltaFile, error) {
+	files, err := utils.ReadDeltaDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	deltas := make([]deltaFile, 0, len(files))
+	for _, f := range files {
+		parts := strings.SplitN(f.Name(), ".", 2)
+
+		d := deltaFile{name: f.Path, size: f.Size(), modTime: f.ModTime()}
+		if d.lsn, err = strconv.ParseUint(parts[0], 16, 64); err != nil {
+			log.Printf("skipping unknown file %q", path.Join(dir, f.Path))
+			continue
+		}
+		if len(parts) == 2 {
+			if d.postfix, err = strconv.ParseUint(parts[1], 16, 32); err != nil {
+				log.Printf("skipping unknown file %q", path.Join(dir, f.Path))
+				continue
+			}
+		}
+
+		deltas = append(deltas, d)
+	}
+
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].lsn != deltas[j].lsn {
+			return deltas[i].lsn < deltas[j].lsn
+		}
+
+		return deltas[i].postfix < deltas[j].postfix
+	})
+
+	return deltas, nil
+}
+
+// compactDeltas appends the runs of consecutive small delta files of the same
+// format to the first file of each run; the restore reads the messages of the
+// merged file in the same order as of the original ones
+func compactDeltas(dir string, deltas []deltaFile, opts Options, stats *Stats) error {
+	for i := 0; i < len(deltas); {
+		first := deltas[i]
+		j := i + 1
+		if first.size < opts.CompactBelow {
+			format, err := deltaFormat(path.Join(dir, first.name))
+			if err != nil {
+				return err
+			}
+
+			size := first.size
+			for ; j < len(deltas) && deltas[j].size < opts.CompactBelow && size+deltas[j].size < opts.CompactBelow; j++ {
+				if f, err := deltaFormat(path.Join(dir, deltas[j].name)); err != nil {
+					return err
+				} else if f != format {
+					break
+				}
+				size += deltas[j].size
+			}
+
+			if err := mergeDeltas(dir, deltas[i:j], opts, stats); err != nil {
+				return err
+			}
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+func deltaFormat(filename string) (byte, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	b := make([]byte, 1)
+	if _, err := fp.Read(b); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("could not read file: %v", err)
+	}
+
+	return b[0], nil
+}
+
+func mergeDeltas(dir string, deltas []deltaFile, opts Options, stats *Stats) error {
+	if len(deltas) < 2 {
+		return nil
+	}
+
+	stats.FilesCompacted += len(deltas)
+	if opts.DryRun {
+		log.Printf("would merge %d delta files into %s", len(deltas), path.Join(dir, deltas[0].name))
+		return nil
+	}
+
+	target := path.Join(dir, deltas[0].name)
+	st, err := os.Stat(target)
+	if err != nil {
+		return fmt.Errorf("could not stat file: %v", err)
+	}
+
+	tempFilename := target + ".new"
+	// the merged file keeps the mode and the group of the first one, see fileGroup
+	gid := -1
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		gid = int(sys.Gid)
+	}
+	fp, err := utils.CreateFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, st.Mode().Perm(), gid)
+	if err != nil {
+		return fmt.Errorf("could not create file: %v", err)
+	}
+
+	for _, d := range deltas {
+		if err := appendFile(fp, path.Join(dir, d.name)); err != nil {
+			fp.Close()
+			os.Remove(tempFilename)
+			return err
+		}
+	}
+
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not sync file: %v", err)
+	}
+	fp.Close()
+
+	if err := os.Rename(tempFilename, target); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not move file: %v", err)
+	}
+
+	for _, d := range deltas[1:] {
+		if err := os.Remove(path.Join(dir, d.name)); err != nil {
+			return fmt.Errorf("could not remove merged file: %v", err)
+		}
+	}
+	log.Printf("merged %d delta files into %s", len(deltas), target)
+
+	return nil
+}
+
+func appendFile(w io.Writer, filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	if _, err := io.Copy(w, fp); err != nil {
+		return fmt.Errorf("could not copy %q: %v", filename, err)
+	}
+
+	return nil
+}
+
+func remove(filename string, size int64, opts Options, stats *Stats) error {
+	stats.FilesRemoved++
+	stats.BytesReclaimed += size
+
+	if opts.DryRun {
+		log.Printf("would remove %s", filename)
+		return nil
+	}
+
+	if err := os.Remove(filename); err != nil {
+		return fmt.Errorf("could not remove file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// writeBasebackup writes the info file of the base backup at startLSN and its
+// dump into dir
+func writeBasebackup(t *testing.T, dir string, startLSN uint64) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("could not create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, basebackupFilename), []byte("data"), 0600); err != nil {
+		t.Fatalf("could not write dump file: %v", err)
+	}
+	data, err := yaml.Marshal(message.DumpInfo{StartLSN: pgx.FormatLSN(startLSN)})
+	if err != nil {
+		t.Fatalf("could not encode info file: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, infoFilename), data, 0600); err != nil {
+		t.Fatalf("could not write info file: %v", err)
+	}
+}
+
+func TestCollectPrevious(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    int // of the retention
+		deltas   int // left
+		previous bool
+	}{
+		{"no retention", 0, 2, false},
+		{"deltas of the previous one retained", 2, 4, true},
+		{"first delta of the previous one removed", 1, 3, false},
+	}
+
+	for _, tt := range tests {
+		archiveDir := t.TempDir()
+		dir := path.Join(archiveDir, utils.TableDir(message.Identifier{Namespace: "public", Name: "test"}))
+
+		// the previous base backup falls into the first delta file, the
+		// latest one into the third one
+		writeBasebackup(t, path.Join(dir, previousDir), 0x18)
+		writeBasebackup(t, dir, 0x38)
+		if err := os.MkdirAll(path.Join(dir, deltasDir), 0700); err != nil {
+			t.Fatalf("could not create deltas dir: %v", err)
+		}
+		for _, lsn := range []uint64{0x10, 0x20, 0x30, 0x40} {
+			if err := ioutil.WriteFile(path.Join(dir, deltasDir, fmt.Sprintf("%016x", lsn)), []byte("data"), 0600); err != nil {
+				t.Fatalf("could not write delta file: %v", err)
+			}
+		}
+
+		stats, err := Run(archiveDir, Options{Retention: utils.DeltaRetention{Files: tt.files}})
+		if err != nil {
+			t.Fatalf("%s: could not collect garbage: %v", tt.name, err)
+		}
+		if stats.Tables != 1 {
+			t.Errorf("%s: %d tables collected, expected 1", tt.name, stats.Tables)
+		}
+
+		deltas, err := listDeltas(path.Join(dir, deltasDir))
+		if err != nil {
+			t.Fatalf("%s: could not list deltas: %v", tt.name, err)
+		}
+		if len(deltas) != tt.deltas {
+			t.Errorf("%s: %d delta files left, expected %d", tt.name, len(deltas), tt.deltas)
+		}
+		if _, err := os.Stat(path.Join(dir, previousDir)); os.IsNotExist(err) == tt.previous {
+			t.Errorf("%s: previous base backup kept: %t, expected %t", tt.name, !os.IsNotExist(err), tt.previous)
+		}
+	}
+}
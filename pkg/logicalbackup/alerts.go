@@ -0,0 +1,146 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/alert"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+const alertCheckInterval = time.Minute
+
+// alertState tracks a condition, i.e. an open circuit breaker of a table, so
+// that it's alerted once it holds long enough and not more often than the
+// repeat interval afterwards
+type alertState struct {
+	since time.Time // the condition holds since
+	sent  time.Time // the last alert sent
+	text  string    // of the last alert sent
+}
+
+// alerter checks the tables and the disk space periodically, posting the
+// alerts to the webhook
+type alerter struct {
+	b       *LogicalBackup
+	webhook *alert.Webhook
+	states  map[string]*alertState
+}
+
+func (b *LogicalBackup) alerts() {
+	defer b.waitGr.Done()
+	ticker := time.NewTicker(alertCheckInterval)
+
+	a := &alerter{
+		b:       b,
+		webhook: alert.NewWebhook(b.cfg.AlertWebhook),
+		states:  make(map[string]*alertState),
+	}
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			a.check(now)
+		}
+	}
+}
+
+func (a *alerter) check(now time.Time) {
+	active := make(map[string]struct{})
+	raise := func(key string, holdFor time.Duration, text string) {
+		active[key] = struct{}{}
+		a.raise(now, key, holdFor, text)
+	}
+
+	a.b.tablesMu.RLock()
+	tables := make([]tablebackup.Status, 0, len(a.b.backupTables))
+	for _, t := range a.b.backupTables {
+		tables = append(tables, t.Status())
+	}
+	a.b.tablesMu.RUnlock()
+
+	for _, st := range tables {
+		if st.Dropped || st.Removed {
+			continue
+		}
+
+		// the breaker opens only after a number of failures in a row, so
+		// the occasional ones don't raise alerts
+		if st.Breaker.State == tablebackup.BreakerOpen {
+			raise("breaker:"+st.Table, 0, fmt.Sprintf("base backups of %s are failing: %d failures in a row, the last one: %s",
+				st.Table, st.Breaker.Failures, st.Breaker.LastError))
+		}
+
+		if a.b.cfg.AlertLag > 0 {
+			lag := now.Sub(a.b.started)
+			if !st.LastBasebackup.IsZero() {
+				lag = now.Sub(st.LastBasebackup)
+			}
+
+			if lag > a.b.cfg.AlertLag {
+				raise("lag:"+st.Table, a.b.cfg.AlertFor, fmt.Sprintf("no base backup of %s for %v", st.Table, lag.Truncate(time.Second)))
+			}
+		}
+	}
+
+	if p := a.b.SlotProgress(); p != nil && p.State == SlotStuck {
+		raise("slot", 0, fmt.Sprintf("replication slot is stuck at %s for %v while the wal is at %s, %0.2fMb behind",
+			p.ConfirmedLSN, now.Sub(p.AdvancedAt).Truncate(time.Second), p.WalLSN, float64(p.LagBytes)/1048576))
+	}
+
+	if a.b.cfg.AlertMinFreeSpaceMB > 0 {
+		for _, dir := range []string{a.b.cfg.TempDir, a.b.cfg.ArchiveDir} {
+			free, err := utils.FreeSpace(dir)
+			if err != nil {
+				log.Printf("could not check free space of %s: %v", dir, err)
+				continue
+			}
+
+			if free < uint64(a.b.cfg.AlertMinFreeSpaceMB)*1024*1024 {
+				raise("disk:"+dir, a.b.cfg.AlertFor, fmt.Sprintf("low disk space in %s: %0.2fMb free", dir, float64(free)/1048576))
+			}
+		}
+	}
+
+	for key, s := range a.states {
+		if _, ok := active[key]; ok {
+			continue
+		}
+
+		if !s.sent.IsZero() {
+			a.send(fmt.Sprintf("resolved: %s", s.text))
+		}
+		delete(a.states, key)
+	}
+}
+
+func (a *alerter) raise(now time.Time, key string, holdFor time.Duration, text string) {
+	s, ok := a.states[key]
+	if !ok {
+		s = &alertState{since: now}
+		a.states[key] = s
+	}
+
+	if now.Sub(s.since) < holdFor || (!s.sent.IsZero() && now.Sub(s.sent) < a.b.cfg.AlertRepeatInterval) {
+		return
+	}
+
+	if a.send(text) {
+		s.sent = now
+		s.text = text
+	}
+}
+
+func (a *alerter) send(text string) bool {
+	if err := a.webhook.Send(fmt.Sprintf("logical backup (slot %s): %s", a.b.cfg.Slotname, text)); err != nil {
+		log.Printf("could not send alert %q: %v", text, err)
+		return false
+	}
+
+	return true
+}
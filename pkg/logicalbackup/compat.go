@@ -0,0 +1,100 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+)
+
+// decoderProtoVersion is the highest pgoutput protocol version the decoder reads
+const decoderProtoVersion = 1
+
+// pluginFeature is a pgoutput option not available in every server version
+type pluginFeature struct {
+	serverVersion int  // server_version_num it appeared in
+	protoVersion  int  // the lowest protocol version supporting it
+	decoded       bool // whether the decoder reads the messages it produces
+}
+
+// pluginFeatures is the compatibility matrix of the pgoutput options
+var pluginFeatures = map[string]pluginFeature{
+	"messages":  {serverVersion: 140000, protoVersion: 1, decoded: true},
+	"binary":    {serverVersion: 140000, protoVersion: 1},
+	"streaming": {serverVersion: 140000, protoVersion: 2},
+	"two_phase": {serverVersion: 150000, protoVersion: 3},
+	"origin":    {serverVersion: 160000, protoVersion: 1, decoded: true},
+}
+
+// serverProtoVersion returns the highest pgoutput protocol version of the server
+func serverProtoVersion(version int) int {
+	switch {
+	case version >= 160000:
+		return 4
+	case version >= 150000:
+		return 3
+	case version >= 140000:
+		return 2
+	}
+
+	return 1
+}
+
+// negotiatePlugin picks the protocol version and the plugin options supported
+// by both the server and the decoder. The unsupported options requested are
+// either refused or left out, depending on unsupportedPluginOptions.
+func (b *LogicalBackup) negotiatePlugin(conn *pgx.Conn) error {
+	var version int
+	if err := conn.QueryRow("select current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return fmt.Errorf("could not get server version: %v", err)
+	}
+
+	proto := serverProtoVersion(version)
+	if proto > decoderProtoVersion {
+		proto = decoderProtoVersion
+	}
+
+	requested := make([]string, 0, len(b.cfg.PluginOptions)+1)
+	for k := range b.cfg.PluginOptions {
+		requested = append(requested, k)
+	}
+	if b.cfg.LogicalMessages {
+		requested = append(requested, "messages")
+	}
+	sort.Strings(requested)
+
+	disabled := make(map[string]struct{})
+	for _, name := range requested {
+		f, ok := pluginFeatures[name]
+		if !ok {
+			continue // up to the plugin
+		}
+
+		var reason string
+		switch {
+		case version < f.serverVersion:
+			reason = fmt.Sprintf("requires PostgreSQL %d, the server is %d", f.serverVersion/10000, version)
+		case f.protoVersion > proto:
+			reason = fmt.Sprintf("requires protocol version %d, only %d is used", f.protoVersion, proto)
+		case !f.decoded:
+			reason = "its messages can't be decoded"
+		default:
+			continue
+		}
+
+		if b.cfg.UnsupportedPluginOptions == config.UnsupportedPluginOptionsRefuse {
+			return fmt.Errorf("plugin option %q is not supported: %s", name, reason)
+		}
+		log.Printf("plugin option %q is not supported: %s; disabling it", name, reason)
+		disabled[name] = struct{}{}
+	}
+
+	b.pluginArgs = pluginArgs(b.cfg, proto, disabled)
+	log.Printf("server version %d, pgoutput options: %s", version, strings.Join(b.pluginArgs, ", "))
+
+	return nil
+}
@@ -3,35 +3,48 @@ package logicalbackup
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
 	"gopkg.in/yaml.v2"
 
 	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
 	"github.com/ikitiki/logical_backup/pkg/decoder"
 	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/metrics"
 	"github.com/ikitiki/logical_backup/pkg/queue"
 	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+	"github.com/ikitiki/logical_backup/pkg/utils"
 )
 
 type cmdType int
 
 const (
-	applicationName = "logical_backup"
 	outputPlugin    = "pgoutput"
 	logicalSlotType = "logical"
 
-	statusTimeout = time.Second * 10
-	waitTimeout   = time.Second * 10
+	statusTimeout    = time.Second * 10
+	statusJitter     = time.Second * 2  // the status is sent every statusTimeout ± statusJitter
+	maxStatusTimeout = time.Second * 30 // while nothing is written, well within the default wal_sender_timeout
+	waitTimeout      = time.Second * 10
+
+	idleCheckInterval = time.Minute
+
+	pauseCheckInterval = time.Second // while the deltas are paused, see pauseDeltasDuringCopy
 
 	cInsert cmdType = iota
 	cUpdate
@@ -51,21 +64,35 @@ type LogicalBackup struct {
 	pluginArgs []string
 
 	backupTables map[uint32]tablebackup.TableBackuper
+	tablesMu     sync.RWMutex // guards backupTables against the readers outside of the replication loop
 
 	dbCfg    pgx.ConnConfig
 	replConn *pgx.ReplicationConn // connection for logical replication
+	replPID  int32                // the process streaming for replConn, 0 if unknown; accessed atomically, see watchSlot
 	tx       *pgx.Tx
 
 	replMessageWaitTimeout time.Duration
 	statusTimeout          time.Duration
-
-	relations     map[message.Identifier]message.Relation
-	relationNames map[uint32]message.Identifier
-	types         map[uint32]message.Type
+	statusInterval         time.Duration // the current one, from statusTimeout up to maxStatusTimeout
+	lastServerMessage      time.Time     // received on the replication connection, see config.ReplicationTimeout
+
+	relations      map[message.Identifier]message.Relation
+	relationNames  map[uint32]message.Identifier
+	meta           *tablebackup.MetaCache // shared with the table backups
+	reconnector    *dbutils.Reconnector
+	deltaPause     *tablebackup.DeltaPause     // shared with the table backups
+	archiveLimiter *tablebackup.ArchiveLimiter // shared with the table backups
+	dbKey          string
+	types          map[uint32]message.Type
 
 	storedFlushLSN uint64
 	startLSN       uint64
-	flushLSN       uint64
+	slotRestartLSN uint64 // the oldest lsn the slot retains the wal for
+	slotLSN        uint64 // the consistent point the slot was created at, 0 if unknown
+	flushLSN       uint64 // the latest commit lsn written and fsynced; the only one reported to the server
+	commitLSN      uint64 // the latest commit lsn written, but not necessarily fsynced yet
+	txLSN          uint64 // final lsn of the transaction being decoded
+	inTx           bool   // between the begin and the commit messages
 	lastTxId       int32
 
 	basebackupQueue *queue.Queue
@@ -74,9 +101,26 @@ type LogicalBackup struct {
 	msgCnt       map[cmdType]int
 	bytesWritten uint64
 
-	txBeginRelMsg map[uint32]struct{}
-	beginMsg      []byte
-	typeMsg       []byte
+	txBeginRelMsg  map[uint32]struct{}
+	unsyncedTables map[uint32]struct{} // tables with the commits written after the last flush
+	beginMsg       []byte
+	typeMsg        []byte
+
+	messagesFp     *os.File // logical decoding messages, opened on the first one
+	lastMessageLSN uint64
+
+	tableUpdates   chan tableUpdate
+	queriedTables  map[string]struct{} // the latest result of the tables query
+	configuredOIDs map[uint32]struct{} // the tables of tableOIDs found at startup
+	hypertables    []hypertable        // backed up as their chunks, see timescaleHypertables
+	viaRoot        bool                // the publication has publish_via_partition_root set
+
+	started   time.Time
+	lastCycle *CycleSummary
+	cycleMu   sync.Mutex // guards lastCycle
+
+	slotProgress slotProgress
+	slotMu       sync.Mutex // guards slotProgress
 
 	srv http.Server
 }
@@ -89,7 +133,7 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 	)
 
 	pgxConn := cfg.DB
-	pgxConn.RuntimeParams = map[string]string{"application_name": applicationName}
+	pgxConn.RuntimeParams = map[string]string{"application_name": cfg.ApplicationName}
 
 	mux := http.NewServeMux()
 
@@ -98,42 +142,70 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	mux.Handle("/debug/vars", expvar.Handler())
 
 	lb := &LogicalBackup{
-		ctx:   ctx,
-		dbCfg: pgxConn,
+		ctx:                    ctx,
+		dbCfg:                  pgxConn,
 		replMessageWaitTimeout: waitTimeout,
 		statusTimeout:          statusTimeout,
+		statusInterval:         statusTimeout,
 		relations:              make(map[message.Identifier]message.Relation),
 		relationNames:          make(map[uint32]message.Identifier),
+		meta:                   tablebackup.NewMetaCache(),
+		reconnector:            dbutils.NewReconnector(cfg.ReconnectConcurrency, cfg.ReconnectInterval),
+		deltaPause:             tablebackup.NewDeltaPause(cfg.PauseDeltasDuringCopy),
+		archiveLimiter:         tablebackup.NewArchiveLimiter(cfg.ArchiveConcurrency),
+		dbKey:                  tablebackup.DBKey(pgxConn),
 		types:                  make(map[uint32]message.Type),
 		backupTables:           make(map[uint32]tablebackup.TableBackuper),
-		pluginArgs:             []string{`"proto_version" '1'`, fmt.Sprintf(`"publication_names" '%s'`, cfg.PublicationName)},
 		basebackupQueue:        queue.New(ctx),
 		waitGr:                 &sync.WaitGroup{},
 		stateFilename:          "state.yaml",
 		cfg:                    cfg,
 		msgCnt:                 make(map[cmdType]int),
+		unsyncedTables:         make(map[uint32]struct{}),
+		started:                time.Now(),
+		tableUpdates:           make(chan tableUpdate),
+		queriedTables:          make(map[string]struct{}),
+		configuredOIDs:         make(map[uint32]struct{}),
 		srv: http.Server{
 			Addr:    fmt.Sprintf(":%d", 8080),                    // TODO: get rid of the hardcoded value
 			Handler: http.TimeoutHandler(mux, time.Second*5, ""), // TODO: get rid of the hardcoded value
 		},
 	}
 
+	mux.Handle("/status", http.HandlerFunc(lb.statusHandler))
+	mux.Handle("/validate", http.HandlerFunc(lb.validateHandler))
+	mux.Handle("/backups", http.HandlerFunc(lb.backupsHandler))
+
 	if _, err := os.Stat(cfg.TempDir); os.IsNotExist(err) {
-		if err := os.Mkdir(cfg.TempDir, os.ModePerm); err != nil {
+		if err := os.Mkdir(cfg.TempDir, cfg.DirMode); err != nil {
 			return nil, fmt.Errorf("could not create base dir: %v", err)
 		}
+		if err := utils.SetGroup(cfg.TempDir, cfg.FileGID()); err != nil {
+			return nil, fmt.Errorf("could not set group of base dir: %v", err)
+		}
 	}
 
-	conn, err := pgx.Connect(pgxConn)
+	// the slot and the replication stream need the primary
+	conn, primaryCfg, err := dbutils.ConnectTarget(pgxConn, dbutils.SessionReadWrite)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect: %v", err)
+		return nil, fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, pgxConn))
 	}
 	defer conn.Close()
+	pgxConn, lb.dbCfg = primaryCfg, primaryCfg
 
 	log.Printf("My PID: %d", conn.PID())
 
+	if err := lb.checkServerSettings(conn); err != nil {
+		return nil, err
+	}
+
+	if err := lb.negotiatePlugin(conn); err != nil {
+		return nil, err
+	}
+
 	//TODO: have a separate "init" command which will set replica identity and create replication slots/publications
 	if err := lb.checkTablesReplicaIdentities(conn); err != nil {
 		return nil, err
@@ -148,27 +220,62 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 		return nil, err
 	}
 
-	if err := lb.initTables(conn, cfg.Tables); err != nil {
+	// the slot is not in use, so no other backup writes to the temp dir
+	if n, err := utils.RemoveTempFiles(cfg.TempDir); err != nil {
+		return nil, fmt.Errorf("could not remove stale temp files: %v", err)
+	} else if n > 0 {
+		log.Printf("removed %d stale temp files left by the previous run", n)
+	}
+
+	tables := cfg.Tables
+	if cfg.TablesQuery != "" {
+		if tables, err = lb.queryTables(conn); err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			lb.queriedTables[t] = struct{}{}
+		}
+	} else if len(cfg.TableOIDs) > 0 {
+		resolved, err := lb.resolveTableOIDs(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 && len(resolved) == 0 {
+			return nil, fmt.Errorf("none of the tables of tableOIDs exist")
+		}
+		tables = append(tables, resolved...)
+	}
+
+	if cfg.TablesQuery == "" || len(tables) > 0 {
+		if err := lb.initTables(conn, tables); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("tables query returned no tables")
+	}
+
+	if err := lb.checkOperationFilters(conn); err != nil {
 		return nil, err
 	}
 
 	if len(lb.backupTables) == 0 {
-		if !lb.cfg.TrackNewTables {
+		if !lb.cfg.TrackNewTables && cfg.TablesQuery == "" {
 			log.Fatalf("no tables to backup")
 		}
 	} else {
-		tables := make([]string, 0)
-		for _, t := range lb.backupTables {
-			tables = append(tables, t.String())
-		}
+		lb.estimateBasebackups(conn)
 	}
 
-	if rc, err := pgx.ReplicationConnect(cfg.DB); err != nil {
-		return nil, fmt.Errorf("could not connect using replication protocol: %v", err)
+	if rc, err := pgx.ReplicationConnect(pgxConn); err != nil {
+		return nil, fmt.Errorf("could not connect using replication protocol: %v", dbutils.RedactPassword(err, pgxConn))
 	} else {
 		lb.replConn = rc
 	}
 
+	if !slotExists && cfg.DeltasOnly {
+		return nil, fmt.Errorf("replication slot %q must exist to stream deltas only", cfg.Slotname)
+	}
+
 	if !slotExists {
 		log.Printf("Creating logical replication slot %s", lb.cfg.Slotname)
 
@@ -179,6 +286,8 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 		log.Printf("Created missing replication slot %q, consistent point %s", lb.cfg.Slotname, pgx.FormatLSN(startLSN))
 
 		lb.startLSN = startLSN
+		lb.slotLSN = startLSN
+		lb.flushLSN = startLSN
 		if err := lb.storeRestartLSN(); err != nil {
 			log.Printf("could not store current LSN: %v", err)
 		}
@@ -188,13 +297,18 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 			return nil, fmt.Errorf("could not read last lsn: %v", err)
 		}
 		if startLSN != 0 {
-			lb.startLSN = startLSN
-			lb.storedFlushLSN = startLSN
+			if err := lb.resumeFromCheckpoint(conn, startLSN); err != nil {
+				return nil, err
+			}
 		}
 	}
+	lb.flushLSN = lb.startLSN
+	lb.commitLSN = lb.startLSN
 
-	if len(cfg.Tables) > 0 {
-		log.Printf("Tables to backup: %s", strings.Join(cfg.Tables, ", "))
+	if len(tables) > 0 {
+		log.Printf("Tables to backup: %s", strings.Join(tables, ", "))
+	} else if cfg.TablesQuery != "" {
+		log.Printf("Backing up the tables returned by the tables query")
 	} else {
 		log.Printf("Backing up all the publication tables")
 	}
@@ -202,6 +316,29 @@ func New(ctx context.Context, cfg *config.Config) (*LogicalBackup, error) {
 	return lb, nil
 }
 
+// pluginArgs returns the options of the START_REPLICATION command: the ones
+// pgoutput needs, followed by the configured ones not disabled, passed as is
+func pluginArgs(cfg *config.Config, protoVersion int, disabled map[string]struct{}) []string {
+	args := []string{fmt.Sprintf(`"proto_version" '%d'`, protoVersion), fmt.Sprintf(`"publication_names" '%s'`, cfg.PublicationName)}
+	if _, ok := disabled["messages"]; cfg.LogicalMessages && !ok {
+		args = append(args, `"messages" 'true'`)
+	}
+
+	names := make([]string, 0, len(cfg.PluginOptions))
+	for k := range cfg.PluginOptions {
+		if _, ok := disabled[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		args = append(args, fmt.Sprintf(`"%s" '%s'`, k, strings.Replace(cfg.PluginOptions[k], "'", "''", -1)))
+	}
+
+	return args
+}
+
 func (b *LogicalBackup) saveRawMessage(tableOID uint32, raw []byte) error {
 	var err error
 
@@ -212,7 +349,7 @@ func (b *LogicalBackup) saveRawMessage(tableOID uint32, raw []byte) error {
 	}
 
 	if _, ok := b.txBeginRelMsg[tableOID]; !ok {
-		ln, err := bt.SaveRawMessage(b.beginMsg, b.flushLSN)
+		ln, err := bt.SaveRawMessage(b.beginMsg, b.txLSN)
 		if err != nil {
 			return fmt.Errorf("could not save begin message: %v", err)
 		}
@@ -222,7 +359,7 @@ func (b *LogicalBackup) saveRawMessage(tableOID uint32, raw []byte) error {
 	}
 
 	if b.typeMsg != nil {
-		ln, err := bt.SaveRawMessage(b.typeMsg, b.flushLSN)
+		ln, err := bt.SaveRawMessage(b.typeMsg, b.txLSN)
 		if err != nil {
 			return fmt.Errorf("could not save type message: %v", err)
 		}
@@ -231,7 +368,7 @@ func (b *LogicalBackup) saveRawMessage(tableOID uint32, raw []byte) error {
 		b.typeMsg = nil
 	}
 
-	ln, err := bt.SaveRawMessage(raw, b.flushLSN)
+	ln, err := bt.SaveRawMessage(raw, b.txLSN)
 	if err != nil {
 		return fmt.Errorf("could not save message: %v", err)
 	}
@@ -241,6 +378,26 @@ func (b *LogicalBackup) saveRawMessage(tableOID uint32, raw []byte) error {
 	return nil
 }
 
+// skipChange reports and counts the changes not backed up: the ones filtered
+// out by the operations setting of the table and the updates and deletes of the
+// tables with replica identity nothing, which have no key to find the rows on
+// restore
+func (b *LogicalBackup) skipChange(oid uint32, op string) bool {
+	rel, ok := b.relations[b.relationNames[oid]]
+	if !ok {
+		return false
+	}
+
+	if b.cfg.CapturesOperation(rel.Namespace+"."+rel.Name, op) &&
+		(op == config.OperationInsert || op == config.OperationTruncate || rel.ReplicaIdentity != message.ReplicaIdentityNothing) {
+		return false
+	}
+
+	metrics.SkippedChanges.Add(rel.Identifier.String(), 1)
+
+	return true
+}
+
 func (b *LogicalBackup) handler(m message.Message) error {
 	var err error
 
@@ -250,29 +407,50 @@ func (b *LogicalBackup) handler(m message.Message) error {
 		if oldRel, ok := b.relations[tblName]; !ok { // new table or renamed
 			if oldTblName, ok := b.relationNames[v.OID]; ok { // renamed table
 				log.Printf("table was renamed %s -> %s", oldTblName, tblName)
+				if _, ok := b.configuredOIDs[v.OID]; ok {
+					log.Printf("table oid %d now resolves to %s", v.OID, tblName)
+				}
 				delete(b.relations, oldTblName)
 				delete(b.relationNames, v.OID)
 
 				err = b.saveRawMessage(v.OID, v.Raw)
 			} else { // new table
 				if _, ok := b.backupTables[v.OID]; !ok { // not tracking
-					if b.cfg.TrackNewTables {
-						log.Printf("new table %s", tblName)
-
-						tb, tErr := tablebackup.New(b.ctx, b.cfg, tblName, b.dbCfg, b.basebackupQueue)
+					h, isChunk := b.chunkOf(tblName)
+					if isChunk || b.cfg.TrackNewTables && !b.isHypertable(tblName) {
+						if isChunk {
+							log.Printf("new chunk %s of hypertable %s", tblName, h)
+						} else {
+							log.Printf("new table %s", tblName)
+						}
+						tb, tErr := tablebackup.New(b.ctx, b.cfg, tblName, b.cfg.DB, b.meta, b.reconnector, b.deltaPause, b.archiveLimiter, b.basebackupQueue)
 						if tErr != nil {
 							err = fmt.Errorf("could not init tablebackup: %v", tErr)
 						} else {
+							b.tablesMu.Lock()
 							b.backupTables[v.OID] = tb
+							b.tablesMu.Unlock()
+
+							if b.cfg.DeltasOnly { // save the info file
+								b.basebackupQueue.Put(tb)
+							}
 						}
+					} else if b.isHypertable(tblName) {
+						log.Printf("skipping hypertable %s, its chunks are backed up", tblName)
 					} else {
 						log.Printf("skipping new table %s due to trackNewTables = false", tblName)
 					}
 				}
+
+				// store the relation so that deltas could be decoded without the catalog
+				if _, ok := b.backupTables[v.OID]; ok && err == nil {
+					err = b.saveRawMessage(v.OID, v.Raw)
+				}
 			}
 		} else { // existing table
 			if oldRel.OID != v.OID { // dropped and created again
 				log.Printf("table was dropped and created again %s", tblName)
+				b.meta.DropRelation(b.dbKey, oldRel.OID)
 				bt, ok := b.backupTables[oldRel.OID]
 				if !ok {
 					// table is not tracked — skip it
@@ -280,7 +458,13 @@ func (b *LogicalBackup) handler(m message.Message) error {
 				}
 				err = bt.Truncate()
 
+				b.tablesMu.Lock()
 				b.backupTables[v.OID] = b.backupTables[oldRel.OID]
+				b.tablesMu.Unlock()
+
+				if err == nil {
+					err = b.saveRawMessage(v.OID, v.Raw)
+				}
 			} else {
 				err = b.saveRawMessage(v.OID, v.Raw)
 			}
@@ -288,35 +472,53 @@ func (b *LogicalBackup) handler(m message.Message) error {
 
 		b.relations[tblName] = v
 		b.relationNames[v.OID] = tblName
+		b.meta.SetRelation(b.dbKey, v)
 	case message.Insert:
 		b.msgCnt[cInsert]++
 
+		if b.skipChange(v.RelationOID, config.OperationInsert) {
+			break
+		}
 		err = b.saveRawMessage(v.RelationOID, v.Raw)
 	case message.Update:
 		b.msgCnt[cUpdate]++
 
+		if b.skipChange(v.RelationOID, config.OperationUpdate) {
+			break
+		}
 		err = b.saveRawMessage(v.RelationOID, v.Raw)
 	case message.Delete:
 		b.msgCnt[cDelete]++
 
+		if b.skipChange(v.RelationOID, config.OperationDelete) {
+			break
+		}
 		err = b.saveRawMessage(v.RelationOID, v.Raw)
 	case message.Begin:
 		b.lastTxId = v.XID
-		b.flushLSN = v.FinalLSN
+		b.txLSN = v.FinalLSN
+		b.inTx = true
 
 		b.txBeginRelMsg = make(map[uint32]struct{})
 		b.beginMsg = v.Raw
 	case message.Commit:
 		var ln uint64
 		for relOID := range b.txBeginRelMsg {
-			ln, err = b.backupTables[relOID].SaveRawMessage(v.Raw, b.flushLSN)
+			ln, err = b.backupTables[relOID].SaveRawMessage(v.Raw, b.txLSN)
 			if err != nil {
 				break
 			}
 
 			b.bytesWritten += ln
+			b.unsyncedTables[relOID] = struct{}{}
 		}
 
+		if err != nil {
+			break
+		}
+		b.commitLSN = v.TransactionLSN
+		b.inTx = false
+
 		if !b.cfg.SendStatusOnCommit {
 			break
 		}
@@ -324,10 +526,23 @@ func (b *LogicalBackup) handler(m message.Message) error {
 		if err == nil {
 			err = b.sendStatus()
 		}
+	case message.LogicalMessage:
+		if b.cfg.LogicalMessages {
+			err = b.saveLogicalMessage(v)
+		}
 	case message.Origin:
 		//TODO:
 	case message.Truncate:
-		//TODO:
+		// the message lists all the tables truncated together, the restore of
+		// each one only truncates its own
+		for _, relOID := range v.RelationOIDs {
+			if b.skipChange(relOID, config.OperationTruncate) {
+				continue
+			}
+			if err = b.saveRawMessage(relOID, v.Raw); err != nil {
+				break
+			}
+		}
 	case message.Type:
 		if _, ok := b.types[v.ID]; !ok {
 			b.types[v.ID] = v
@@ -338,7 +553,54 @@ func (b *LogicalBackup) handler(m message.Message) error {
 	return err
 }
 
-func (b *LogicalBackup) sendStatus() error {
+// flush fsyncs the delta files written since the previous flush, making all
+// the commits received so far durable
+func (b *LogicalBackup) flush() error {
+	for relOID := range b.unsyncedTables {
+		if err := b.backupTables[relOID].Sync(); err != nil {
+			return fmt.Errorf("could not fsync deltas of %s: %v", b.backupTables[relOID], err)
+		}
+		delete(b.unsyncedTables, relOID)
+	}
+	b.flushLSN = b.commitLSN
+
+	return nil
+}
+
+// statusDelay returns the interval until the next status, with the jitter
+func (b *LogicalBackup) statusDelay() time.Duration {
+	if b.statusInterval <= statusJitter {
+		return b.statusInterval
+	}
+
+	return b.statusInterval - statusJitter + time.Duration(rand.Int63n(int64(2*statusJitter)))
+}
+
+// adaptStatusInterval doubles the status interval while nothing is written
+// since the previous status, i.e. the deltas are paused or the server has
+// nothing to send, and gets back to statusTimeout once the writes resume.
+// The keepalives requesting a reply are answered regardless.
+func (b *LogicalBackup) adaptStatusInterval() {
+	if b.commitLSN != b.storedFlushLSN || len(b.unsyncedTables) > 0 {
+		b.statusInterval = b.statusTimeout
+		return
+	}
+
+	if b.statusInterval *= 2; b.statusInterval > maxStatusTimeout {
+		b.statusInterval = maxStatusTimeout
+	}
+	if b.statusInterval < b.statusTimeout {
+		b.statusInterval = b.statusTimeout
+	}
+}
+
+// standbyStatus fsyncs the deltas and returns the status reporting the
+// flushed position, never past it
+func (b *LogicalBackup) standbyStatus() (*pgx.StandbyStatus, error) {
+	if err := b.flush(); err != nil {
+		return nil, err
+	}
+
 	log.Printf("sending new status with %s flush lsn (i:%d u:%d d:%d b:%0.2fMb) ",
 		pgx.FormatLSN(b.flushLSN), b.msgCnt[cInsert], b.msgCnt[cUpdate], b.msgCnt[cDelete], float64(b.bytesWritten)/1048576)
 
@@ -348,7 +610,20 @@ func (b *LogicalBackup) sendStatus() error {
 	status, err := pgx.NewStandbyStatus(b.flushLSN)
 
 	if err != nil {
-		return fmt.Errorf("error creating standby status: %s", err)
+		return nil, fmt.Errorf("error creating standby status: %s", err)
+	}
+	// the keepalive reply tells the connection is alive while the stream is quiet
+	if b.cfg.ReplicationTimeout > 0 && time.Since(b.lastServerMessage) >= b.statusTimeout {
+		status.ReplyRequested = 1
+	}
+
+	return status, nil
+}
+
+func (b *LogicalBackup) sendStatus() error {
+	status, err := b.standbyStatus()
+	if err != nil {
+		return err
 	}
 
 	if err := b.replConn.SendStandbyStatus(status); err != nil {
@@ -375,18 +650,47 @@ func (b *LogicalBackup) startReplication() error {
 	if err != nil {
 		log.Fatalf("failed to start replication: %s", err)
 	}
+	b.recordReplPID()
 
-	ticker := time.NewTicker(b.statusTimeout)
+	// the backups of many databases started at once would otherwise report
+	// their positions in sync
+	statusTimer := time.NewTimer(b.statusDelay())
+	idleTicker := time.NewTicker(idleCheckInterval)
+	b.lastServerMessage = time.Now()
 	for {
 		select {
 		case <-b.ctx.Done():
-			ticker.Stop()
+			statusTimer.Stop()
+			idleTicker.Stop()
+			if b.messagesFp != nil {
+				b.messagesFp.Close()
+			}
 			return nil
-		case <-ticker.C:
+		case <-statusTimer.C:
+			if silence := time.Since(b.lastServerMessage); b.cfg.ReplicationTimeout > 0 && silence > b.cfg.ReplicationTimeout {
+				b.reconnectReplication(fmt.Errorf("no message from the server for %v", silence.Truncate(time.Second)))
+			}
+			b.adaptStatusInterval()
 			if err := b.sendStatus(); err != nil {
-				log.Fatalf("could not send status: %v", err)
+				if !b.replicationDead() {
+					log.Fatalf("could not send status: %v", err)
+				}
+				b.reconnectReplication(err)
 			}
+			statusTimer.Reset(b.statusDelay())
+		case <-idleTicker.C:
+			b.closeOldFiles()
+		case u := <-b.tableUpdates:
+			b.applyTableUpdate(u)
 		default:
+			// the server stops sending once the socket buffers are full, while
+			// the status above keeps the connection alive
+			if b.deltaPause.Paused() {
+				time.Sleep(pauseCheckInterval)
+				b.lastServerMessage = time.Now() // the silence while paused is ours
+				continue
+			}
+
 			wctx, cancel := context.WithTimeout(b.ctx, b.replMessageWaitTimeout)
 			repMsg, err := b.replConn.WaitForReplicationMessage(wctx)
 			cancel()
@@ -394,13 +698,18 @@ func (b *LogicalBackup) startReplication() error {
 				continue
 			}
 			if err != nil {
-				log.Fatalf("replication failed: %s", err)
+				if !b.replicationDead() {
+					log.Fatalf("replication failed: %s", err)
+				}
+				b.reconnectReplication(err)
+				continue
 			}
 
 			if repMsg == nil {
 				log.Printf("receieved null replication message")
 				continue
 			}
+			b.lastServerMessage = time.Now()
 
 			if repMsg.WalMessage != nil {
 				logmsg, err := decoder.Parse(repMsg.WalMessage.WalData)
@@ -412,33 +721,116 @@ func (b *LogicalBackup) startReplication() error {
 				}
 			}
 
+			if repMsg.ServerHeartbeat != nil {
+				b.handleHeartbeat(repMsg.ServerHeartbeat)
+			}
+
 			if repMsg.ServerHeartbeat != nil && repMsg.ServerHeartbeat.ReplyRequested == 1 {
 				log.Println("server wants a reply")
 				if err := b.sendStatus(); err != nil {
-					log.Fatalf("could not send status: %v", err)
+					if !b.replicationDead() {
+						log.Fatalf("could not send status: %v", err)
+					}
+					b.reconnectReplication(err)
 				}
 			}
 		}
 	}
 }
 
+// handleHeartbeat advances the position to the end of the wal processed by
+// the server: all the commits before it are received, so with no transaction
+// in progress it advances even if none of those touched the backed up tables,
+// letting the server recycle the wal
+func (b *LogicalBackup) handleHeartbeat(hb *pgx.ServerHeartbeat) {
+	if !b.inTx && hb.ServerWalEnd > b.commitLSN {
+		b.commitLSN = hb.ServerWalEnd
+	}
+}
+
+// replicationDead reports whether the replication connection failed and is to
+// be reconnected, which it is with replicationTimeout set
+func (b *LogicalBackup) replicationDead() bool {
+	return b.cfg.ReplicationTimeout > 0 && !b.replConn.IsAlive()
+}
+
+// reconnectReplication replaces the dead replication connection, streaming
+// again from the last fsynced position the way the restart does: the
+// transaction cut off is streamed again from its begin
+func (b *LogicalBackup) reconnectReplication(cause error) {
+	metrics.ReplicationDeadConnections.Add(1)
+	log.Printf("replication connection is dead: %v; reconnecting", cause)
+	b.replConn.Close()
+	atomic.StoreInt32(&b.replPID, 0)
+
+	if err := b.flush(); err != nil {
+		log.Fatalf("could not flush deltas: %v", err)
+	}
+	b.inTx = false
+
+	backoff := time.Second
+	for {
+		err := b.reconnector.Connect(b.ctx, func() error {
+			dbCfg := b.connConfig()
+			rc, err := pgx.ReplicationConnect(dbCfg)
+			if err != nil {
+				return dbutils.RedactPassword(err, dbCfg)
+			}
+			// the slot stays active until the server notices the old connection is gone
+			if err := rc.StartReplication(b.cfg.Slotname, b.flushLSN, -1, b.pluginArgs...); err != nil {
+				rc.Close()
+				return fmt.Errorf("could not start replication: %v", err)
+			}
+			b.replConn = rc
+
+			return nil
+		})
+		if err == nil {
+			break
+		}
+		if b.ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("could not reconnect replication: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > b.cfg.ReplicationTimeout {
+			backoff = b.cfg.ReplicationTimeout
+		}
+	}
+
+	b.recordReplPID()
+	log.Printf("replication reconnected, streaming from %s", pgx.FormatLSN(b.flushLSN))
+	b.lastServerMessage = time.Now()
+}
+
 func (b *LogicalBackup) initSlot(conn *pgx.Conn) (bool, error) {
 	slotExists := false
 
-	rows, err := conn.Query("select confirmed_flush_lsn, slot_type, database from pg_replication_slots where slot_name = $1;", b.cfg.Slotname)
+	rows, err := conn.Query(`select confirmed_flush_lsn, coalesce(restart_lsn::text, '0/0'), slot_type, database, active, coalesce(active_pid, 0)
+from pg_replication_slots where slot_name = $1;`, b.cfg.Slotname)
 	if err != nil {
 		return false, fmt.Errorf("could not execute query: %v", err)
 	}
 	defer rows.Close()
 
 	if rows.Next() {
-		var lsnString, slotType, database string
+		var (
+			lsnString, restartLSNString, slotType, database string
+			active                                          bool
+			activePID                                       int32
+		)
 
 		slotExists = true
-		if err := rows.Scan(&lsnString, &slotType, &database); err != nil {
+		if err := rows.Scan(&lsnString, &restartLSNString, &slotType, &database, &active, &activePID); err != nil {
 			return false, fmt.Errorf("could not scan lsn: %v", err)
 		}
 
+		if active {
+			return false, fmt.Errorf("replication slot %q is in use by the process %d, another backup may be running; stop it or start with -force to take the slot over",
+				b.cfg.Slotname, activePID)
+		}
+
 		if slotType != logicalSlotType {
 			return false, fmt.Errorf("slot %q is not a logical slot", b.cfg.Slotname)
 		}
@@ -452,6 +844,10 @@ func (b *LogicalBackup) initSlot(conn *pgx.Conn) (bool, error) {
 		} else {
 			b.startLSN = lsn
 		}
+
+		if b.slotRestartLSN, err = pgx.ParseLSN(restartLSNString); err != nil {
+			return false, fmt.Errorf("could not parse restart lsn: %v", err)
+		}
 	}
 
 	return slotExists, nil
@@ -481,49 +877,238 @@ func (b *LogicalBackup) Wait() {
 	b.waitGr.Wait()
 }
 
-func (b *LogicalBackup) initTables(conn *pgx.Conn, tables []string) error {
-	query := `select c.oid, n.nspname, c.relname
+// publicationTable is a table of the publication to back up
+type publicationTable struct {
+	oid       uint32
+	name      message.Identifier
+	nothing   bool     // replica identity nothing
+	ancestors []string // schema.name of the partitioned tables the partition belongs to, the parent first
+}
+
+// publicationTables returns the publication tables of the schema.name list,
+// all of them if the list is empty
+func (b *LogicalBackup) publicationTables(conn *pgx.Conn, tables []string) ([]publicationTable, error) {
+	rows, err := conn.Query(fmt.Sprintf(`select c.oid, n.nspname, c.relname, c.relreplident = 'n',
+	array(with recursive ancestors (relid, depth) as (
+			select i.inhparent, 1 from pg_inherits i where i.inhrelid = c.oid
+			union all
+			select i.inhparent, a.depth + 1 from ancestors a join pg_inherits i on i.inhrelid = a.relid
+		)
+		select an.nspname || '.' || ac.relname from ancestors a
+		inner join pg_class ac on ac.oid = a.relid
+		inner join pg_namespace an on an.oid = ac.relnamespace
+		order by a.depth)
      from pg_class c
      inner join pg_namespace n on (n.oid = c.relnamespace)
-     inner join pg_get_publication_tables('%s') x on x.relid = c.oid;`
+     inner join pg_get_publication_tables(%s) x on x.relid = c.oid`, dbutils.QuoteLiteral(b.cfg.PublicationName)))
+	if err != nil {
+		return nil, fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
 
-	if len(tables) > 0 {
-		tbls := make([]string, 0)
-		for _, t := range tables {
-			tbls = append(tbls, fmt.Sprintf("'%s'", t))
+	pubTables := make([]publicationTable, 0)
+	for rows.Next() {
+		var t publicationTable
+
+		if err := rows.Scan(&t.oid, &t.name.Namespace, &t.name.Name, &t.nothing, &t.ancestors); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+		pubTables = append(pubTables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]publicationTable, 0)
+	for _, t := range selectPublicationTables(pubTables, tables, b.viaRoot) {
+		if b.isHypertable(t.name) {
+			continue // captures nothing
+		}
+
+		if h, ok := b.chunkOf(t.name); ok {
+			log.Printf("backing up chunk %s of hypertable %s", t.name, h)
 		}
 
-		query += " where n.nspname || '.' || c.relname in (" + strings.Join(tbls, ", ") + ")"
+		res = append(res, t)
 	}
-	query = fmt.Sprintf(query, b.cfg.PublicationName)
 
-	rows, err := conn.Query(query)
+	return res, nil
+}
+
+// selectPublicationTables returns the publication tables of the schema.name
+// list, all of them if the list is empty. The publication has either the
+// partitions or, published via the root, the root partitioned tables: without
+// viaRoot a partitioned table in the list stands for all of its partitions,
+// with it the partitions are only backed up as part of the root.
+func selectPublicationTables(pubTables []publicationTable, tables []string, viaRoot bool) []publicationTable {
+	if len(tables) == 0 {
+		return pubTables
+	}
+
+	configured := make(map[string]bool)
+	for _, t := range tables {
+		configured[t] = true
+	}
+
+	res := make([]publicationTable, 0)
+	found := make(map[string]bool)
+	for _, t := range pubTables {
+		name := t.name.Namespace + "." + t.name.Name
+		if configured[name] {
+			found[name] = true
+			res = append(res, t)
+			continue
+		}
+		if viaRoot {
+			continue
+		}
+
+		for _, a := range t.ancestors {
+			if configured[a] {
+				found[a] = true
+				log.Printf("backing up partition %s of the configured partitioned table %s", t.name, a)
+				res = append(res, t)
+				break
+			}
+		}
+	}
+
+	for _, t := range tables {
+		if found[t] {
+			continue
+		}
+		if viaRoot {
+			log.Printf("table %s is not in the publication, or is a partition published via its root: back up the root table instead", t)
+		} else {
+			log.Printf("table %s is not in the publication", t)
+		}
+	}
+
+	return res
+}
+
+func (b *LogicalBackup) initTables(conn *pgx.Conn, tables []string) error {
+	viaRoot, err := b.publishViaRoot(conn)
 	if err != nil {
-		return fmt.Errorf("could not execute query: %v", err)
+		return err
 	}
-	defer rows.Close()
+	if viaRoot {
+		log.Printf("publication %q is published via the partition root: partitioned tables are backed up as a whole", b.cfg.PublicationName)
+	}
+	b.viaRoot = viaRoot
 
-	for rows.Next() {
-		var (
-			t   message.Identifier
-			oid uint32
-		)
+	if b.cfg.TimescaleHypertables {
+		if err := b.initHypertables(conn, tables); err != nil {
+			return err
+		}
+	}
 
-		if err := rows.Scan(&oid, &t.Namespace, &t.Name); err != nil {
-			return fmt.Errorf("could not scan: %v", err)
+	pubTables, err := b.publicationTables(conn, tables)
+	if err != nil {
+		return err
+	}
+
+	newTables, err := b.newTables(pubTables)
+	if err != nil {
+		return err
+	}
+
+	for oid, tb := range newTables {
+		b.backupTables[oid] = tb
+	}
+
+	return nil
+}
+
+// newTables creates the table backups of the publication tables
+func (b *LogicalBackup) newTables(pubTables []publicationTable) (map[uint32]tablebackup.TableBackuper, error) {
+	res := make(map[uint32]tablebackup.TableBackuper)
+
+	noIdentity := make([]string, 0)
+	for _, t := range pubTables {
+		if t.nothing {
+			noIdentity = append(noIdentity, t.name.String())
+			if b.cfg.ReplicaIdentityNothing == config.ReplicaIdentityNothingRefuse {
+				continue
+			}
 		}
 
-		tb, err := tablebackup.New(b.ctx, b.cfg, t, b.dbCfg, b.basebackupQueue)
+		tb, err := tablebackup.New(b.ctx, b.cfg, t.name, b.cfg.DB, b.meta, b.reconnector, b.deltaPause, b.archiveLimiter, b.basebackupQueue)
 		if err != nil {
-			return fmt.Errorf("could not create tablebackup instance: %v", err)
+			return nil, fmt.Errorf("could not create tablebackup instance: %v", err)
 		}
 
-		b.backupTables[oid] = tb
+		res[t.oid] = tb
+	}
+
+	if len(noIdentity) > 0 {
+		if b.cfg.ReplicaIdentityNothing == config.ReplicaIdentityNothingRefuse {
+			return nil, fmt.Errorf("tables %s have replica identity nothing, so their updates and deletes can't be restored; "+
+				"set replica identity to default or full, or set replicaIdentityNothing to %q",
+				strings.Join(noIdentity, ", "), config.ReplicaIdentityNothingInsertOnly)
+		}
+
+		log.Printf("tables %s have replica identity nothing: only their inserts are backed up", strings.Join(noIdentity, ", "))
+	}
+
+	return res, nil
+}
+
+// checkOperationFilters warns about the tables whose restored state would
+// diverge from the original because of the operations filtered out: the ones
+// with the updates or deletes recorded in the statistics, or with the inserts
+// filtered out, but not the rest.
+func (b *LogicalBackup) checkOperationFilters(conn *pgx.Conn) error {
+	for table := range b.cfg.Operations {
+		captures := func(op string) bool { return b.cfg.CapturesOperation(table, op) }
+
+		if !captures(config.OperationInsert) && (captures(config.OperationUpdate) || captures(config.OperationDelete)) {
+			log.Printf("the inserts of %s are not backed up, its updates and deletes won't find the rows on restore", table)
+		}
+
+		if captures(config.OperationUpdate) && captures(config.OperationDelete) {
+			continue
+		}
+
+		var updates, deletes int64
+		err := conn.QueryRow(`select n_tup_upd, n_tup_del from pg_stat_user_tables
+	where schemaname || '.' || relname = $1`, table).Scan(&updates, &deletes)
+		if err == pgx.ErrNoRows {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not fetch statistics of %s: %v", table, err)
+		}
+
+		if !captures(config.OperationUpdate) && updates > 0 || !captures(config.OperationDelete) && deletes > 0 {
+			log.Printf("%s had %d updates and %d deletes, which are not all backed up: the restored table would diverge from the original",
+				table, updates, deletes)
+		}
 	}
 
 	return nil
 }
 
+// publishViaRoot reports whether the changes of the partitions are published
+// as the changes of their root partitioned table; otherwise each partition is
+// published and backed up on its own
+func (b *LogicalBackup) publishViaRoot(conn *pgx.Conn) (bool, error) {
+	var version int
+	if err := conn.QueryRow("select current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return false, fmt.Errorf("could not get server version: %v", err)
+	}
+
+	if version < 130000 {
+		return false, nil
+	}
+
+	var viaRoot bool
+	if err := conn.QueryRow("select pubviaroot from pg_publication where pubname = $1", b.cfg.PublicationName).Scan(&viaRoot); err != nil {
+		return false, fmt.Errorf("could not fetch publication settings: %v", err)
+	}
+
+	return viaRoot, nil
+}
+
 func (b *LogicalBackup) initPublication(conn *pgx.Conn) error {
 	rows, err := conn.Query("select 1 from pg_publication where pubname = $1;", b.cfg.PublicationName)
 	if err != nil {
@@ -548,11 +1133,47 @@ func (b *LogicalBackup) initPublication(conn *pgx.Conn) error {
 	return nil
 }
 
+// resumeFromCheckpoint starts streaming from the lsn stored in the state file,
+// the latest one made durable before the restart, if it's ahead of the slot,
+// saving the replay of the changes the server hasn't got confirmed. The
+// checkpoint must be in the range of the wal retained by the slot and already
+// generated by the server, otherwise it belongs to another slot or cluster and
+// is ignored.
+func (b *LogicalBackup) resumeFromCheckpoint(conn *pgx.Conn, checkpoint uint64) error {
+	var currentLSNString string
+	if err := conn.QueryRow(`select case when pg_is_in_recovery() then pg_last_wal_replay_lsn()
+	else pg_current_wal_lsn() end::text`).Scan(&currentLSNString); err != nil {
+		return fmt.Errorf("could not fetch current wal lsn: %v", err)
+	}
+
+	currentLSN, err := pgx.ParseLSN(currentLSNString)
+	if err != nil {
+		return fmt.Errorf("could not parse lsn: %v", err)
+	}
+
+	switch {
+	case checkpoint < b.slotRestartLSN || checkpoint > currentLSN:
+		log.Printf("checkpoint lsn %s is out of the range %s - %s retained by the slot; starting from the slot position %s",
+			pgx.FormatLSN(checkpoint), pgx.FormatLSN(b.slotRestartLSN), pgx.FormatLSN(currentLSN), pgx.FormatLSN(b.startLSN))
+	case checkpoint > b.startLSN:
+		log.Printf("resuming from checkpoint lsn %s, ahead of the slot position %s",
+			pgx.FormatLSN(checkpoint), pgx.FormatLSN(b.startLSN))
+		b.startLSN = checkpoint
+		b.storedFlushLSN = checkpoint
+	}
+
+	return nil
+}
+
+// state is the stream position stored in the state file
+type state struct {
+	Timestamp  time.Time
+	CurrentLSN string
+	SlotLSN    string `yaml:",omitempty"` // the consistent point the slot was created at
+}
+
 func (b *LogicalBackup) readRestartLSN() (uint64, error) {
-	var (
-		ts     time.Time
-		LSNstr string
-	)
+	var st state
 
 	stateFilename := path.Join(b.cfg.TempDir, b.stateFilename)
 	if _, err := os.Stat(stateFilename); os.IsNotExist(err) {
@@ -565,14 +1186,17 @@ func (b *LogicalBackup) readRestartLSN() (uint64, error) {
 	}
 	defer fp.Close()
 
-	yaml.NewDecoder(fp).Decode(&struct {
-		Timestamp  *time.Time
-		CurrentLSN *string
-	}{&ts, &LSNstr})
+	yaml.NewDecoder(fp).Decode(&st)
 
-	currentLSN, err := pgx.ParseLSN(LSNstr)
+	currentLSN, err := pgx.ParseLSN(st.CurrentLSN)
 	if err != nil {
-		return 0, fmt.Errorf("could not parse %q LSN string: %v", LSNstr, err)
+		return 0, fmt.Errorf("could not parse %q LSN string: %v", st.CurrentLSN, err)
+	}
+
+	if st.SlotLSN != "" {
+		if b.slotLSN, err = pgx.ParseLSN(st.SlotLSN); err != nil {
+			return 0, fmt.Errorf("could not parse %q LSN string: %v", st.SlotLSN, err)
+		}
 	}
 
 	return currentLSN, nil
@@ -581,31 +1205,30 @@ func (b *LogicalBackup) readRestartLSN() (uint64, error) {
 func (b *LogicalBackup) storeRestartLSN() error {
 	//TODO: I'm ugly, refactor me
 
-	fp, err := os.OpenFile(path.Join(b.cfg.TempDir, b.stateFilename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	fp, err := utils.CreateFile(path.Join(b.cfg.TempDir, b.stateFilename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, b.cfg.FileMode, b.cfg.FileGID())
 	if err != nil {
 		return fmt.Errorf("could not create current lsn file: %v", err)
 	}
 	defer fp.Close()
 
-	fpArchive, err := os.OpenFile(path.Join(b.cfg.ArchiveDir, b.stateFilename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	fpArchive, err := utils.CreateFile(path.Join(b.cfg.ArchiveDir, b.stateFilename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, b.cfg.FileMode, b.cfg.FileGID())
 	if err != nil {
 		return fmt.Errorf("could not create archive lsn file: %v", err)
 	}
 	defer fpArchive.Close()
 
-	err = yaml.NewEncoder(fp).Encode(struct {
-		Timestamp  time.Time
-		CurrentLSN string
-	}{time.Now(), pgx.FormatLSN(b.flushLSN)})
+	st := state{Timestamp: time.Now(), CurrentLSN: pgx.FormatLSN(b.flushLSN)}
+	if b.slotLSN != 0 {
+		st.SlotLSN = pgx.FormatLSN(b.slotLSN)
+	}
+
+	err = yaml.NewEncoder(fp).Encode(st)
 	if err != nil {
 		return fmt.Errorf("could not save current lsn: %v", err)
 	}
 	fp.Sync()
 
-	err = yaml.NewEncoder(fpArchive).Encode(struct {
-		Timestamp  time.Time
-		CurrentLSN string
-	}{time.Now(), pgx.FormatLSN(b.flushLSN)})
+	err = yaml.NewEncoder(fpArchive).Encode(st)
 	if err != nil {
 		return fmt.Errorf("could not save current lsn: %v", err)
 	}
@@ -614,6 +1237,60 @@ func (b *LogicalBackup) storeRestartLSN() error {
 	return nil
 }
 
+// checkServerSettings makes sure the server is able to stream the changes and
+// has enough replication slots and wal senders for the slot of the tool and
+// the temporary ones of the concurrent base backups
+func (b *LogicalBackup) checkServerSettings(conn *pgx.Conn) error {
+	var (
+		walLevel                           string
+		maxSlots, maxSenders               int
+		usedSlots, ownSlots, activeSenders int
+	)
+
+	row := conn.QueryRow(`select current_setting('wal_level'),
+	current_setting('max_replication_slots')::int,
+	current_setting('max_wal_senders')::int,
+	(select count(*) from pg_replication_slots),
+	(select count(*) from pg_replication_slots where slot_name = $1),
+	(select count(*) from pg_stat_replication)`, b.cfg.Slotname)
+	if err := row.Scan(&walLevel, &maxSlots, &maxSenders, &usedSlots, &ownSlots, &activeSenders); err != nil {
+		return fmt.Errorf("could not fetch server settings: %v", err)
+	}
+
+	if walLevel != "logical" {
+		return fmt.Errorf("wal_level is %q: set it to \"logical\" in postgresql.conf and restart the server", walLevel)
+	}
+
+	log.Printf("replication slots: %d of %d used, wal senders: %d of %d used", usedSlots, maxSlots, activeSenders, maxSenders)
+
+	if ownSlots == 0 && usedSlots >= maxSlots {
+		return fmt.Errorf("no free replication slots to create slot %q: %d of max_replication_slots = %d are in use; increase max_replication_slots or drop unused slots",
+			b.cfg.Slotname, usedSlots, maxSlots)
+	}
+
+	if activeSenders >= maxSenders {
+		return fmt.Errorf("no free wal senders: %d of max_wal_senders = %d are in use; increase max_wal_senders",
+			activeSenders, maxSenders)
+	}
+
+	if b.cfg.DeltasOnly {
+		return nil
+	}
+
+	// each base backup creates a temporary slot on its own replication connection
+	if free := maxSlots - usedSlots - (1 - ownSlots); free < b.cfg.ConcurrentBasebackups {
+		log.Printf("only %d replication slots are left for %d concurrent base backups; increase max_replication_slots",
+			free, b.cfg.ConcurrentBasebackups)
+	}
+
+	if free := maxSenders - activeSenders - 1; free < b.cfg.ConcurrentBasebackups {
+		log.Printf("only %d wal senders are left for %d concurrent base backups; increase max_wal_senders",
+			free, b.cfg.ConcurrentBasebackups)
+	}
+
+	return nil
+}
+
 func (b *LogicalBackup) checkTablesReplicaIdentities(conn *pgx.Conn) error {
 	tables := make([]string, 0)
 
@@ -652,7 +1329,6 @@ func (b *LogicalBackup) checkTablesReplicaIdentities(conn *pgx.Conn) error {
 		log.Printf("set replica identity for table %s to full", t)
 	}
 
-	//TODO: check stuff like wal_level = logical, max_replication_slots, max_wal_senders
 	//TODO: for the tables without PK alter table to use replica identity full
 	return nil
 }
@@ -666,37 +1342,110 @@ func (b *LogicalBackup) BackgroundBasebackuper() {
 			return
 		}
 
-		if err := obj.(tablebackup.TableBackuper).Basebackup(); err != nil && err != context.Canceled {
-			log.Printf("could not basebackup %s: %v", obj.(tablebackup.TableBackuper), err)
+		t := obj.(tablebackup.TableBackuper)
+		if !b.waitBlackout(t) {
+			return
+		}
+
+		if err := t.Basebackup(); err != nil && err != context.Canceled {
+			log.Printf("could not basebackup %s: %v", t, err)
 		}
 	}
 }
 
-func (b *LogicalBackup) closeOldFiles() {
-	defer b.waitGr.Done()
-	ticker := time.NewTicker(time.Hour)
+// waitBlackout holds off the base backup of the table until the end of the
+// basebackupBlackout window; the other base backups wait in the queue in the
+// meantime. The first base backup of a table is let through if configured to.
+// It returns false if the backup is stopped while waiting.
+func (b *LogicalBackup) waitBlackout(t tablebackup.TableBackuper) bool {
+	if b.cfg.DeltasOnly || (b.cfg.BlackoutInitialBackups && !t.HasBasebackup()) {
+		return true
+	}
 
 	for {
+		end := b.cfg.BlackoutEnd(time.Now())
+		if end.IsZero() {
+			return true
+		}
+
+		log.Printf("deferring base backup of %s until %s, the end of the blackout window", t, end.Format(time.RFC3339))
 		select {
 		case <-b.ctx.Done():
-			ticker.Stop()
-			return
-		case <-ticker.C:
-			for _, t := range b.backupTables {
-				if err := t.CloseOldFiles(); err != nil {
-					log.Printf("could not close %s: %v", t, err)
-				}
-			}
+			return false
+		case <-time.After(time.Until(end)):
+		}
+	}
+}
+
+// closeOldFiles closes the delta files of the idle tables; it's called from
+// the replication loop, which writes the deltas
+func (b *LogicalBackup) closeOldFiles() {
+	for _, t := range b.backupTables {
+		if err := t.CloseOldFiles(); err != nil {
+			log.Printf("could not close %s: %v", t, err)
 		}
 	}
 }
 
 func (b *LogicalBackup) QueueBasebackupTables() {
+	b.tablesMu.RLock()
+	defer b.tablesMu.RUnlock()
+
 	for _, t := range b.backupTables {
 		b.basebackupQueue.Put(t)
 	}
 }
 
+// estimateBasebackups logs the expected size and duration of the basebackups
+// of all tables, based on the catalog statistics
+func (b *LogicalBackup) estimateBasebackups(conn *pgx.Conn) {
+	var (
+		totalSize     int64
+		totalDuration time.Duration
+	)
+
+	for _, t := range b.backupTables {
+		est, err := t.EstimateBasebackup(conn)
+		if err != nil {
+			log.Printf("could not estimate basebackup of %s: %v", t, err)
+			continue
+		}
+
+		log.Printf("basebackup estimate of %s: %0.2fMb, ~%d rows, %v", t, float64(est.Size)/1048576, est.Rows, est.Duration)
+		totalSize += est.Size
+		totalDuration += est.Duration
+	}
+
+	if b.cfg.ConcurrentBasebackups > 0 {
+		totalDuration /= time.Duration(b.cfg.ConcurrentBasebackups)
+	}
+
+	log.Printf("basebackup estimate of all tables: %0.2fMb, %v with %d concurrent basebackups",
+		float64(totalSize)/1048576, totalDuration, b.cfg.ConcurrentBasebackups)
+}
+
+func (b *LogicalBackup) statusHandler(w http.ResponseWriter, r *http.Request) {
+	b.tablesMu.RLock()
+	tables := make([]tablebackup.Status, 0, len(b.backupTables))
+	for _, t := range b.backupTables {
+		tables = append(tables, t.Status())
+	}
+	b.tablesMu.RUnlock()
+
+	b.cycleMu.Lock()
+	lastCycle := b.lastCycle
+	b.cycleMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Tables    []tablebackup.Status `json:"tables"`
+		LastCycle *CycleSummary        `json:"lastCycle,omitempty"`
+		Slot      *SlotProgress        `json:"slot,omitempty"`
+	}{tables, lastCycle, b.SlotProgress()}); err != nil {
+		log.Printf("could not encode status: %v", err)
+	}
+}
+
 func (b *LogicalBackup) Run() {
 	b.waitGr.Add(1)
 	go b.startReplication()
@@ -713,6 +1462,34 @@ func (b *LogicalBackup) Run() {
 		}
 	}()
 
+	if b.cfg.TablesQuery != "" {
+		b.waitGr.Add(1)
+		go b.refreshTables()
+	}
+
+	b.waitGr.Add(1)
+	go b.validateOnStart()
+
 	b.waitGr.Add(1)
-	go b.closeOldFiles()
+	go b.watchSlot()
+
+	if b.cfg.AlertWebhook != "" {
+		b.waitGr.Add(1)
+		go b.alerts()
+	}
+
+	if b.cfg.SummaryInterval > 0 {
+		b.waitGr.Add(1)
+		go b.cycleSummaries()
+	}
+
+	if b.cfg.StatsdAddress != "" {
+		b.waitGr.Add(1)
+		go b.pushMetrics()
+	}
+
+	if b.cfg.SecretsWatchInterval > 0 {
+		b.waitGr.Add(1)
+		go b.watchSecrets()
+	}
 }
@@ -0,0 +1,308 @@
+package logicalbackup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// testTable keeps the writes of the deltas in memory, lost on the crash
+// unless synced
+type testTable struct {
+	tablebackup.TableBackuper
+
+	written []byte
+	synced  []byte
+	syncErr error
+}
+
+func (t *testTable) SaveRawMessage(msg []byte, lsn uint64) (uint64, error) {
+	t.written = append(t.written, msg...)
+
+	return uint64(len(msg)), nil
+}
+
+func (t *testTable) Sync() error {
+	if t.syncErr != nil {
+		return t.syncErr
+	}
+	t.synced = append(t.synced[:0], t.written...)
+
+	return nil
+}
+
+func (t *testTable) String() string {
+	return "public.test"
+}
+
+func newTestBackup(tables map[uint32]tablebackup.TableBackuper) *LogicalBackup {
+	return &LogicalBackup{
+		cfg:            &config.Config{},
+		backupTables:   tables,
+		relations:      make(map[message.Identifier]message.Relation),
+		relationNames:  make(map[uint32]message.Identifier),
+		msgCnt:         make(map[cmdType]int),
+		unsyncedTables: make(map[uint32]struct{}),
+	}
+}
+
+func (b *LogicalBackup) handleAll(t *testing.T, msgs ...message.Message) {
+	t.Helper()
+
+	for _, m := range msgs {
+		if err := b.handler(m); err != nil {
+			t.Fatalf("could not handle %T: %v", m, err)
+		}
+	}
+}
+
+func TestCrashBeforeFsyncKeepsFlushLSN(t *testing.T) {
+	tbl := &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: tbl})
+	b.flushLSN, b.commitLSN = 100, 100
+
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 200},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+		message.Commit{Raw: []byte("C"), LSN: 200, TransactionLSN: 210},
+	)
+	if b.commitLSN != 210 {
+		t.Fatalf("commit lsn is %d, expected 210", b.commitLSN)
+	}
+	if b.flushLSN != 100 {
+		t.Fatalf("flush lsn advanced to %d before the fsync", b.flushLSN)
+	}
+
+	// the fsync fails, i.e. the disk is gone: the commit may be lost
+	tbl.syncErr = errors.New("input/output error")
+	if err := b.flush(); err == nil {
+		t.Fatalf("flush succeeded with the failing fsync")
+	}
+	if b.flushLSN != 100 {
+		t.Fatalf("flush lsn advanced to %d with the commit not fsynced", b.flushLSN)
+	}
+	if len(tbl.synced) != 0 {
+		t.Fatalf("deltas %q synced with the failing fsync", tbl.synced)
+	}
+
+	tbl.syncErr = nil
+	if err := b.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if b.flushLSN != 210 {
+		t.Fatalf("flush lsn is %d after the fsync, expected 210", b.flushLSN)
+	}
+	if string(tbl.synced) != "BIC" {
+		t.Fatalf("synced deltas are %q, expected %q", tbl.synced, "BIC")
+	}
+}
+
+func TestFlushLSNStopsAtLastCommit(t *testing.T) {
+	tbl := &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: tbl})
+	b.flushLSN, b.commitLSN = 100, 100
+
+	// the transaction in progress is not acknowledged with the earlier one
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 200},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+		message.Commit{Raw: []byte("C"), LSN: 200, TransactionLSN: 210},
+		message.Begin{Raw: []byte("B"), FinalLSN: 300},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+	)
+	if err := b.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if b.flushLSN != 210 {
+		t.Fatalf("flush lsn is %d, expected the one of the last commit 210", b.flushLSN)
+	}
+}
+
+func TestHeartbeatAdvancesCommitLSN(t *testing.T) {
+	tbl := &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: tbl})
+	b.flushLSN, b.commitLSN = 100, 100
+
+	// none of the transactions touch the backed up tables
+	b.handleHeartbeat(&pgx.ServerHeartbeat{ServerWalEnd: 500})
+	if b.commitLSN != 500 {
+		t.Fatalf("commit lsn is %d after the heartbeat, expected the server wal end 500", b.commitLSN)
+	}
+	b.handleHeartbeat(&pgx.ServerHeartbeat{ServerWalEnd: 400})
+	if b.commitLSN != 500 {
+		t.Fatalf("commit lsn went back to %d", b.commitLSN)
+	}
+	if err := b.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if b.flushLSN != 500 {
+		t.Fatalf("flush lsn is %d, expected 500", b.flushLSN)
+	}
+
+	// the rest of the transaction in progress is still to be received
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 700},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+	)
+	b.handleHeartbeat(&pgx.ServerHeartbeat{ServerWalEnd: 800})
+	if b.commitLSN != 500 {
+		t.Fatalf("commit lsn advanced to %d in the middle of the transaction", b.commitLSN)
+	}
+
+	b.handleAll(t, message.Commit{Raw: []byte("C"), LSN: 700, TransactionLSN: 710})
+	b.handleHeartbeat(&pgx.ServerHeartbeat{ServerWalEnd: 800})
+	if b.commitLSN != 800 {
+		t.Fatalf("commit lsn is %d after the commit and the heartbeat, expected 800", b.commitLSN)
+	}
+}
+
+func TestAdaptStatusInterval(t *testing.T) {
+	tbl := &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: tbl})
+	b.statusTimeout, b.statusInterval = statusTimeout, statusTimeout
+	b.flushLSN, b.commitLSN, b.storedFlushLSN = 100, 100, 100
+
+	// nothing is written: backs off up to maxStatusTimeout
+	for _, expected := range []time.Duration{2 * statusTimeout, maxStatusTimeout, maxStatusTimeout} {
+		b.adaptStatusInterval()
+		if b.statusInterval != expected {
+			t.Fatalf("status interval is %v, expected %v", b.statusInterval, expected)
+		}
+		if d := b.statusDelay(); d < b.statusInterval-statusJitter || d >= b.statusInterval+statusJitter {
+			t.Fatalf("status delay %v is not within %v of %v", d, statusJitter, b.statusInterval)
+		}
+	}
+
+	// the writes resume: the deltas not fsynced yet are reported without the delay
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 200},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+		message.Commit{Raw: []byte("C"), LSN: 200, TransactionLSN: 210},
+	)
+	b.adaptStatusInterval()
+	if b.statusInterval != statusTimeout {
+		t.Fatalf("status interval is %v with the unsynced deltas, expected %v", b.statusInterval, statusTimeout)
+	}
+
+	if err := b.flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	b.statusInterval = maxStatusTimeout
+	b.adaptStatusInterval()
+	if b.statusInterval != statusTimeout {
+		t.Fatalf("status interval is %v with the commit not reported, expected %v", b.statusInterval, statusTimeout)
+	}
+}
+
+func TestStatusNotPastFlushLSN(t *testing.T) {
+	tbl := &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: tbl})
+	b.flushLSN, b.commitLSN = 100, 100
+
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 200},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+		message.Commit{Raw: []byte("C"), LSN: 200, TransactionLSN: 210},
+		message.Begin{Raw: []byte("B"), FinalLSN: 300},
+		message.Insert{Raw: []byte("I"), RelationOID: 1},
+	)
+	b.handleHeartbeat(&pgx.ServerHeartbeat{ServerWalEnd: 400})
+
+	// the commit is not reported until fsynced
+	tbl.syncErr = errors.New("input/output error")
+	if _, err := b.standbyStatus(); err == nil {
+		t.Fatalf("status created with the failing fsync")
+	}
+	if b.flushLSN != 100 {
+		t.Fatalf("flush lsn advanced to %d with the commit not fsynced", b.flushLSN)
+	}
+
+	tbl.syncErr = nil
+	status, err := b.standbyStatus()
+	if err != nil {
+		t.Fatalf("could not create status: %v", err)
+	}
+	if status.WalFlushPosition != 210 || status.WalWritePosition != 210 || status.WalApplyPosition != 210 {
+		t.Fatalf("status reports write %d, flush %d, apply %d, expected the fsynced commit 210",
+			status.WalWritePosition, status.WalFlushPosition, status.WalApplyPosition)
+	}
+}
+
+func TestSelectPublicationTables(t *testing.T) {
+	table := func(oid uint32, name string, ancestors ...string) publicationTable {
+		return publicationTable{oid: oid, name: message.Identifier{Namespace: "public", Name: name}, ancestors: ancestors}
+	}
+
+	// measurements is partitioned by range of the timestamp, by the year and
+	// then by the half of the year; the publication has either the leaf
+	// partitions or, published via the root, the root table
+	partitions := []publicationTable{
+		table(2, "measurements_2026", "public.measurements"),
+		table(4, "measurements_2027_h1", "public.measurements_2027", "public.measurements"),
+		table(5, "measurements_2027_h2", "public.measurements_2027", "public.measurements"),
+		table(6, "orders"),
+	}
+	roots := []publicationTable{
+		table(1, "measurements"),
+		table(6, "orders"),
+	}
+
+	tests := []struct {
+		name      string
+		pubTables []publicationTable
+		viaRoot   bool
+		tables    []string
+		expected  []uint32
+	}{
+		{"partitioned table", partitions, false, []string{"public.measurements"}, []uint32{2, 4, 5}},
+		{"sub-partitioned partition", partitions, false, []string{"public.measurements_2027"}, []uint32{4, 5}},
+		{"partitions", partitions, false, []string{"public.measurements_2026", "public.orders"}, []uint32{2, 6}},
+		{"all partitions", partitions, false, nil, []uint32{2, 4, 5, 6}},
+		{"via root", roots, true, []string{"public.measurements"}, []uint32{1}},
+		{"partition via root", roots, true, []string{"public.measurements_2026", "public.orders"}, []uint32{6}},
+		{"all via root", roots, true, nil, []uint32{1, 6}},
+	}
+
+	for _, tt := range tests {
+		oids := make([]uint32, 0)
+		for _, pt := range selectPublicationTables(tt.pubTables, tt.tables, tt.viaRoot) {
+			oids = append(oids, pt.oid)
+		}
+		if !reflect.DeepEqual(oids, tt.expected) {
+			t.Errorf("%s: selected tables %v, expected %v", tt.name, oids, tt.expected)
+		}
+	}
+}
+
+func TestTruncateWrittenToTruncatedTables(t *testing.T) {
+	audit, orders := &testTable{}, &testTable{}
+	b := newTestBackup(map[uint32]tablebackup.TableBackuper{1: audit, 2: orders})
+	b.meta = tablebackup.NewMetaCache()
+	b.cfg.Operations = map[string]string{"public.audit": config.OperationInsert}
+
+	relation := func(oid uint32, name string) message.Relation {
+		return message.Relation{Identifier: message.Identifier{Namespace: "public", Name: name}, Raw: []byte("R"), OID: oid}
+	}
+	// the untracked table 3 is truncated along with the others
+	b.handleAll(t,
+		message.Begin{Raw: []byte("B"), FinalLSN: 200},
+		relation(1, "audit"), relation(2, "orders"), relation(3, "items"),
+		message.Truncate{Raw: []byte("T"), Relations: 3, RelationOIDs: []uint32{1, 2, 3}, Cascade: true},
+		message.Commit{Raw: []byte("C"), LSN: 200, TransactionLSN: 210},
+	)
+
+	if string(orders.written) != "BRTC" {
+		t.Errorf("deltas of the truncated table are %q, expected %q", orders.written, "BRTC")
+	}
+	// the truncates are filtered out by the operations of the table
+	if string(audit.written) != "BRC" {
+		t.Errorf("deltas of the table with the truncates filtered out are %q, expected %q", audit.written, "BRC")
+	}
+}
@@ -0,0 +1,110 @@
+package logicalbackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// saveLogicalMessage appends the logical decoding message to the messages file
+// of the archive dir. The messages are rare, so each one is fsynced right away;
+// the ones streamed again after the restart are skipped.
+func (b *LogicalBackup) saveLogicalMessage(m message.LogicalMessage) error {
+	if b.messagesFp == nil {
+		if err := b.openMessages(); err != nil {
+			return err
+		}
+	}
+
+	if m.LSN <= b.lastMessageLSN {
+		return nil
+	}
+
+	jm := message.JSONLogicalMessage{
+		LSN:           pgx.FormatLSN(m.LSN),
+		Transactional: m.Transactional,
+		Prefix:        m.Prefix,
+		Content:       m.Content,
+	}
+	if m.Transactional && b.inTx {
+		jm.TxLSN = pgx.FormatLSN(b.txLSN)
+	}
+
+	data, err := json.Marshal(jm)
+	if err != nil {
+		return fmt.Errorf("could not encode logical message: %v", err)
+	}
+
+	if _, err := b.messagesFp.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write logical message: %v", err)
+	}
+	if err := b.messagesFp.Sync(); err != nil {
+		return fmt.Errorf("could not fsync logical messages: %v", err)
+	}
+	b.lastMessageLSN = m.LSN
+
+	return nil
+}
+
+// openMessages opens the messages file for appending, reading the lsn of the
+// last message stored
+func (b *LogicalBackup) openMessages() error {
+	filename := path.Join(b.cfg.ArchiveDir, message.MessagesFilename)
+
+	fp, err := utils.CreateFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, b.cfg.FileMode, b.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not open logical messages file: %v", err)
+	}
+
+	// a line cut off by a crash is followed by the next message on a new line
+	sc := bufio.NewScanner(fp)
+	sc.Buffer(nil, 1024*1024*1024)
+	for sc.Scan() {
+		var jm message.JSONLogicalMessage
+		if err := json.Unmarshal(sc.Bytes(), &jm); err != nil {
+			continue
+		}
+		if lsn, err := pgx.ParseLSN(jm.LSN); err == nil && lsn > b.lastMessageLSN {
+			b.lastMessageLSN = lsn
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fp.Close()
+		return fmt.Errorf("could not read logical messages file: %v", err)
+	}
+
+	if err := endLine(fp); err != nil {
+		fp.Close()
+		return fmt.Errorf("could not write logical messages file: %v", err)
+	}
+	b.messagesFp = fp
+
+	return nil
+}
+
+// endLine terminates the last line of the file if it's cut off
+func endLine(fp *os.File) error {
+	st, err := fp.Stat()
+	if err != nil || st.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := fp.ReadAt(last, st.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+
+	_, err = fp.Write([]byte{'\n'})
+
+	return err
+}
@@ -0,0 +1,136 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+const onceCheckInterval = time.Second
+
+// The outcomes of the base backups in the one-shot mode
+const (
+	OnceOK      = "ok"
+	OnceFailed  = "failed"
+	OnceSkipped = "skipped" // not needed, held off by the circuit breaker or the table is gone
+)
+
+// OnceResult is the outcome of the base backup of a table in the one-shot mode
+type OnceResult struct {
+	Table   string
+	Outcome string
+	Error   string // the last error of the failed one
+}
+
+// BackupOnce takes the base backups of all tables, waiting for them to
+// complete, then keeps streaming the deltas for up to catchUp, until the slot
+// is confirmed at the position the server was at once the base backups were
+// over. Run must be called first; the caller stops the backup afterwards,
+// which drops the temporary slots along with their connections.
+func (b *LogicalBackup) BackupOnce(catchUp time.Duration) ([]OnceResult, error) {
+	b.tablesMu.RLock()
+	tables := make([]tablebackup.TableBackuper, 0, len(b.backupTables))
+	for _, t := range b.backupTables {
+		tables = append(tables, t)
+	}
+	b.tablesMu.RUnlock()
+
+	before := make([]tablebackup.Status, len(tables))
+	for i, t := range tables {
+		before[i] = t.Status()
+		b.basebackupQueue.Put(t)
+	}
+
+	results := make([]OnceResult, len(tables))
+	ticker := time.NewTicker(onceCheckInterval)
+	defer ticker.Stop()
+	for pending := len(tables); pending > 0; {
+		select {
+		case <-b.ctx.Done():
+			return results, b.ctx.Err()
+		case <-ticker.C:
+		}
+
+		pending = 0
+		for i, t := range tables {
+			if results[i].Outcome != "" {
+				continue
+			}
+
+			st := t.Status()
+			results[i].Table = t.String()
+			switch {
+			case st.Basebackups > before[i].Basebackups:
+				results[i].Outcome = OnceOK
+			case st.FailedBasebackups > before[i].FailedBasebackups:
+				results[i].Outcome, results[i].Error = OnceFailed, st.Breaker.LastError
+			case st.SkippedBasebackups > before[i].SkippedBasebackups, st.Dropped, st.Removed:
+				results[i].Outcome = OnceSkipped
+			default:
+				pending++
+			}
+		}
+	}
+
+	if catchUp > 0 {
+		if err := b.catchUp(catchUp); err != nil {
+			return results, fmt.Errorf("could not catch up: %v", err)
+		}
+	}
+
+	return results, nil
+}
+
+// catchUp waits for the slot to be confirmed at the current position of the
+// server, for up to timeout
+func (b *LogicalBackup) catchUp(timeout time.Duration) error {
+	dbCfg := b.connConfig()
+	conn, err := pgx.Connect(dbCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, dbCfg))
+	}
+	defer conn.Close()
+
+	var target string
+	if err := conn.QueryRow("select pg_current_wal_lsn()::text").Scan(&target); err != nil {
+		return fmt.Errorf("could not fetch current wal lsn: %v", err)
+	}
+	targetLSN, err := pgx.ParseLSN(target)
+	if err != nil {
+		return fmt.Errorf("could not parse lsn: %v", err)
+	}
+	log.Printf("streaming the deltas up to %s for at most %v", target, timeout)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var flushed string
+		if err := conn.QueryRow("select coalesce(confirmed_flush_lsn::text, '0/0') from pg_replication_slots where slot_name = $1",
+			b.cfg.Slotname).Scan(&flushed); err != nil {
+			return fmt.Errorf("could not fetch replication slot: %v", err)
+		}
+		flushedLSN, err := pgx.ParseLSN(flushed)
+		if err != nil {
+			return fmt.Errorf("could not parse lsn: %v", err)
+		}
+
+		if flushedLSN >= targetLSN {
+			log.Printf("caught up: the slot is confirmed at %s", flushed)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			log.Printf("catch-up timed out: the slot is confirmed at %s, short of %s", flushed, target)
+			return nil
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		case <-time.After(onceCheckInterval):
+		}
+	}
+}
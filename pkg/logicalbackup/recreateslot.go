@@ -0,0 +1,72 @@
+package logicalbackup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+)
+
+// RecreateSlot drops the replication slot and creates it again from the
+// current consistent point, for the slots which got stuck or corrupted. The
+// changes between the old and the new position of the slot are lost, so all
+// tables need new base backups; the files in the archive are left intact until
+// those replace them. The slot must not be in use.
+func RecreateSlot(ctx context.Context, cfg *config.Config) (uint64, error) {
+	pgxConn := cfg.DB
+	pgxConn.RuntimeParams = map[string]string{"application_name": cfg.ApplicationName}
+
+	conn, pgxConn, err := dbutils.ConnectTarget(pgxConn, dbutils.SessionReadWrite)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, cfg.DB))
+	}
+	defer conn.Close()
+
+	b := &LogicalBackup{
+		ctx:           ctx,
+		cfg:           cfg,
+		dbCfg:         pgxConn,
+		stateFilename: "state.yaml",
+	}
+
+	var (
+		restartLSN, flushLSN sql.NullString
+		active               bool
+		activePID            sql.NullInt64
+	)
+	row := conn.QueryRow("select restart_lsn::text, confirmed_flush_lsn::text, active, active_pid from pg_replication_slots where slot_name = $1",
+		cfg.Slotname)
+	if err := row.Scan(&restartLSN, &flushLSN, &active, &activePID); err == pgx.ErrNoRows {
+		return 0, fmt.Errorf("replication slot %q does not exist", cfg.Slotname)
+	} else if err != nil {
+		return 0, fmt.Errorf("could not fetch replication slot: %v", err)
+	}
+
+	if active {
+		return 0, fmt.Errorf("replication slot %q is in use by the process %d, stop the backup first", cfg.Slotname, activePID.Int64)
+	}
+
+	log.Printf("dropping replication slot %q: restart lsn %s, confirmed flush lsn %s", cfg.Slotname, restartLSN.String, flushLSN.String)
+	if _, err := conn.Exec("select pg_drop_replication_slot($1)", cfg.Slotname); err != nil {
+		return 0, fmt.Errorf("could not drop replication slot: %v", err)
+	}
+
+	lsn, err := b.createSlot(conn)
+	if err != nil {
+		return 0, fmt.Errorf("replication slot %q was dropped, but could not be created again, the backup creates it on start: %v", cfg.Slotname, err)
+	}
+	log.Printf("created replication slot %q: restart lsn %s", cfg.Slotname, pgx.FormatLSN(lsn))
+
+	b.flushLSN = lsn
+	b.slotLSN = lsn
+	if err := b.storeRestartLSN(); err != nil {
+		return 0, fmt.Errorf("could not store restart lsn: %v", err)
+	}
+
+	return lsn, nil
+}
@@ -0,0 +1,17 @@
+package logicalbackup
+
+import (
+	"github.com/jackc/pgx"
+)
+
+// connConfig returns the config of the connections to the primary with the
+// current credentials, see config.Secrets
+func (b *LogicalBackup) connConfig() pgx.ConnConfig {
+	return b.cfg.Secrets().Apply(b.dbCfg)
+}
+
+func (b *LogicalBackup) watchSecrets() {
+	defer b.waitGr.Done()
+
+	b.cfg.Secrets().Watch(b.ctx, b.cfg.SecretsWatchInterval)
+}
@@ -0,0 +1,152 @@
+package logicalbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+)
+
+const (
+	slotCheckInterval = time.Minute
+	takeOverTimeout   = 10 * time.Second
+)
+
+// TakeOverSlot terminates the process holding the replication slot, i.e. the
+// stale connection of the previous run, so that the backup could use it
+func TakeOverSlot(ctx context.Context, cfg *config.Config) error {
+	pgxConn := cfg.DB
+	pgxConn.RuntimeParams = map[string]string{"application_name": cfg.ApplicationName}
+
+	conn, pgxConn, err := dbutils.ConnectTarget(pgxConn, dbutils.SessionReadWrite)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, cfg.DB))
+	}
+	defer conn.Close()
+
+	var activePID int32
+	row := conn.QueryRow("select coalesce(active_pid, 0) from pg_replication_slots where slot_name = $1", cfg.Slotname)
+	if err := row.Scan(&activePID); err == pgx.ErrNoRows || err == nil && activePID == 0 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not fetch replication slot: %v", err)
+	}
+
+	log.Printf("terminating the process %d holding the replication slot %q", activePID, cfg.Slotname)
+	if _, err := conn.Exec("select pg_terminate_backend($1)", activePID); err != nil {
+		return fmt.Errorf("could not terminate the process %d: %v", activePID, err)
+	}
+
+	// the slot is released once the process exits
+	deadline := time.Now().Add(takeOverTimeout)
+	for time.Now().Before(deadline) {
+		var active bool
+		if err := conn.QueryRow("select active from pg_replication_slots where slot_name = $1", cfg.Slotname).Scan(&active); err != nil {
+			return fmt.Errorf("could not fetch replication slot: %v", err)
+		}
+		if !active {
+			return nil
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return fmt.Errorf("replication slot %q is still in use after terminating the process %d", cfg.Slotname, activePID)
+}
+
+// watchSlot checks periodically that the replication slot is still held by
+// the backup: the process streaming from it is the one recorded for the
+// current replication connection and the backup stops if another one has
+// taken the slot over, as both would advance its position
+func (b *LogicalBackup) watchSlot() {
+	defer b.waitGr.Done()
+	ticker := time.NewTicker(slotCheckInterval)
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			ownPID := atomic.LoadInt32(&b.replPID)
+			pid, confirmedLSN, walLSN, err := b.slotState()
+			if err != nil {
+				log.Printf("could not verify replication slot ownership: %v", err)
+				continue
+			}
+			b.trackSlotProgress(now, confirmedLSN, walLSN)
+
+			if atomic.LoadInt32(&b.replPID) != ownPID {
+				// reconnected meanwhile, the pid seen may be of either connection
+				continue
+			}
+
+			switch {
+			case pid == 0:
+				// not streaming at the moment, i.e. reconnecting
+			case ownPID == 0:
+				// could not be recorded on connect
+				atomic.CompareAndSwapInt32(&b.replPID, 0, pid)
+			case pid != ownPID:
+				log.Fatalf("replication slot %q has been taken over by the process %d, streaming from process %d; another backup may be running",
+					b.cfg.Slotname, pid, ownPID)
+			}
+		}
+	}
+}
+
+// recordReplPID stores the process streaming from the slot once the
+// replication has been started: the slot could not have been active for
+// another one then
+func (b *LogicalBackup) recordReplPID() {
+	pid, _, _, err := b.slotState()
+	if err != nil {
+		log.Printf("could not fetch the process streaming from the replication slot: %v", err)
+		pid = 0
+	}
+	atomic.StoreInt32(&b.replPID, pid)
+}
+
+// slotState returns the process streaming from the slot, its confirmed flush
+// lsn and the current lsn of the server wal
+func (b *LogicalBackup) slotState() (int32, uint64, uint64, error) {
+	dbCfg := b.connConfig()
+	conn, err := pgx.Connect(dbCfg)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, dbCfg))
+	}
+	defer conn.Close()
+
+	var (
+		pid                  int32
+		confirmedLSN, walLSN string
+	)
+	err = conn.QueryRow(`select coalesce(active_pid, 0), coalesce(confirmed_flush_lsn, '0/0')::text,
+			case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_lsn() end::text
+		from pg_replication_slots
+		where slot_name = $1`, b.cfg.Slotname).Scan(&pid, &confirmedLSN, &walLSN)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("could not fetch replication slot: %v", err)
+	}
+
+	confirmed, err := pgx.ParseLSN(confirmedLSN)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("could not parse lsn: %v", err)
+	}
+	wal, err := pgx.ParseLSN(walLSN)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("could not parse lsn: %v", err)
+	}
+
+	return pid, confirmed, wal, nil
+}
@@ -0,0 +1,92 @@
+package logicalbackup
+
+import (
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+)
+
+// The states of the slot progress
+const (
+	SlotAdvancing = "advancing" // the confirmed lsn moved since the previous check
+	SlotIdle      = "idle"      // no wal written since the confirmed lsn last moved
+	SlotPaused    = "paused"    // the deltas are paused for the copy, see pauseDeltasDuringCopy
+	SlotBehind    = "behind"    // the wal is written, the confirmed lsn hasn't moved for less than slotStuckWindow
+	SlotStuck     = "stuck"     // the same for longer than slotStuckWindow
+)
+
+// SlotProgress is the progress of the replication slot seen by watchSlot. The
+// confirmed lsn advances with the heartbeats of the server even if no changes
+// of the backed up tables are streamed, so while the server writes the wal a
+// slot not moving means the stream or the feedback is broken.
+type SlotProgress struct {
+	State        string    `json:"state"`
+	ConfirmedLSN string    `json:"confirmedLSN"`
+	WalLSN       string    `json:"walLSN"` // the current lsn of the server
+	LagBytes     uint64    `json:"lagBytes"`
+	AdvancedAt   time.Time `json:"advancedAt"` // the confirmed lsn last moved, or the tracking started
+}
+
+type slotProgress struct {
+	SlotProgress
+	confirmedLSN uint64
+	walLSN       uint64 // when the confirmed lsn last moved
+}
+
+func (b *LogicalBackup) trackSlotProgress(now time.Time, confirmedLSN, walLSN uint64) {
+	b.slotMu.Lock()
+	defer b.slotMu.Unlock()
+
+	p := &b.slotProgress
+	prevState := p.State
+	switch {
+	case p.AdvancedAt.IsZero() || confirmedLSN != p.confirmedLSN:
+		p.State = SlotAdvancing
+		p.AdvancedAt, p.confirmedLSN, p.walLSN = now, confirmedLSN, walLSN
+	case b.deltaPause.Paused():
+		p.State = SlotPaused
+	case walLSN <= p.walLSN || walLSN <= confirmedLSN:
+		p.State = SlotIdle
+	case b.cfg.SlotStuckWindow > 0 && now.Sub(p.AdvancedAt) > b.cfg.SlotStuckWindow:
+		p.State = SlotStuck
+	default:
+		p.State = SlotBehind
+	}
+
+	p.ConfirmedLSN, p.WalLSN = pgx.FormatLSN(confirmedLSN), pgx.FormatLSN(walLSN)
+	p.LagBytes = 0
+	if walLSN > confirmedLSN {
+		p.LagBytes = walLSN - confirmedLSN
+	}
+
+	metrics.SlotLagBytes.Set(int64(p.LagBytes))
+	if p.State == SlotStuck || p.State == SlotBehind {
+		metrics.SlotStalledSeconds.Set(int64(now.Sub(p.AdvancedAt).Seconds()))
+	} else {
+		metrics.SlotStalledSeconds.Set(0)
+	}
+
+	if p.State == SlotStuck && prevState != SlotStuck {
+		log.Printf("replication slot %q is stuck at %s for %v while the wal is at %s",
+			b.cfg.Slotname, p.ConfirmedLSN, now.Sub(p.AdvancedAt).Truncate(time.Second), p.WalLSN)
+	} else if prevState == SlotStuck && p.State != SlotStuck {
+		log.Printf("replication slot %q is %s again at %s", b.cfg.Slotname, p.State, p.ConfirmedLSN)
+	}
+}
+
+// SlotProgress returns the latest progress of the replication slot, nil if
+// not checked yet
+func (b *LogicalBackup) SlotProgress() *SlotProgress {
+	b.slotMu.Lock()
+	defer b.slotMu.Unlock()
+
+	if b.slotProgress.AdvancedAt.IsZero() {
+		return nil
+	}
+	p := b.slotProgress.SlotProgress
+
+	return &p
+}
@@ -0,0 +1,32 @@
+package logicalbackup
+
+import (
+	"log"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+)
+
+// pushMetrics sends the metrics to statsd every statsdInterval
+func (b *LogicalBackup) pushMetrics() {
+	defer b.waitGr.Done()
+
+	statsd, err := metrics.NewStatsd(b.cfg.StatsdAddress, b.cfg.StatsdPrefix)
+	if err != nil {
+		log.Printf("not pushing metrics: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(b.cfg.StatsdInterval)
+	for {
+		select {
+		case <-b.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if err := statsd.Push(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
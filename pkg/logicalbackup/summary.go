@@ -0,0 +1,91 @@
+package logicalbackup
+
+import (
+	"log"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// CycleSummary aggregates the work done on all tables during one summary interval
+type CycleSummary struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	Tables             int   `json:"tables"`
+	TablesBackedUp     int   `json:"tablesBackedUp"` // with at least one base backup taken
+	SkippedBasebackups int   `json:"skippedBasebackups"`
+	FailedBasebackups  int   `json:"failedBasebackups"`
+	BytesWritten       int64 `json:"bytesWritten"` // moved to the archive dir
+	DeltasRotated      int   `json:"deltasRotated"`
+
+	// the lag is the time since the latest base backup of the table, or since
+	// the start of the backup if there is none yet
+	MinLag        time.Duration `json:"minLag"`
+	MaxLag        time.Duration `json:"maxLag"`
+	WorstLagTable string        `json:"worstLagTable,omitempty"`
+}
+
+func (b *LogicalBackup) cycleSummaries() {
+	defer b.waitGr.Done()
+	ticker := time.NewTicker(b.cfg.SummaryInterval)
+
+	start := time.Now()
+	prev := make(map[string]tablebackup.Status)
+	for {
+		select {
+		case <-b.ctx.Done():
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			s := b.summarize(start, now, prev)
+			log.Printf("backup cycle complete in %v: %d tables, %d backed up, %d skipped, %d failed, %0.2fMb written, %d deltas rotated, lag %v - %v (worst %s)",
+				s.Duration, s.Tables, s.TablesBackedUp, s.SkippedBasebackups, s.FailedBasebackups,
+				float64(s.BytesWritten)/1048576, s.DeltasRotated, s.MinLag, s.MaxLag, s.WorstLagTable)
+
+			b.cycleMu.Lock()
+			b.lastCycle = &s
+			b.cycleMu.Unlock()
+
+			start = now
+		}
+	}
+}
+
+// summarize computes the summary from the differences of the table counters
+// with the previous cycle, updating prev
+func (b *LogicalBackup) summarize(start, now time.Time, prev map[string]tablebackup.Status) CycleSummary {
+	s := CycleSummary{Start: start, Duration: now.Sub(start)}
+
+	b.tablesMu.RLock()
+	defer b.tablesMu.RUnlock()
+
+	for _, t := range b.backupTables {
+		st := t.Status()
+		p := prev[st.Table]
+		prev[st.Table] = st
+
+		s.Tables++
+		if st.Basebackups > p.Basebackups {
+			s.TablesBackedUp++
+		}
+		s.SkippedBasebackups += st.SkippedBasebackups - p.SkippedBasebackups
+		s.FailedBasebackups += st.FailedBasebackups - p.FailedBasebackups
+		s.BytesWritten += st.ArchivedBytes - p.ArchivedBytes
+		s.DeltasRotated += st.ArchivedDeltas - p.ArchivedDeltas
+
+		lag := now.Sub(b.started)
+		if !st.LastBasebackup.IsZero() {
+			lag = now.Sub(st.LastBasebackup)
+		}
+		if s.Tables == 1 || lag < s.MinLag {
+			s.MinLag = lag
+		}
+		if s.Tables == 1 || lag > s.MaxLag {
+			s.MaxLag = lag
+			s.WorstLagTable = st.Table
+		}
+	}
+
+	return s
+}
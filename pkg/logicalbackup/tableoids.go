@@ -0,0 +1,38 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// resolveTableOIDs returns the current schema.name of each of the configured
+// table oids, skipping the ones no longer existing
+func (b *LogicalBackup) resolveTableOIDs(conn *pgx.Conn) ([]string, error) {
+	tables := make([]string, 0, len(b.cfg.TableOIDs))
+	for _, s := range b.cfg.TableOIDs {
+		oid, _ := strconv.ParseUint(s, 10, 32)
+
+		var name message.Identifier
+		err := conn.QueryRow(`select n.nspname, c.relname
+			from pg_class c
+			inner join pg_namespace n on (n.oid = c.relnamespace)
+			where c.oid = $1 and c.relkind in ('r', 'p')`, uint32(oid)).Scan(&name.Namespace, &name.Name)
+		if err == pgx.ErrNoRows {
+			log.Printf("table with oid %d does not exist; skipping", oid)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not resolve table oid %d: %v", oid, err)
+		}
+
+		log.Printf("table oid %d resolved to %s", oid, name)
+		b.configuredOIDs[uint32(oid)] = struct{}{}
+		tables = append(tables, name.Namespace+"."+name.Name)
+	}
+
+	return tables, nil
+}
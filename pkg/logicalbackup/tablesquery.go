@@ -0,0 +1,184 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// tableUpdate is the change of the backup set found by the tables query,
+// applied by the replication loop, the only writer of the backup tables
+type tableUpdate struct {
+	added   map[uint32]tablebackup.TableBackuper
+	removed []uint32
+}
+
+// queryTables runs the tables query, which must return the schema and the name
+// of each table to back up
+func (b *LogicalBackup) queryTables(conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(b.cfg.TablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute tables query: %v", err)
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("tables query must return 2 columns, the schema and the table name, not %d", len(fields))
+	}
+	for _, f := range fields {
+		switch f.DataTypeName {
+		case "text", "varchar", "name":
+		default:
+			return nil, fmt.Errorf("column %q of the tables query is of type %s, must be text", f.Name, f.DataTypeName)
+		}
+	}
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+		tables = append(tables, schema+"."+name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch tables: %v", err)
+	}
+	sort.Strings(tables)
+
+	return tables, nil
+}
+
+// refreshTables evaluates the tables query periodically, starting the backup
+// of the tables added to its result and stopping the one of the removed ones
+func (b *LogicalBackup) refreshTables() {
+	defer b.waitGr.Done()
+	ticker := time.NewTicker(b.cfg.TablesQueryInterval)
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if err := b.refreshTablesOnce(); err != nil {
+				log.Printf("could not refresh tables: %v", err)
+			}
+		}
+	}
+}
+
+func (b *LogicalBackup) refreshTablesOnce() error {
+	dbCfg := b.connConfig()
+	conn, err := pgx.Connect(dbCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, dbCfg))
+	}
+	defer conn.Close()
+
+	tables, err := b.queryTables(conn)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]struct{}, len(tables))
+	added := make([]string, 0)
+	for _, t := range tables {
+		current[t] = struct{}{}
+		if _, ok := b.queriedTables[t]; !ok {
+			added = append(added, t)
+		}
+	}
+
+	removed := make([]string, 0)
+	for t := range b.queriedTables {
+		if _, ok := current[t]; !ok {
+			removed = append(removed, t)
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	var u tableUpdate
+	if len(added) > 0 {
+		pubTables, err := b.publicationTables(conn, added)
+		if err != nil {
+			return err
+		}
+
+		// the tables may already be backed up, i.e. tracked as new ones
+		b.tablesMu.RLock()
+		untracked := make([]publicationTable, 0, len(pubTables))
+		for _, t := range pubTables {
+			if _, ok := b.backupTables[t.oid]; !ok {
+				untracked = append(untracked, t)
+			}
+		}
+		b.tablesMu.RUnlock()
+
+		if u.added, err = b.newTables(untracked); err != nil {
+			return err
+		}
+		log.Printf("tables added to the backup set: %v", added)
+	}
+
+	if len(removed) > 0 {
+		pubTables, err := b.publicationTables(conn, removed)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range pubTables {
+			u.removed = append(u.removed, t.oid)
+		}
+		log.Printf("tables removed from the backup set: %v", removed)
+	}
+
+	select {
+	case b.tableUpdates <- u:
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+
+	b.queriedTables = current
+
+	return nil
+}
+
+// applyTableUpdate changes the backup set; the added tables get their base
+// backups right away, as their changes before were not streamed
+func (b *LogicalBackup) applyTableUpdate(u tableUpdate) {
+	for _, oid := range u.removed {
+		bt, ok := b.backupTables[oid]
+		if !ok {
+			continue
+		}
+
+		if err := bt.Stop(); err != nil {
+			log.Printf("could not stop backup of %s: %v", bt, err)
+		}
+
+		b.tablesMu.Lock()
+		delete(b.backupTables, oid)
+		b.tablesMu.Unlock()
+		delete(b.unsyncedTables, oid)
+		delete(b.txBeginRelMsg, oid)
+	}
+
+	for oid, bt := range u.added {
+		b.tablesMu.Lock()
+		b.backupTables[oid] = bt
+		b.tablesMu.Unlock()
+
+		b.basebackupQueue.Put(bt)
+	}
+}
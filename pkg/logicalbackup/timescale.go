@@ -0,0 +1,82 @@
+package logicalbackup
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// hypertable is a TimescaleDB hypertable, which holds no rows itself: they are
+// in its chunks, the inheritance children created in the associated schema
+// and named with the associated prefix
+type hypertable struct {
+	name   message.Identifier
+	schema string // of the chunks
+	prefix string // of the chunk names
+}
+
+// initHypertables finds the hypertables backed up as their chunks: the
+// configured ones, or all of them if there is no table list
+func (b *LogicalBackup) initHypertables(conn *pgx.Conn, tables []string) error {
+	var installed bool
+	if err := conn.QueryRow("select exists(select 1 from pg_extension where extname = 'timescaledb')").Scan(&installed); err != nil {
+		return fmt.Errorf("could not check timescaledb extension: %v", err)
+	}
+	if !installed {
+		log.Printf("timescaleHypertables is set, but the timescaledb extension is not installed")
+		return nil
+	}
+
+	configured := make(map[string]bool)
+	for _, t := range tables {
+		configured[t] = true
+	}
+
+	rows, err := conn.Query(`select schema_name::text, table_name::text, associated_schema_name::text, associated_table_prefix::text
+from _timescaledb_catalog.hypertable`)
+	if err != nil {
+		return fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
+
+	b.hypertables = b.hypertables[:0]
+	for rows.Next() {
+		var h hypertable
+		if err := rows.Scan(&h.name.Namespace, &h.name.Name, &h.schema, &h.prefix); err != nil {
+			return fmt.Errorf("could not scan: %v", err)
+		}
+
+		if len(tables) > 0 && !configured[h.name.Namespace+"."+h.name.Name] {
+			continue
+		}
+		log.Printf("hypertable %s is backed up as its chunks", h.name)
+		b.hypertables = append(b.hypertables, h)
+	}
+
+	return rows.Err()
+}
+
+func (b *LogicalBackup) isHypertable(name message.Identifier) bool {
+	for _, h := range b.hypertables {
+		if h.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chunkOf returns the hypertable the table is a chunk of
+func (b *LogicalBackup) chunkOf(name message.Identifier) (message.Identifier, bool) {
+	for _, h := range b.hypertables {
+		if name.Namespace == h.schema && strings.HasPrefix(name.Name, h.prefix+"_") && strings.HasSuffix(name.Name, "_chunk") {
+			return h.name, true
+		}
+	}
+
+	return message.Identifier{}, false
+}
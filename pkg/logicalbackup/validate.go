@@ -0,0 +1,76 @@
+package logicalbackup
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// validateTables checks the delta chains of all tables, see TableBackup.Validate
+func (b *LogicalBackup) validateTables(table string) []tablebackup.Validation {
+	b.tablesMu.RLock()
+	tables := make([]tablebackup.TableBackuper, 0, len(b.backupTables))
+	for _, t := range b.backupTables {
+		if table == "" || t.String() == table {
+			tables = append(tables, t)
+		}
+	}
+	b.tablesMu.RUnlock()
+
+	res := make([]tablebackup.Validation, 0, len(tables))
+	for _, t := range tables {
+		res = append(res, t.Validate(b.slotLSN))
+	}
+
+	return res
+}
+
+// validateOnStart logs the tables with gaps in their backups
+func (b *LogicalBackup) validateOnStart() {
+	defer b.waitGr.Done()
+
+	valid := 0
+	for _, v := range b.validateTables("") {
+		switch {
+		case v.Error != "":
+			log.Printf("could not validate backup of %s: %s", v.Table, v.Error)
+		case v.Gap != "":
+			log.Printf("backup of %s is not restorable until the next base backup: %s", v.Table, v.Gap)
+		default:
+			valid++
+		}
+	}
+	log.Printf("validated backups: %d tables without gaps", valid)
+}
+
+// validateHandler serves the validation of all tables, or of the one given
+// with the table parameter as schema.name
+func (b *LogicalBackup) validateHandler(w http.ResponseWriter, r *http.Request) {
+	res := b.validateTables(r.URL.Query().Get("table"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Tables []tablebackup.Validation `json:"tables"`
+	}{res}); err != nil {
+		log.Printf("could not encode validation: %v", err)
+	}
+}
+
+// backupsHandler serves the backups of all tables in the archive dir, see
+// tablebackup.ListBackups
+func (b *LogicalBackup) backupsHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := tablebackup.ListBackups(b.cfg.ArchiveDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Tables []tablebackup.Validation `json:"tables"`
+	}{res}); err != nil {
+		log.Printf("could not encode backups: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package logicalrestore
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// ArchiveManifestEnd ends the manifest of the archive file, the rows follow
+const ArchiveManifestEnd = "...\n"
+
+// ArchiveManifest is the header of the archive file, describing the state of
+// the table materialized in it
+type ArchiveManifest struct {
+	Table         message.Identifier
+	LSN           string // the table is as of the commit of this lsn
+	BasebackupLSN string
+	CreateDate    time.Time
+	Format        string               // of the rows following the manifest
+	DDL           *message.TableDDL    `yaml:",omitempty"`
+	Schema        *message.TableSchema `yaml:",omitempty"`
+}
+
+// Archive materializes the state of the table at ToLSN, or at the latest
+// transaction in the deltas, into a single self-contained file written to w:
+// gzip-compressed, the yaml manifest ended by ArchiveManifestEnd, followed by
+// the rows in csv with the header. The table is restored into the database of
+// the connection as scratch space, creating it from the captured ddl in a
+// transaction rolled back once the rows are copied out. It returns the
+// manifest and the sha256 checksum of the written file.
+func (r *LogicalRestore) Archive(w io.Writer) (*ArchiveManifest, string, error) {
+	if r.Subscription != "" || r.MessageHook != nil {
+		return nil, "", fmt.Errorf("the subscription and the message hook are not supported when archiving")
+	}
+
+	if err := r.connect(); err != nil {
+		return nil, "", fmt.Errorf("could not connect: %v", err)
+	}
+	defer r.disconnect()
+
+	r.CreateTable = true
+	if err := r.loadInfo(); err != nil {
+		return nil, "", fmt.Errorf("could not load dump info: %v", err)
+	}
+
+	if err := r.checkTransforms(); err != nil {
+		return nil, "", fmt.Errorf("could not transform: %v", err)
+	}
+
+	if err := r.begin(); err != nil {
+		return nil, "", fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer r.rollback()
+
+	if err := r.loadTable(); err != nil {
+		return nil, "", err
+	}
+
+	if err := r.applyDeltas(); err != nil {
+		return nil, "", fmt.Errorf("could not apply deltas: %v", err)
+	}
+
+	manifest := &ArchiveManifest{
+		Table:         r.Identifier,
+		LSN:           pgx.FormatLSN(r.appliedLSN),
+		BasebackupLSN: pgx.FormatLSN(r.startLSN),
+		CreateDate:    time.Now(),
+		Format:        "csv",
+		DDL:           r.ddl,
+		Schema:        r.schema,
+	}
+
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(w, h))
+	if err := yaml.NewEncoder(gz).Encode(manifest); err != nil {
+		return nil, "", fmt.Errorf("could not write manifest: %v", err)
+	}
+	if _, err := io.WriteString(gz, ArchiveManifestEnd); err != nil {
+		return nil, "", fmt.Errorf("could not write manifest: %v", err)
+	}
+	if err := r.tx.CopyToWriter(gz, fmt.Sprintf("copy %s to stdout with (format csv, header)", r.target.Sanitize())); err != nil {
+		return nil, "", fmt.Errorf("could not copy rows: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, "", fmt.Errorf("could not write rows: %v", err)
+	}
+
+	return manifest, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadTable creates the table and loads the base backup into it, with the
+// constraints and indexes the deltas look the rows up by
+func (r *LogicalRestore) loadTable() error {
+	if err := r.createTable(); err != nil {
+		return fmt.Errorf("could not create table: %v", err)
+	}
+
+	if err := r.checkTableStruct(); err != nil {
+		return fmt.Errorf("table struct error: %v", err)
+	}
+
+	if err := r.checkServerVersion(); err != nil {
+		return err
+	}
+
+	if err := r.loadDump(); err != nil {
+		return fmt.Errorf("could not load dump: %v", err)
+	}
+
+	if err := r.finishTable(); err != nil {
+		return fmt.Errorf("could not create constraints and indexes: %v", err)
+	}
+
+	return nil
+}
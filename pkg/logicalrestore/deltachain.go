@@ -0,0 +1,30 @@
+package logicalrestore
+
+import (
+	"fmt"
+
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// checkDeltaChain refuses to restore if the deltas since the base backup
+// don't form a chain up to the target lsn, i.e. a delta file was lost: the
+// changes in the gap would be silently missing. The table keeps only its
+// latest base backup, and the previous one while its deltas are retained, so
+// the gap is only bridged by the next one.
+func (r *LogicalRestore) checkDeltaChain() error {
+	v := tablebackup.ValidateArchive(r.tableDir(), r.basebackupLSN(), r.ToLSN)
+	if v.Error != "" {
+		return fmt.Errorf("could not check the deltas of %s: %s", r.Identifier, v.Error)
+	}
+	if v.Gap == "" {
+		return nil
+	}
+
+	gap := v.Gap
+	if v.LastLSN != "" {
+		gap += fmt.Sprintf(", the last transaction before it is %s", v.LastLSN)
+	}
+
+	return fmt.Errorf("backup of %s can't be restored consistently: %s; take a new base backup of the table to restore it past the gap",
+		r.Identifier, gap)
+}
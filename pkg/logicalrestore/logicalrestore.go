@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math"
 	"os"
 	"path"
 	"reflect"
@@ -16,6 +17,9 @@ import (
 	"github.com/jackc/pgx"
 	"gopkg.in/yaml.v2"
 
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/decoder"
 	"github.com/ikitiki/logical_backup/pkg/message"
 	"github.com/ikitiki/logical_backup/pkg/tablebackup"
 	"github.com/ikitiki/logical_backup/pkg/utils"
@@ -34,16 +38,17 @@ func (d deltas) Swap(i, j int) {
 func (d deltas) Less(i, j int) bool {
 	var parts1, parts2 []string
 
-	if strings.Contains(d[i], ".") {
-		parts1 = strings.Split(d[i], ".")
+	name1, name2 := path.Base(d[i]), path.Base(d[j])
+	if strings.Contains(name1, ".") {
+		parts1 = strings.Split(name1, ".")
 	} else {
-		parts1 = []string{d[i], "0"}
+		parts1 = []string{name1, "0"}
 	}
 
-	if strings.Contains(d[j], ".") {
-		parts2 = strings.Split(d[j], ".")
+	if strings.Contains(name2, ".") {
+		parts2 = strings.Split(name2, ".")
 	} else {
-		parts2 = []string{d[j], "0"}
+		parts2 = []string{name2, "0"}
 	}
 
 	if parts1[0] != parts2[0] {
@@ -63,38 +68,126 @@ func (d deltas) Less(i, j int) bool {
 	return i1 < i2
 }
 
+func deltaFileLSN(filename string) uint64 {
+	lsn, err := strconv.ParseUint(strings.Split(path.Base(filename), ".")[0], 16, 64)
+	if err != nil {
+		return 0
+	}
+
+	return lsn
+}
+
 type LogicalRestorer interface {
 	Restore(schemaName, tableName string) error
 }
 
+// Options control which part of the backup is restored
+type Options struct {
+	FromLSN uint64 // the base backup must start at or before this LSN; 0 means any
+	ToLSN   uint64 // deltas past this LSN are not applied; 0 means up to the latest one
+
+	SkipSequences bool // do not set the sequences owned by the table after the restore
+	CreateTable   bool // create the table from the ddl captured with the base backup
+
+	InsertBatchSize int // number of consecutive inserts applied with a single statement; 0 or 1 applies them one by one
+
+	AllowVersionMismatch bool // load the binary base backup taken from another major version
+	AllowSchemaDrift     bool // only log the differences of the target table from the schema embedded in the base backup
+
+	Staging string // restore into the new table of this name in the schema of the table, created like it
+	Swap    bool   // replace the table with the staging one once its row count checks out
+
+	Transforms map[string]Transform // by column name, applied to the base backup rows and the changes
+
+	// called with the logical decoding messages stored with logicalMessages
+	// in the order of the changes: a transactional message once its
+	// transaction is applied, the other ones before the next transaction
+	MessageHook func(message.JSONLogicalMessage) error
+
+	// hand off to the subscription of that name after loading the base
+	// backup instead of applying the deltas
+	Subscription      string
+	Publisher         string // connection string of the publisher
+	Publication       string
+	SubscriptionSlot  string // existing slot on the publisher, at or before the base backup lsn
+	PrintSubscription bool   // print the subscription statements instead of running them
+}
+
 type LogicalRestore struct {
 	message.Identifier
-
-	startLSN    uint64
-	columnNames []string
-	relInfo     message.Relation
+	Options
+
+	target message.Identifier // the table restored into: the hypertable of a chunk, the table itself otherwise
+
+	startLSN      uint64
+	dumpParts     []string
+	dumpFormat    string
+	footers       bool
+	serverVersion int // of the base backup
+	copyOptions   *message.CopyOptions
+	columnNames   []string
+	relInfo       message.Relation
+	schema        *message.TableSchema // embedded in the base backup, nil if not
+	sequences     []message.Sequence
+	ddl           *message.TableDDL
+
+	relations  map[uint32]message.Relation // relation messages from the deltas
+	skipTx     bool                        // the current transaction is already in the dump or applied, or there is none
+	txLSN      uint64                      // final lsn of the current transaction
+	txChanges  []change                    // of the current transaction, applied on its commit
+	messages   []logicalMessage            // not delivered to the hook yet
+	done       bool                        // reached the target lsn
+	appliedLSN uint64                      // final lsn of the latest transaction applied, or of the dump
+
+	pendingInserts []message.Insert // consecutive inserts of pendingRel not applied yet
+	pendingRel     message.Relation
+
+	stagingRows stagingRows
 
 	conn *pgx.Conn
 	tx   *pgx.Tx
 	cfg  pgx.ConnConfig
 	ctx  context.Context
+	exec func(sql string) error // runs the statements of the deltas, in tx
+
+	baseDir       string
+	basebackupDir string // of the base backup restored, see tablebackup.BasebackupDir
+}
 
-	baseDir string
+// change is the change of the transaction held until its commit, with the
+// relation it was decoded with
+type change struct {
+	msg message.Message
+	rel message.Relation
 }
 
-func New(schemaName, tableName, dir string, cfg pgx.ConnConfig) *LogicalRestore {
-	return &LogicalRestore{
+func New(schemaName, tableName, dir string, cfg pgx.ConnConfig, opts Options) *LogicalRestore {
+	r := &LogicalRestore{
 		ctx:        context.Background(),
 		baseDir:    dir,
 		cfg:        cfg,
 		Identifier: message.Identifier{Namespace: schemaName, Name: tableName},
+		target:     message.Identifier{Namespace: schemaName, Name: tableName},
+		Options:    opts,
+		relations:  make(map[uint32]message.Relation),
+		skipTx:     true, // until the first begin
 	}
+	r.exec = r.txExec
+	r.basebackupDir = r.tableDir()
+
+	return r
+}
+
+func (r *LogicalRestore) txExec(sql string) error {
+	_, err := r.tx.Exec(sql)
+
+	return err
 }
 
 func (r *LogicalRestore) connect() error {
 	conn, err := pgx.Connect(r.cfg)
 	if err != nil {
-		return fmt.Errorf("could not connect: %v", err)
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, r.cfg))
 	}
 
 	r.conn = conn
@@ -150,19 +243,43 @@ func (r *LogicalRestore) rollback() error {
 	return nil
 }
 
+// tableDir is the archive dir of the table
+func (r *LogicalRestore) tableDir() string {
+	return path.Join(r.baseDir, utils.TableDir(r.Identifier))
+}
+
 func (r *LogicalRestore) infoFilepath() string {
-	return path.Join(r.baseDir, utils.TableDir(r.Identifier), "info.yaml")
+	return path.Join(r.basebackupDir, "info.yaml")
 }
 
 func (r *LogicalRestore) dumpFilepath() string {
-	return path.Join(r.baseDir, utils.TableDir(r.Identifier), "basebackup.copy")
+	return path.Join(r.basebackupDir, "basebackup.copy")
 }
 
 func (r *LogicalRestore) deltaDir() string {
-	return path.Join(r.baseDir, utils.TableDir(r.Identifier), "deltas")
+	return path.Join(r.tableDir(), "deltas")
+}
+
+// basebackupLSN is the lsn the base backup restored must start at or before,
+// 0 for any
+func (r *LogicalRestore) basebackupLSN() uint64 {
+	if r.FromLSN != 0 && (r.ToLSN == 0 || r.FromLSN < r.ToLSN) {
+		return r.FromLSN
+	}
+
+	return r.ToLSN
 }
 
 func (r *LogicalRestore) loadInfo() error {
+	dir, err := tablebackup.BasebackupDir(r.tableDir(), r.basebackupLSN())
+	if err != nil {
+		return fmt.Errorf("could not find base backup: %v", err)
+	}
+	if dir != r.tableDir() {
+		log.Printf("restoring %s from the previous base backup, kept with the deltas", r.Identifier)
+	}
+	r.basebackupDir = dir
+
 	var info message.DumpInfo
 	fp, err := os.OpenFile(r.infoFilepath(), os.O_RDONLY, os.ModePerm)
 	if err != nil {
@@ -179,24 +296,163 @@ func (r *LogicalRestore) loadInfo() error {
 		return fmt.Errorf("could not parse lsn: %v", err)
 	}
 	r.startLSN = lsn
+	r.appliedLSN = lsn
+
+	// the files of the base backup not pointed to by latest may be partial
+	latest, err := tablebackup.ReadLatest(path.Dir(r.infoFilepath()))
+	if err != nil {
+		return err
+	} else if latest == nil {
+		log.Printf("no latest pointer of %s, the base backup may not be completely archived", r.Identifier)
+	} else if latest.StartLSN != info.StartLSN {
+		return fmt.Errorf("base backup at %s is not completely archived, latest points to %s", info.StartLSN, latest.StartLSN)
+	}
+
+	if r.FromLSN != 0 && r.startLSN > r.FromLSN {
+		return fmt.Errorf("no base backup at or before %s: the base backup starts at %s",
+			pgx.FormatLSN(r.FromLSN), pgx.FormatLSN(r.startLSN))
+	}
+
+	if r.ToLSN != 0 && r.ToLSN < r.startLSN {
+		return fmt.Errorf("target lsn %s is before the base backup lsn %s",
+			pgx.FormatLSN(r.ToLSN), pgx.FormatLSN(r.startLSN))
+	}
+
+	if err := r.checkDeltaChain(); err != nil {
+		return err
+	}
 
 	r.columnNames = make([]string, 0)
 	for _, c := range info.Relation.Columns {
 		r.columnNames = append(r.columnNames, c.Name)
 	}
 	r.relInfo = info.Relation
+	r.dumpParts = info.Parts
+	r.dumpFormat = info.Format
+	r.footers = info.Footers
+	r.serverVersion = info.ServerVersion
+	r.copyOptions = info.CopyOptions
+	r.sequences = info.Sequences
+	r.ddl = info.DDL
+	r.schema = info.Schema
+
+	if r.CreateTable && r.ddl == nil {
+		return fmt.Errorf("the base backup has no table ddl, enable captureDDL to create the table on restore")
+	}
+
+	if info.Hypertable != nil {
+		if r.CreateTable {
+			return fmt.Errorf("%s is a chunk of hypertable %s, create the hypertable instead", r.Identifier, info.Hypertable)
+		}
+		log.Printf("%s is a chunk of hypertable %s, restoring into the hypertable", r.Identifier, info.Hypertable)
+		r.target = *info.Hypertable
+	}
+
+	if info.InsertOnly {
+		log.Printf("%s had replica identity nothing, its updates and deletes were not backed up", r.Identifier)
+	}
+
+	if len(info.Operations) > 0 {
+		log.Printf("only the %s changes of %s were backed up", strings.Join(info.Operations, ", "), r.Identifier)
+	}
 
 	return nil
 }
 
 func (r *LogicalRestore) loadDump() error {
-	fp, err := os.OpenFile(r.dumpFilepath(), os.O_RDONLY, os.ModePerm)
+	if r.dumpFormat == config.DumpFormatDeltasOnly {
+		log.Printf("no base backup of %s, only applying the deltas", r.Identifier)
+		return nil
+	}
+
+	if r.dumpFormat == config.BasebackupFormatSQL {
+		return r.loadSQLDump(path.Join(r.basebackupDir, tablebackup.SQLDumpFilename))
+	}
+
+	if len(r.dumpParts) == 0 {
+		return r.loadDumpFile(r.dumpFilepath())
+	}
+
+	for _, part := range r.dumpParts {
+		log.Printf("loading %q dump part", part)
+		if err := r.loadDumpFile(path.Join(r.basebackupDir, part)); err != nil {
+			return fmt.Errorf("could not load %q part: %v", part, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *LogicalRestore) loadDumpFile(filePath string) error {
+	fp, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	// the footer is checked before loading anything, the checksum at the end
+	var rd io.Reader = fp
+	if r.footers {
+		footer, err := tablebackup.ReadFooter(fp)
+		if err != nil {
+			return err
+		}
+		log.Printf("loading %d rows from %q", footer.Rows, filePath)
+		r.stagingRows.dump += footer.Rows
+		rd = footer.Reader(fp)
+	}
+
+	query := fmt.Sprintf("copy %s%s from stdin%s", r.target.Sanitize(), r.relInfo.CopyColumns(), config.CopyOptions(r.dumpFormat, r.copyOptions))
+	if err := r.conn.CopyFromReader(r.transformCopy(rd, r.copyOptions), query); err != nil {
+		return fmt.Errorf("could not copy: %v", err)
+	}
+
+	return nil
+}
+
+// loadSQLDump loads the data from the COPY block of the sql dump; the table
+// itself must already exist, the same as for the copy dumps
+func (r *LogicalRestore) loadSQLDump(filePath string) error {
+	fp, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("could not open file: %v", err)
 	}
 	defer fp.Close()
 
-	if err := r.conn.CopyFromReader(fp, fmt.Sprintf("copy %s from stdin", r.Identifier.Sanitize())); err != nil {
+	rd := bufio.NewReader(fp)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("could not find the COPY block: %v", err)
+		}
+
+		if strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, " FROM stdin;\n") {
+			break
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("unterminated COPY block: %v", err))
+				return
+			}
+
+			if line == "\\.\n" {
+				pw.Close()
+				return
+			}
+
+			if _, err := io.WriteString(pw, line); err != nil {
+				return
+			}
+		}
+	}()
+	defer pr.Close()
+
+	if err := r.conn.CopyFromReader(r.transformCopy(pr, nil), fmt.Sprintf("copy %s%s from stdin", r.target.Sanitize(), r.relInfo.CopyColumns())); err != nil {
 		return fmt.Errorf("could not copy: %v", err)
 	}
 
@@ -212,70 +468,436 @@ func (r *LogicalRestore) applyDelta(filePath string) error {
 	}
 	defer fp.Close()
 
-	scanner := bufio.NewScanner(fp)
-	for scanner.Scan() {
-		var (
-			sql  string
-			lsn  uint64
-			txId int32
-		)
-		line := scanner.Text()
+	dr, err := decoder.NewDeltaReader(fp)
+	if err != nil {
+		return err
+	}
 
-		_, err := fmt.Sscanf(line, message.DeltaMessageFormat, &lsn, &txId, &sql)
-		if err != nil {
-			return fmt.Errorf("could not parse delta line %q: %v", line, err)
+	for !r.done {
+		m, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read %s delta: %v", dr.Format(), err)
 		}
 
-		if lsn <= r.startLSN {
-			continue
+		if err := r.applyMessage(m); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		if _, err := r.tx.Exec(sql); err != nil {
-			return fmt.Errorf("could not apply delta sql %q: %v", sql, err)
+// applyMessage applies the transaction of the deltas on its commit. After the
+// reconnect or the restart of the backup the server streams again from the
+// last fsynced position: the transactions already in the deltas come once more,
+// skipped here, and the one cut off is streamed again from its begin, which
+// discards the part of it read so far.
+func (r *LogicalRestore) applyMessage(m message.Message) error {
+	switch v := m.(type) {
+	case message.Relation:
+		r.relations[v.OID] = v
+	case message.Begin:
+		r.discardTx()
+		if r.ToLSN != 0 && v.FinalLSN > r.ToLSN {
+			r.done = true
+			return nil
 		}
+
+		// transactions committed before the consistent point are in the dump,
+		// the ones up to the last applied are streamed again
+		r.skipTx = v.FinalLSN <= r.appliedLSN
+		r.txLSN = v.FinalLSN
+
+		return r.deliverMessages(v.FinalLSN - 1)
+	case message.Commit:
+		if r.skipTx {
+			return nil
+		}
+
+		changes := r.txChanges
+		r.txChanges, r.skipTx = r.txChanges[:0], true
+		for _, c := range changes {
+			if err := r.applyChange(c); err != nil {
+				return err
+			}
+		}
+		r.appliedLSN = r.txLSN
+
+		return r.deliverMessages(r.txLSN)
+	case message.Insert:
+		return r.holdChange(v, v.RelationOID, len(v.NewRow))
+	case message.Update:
+		return r.holdChange(v, v.RelationOID, len(v.NewRow))
+	case message.Delete:
+		return r.holdChange(v, v.RelationOID, len(v.OldRow))
+	case message.Truncate:
+		if !r.skipTx {
+			r.txChanges = append(r.txChanges, change{msg: v, rel: message.Relation{Identifier: r.target}})
+		}
+	}
+
+	return nil
+}
+
+// holdChange keeps the change until the commit of its transaction
+func (r *LogicalRestore) holdChange(m message.Message, relOID uint32, columns int) error {
+	if r.skipTx {
+		return nil
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("could not read line: %v", err)
+	rel, err := r.relation(relOID, columns)
+	if err != nil {
+		return err
 	}
+	r.txChanges = append(r.txChanges, change{msg: m, rel: rel})
 
 	return nil
 }
 
-func (r *LogicalRestore) applyDeltas() error {
+// discardTx drops the changes of the transaction without the commit
+func (r *LogicalRestore) discardTx() {
+	if len(r.txChanges) > 0 {
+		log.Printf("transaction %s of %s is incomplete, discarding its %d changes", pgx.FormatLSN(r.txLSN), r.Identifier, len(r.txChanges))
+	}
+	r.txChanges, r.skipTx = r.txChanges[:0], true
+}
+
+func (r *LogicalRestore) applyChange(c change) error {
+	var sql string
+
+	// only the inserts are batched: the other changes may depend on the rows
+	// inserted before them, so the pending ones are applied first, keeping the
+	// order. The batches span the transactions, all restored in a single one.
+	switch c.msg.(type) {
+	case message.Update, message.Delete, message.Truncate:
+		if err := r.flushInserts(); err != nil {
+			return err
+		}
+	}
+
+	switch v := c.msg.(type) {
+	case message.Insert:
+		r.stagingRows.inserts++
+		if err := r.transformRow(c.rel, v.NewRow); err != nil {
+			return err
+		}
+		if r.InsertBatchSize > 1 {
+			return r.batchInsert(v, c.rel)
+		}
+		sql = v.SQL(c.rel)
+	case message.Update:
+		if err := r.transformRow(c.rel, v.NewRow); err != nil {
+			return err
+		}
+		if err := r.transformRow(c.rel, v.OldRow); err != nil {
+			return err
+		}
+		sql = v.SQL(c.rel)
+	case message.Delete:
+		r.stagingRows.deletes++
+		if err := r.transformRow(c.rel, v.OldRow); err != nil {
+			return err
+		}
+		sql = v.SQL(c.rel)
+	case message.Truncate:
+		r.stagingRows = stagingRows{dump: r.stagingRows.dump}
+		sql = v.SQL(c.rel)
+	}
+
+	if err := r.exec(sql); err != nil {
+		return fmt.Errorf("could not apply delta sql %q: %v", sql, err)
+	}
+
+	return nil
+}
+
+func (r *LogicalRestore) batchInsert(ins message.Insert, rel message.Relation) error {
+	if len(r.pendingInserts) > 0 && !reflect.DeepEqual(r.pendingRel, rel) {
+		if err := r.flushInserts(); err != nil {
+			return err
+		}
+	}
+
+	r.pendingRel = rel
+	r.pendingInserts = append(r.pendingInserts, ins)
+	if len(r.pendingInserts) >= r.InsertBatchSize {
+		return r.flushInserts()
+	}
+
+	return nil
+}
+
+// flushInserts applies the pending inserts with a single statement
+func (r *LogicalRestore) flushInserts() error {
+	if len(r.pendingInserts) == 0 {
+		return nil
+	}
+
+	n := len(r.pendingInserts)
+	sql := message.InsertSQL(r.pendingRel, r.pendingInserts)
+	r.pendingInserts = r.pendingInserts[:0]
+	if err := r.exec(sql); err != nil {
+		return fmt.Errorf("could not apply batch of %d inserts: %v", n, err)
+	}
+
+	return nil
+}
+
+// relation returns the latest relation message seen in the deltas, falling
+// back to the table structure recorded at the basebackup time. The identity
+// columns and the ones of the unsupported types are only known from the latter.
+func (r *LogicalRestore) relation(oid uint32, columns int) (message.Relation, error) {
+	rel, ok := r.relations[oid]
+	if !ok {
+		rel = r.relInfo.Replicated()
+	} else {
+		catalog := make(map[string]message.Column)
+		for _, c := range r.relInfo.Columns {
+			catalog[c.Name] = c
+		}
+
+		rel.Columns = append([]message.Column(nil), rel.Columns...)
+		for i := range rel.Columns {
+			c := catalog[rel.Columns[i].Name]
+			rel.Columns[i].IdentityAlways = c.IdentityAlways
+			rel.Columns[i].Raw, rel.Columns[i].Skipped = c.Raw, c.Skipped
+			if c.Raw {
+				rel.Columns[i].FormattedType = c.FormattedType
+			}
+		}
+	}
+
+	if r.target != r.Identifier {
+		rel.Identifier = r.target
+	}
+
+	if len(rel.Columns) != columns {
+		return rel, fmt.Errorf("relation %s has %d columns, while the delta has %d values", rel.Identifier, len(rel.Columns), columns)
+	}
+
+	return rel, nil
+}
+
+// DeltaFiles lists the delta files in the dir and its shards in the order of
+// their lsn, the paths relative to the dir
+func DeltaFiles(dir string) ([]string, error) {
 	deltaFiles := make(deltas, 0)
-	fileList, err := ioutil.ReadDir(r.deltaDir())
+	fileList, err := utils.ReadDeltaDir(dir)
 	if err != nil {
-		return fmt.Errorf("could not read directory: %v", err)
+		return nil, fmt.Errorf("could not read directory: %v", err)
 	}
 	for _, v := range fileList {
-		deltaFiles = append(deltaFiles, v.Name())
+		deltaFiles = append(deltaFiles, v.Path)
 	}
 
 	sort.Sort(deltaFiles)
 
+	return deltaFiles, nil
+}
+
+func (r *LogicalRestore) applyDeltas() error {
+	deltaFiles, err := DeltaFiles(r.deltaDir())
+	if err != nil {
+		return err
+	}
+
+	if r.MessageHook != nil {
+		if err := r.loadMessages(); err != nil {
+			return fmt.Errorf("could not load logical messages: %v", err)
+		}
+	}
+
 	for _, deltaFile := range deltaFiles {
+		if r.done || r.ToLSN != 0 && deltaFileLSN(deltaFile) > r.ToLSN {
+			// files are named after the lsn of their first message
+			break
+		}
+
 		if err := r.applyDelta(path.Join(r.deltaDir(), deltaFile)); err != nil {
 			return fmt.Errorf("could not apply %q delta file: %v", deltaFile, err)
 		}
 	}
 
+	// the last transaction, cut off by the crash of the backup
+	r.discardTx()
+	if err := r.flushInserts(); err != nil {
+		return err
+	}
+
+	// the messages after the last transaction
+	return r.deliverMessages(math.MaxUint64)
+}
+
+// setSequences moves the sequences owned by the table past the restored values:
+// the deltas don't carry the sequence changes, so the value stored with the
+// base backup is advanced to the maximum value of the column if it's larger.
+// The values are those of the table restored into, i.e. the staging one, which
+// has its own identity sequences.
+func (r *LogicalRestore) setSequences() error {
+	for _, seq := range r.sequences {
+		column := pgx.Identifier{seq.Column}.Sanitize()
+		sequence := fmt.Sprintf("coalesce(pg_get_serial_sequence(%s, %s)::regclass, %s::regclass)",
+			dbutils.QuoteLiteral(r.target.Sanitize()), dbutils.QuoteLiteral(seq.Column), dbutils.QuoteLiteral(seq.Identifier.Sanitize()))
+		query := fmt.Sprintf(`select setval(%[1]s,
+	greatest(%[2]d, (select max(%[3]s) from %[4]s)),
+	%[5]t or exists (select 1 from %[4]s where %[3]s >= %[2]d))`,
+			sequence, seq.LastValue, column, r.target.Sanitize(), seq.IsCalled)
+
+		if _, err := r.tx.Exec(query); err != nil {
+			return fmt.Errorf("could not set sequence %s: %v", seq.Identifier, err)
+		}
+		log.Printf("sequence %s set", seq.Identifier)
+	}
+
 	return nil
 }
 
+func majorVersion(version int) int {
+	if version >= 100000 {
+		return version / 10000
+	}
+
+	return version / 100
+}
+
+// checkServerVersion refuses to load the binary base backup taken from another
+// major version, the binary format of the types may differ between them
+func (r *LogicalRestore) checkServerVersion() error {
+	if r.serverVersion == 0 || r.dumpFormat == config.DumpFormatDeltasOnly {
+		return nil
+	}
+
+	version, err := tablebackup.ServerVersion(r.tx)
+	if err != nil {
+		return err
+	}
+	if majorVersion(version) == majorVersion(r.serverVersion) {
+		return nil
+	}
+
+	if r.dumpFormat != config.BasebackupFormatBinary {
+		log.Printf("the base backup of %s was taken from server version %d, restoring into %d", r.Identifier, r.serverVersion, version)
+		return nil
+	}
+	if r.AllowVersionMismatch {
+		log.Printf("loading the binary base backup of %s taken from server version %d into %d", r.Identifier, r.serverVersion, version)
+		return nil
+	}
+
+	return fmt.Errorf("the binary base backup of %s was taken from server version %d and may not load into %d; "+
+		"use the copy or csv basebackupFormat for the backups restored into other major versions",
+		r.Identifier, r.serverVersion, version)
+}
+
 func (r *LogicalRestore) checkTableStruct() error {
-	relationInfo, err := tablebackup.FetchRelationInfo(r.tx, r.Identifier)
+	if r.schema != nil {
+		return r.checkSchemaDrift()
+	}
+
+	relationInfo, err := tablebackup.FetchRelationInfo(r.tx, r.target)
 	if err != nil {
 		return fmt.Errorf("could not fetch table info: %v", err)
 	}
 
-	if !reflect.DeepEqual(relationInfo.Columns, r.relInfo.Columns) {
+	// the replica identity of the target doesn't matter, nor is it known for
+	// the base backups taken before it was recorded
+	if !reflect.DeepEqual(withoutKeys(relationInfo.Columns), withoutKeys(r.relInfo.Columns)) {
 		return fmt.Errorf("table structs do not match: \n%#v\n%#v", relationInfo.Columns, r.relInfo.Columns)
 	}
 
 	return nil
 }
 
+func withoutKeys(columns []message.Column) []message.Column {
+	res := make([]message.Column, len(columns))
+	for i, c := range columns {
+		c.IsKey = false
+		res[i] = c
+	}
+
+	return res
+}
+
+// checkSchemaDrift compares the target table to the schema embedded in the
+// base backup. The constraints are not compared for the table created from
+// the captured ddl, which only gets them after the load, nor for the
+// hypertable a chunk is restored into.
+func (r *LogicalRestore) checkSchemaDrift() error {
+	schema, err := tablebackup.FetchTableSchema(r.tx, r.target)
+	if err != nil {
+		return fmt.Errorf("could not fetch table schema: %v", err)
+	}
+
+	backup := *r.schema
+	if r.CreateTable || r.target != r.Identifier {
+		backup.Constraints, schema.Constraints = nil, nil
+	}
+
+	diffs := backup.Diff(schema)
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	if r.AllowSchemaDrift {
+		for _, d := range diffs {
+			log.Printf("%s drifted from the base backup: %s", r.target, d)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s drifted from the base backup: %s; use -allow-schema-drift to load it anyway",
+		r.target, strings.Join(diffs, ", "))
+}
+
+func (r *LogicalRestore) execAll(stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := r.tx.Exec(stmt); err != nil {
+			return fmt.Errorf("could not execute %q: %v", stmt, err)
+		}
+	}
+
+	return nil
+}
+
+// createTable creates the table with its columns only; the constraints and
+// indexes are added by finishTable once the base backup is loaded
+func (r *LogicalRestore) createTable() error {
+	log.Printf("creating table %s", r.Identifier)
+
+	return r.execAll(append(r.ddl.Sequences, r.ddl.CreateTable))
+}
+
+// finishTable adds the constraints and indexes before the deltas are applied,
+// as the updates and deletes look up the rows by the replica identity. The
+// partition is only attached if the parent table exists.
+func (r *LogicalRestore) finishTable() error {
+	for _, stmts := range [][]string{r.ddl.Constraints, r.ddl.Indexes, r.ddl.OwnedBy} {
+		if err := r.execAll(stmts); err != nil {
+			return err
+		}
+	}
+
+	if r.ddl.Partition == "" {
+		return nil
+	}
+
+	var parentExists bool
+	row := r.tx.QueryRow(fmt.Sprintf("select to_regclass(%s) is not null",
+		dbutils.QuoteLiteral(r.ddl.Parent)))
+	if err := row.Scan(&parentExists); err != nil {
+		return fmt.Errorf("could not check partition parent: %v", err)
+	}
+
+	if !parentExists {
+		log.Printf("%s does not exist, not attaching %s as its partition", r.ddl.Parent, r.Identifier)
+		return nil
+	}
+
+	return r.execAll([]string{r.ddl.Partition})
+}
+
 func (r *LogicalRestore) Restore() error {
 	if err := r.connect(); err != nil {
 		return fmt.Errorf("could not connect: %v", err)
@@ -285,25 +907,83 @@ func (r *LogicalRestore) Restore() error {
 		return fmt.Errorf("could not load dump info: %v", err)
 	}
 
+	if err := r.checkTransforms(); err != nil {
+		return fmt.Errorf("could not transform: %v", err)
+	}
+
+	if r.Subscription != "" {
+		if err := r.checkPublisher(); err != nil {
+			return fmt.Errorf("could not start subscription: %v", err)
+		}
+	}
+
 	if err := r.begin(); err != nil {
 		return fmt.Errorf("could not start transaction: %v", err)
 	}
 
+	if r.CreateTable {
+		if err := r.createTable(); err != nil {
+			return fmt.Errorf("could not create table: %v", err)
+		}
+	}
+
+	if r.Staging != "" {
+		if err := r.createStaging(); err != nil {
+			return fmt.Errorf("could not stage: %v", err)
+		}
+	}
+
 	if err := r.checkTableStruct(); err != nil {
 		return fmt.Errorf("table struct error: %v", err)
 	}
 
+	if err := r.checkServerVersion(); err != nil {
+		return err
+	}
+
 	if err := r.loadDump(); err != nil {
 		return fmt.Errorf("could not load dump: %v", err)
 	}
 
-	if err := r.applyDeltas(); err != nil {
-		return fmt.Errorf("could not apply deltas: %v", err)
+	if r.Staging != "" {
+		if err := r.checkStagingDump(); err != nil {
+			return err
+		}
+	}
+
+	if r.CreateTable {
+		if err := r.finishTable(); err != nil {
+			return fmt.Errorf("could not create constraints and indexes: %v", err)
+		}
+	}
+
+	if r.Subscription == "" {
+		if err := r.applyDeltas(); err != nil {
+			return fmt.Errorf("could not apply deltas: %v", err)
+		}
+	}
+
+	if !r.SkipSequences {
+		if err := r.setSequences(); err != nil {
+			return fmt.Errorf("could not set sequences: %v", err)
+		}
+	}
+
+	if r.Staging != "" {
+		if err := r.checkStaging(); err != nil {
+			return err
+		}
 	}
 
 	if err := r.commit(); err != nil {
 		return fmt.Errorf("could not commit transaction: %v", err)
 	}
 
+	if r.Subscription != "" {
+		if err := r.subscribe(); err != nil {
+			return fmt.Errorf("could not create subscription: %v", err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,258 @@
+package logicalrestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// newTestRestore returns the restore of public.test starting after the dump at
+// startLSN, collecting the statements instead of running them
+func newTestRestore(startLSN uint64, opts Options) (*LogicalRestore, *[]string) {
+	var statements []string
+
+	r := New("public", "test", "", pgx.ConnConfig{}, opts)
+	r.startLSN, r.appliedLSN = startLSN, startLSN
+	r.exec = func(sql string) error {
+		statements = append(statements, sql)
+		return nil
+	}
+
+	return r, &statements
+}
+
+func insert(id string) message.Insert {
+	return message.Insert{RelationOID: 1, NewRow: []message.Tuple{{Kind: message.TextValue, Value: []byte(id)}}}
+}
+
+func TestApplyStreamedAgain(t *testing.T) {
+	rel := message.Relation{
+		Identifier: message.Identifier{Namespace: "public", Name: "test"},
+		OID:        1,
+		Columns:    []message.Column{{Name: "id", IsKey: true}},
+	}
+
+	tests := []struct {
+		name       string
+		batchSize  int
+		toLSN      uint64
+		statements []string
+	}{
+		{
+			name:       "one by one",
+			statements: []string{`insert into "public"."test" ("id") values ('2');`, `insert into "public"."test" ("id") values ('3');`},
+		},
+		{
+			name:       "batched",
+			batchSize:  10,
+			statements: []string{`insert into "public"."test" ("id") values ('2'), ('3');`},
+		},
+		{
+			name:       "up to lsn",
+			toLSN:      200,
+			statements: []string{`insert into "public"."test" ("id") values ('2');`},
+		},
+	}
+
+	for _, tt := range tests {
+		r, statements := newTestRestore(100, Options{InsertBatchSize: tt.batchSize, ToLSN: tt.toLSN})
+
+		msgs := []message.Message{
+			// the transaction in the dump
+			message.Begin{FinalLSN: 100}, rel, insert("1"), message.Commit{},
+			message.Begin{FinalLSN: 200}, insert("2"), message.Commit{},
+			// cut off by the reconnect
+			message.Begin{FinalLSN: 300}, insert("3"),
+			// streamed again from the last fsynced position
+			message.Begin{FinalLSN: 200}, insert("2"), message.Commit{},
+			message.Begin{FinalLSN: 300}, insert("3"), message.Commit{},
+			// cut off by the crash
+			message.Begin{FinalLSN: 400}, insert("4"),
+		}
+		for _, m := range msgs {
+			if r.done {
+				break
+			}
+			if err := r.applyMessage(m); err != nil {
+				t.Fatalf("%s: could not apply %T: %v", tt.name, m, err)
+			}
+		}
+		r.discardTx()
+		if err := r.flushInserts(); err != nil {
+			t.Fatalf("%s: could not flush inserts: %v", tt.name, err)
+		}
+
+		if strings.Join(*statements, "\n") != strings.Join(tt.statements, "\n") {
+			t.Errorf("%s: statements\n%s\nexpected\n%s", tt.name, strings.Join(*statements, "\n"), strings.Join(tt.statements, "\n"))
+		}
+	}
+}
+
+func TestApplyWithoutRelationMessage(t *testing.T) {
+	r, statements := newTestRestore(100, Options{})
+	// the delta file with the relation message is rotated out after the base backup
+	r.relInfo = message.Relation{
+		Identifier:      message.Identifier{Namespace: "public", Name: "test"},
+		OID:             1,
+		ReplicaIdentity: message.ReplicaIdentityDefault,
+		Columns:         []message.Column{{Name: "id", IsKey: true}, {Name: "val"}},
+	}
+
+	msgs := []message.Message{
+		message.Begin{FinalLSN: 200},
+		message.Update{RelationOID: 1, NewRow: []message.Tuple{
+			{Kind: message.TextValue, Value: []byte("1")}, {Kind: message.TextValue, Value: []byte("b")},
+		}},
+		message.Delete{RelationOID: 1, IsKey: true, OldRow: []message.Tuple{
+			{Kind: message.TextValue, Value: []byte("2")}, {Kind: message.NullValue},
+		}},
+		message.Commit{},
+	}
+	for _, m := range msgs {
+		if err := r.applyMessage(m); err != nil {
+			t.Fatalf("could not apply %T: %v", m, err)
+		}
+	}
+
+	expected := []string{
+		`update "public"."test" set "id" = '1', "val" = 'b' where "id" = '1';`,
+		`delete from "public"."test" where "id" = '2';`,
+	}
+	if strings.Join(*statements, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("statements\n%s\nexpected\n%s", strings.Join(*statements, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestApplyTruncate(t *testing.T) {
+	r, statements := newTestRestore(100, Options{InsertBatchSize: 10})
+	r.relInfo = message.Relation{
+		Identifier: message.Identifier{Namespace: "public", Name: "test"},
+		OID:        1,
+		Columns:    []message.Column{{Name: "id", IsKey: true}},
+	}
+	r.stagingRows = stagingRows{dump: 5, loaded: 5}
+
+	msgs := []message.Message{
+		message.Begin{FinalLSN: 200}, insert("1"), message.Commit{},
+		message.Begin{FinalLSN: 300},
+		message.Truncate{Relations: 2, RelationOIDs: []uint32{1, 2}, RestartIdentity: true, Cascade: true},
+		insert("2"),
+		message.Commit{},
+	}
+	for _, m := range msgs {
+		if err := r.applyMessage(m); err != nil {
+			t.Fatalf("could not apply %T: %v", m, err)
+		}
+	}
+	if err := r.flushInserts(); err != nil {
+		t.Fatalf("could not flush inserts: %v", err)
+	}
+
+	// the inserts before the truncate are applied first
+	expected := []string{
+		`insert into "public"."test" ("id") values ('1');`,
+		`truncate table "public"."test" restart identity cascade;`,
+		`insert into "public"."test" ("id") values ('2');`,
+	}
+	if strings.Join(*statements, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("statements\n%s\nexpected\n%s", strings.Join(*statements, "\n"), strings.Join(expected, "\n"))
+	}
+	if s := r.stagingRows; s.loaded != 0 || s.inserts != 1 || s.deletes != 0 {
+		t.Errorf("rows after the truncate: %d loaded, %d inserted, %d deleted, expected only 1 inserted", s.loaded, s.inserts, s.deletes)
+	}
+}
+
+// writeBasebackup writes the complete base backup of public.test at startLSN
+// into dir, the archive dir of the table or its previous dir
+func writeBasebackup(t *testing.T, dir string, startLSN uint64) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("could not create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "basebackup.copy"), nil, 0600); err != nil {
+		t.Fatalf("could not write dump file: %v", err)
+	}
+
+	files := map[string]interface{}{
+		"info.yaml": message.DumpInfo{
+			StartLSN: pgx.FormatLSN(startLSN),
+			Relation: message.Relation{Identifier: message.Identifier{Namespace: "public", Name: "test"}},
+		},
+		tablebackup.LatestFilename: message.BasebackupPointer{
+			StartLSN: pgx.FormatLSN(startLSN),
+			Info:     "info.yaml",
+			Files:    []string{"basebackup.copy"},
+		},
+	}
+	for name, v := range files {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			t.Fatalf("could not encode %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("could not write %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadPreviousBasebackup(t *testing.T) {
+	baseDir := t.TempDir()
+	tableDir := path.Join(baseDir, utils.TableDir(message.Identifier{Namespace: "public", Name: "test"}))
+	prevDir := path.Join(tableDir, tablebackup.PreviousDir)
+
+	// the previous base backup is kept along with the deltas preceding the
+	// latest one
+	writeBasebackup(t, tableDir, 0x300)
+	writeBasebackup(t, prevDir, 0x100)
+	if err := os.MkdirAll(path.Join(tableDir, "deltas"), 0700); err != nil {
+		t.Fatalf("could not create deltas dir: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		startLSN uint64
+		dir      string
+		err      string
+	}{
+		{name: "latest", startLSN: 0x300, dir: tableDir},
+		{name: "past the latest", opts: Options{ToLSN: 0x400}, startLSN: 0x300, dir: tableDir},
+		{name: "before the latest", opts: Options{ToLSN: 0x200}, startLSN: 0x100, dir: prevDir},
+		{name: "from before the latest", opts: Options{FromLSN: 0x200, ToLSN: 0x400}, startLSN: 0x100, dir: prevDir},
+		{name: "before both", opts: Options{ToLSN: 0x50}, err: "target lsn 0/50 is before the base backup lsn 0/300"},
+	}
+
+	for _, tt := range tests {
+		r := New("public", "test", baseDir, pgx.ConnConfig{}, tt.opts)
+		err := r.loadInfo()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, expected %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not load info: %v", tt.name, err)
+		}
+
+		if r.startLSN != tt.startLSN {
+			t.Errorf("%s: base backup at %s, expected %s", tt.name, pgx.FormatLSN(r.startLSN), pgx.FormatLSN(tt.startLSN))
+		}
+		if r.dumpFilepath() != path.Join(tt.dir, "basebackup.copy") {
+			t.Errorf("%s: dump file %s, expected in %s", tt.name, r.dumpFilepath(), tt.dir)
+		}
+		if r.deltaDir() != path.Join(tableDir, "deltas") {
+			t.Errorf("%s: deltas dir %s, expected %s", tt.name, r.deltaDir(), path.Join(tableDir, "deltas"))
+		}
+	}
+}
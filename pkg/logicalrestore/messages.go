@@ -0,0 +1,78 @@
+package logicalrestore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+type logicalMessage struct {
+	message.JSONLogicalMessage
+	pos uint64
+}
+
+// loadMessages reads the logical decoding messages stored after the base
+// backup and up to the target lsn, ordered by their position
+func (r *LogicalRestore) loadMessages() error {
+	fp, err := os.Open(path.Join(r.baseDir, message.MessagesFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	sc := bufio.NewScanner(fp)
+	sc.Buffer(nil, 1024*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+
+		var m logicalMessage
+		if err := json.Unmarshal(sc.Bytes(), &m.JSONLogicalMessage); err != nil {
+			// cut off by a crash
+			continue
+		}
+		if m.pos, err = m.Position(); err != nil {
+			return fmt.Errorf("could not parse lsn: %v", err)
+		}
+
+		if m.pos > r.startLSN && (r.ToLSN == 0 || m.pos <= r.ToLSN) {
+			r.messages = append(r.messages, m)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read file: %v", err)
+	}
+
+	sort.SliceStable(r.messages, func(i, j int) bool { return r.messages[i].pos < r.messages[j].pos })
+
+	return nil
+}
+
+// deliverMessages passes the messages positioned up to the lsn to the hook,
+// once the changes before them are applied
+func (r *LogicalRestore) deliverMessages(lsn uint64) error {
+	if len(r.messages) == 0 || r.messages[0].pos > lsn {
+		return nil
+	}
+
+	if err := r.flushInserts(); err != nil {
+		return err
+	}
+
+	for len(r.messages) > 0 && r.messages[0].pos <= lsn {
+		if err := r.MessageHook(r.messages[0].JSONLogicalMessage); err != nil {
+			return fmt.Errorf("logical message hook failed at %s: %v", r.messages[0].LSN, err)
+		}
+		r.messages = r.messages[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package logicalrestore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/decoder"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// MultiRestore restores several tables in a single transaction, replaying
+// their deltas merged into one stream ordered by the commit lsn, so that the
+// changes of a transaction touching several tables are applied together. The
+// deferrable constraints, i.e. the foreign keys between the tables, are
+// deferred and checked after each transaction once every table is past its
+// base backup; before that the tables are at different points.
+type MultiRestore struct {
+	Options
+
+	tables  []*LogicalRestore // in the order given, which the changes of a transaction are applied in
+	streams []*deltaStream
+
+	tx  *pgx.Tx
+	cfg pgx.ConnConfig
+
+	consistentLSN uint64 // the latest base backup of the tables
+}
+
+// deltaStream reads the transactions of a table from its delta files
+type deltaStream struct {
+	r     *LogicalRestore
+	files []string
+	fp    *os.File
+	dr    *decoder.DeltaReader
+	begin *message.Begin // of the next transaction, nil once the deltas are over
+}
+
+func NewMulti(tables []message.Identifier, dir string, cfg pgx.ConnConfig, opts Options) *MultiRestore {
+	m := &MultiRestore{
+		Options: opts,
+		cfg:     cfg,
+	}
+	for _, t := range tables {
+		m.tables = append(m.tables, New(t.Namespace, t.Name, dir, cfg, opts))
+	}
+
+	return m
+}
+
+func (m *MultiRestore) Restore() error {
+	if m.Subscription != "" || m.MessageHook != nil {
+		return fmt.Errorf("the subscription and the message hook are not supported when restoring several tables")
+	}
+
+	conn, err := pgx.Connect(m.cfg)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, m.cfg))
+	}
+	defer conn.Close()
+
+	for _, r := range m.tables {
+		r.conn = conn
+		if err := r.loadInfo(); err != nil {
+			return fmt.Errorf("could not load dump info of %s: %v", r.Identifier, err)
+		}
+		if err := r.checkTransforms(); err != nil {
+			return fmt.Errorf("could not transform %s: %v", r.Identifier, err)
+		}
+		if r.startLSN > m.consistentLSN {
+			m.consistentLSN = r.startLSN
+		}
+	}
+	log.Printf("the tables are consistent from %s", pgx.FormatLSN(m.consistentLSN))
+
+	if m.tx, err = conn.Begin(); err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer m.tx.Rollback()
+
+	if _, err := m.tx.Exec("set constraints all deferred"); err != nil {
+		return fmt.Errorf("could not defer constraints: %v", err)
+	}
+
+	for _, r := range m.tables {
+		r.tx = m.tx
+		if err := m.loadTable(r); err != nil {
+			return fmt.Errorf("could not load %s: %v", r.Identifier, err)
+		}
+	}
+
+	if err := m.applyDeltas(); err != nil {
+		return fmt.Errorf("could not apply deltas: %v", err)
+	}
+
+	if !m.SkipSequences {
+		for _, r := range m.tables {
+			if err := r.setSequences(); err != nil {
+				return fmt.Errorf("could not set sequences: %v", err)
+			}
+		}
+	}
+
+	if err := m.tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (m *MultiRestore) loadTable(r *LogicalRestore) error {
+	if r.CreateTable {
+		if err := r.createTable(); err != nil {
+			return fmt.Errorf("could not create table: %v", err)
+		}
+	}
+
+	if err := r.checkTableStruct(); err != nil {
+		return fmt.Errorf("table struct error: %v", err)
+	}
+
+	if err := r.checkServerVersion(); err != nil {
+		return err
+	}
+
+	if err := r.loadDump(); err != nil {
+		return fmt.Errorf("could not load dump: %v", err)
+	}
+
+	if r.CreateTable {
+		if err := r.finishTable(); err != nil {
+			return fmt.Errorf("could not create constraints and indexes: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// applyDeltas applies the transactions of all tables in the order of their
+// final lsn; the parts of a transaction in the deltas of several tables share it
+func (m *MultiRestore) applyDeltas() error {
+	defer func() {
+		for _, s := range m.streams {
+			s.close()
+		}
+	}()
+
+	for _, r := range m.tables {
+		files, err := DeltaFiles(r.deltaDir())
+		if err != nil {
+			return err
+		}
+
+		s := &deltaStream{r: r, files: files}
+		if err := s.readAhead(); err != nil {
+			return fmt.Errorf("could not read deltas of %s: %v", r.Identifier, err)
+		}
+		m.streams = append(m.streams, s)
+	}
+
+	for {
+		var lsn uint64
+		for _, s := range m.streams {
+			if s.begin != nil && (lsn == 0 || s.begin.FinalLSN < lsn) {
+				lsn = s.begin.FinalLSN
+			}
+		}
+		if lsn == 0 || m.ToLSN != 0 && lsn > m.ToLSN {
+			return nil
+		}
+
+		for _, s := range m.streams {
+			if s.begin == nil || s.begin.FinalLSN != lsn {
+				continue
+			}
+			if err := s.applyTx(); err != nil {
+				return fmt.Errorf("could not apply transaction %s to %s: %v", pgx.FormatLSN(lsn), s.r.Identifier, err)
+			}
+		}
+
+		if lsn > m.consistentLSN {
+			if _, err := m.tx.Exec("set constraints all immediate"); err != nil {
+				return fmt.Errorf("constraints violated after transaction %s: %v", pgx.FormatLSN(lsn), err)
+			}
+			if _, err := m.tx.Exec("set constraints all deferred"); err != nil {
+				return fmt.Errorf("could not defer constraints: %v", err)
+			}
+		}
+	}
+}
+
+// next returns the next message of the table, moving on to the next file at
+// the end of the current one
+func (s *deltaStream) next() (message.Message, error) {
+	for {
+		if s.dr == nil {
+			if len(s.files) == 0 {
+				return nil, io.EOF
+			}
+
+			filePath := path.Join(s.r.deltaDir(), s.files[0])
+			s.files = s.files[1:]
+			log.Printf("reading %q delta file", filePath)
+
+			fp, err := os.Open(filePath)
+			if err != nil {
+				return nil, fmt.Errorf("could not open file: %v", err)
+			}
+			dr, err := decoder.NewDeltaReader(fp)
+			if err != nil {
+				fp.Close()
+				return nil, err
+			}
+			s.fp, s.dr = fp, dr
+		}
+
+		msg, err := s.dr.Next()
+		if err == io.EOF {
+			s.close()
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read %s delta: %v", s.dr.Format(), err)
+		}
+
+		return msg, nil
+	}
+}
+
+// readAhead applies the messages up to the begin of the next transaction
+func (s *deltaStream) readAhead() error {
+	s.begin = nil
+	for {
+		msg, err := s.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if b, ok := msg.(message.Begin); ok {
+			s.begin = &b
+			return nil
+		}
+		if err := s.r.applyMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// applyTx applies the transaction starting with the begin read ahead. The one
+// interrupted by the restart of the backup is streamed again from its begin,
+// which ends the current one.
+func (s *deltaStream) applyTx() error {
+	if err := s.r.applyMessage(*s.begin); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := s.next()
+		if err == io.EOF {
+			s.begin = nil
+			return s.r.flushInserts()
+		} else if err != nil {
+			return err
+		}
+
+		if b, ok := msg.(message.Begin); ok {
+			s.begin = &b
+			return s.r.flushInserts()
+		}
+		if err := s.r.applyMessage(msg); err != nil {
+			return err
+		}
+
+		if _, ok := msg.(message.Commit); ok {
+			if err := s.r.flushInserts(); err != nil {
+				return err
+			}
+			return s.readAhead()
+		}
+	}
+}
+
+func (s *deltaStream) close() {
+	if s.fp != nil {
+		s.fp.Close()
+	}
+	s.fp, s.dr = nil, nil
+}
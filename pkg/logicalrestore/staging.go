@@ -0,0 +1,141 @@
+package logicalrestore
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// stagingRows tracks the rows restored into the staging table, to check its
+// row count before the swap: the rows of the dump, known from the footers of
+// the files if any, and the inserts and deletes applied from the deltas; a
+// truncate leaves only the changes applied after it
+type stagingRows struct {
+	dump    int64
+	loaded  int64
+	inserts int64
+	deletes int64
+}
+
+// createStaging creates the staging table like the table, with its columns,
+// defaults, constraints and indexes, and restores into it instead
+func (r *LogicalRestore) createStaging() error {
+	if r.CreateTable {
+		return fmt.Errorf("the staging table is created like the existing table, it can't be combined with creating the table")
+	}
+	if r.target != r.Identifier {
+		return fmt.Errorf("%s is restored into %s, it can't be staged", r.Identifier, r.target)
+	}
+	if r.Subscription != "" {
+		return fmt.Errorf("the subscription continues into the table, it can't be staged")
+	}
+
+	staging := message.Identifier{Namespace: r.Namespace, Name: r.Staging}
+	log.Printf("restoring %s into the staging table %s", r.Identifier, staging)
+	if _, err := r.tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", staging.Sanitize(), r.Identifier.Sanitize())); err != nil {
+		return fmt.Errorf("could not create staging table: %v", err)
+	}
+	r.target = staging
+
+	return nil
+}
+
+func (r *LogicalRestore) stagingCount() (int64, error) {
+	var n int64
+	if err := r.tx.QueryRow(fmt.Sprintf("select count(*) from %s", r.target.Sanitize())).Scan(&n); err != nil {
+		return 0, fmt.Errorf("could not count rows of %s: %v", r.target, err)
+	}
+
+	return n, nil
+}
+
+// checkStagingDump checks that the staging table got all the rows of the dump
+func (r *LogicalRestore) checkStagingDump() error {
+	n, err := r.stagingCount()
+	if err != nil {
+		return err
+	}
+
+	if r.footers && n != r.stagingRows.dump {
+		return fmt.Errorf("staging table %s has %d rows, the base backup has %d", r.target, n, r.stagingRows.dump)
+	}
+	r.stagingRows.loaded = n
+
+	return nil
+}
+
+// checkStaging checks the row count of the staging table against the rows of
+// the dump and the changes applied since, and swaps it with the table if asked:
+// the table is renamed to <name>_old_<unix time>, kept for the rollback, and
+// the staging table takes its name, both in the restore transaction
+func (r *LogicalRestore) checkStaging() error {
+	n, err := r.stagingCount()
+	if err != nil {
+		return err
+	}
+
+	s := r.stagingRows
+	if expected := s.loaded + s.inserts - s.deletes; n != expected {
+		return fmt.Errorf("staging table %s has %d rows, expected %d: %d of the base backup, %d inserted and %d deleted",
+			r.target, n, expected, s.loaded, s.inserts, s.deletes)
+	}
+	log.Printf("staging table %s has %d rows: %d of the base backup, %d inserted and %d deleted",
+		r.target, n, s.loaded, s.inserts, s.deletes)
+
+	if !r.Swap {
+		return nil
+	}
+
+	old := fmt.Sprintf("%s_old_%d", r.Name, time.Now().Unix())
+	log.Printf("swapping %s with %s, keeping the table as %s", r.target, r.Identifier, old)
+
+	ownedBy, err := r.stagingOwnedBy()
+	if err != nil {
+		return err
+	}
+
+	return r.execAll(append([]string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", r.Identifier.Sanitize(), pgx.Identifier{old}.Sanitize()),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", r.target.Sanitize(), pgx.Identifier{r.Name}.Sanitize()),
+	}, ownedBy...))
+}
+
+// stagingOwnedBy returns the statements moving the serial sequences owned by
+// the table to the staging one once swapped: its columns default to them, as
+// they are copied along with the defaults, and would be dropped with the old
+// table otherwise. The identity ones are created for the staging table.
+func (r *LogicalRestore) stagingOwnedBy() ([]string, error) {
+	rows, err := r.tx.Query(fmt.Sprintf(`select format('%%I.%%I', n.nspname, s.relname), a.attname
+from pg_catalog.pg_depend d
+join pg_catalog.pg_class s on s.oid = d.objid and s.relkind = 'S'
+join pg_catalog.pg_namespace n on n.oid = s.relnamespace
+join pg_catalog.pg_attribute a on a.attrelid = d.refobjid and a.attnum = d.refobjsubid
+where d.classid = 'pg_catalog.pg_class'::regclass and d.refobjid = %s::regclass and d.deptype = 'a'
+order by a.attnum`, dbutils.QuoteLiteral(r.Identifier.Sanitize())))
+	if err != nil {
+		return nil, fmt.Errorf("could not query sequences: %v", err)
+	}
+	defer rows.Close()
+
+	var stmts []string
+	for rows.Next() {
+		var seq, column string
+		if err := rows.Scan(&seq, &column); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		// the staging table has the name of the table by then
+		stmts = append(stmts, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s",
+			seq, r.Identifier.Sanitize(), pgx.Identifier{column}.Sanitize()))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch sequences: %v", err)
+	}
+
+	return stmts, nil
+}
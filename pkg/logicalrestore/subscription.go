@@ -0,0 +1,113 @@
+package logicalrestore
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+)
+
+// subscriptionStatements returns the statements creating the subscription
+// which continues from the base backup: it uses the existing slot, without
+// copying the data, and starts streaming the transactions committed after the
+// consistent point of the base backup
+func (r *LogicalRestore) subscriptionStatements() []string {
+	name := pgx.Identifier{r.Subscription}.Sanitize()
+
+	return []string{
+		fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s WITH (copy_data = false, create_slot = false, slot_name = %s, enabled = false)",
+			name, dbutils.QuoteLiteral(r.Publisher), pgx.Identifier{r.Publication}.Sanitize(), dbutils.QuoteLiteral(r.SubscriptionSlot)),
+		fmt.Sprintf("SELECT pg_replication_origin_advance('pg_' || oid, %s) FROM pg_subscription WHERE subname = %s",
+			dbutils.QuoteLiteral(pgx.FormatLSN(r.startLSN)), dbutils.QuoteLiteral(r.Subscription)),
+		fmt.Sprintf("ALTER SUBSCRIPTION %s ENABLE", name),
+	}
+}
+
+// checkPublisher makes sure the slot on the publisher still has the changes
+// after the base backup and the publication has the table
+func (r *LogicalRestore) checkPublisher() error {
+	if r.dumpFormat == config.DumpFormatDeltasOnly {
+		return fmt.Errorf("the table backup has no base backup to start the subscription from")
+	}
+
+	cfg, err := pgx.ParseConnectionString(r.Publisher)
+	if err != nil {
+		return fmt.Errorf("could not parse publisher connection string: %v", err)
+	}
+
+	conn, err := pgx.Connect(cfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to publisher: %v", dbutils.RedactPassword(err, cfg))
+	}
+	defer conn.Close()
+
+	var (
+		plugin, slotType, lsnString string
+		active                      bool
+	)
+	row := conn.QueryRow("select coalesce(plugin, ''), slot_type, coalesce(confirmed_flush_lsn::text, ''), active from pg_replication_slots where slot_name = $1",
+		r.SubscriptionSlot)
+	if err := row.Scan(&plugin, &slotType, &lsnString, &active); err == pgx.ErrNoRows {
+		return fmt.Errorf("replication slot %q does not exist on the publisher", r.SubscriptionSlot)
+	} else if err != nil {
+		return fmt.Errorf("could not fetch replication slot: %v", err)
+	}
+
+	if slotType != "logical" || plugin != "pgoutput" {
+		return fmt.Errorf("replication slot %q is not a logical pgoutput slot", r.SubscriptionSlot)
+	}
+	if active {
+		return fmt.Errorf("replication slot %q is in use", r.SubscriptionSlot)
+	}
+
+	lsn, err := pgx.ParseLSN(lsnString)
+	if err != nil {
+		return fmt.Errorf("could not parse lsn: %v", err)
+	}
+	if lsn > r.startLSN {
+		return fmt.Errorf("replication slot %q is at %s, past the base backup lsn %s: the changes in between are not available",
+			r.SubscriptionSlot, lsnString, pgx.FormatLSN(r.startLSN))
+	}
+
+	var tables int
+	var published bool
+	row = conn.QueryRow("select count(*), coalesce(bool_or(schemaname = $2 and tablename = $3), false) from pg_publication_tables where pubname = $1",
+		r.Publication, r.Namespace, r.Name)
+	if err := row.Scan(&tables, &published); err != nil {
+		return fmt.Errorf("could not fetch publication tables: %v", err)
+	}
+
+	if !published {
+		return fmt.Errorf("publication %q does not have %s", r.Publication, r.Identifier)
+	}
+	if tables > 1 {
+		log.Printf("publication %q has %d tables, the subscription streams the changes of all of them", r.Publication, tables)
+	}
+
+	return nil
+}
+
+// subscribe creates the subscription continuing from the restored base
+// backup, or prints its statements
+func (r *LogicalRestore) subscribe() error {
+	stmts := r.subscriptionStatements()
+
+	if r.PrintSubscription {
+		for _, stmt := range stmts {
+			fmt.Printf("%s;\n", stmt)
+		}
+		return nil
+	}
+
+	for _, stmt := range stmts {
+		if _, err := r.conn.Exec(stmt); err != nil {
+			return fmt.Errorf("could not execute %q: %v", stmt, err)
+		}
+	}
+	log.Printf("subscription %q streams the changes of %s after %s", r.Subscription, r.Identifier, pgx.FormatLSN(r.startLSN))
+
+	return nil
+}
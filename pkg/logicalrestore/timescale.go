@@ -0,0 +1,54 @@
+package logicalrestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/tablebackup"
+)
+
+// HypertableChunks lists the chunks of the TimescaleDB hypertable backed up
+// in the archive dir, to be restored together into the hypertable
+func HypertableChunks(dir string, hypertable message.Identifier) ([]message.Identifier, error) {
+	chunks := make([]message.Identifier, 0)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == tablebackup.PreviousDir {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() || fi.Name() != "info.yaml" {
+			return nil
+		}
+
+		fp, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("could not open file: %v", err)
+		}
+		defer fp.Close()
+
+		var info message.DumpInfo
+		if err := yaml.NewDecoder(fp).Decode(&info); err != nil {
+			return fmt.Errorf("could not decode %q: %v", p, err)
+		}
+		if info.Hypertable != nil && *info.Hypertable == hypertable {
+			chunks = append(chunks, info.Relation.Identifier)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk archive dir: %v", err)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Name < chunks[j].Name })
+
+	return chunks, nil
+}
@@ -0,0 +1,249 @@
+package logicalrestore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// Transform rewrites a non-null column value while restoring, i.e. to mask the
+// personal data in a non-production copy. It must be deterministic: with the
+// replica identity full the old values of the updated and deleted rows are
+// transformed as well to find the rows restored before.
+type Transform func(value []byte) []byte
+
+// BuiltinTransforms are the transforms available by name, see the -transform
+// flag of the restore
+var BuiltinTransforms = map[string]Transform{
+	"hash":   hashValue,
+	"email":  maskEmail,
+	"redact": redactValue,
+}
+
+// hashValue replaces the value with the hex of its sha256
+func hashValue(value []byte) []byte {
+	sum := sha256.Sum256(value)
+
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// maskEmail replaces the local part of the address with its hash, keeping the
+// domain
+func maskEmail(value []byte) []byte {
+	at := bytes.LastIndexByte(value, '@')
+	if at < 0 {
+		return hashValue(value)
+	}
+
+	return append(hashValue(value[:at])[:16], value[at:]...)
+}
+
+// redactValue replaces every character of the value with x
+func redactValue(value []byte) []byte {
+	return bytes.Repeat([]byte{'x'}, utf8.RuneCount(value))
+}
+
+// checkTransforms makes sure the transforms can be applied to the table
+func (r *LogicalRestore) checkTransforms() error {
+	if len(r.Transforms) == 0 {
+		return nil
+	}
+
+	if r.Subscription != "" {
+		return fmt.Errorf("the changes streamed by the subscription can't be transformed")
+	}
+
+	switch r.dumpFormat {
+	case "", config.BasebackupFormatCopy, config.BasebackupFormatSQL, config.DumpFormatDeltasOnly:
+	default:
+		return fmt.Errorf("the base backups in the %s format can't be transformed", r.dumpFormat)
+	}
+
+	columns := make(map[string]struct{})
+	for _, c := range r.relInfo.Columns {
+		columns[c.Name] = struct{}{}
+	}
+	for name := range r.Transforms {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("no column %q to transform", name)
+		}
+	}
+
+	return nil
+}
+
+// transformRow applies the transforms to the values of the row. The columns of
+// the replica identity can't be transformed: the updates and deletes find the
+// rows by their values.
+func (r *LogicalRestore) transformRow(rel message.Relation, row []message.Tuple) error {
+	for i, c := range rel.Columns {
+		fn, ok := r.Transforms[c.Name]
+		if !ok {
+			continue
+		}
+		if c.IsKey {
+			return fmt.Errorf("column %q is part of the replica identity, it can't be transformed", c.Name)
+		}
+
+		if i < len(row) && row[i].Kind == message.TextValue {
+			row[i].Value = fn(row[i].Value)
+		}
+	}
+
+	return nil
+}
+
+// transformCopy returns the reader of the COPY data in the text format with
+// the transforms applied to the rows read from rd
+func (r *LogicalRestore) transformCopy(rd io.Reader, opts *message.CopyOptions) io.Reader {
+	if len(r.Transforms) == 0 {
+		return rd
+	}
+
+	delimiter, null := byte('\t'), `\N`
+	if opts != nil {
+		if opts.Delimiter != "" {
+			delimiter = opts.Delimiter[0]
+		}
+		if opts.Null != "" {
+			null = opts.Null
+		}
+	}
+
+	// the columns in the order of the dump, the generated and the skipped ones
+	// are not there
+	fns := make([]Transform, 0, len(r.relInfo.Columns))
+	for _, c := range r.relInfo.Replicated().Columns {
+		if !c.Skipped {
+			fns = append(fns, r.Transforms[c.Name])
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(rd)
+		bw := bufio.NewWriter(pw)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				bw.Write(transformCopyLine(line, delimiter, null, fns))
+			}
+			if err == io.EOF {
+				pw.CloseWithError(bw.Flush())
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return pr
+}
+
+// transformCopyLine applies the transforms to the fields of the line in the
+// text COPY format, re-escaping the transformed ones
+func transformCopyLine(line []byte, delimiter byte, null string, fns []Transform) []byte {
+	eol := []byte{}
+	if bytes.HasSuffix(line, []byte{'\n'}) {
+		line, eol = line[:len(line)-1], []byte{'\n'}
+	}
+
+	// the delimiter is always escaped inside the values
+	fields := bytes.Split(line, []byte{delimiter})
+	for i, field := range fields {
+		if i >= len(fns) || fns[i] == nil || string(field) == null {
+			continue
+		}
+
+		fields[i] = copyEscape(fns[i](copyUnescape(field)), delimiter)
+	}
+
+	return append(bytes.Join(fields, []byte{delimiter}), eol...)
+}
+
+func copyUnescape(field []byte) []byte {
+	if bytes.IndexByte(field, '\\') < 0 {
+		return field
+	}
+
+	res := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i == len(field)-1 {
+			res = append(res, field[i])
+			continue
+		}
+
+		i++
+		switch c := field[i]; c {
+		case 'b':
+			res = append(res, '\b')
+		case 'f':
+			res = append(res, '\f')
+		case 'n':
+			res = append(res, '\n')
+		case 'r':
+			res = append(res, '\r')
+		case 't':
+			res = append(res, '\t')
+		case 'v':
+			res = append(res, '\v')
+		case 'x':
+			j := i + 1
+			for j < len(field) && j < i+3 && isHex(field[j]) {
+				j++
+			}
+			if j == i+1 {
+				res = append(res, c)
+				break
+			}
+			v, _ := strconv.ParseUint(string(field[i+1:j]), 16, 8)
+			res = append(res, byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(field) && j < i+3 && field[j] >= '0' && field[j] <= '7' {
+				j++
+			}
+			v, _ := strconv.ParseUint(string(field[i:j]), 8, 16)
+			res = append(res, byte(v))
+			i = j - 1
+		default:
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func copyEscape(value []byte, delimiter byte) []byte {
+	res := make([]byte, 0, len(value))
+	for _, c := range value {
+		switch c {
+		case '\\':
+			res = append(res, '\\', '\\')
+		case '\n':
+			res = append(res, '\\', 'n')
+		case '\r':
+			res = append(res, '\\', 'r')
+		case delimiter:
+			res = append(res, '\\', c)
+		default:
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,250 @@
+package message
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// JSONColumn is a column value of the JSON delta
+type JSONColumn struct {
+	Name      string  `json:"name"`
+	Value     *string `json:"value"`               // nil for null
+	Unchanged bool    `json:"unchanged,omitempty"` // unchanged toasted value, not sent by the server
+}
+
+// JSONRelation describes the table the following JSON deltas belong to
+type JSONRelation struct {
+	OID             uint32          `json:"oid"`
+	Namespace       string          `json:"namespace"`
+	Name            string          `json:"name"`
+	ReplicaIdentity ReplicaIdentity `json:"replicaIdentity"`
+	Columns         []Column        `json:"columns"`
+}
+
+// JSONDelta is a single message of the newline-delimited JSON delta format.
+// Column values are listed in the order of the relation columns.
+type JSONDelta struct {
+	Op          string        `json:"op"`
+	LSN         string        `json:"lsn,omitempty"`    // final lsn for begin, commit lsn for commit
+	EndLSN      string        `json:"endLSN,omitempty"` // end of the transaction, commit only
+	XID         int32         `json:"xid,omitempty"`
+	CommitTime  *time.Time    `json:"commitTime,omitempty"` // begin and commit, or every change with the commit info
+	RelationOID uint32        `json:"relationOID,omitempty"`
+	Relation    *JSONRelation `json:"relation,omitempty"`
+	Key         []JSONColumn  `json:"key,omitempty"`     // replica identity index columns of update and delete
+	Old         []JSONColumn  `json:"old,omitempty"`     // old row of update and delete with replica identity full
+	Columns     []JSONColumn  `json:"columns,omitempty"` // new row of insert and update
+
+	// truncate only: all the tables truncated together and the options
+	RelationOIDs    []uint32 `json:"relationOIDs,omitempty"`
+	Cascade         bool     `json:"cascade,omitempty"`
+	RestartIdentity bool     `json:"restartIdentity,omitempty"`
+}
+
+const (
+	OpBegin    = "begin"
+	OpCommit   = "commit"
+	OpRelation = "relation"
+	OpInsert   = "insert"
+	OpUpdate   = "update"
+	OpDelete   = "delete"
+	OpTruncate = "truncate"
+)
+
+func jsonColumns(tuples []Tuple, rel Relation) []JSONColumn {
+	res := make([]JSONColumn, len(tuples))
+	for i, t := range tuples {
+		if i < len(rel.Columns) {
+			res[i].Name = rel.Columns[i].Name
+		}
+
+		switch t.Kind {
+		case TextValue:
+			val := string(t.Value)
+			res[i].Value = &val
+		case ToastedValue:
+			res[i].Unchanged = true
+		}
+	}
+
+	return res
+}
+
+func jsonTuples(cols []JSONColumn) []Tuple {
+	res := make([]Tuple, len(cols))
+	for i, c := range cols {
+		switch {
+		case c.Unchanged:
+			res[i] = Tuple{Kind: ToastedValue, Value: []byte{}}
+		case c.Value == nil:
+			res[i] = Tuple{Kind: NullValue, Value: []byte{}}
+		default:
+			res[i] = Tuple{Kind: TextValue, Value: []byte(*c.Value)}
+		}
+	}
+
+	return res
+}
+
+// NewJSONDelta converts the message to its JSON form; rel is the relation of
+// the data-modifying messages. Returns nil for the messages that aren't
+// needed to restore the table, such as types and origins.
+func NewJSONDelta(m Message, rel Relation) *JSONDelta {
+	switch v := m.(type) {
+	case Begin:
+		return &JSONDelta{Op: OpBegin, LSN: pgx.FormatLSN(v.FinalLSN), XID: v.XID, CommitTime: timePtr(v.Timestamp)}
+	case Commit:
+		return &JSONDelta{Op: OpCommit, LSN: pgx.FormatLSN(v.LSN), EndLSN: pgx.FormatLSN(v.TransactionLSN), CommitTime: timePtr(v.Timestamp)}
+	case Relation:
+		return &JSONDelta{Op: OpRelation, RelationOID: v.OID, Relation: &JSONRelation{
+			OID:             v.OID,
+			Namespace:       v.Namespace,
+			Name:            v.Name,
+			ReplicaIdentity: v.ReplicaIdentity,
+			Columns:         v.Columns,
+		}}
+	case Insert:
+		return &JSONDelta{Op: OpInsert, RelationOID: v.RelationOID, Columns: jsonColumns(v.NewRow, rel)}
+	case Update:
+		d := &JSONDelta{Op: OpUpdate, RelationOID: v.RelationOID, Columns: jsonColumns(v.NewRow, rel)}
+		if v.IsKey {
+			d.Key = jsonColumns(v.OldRow, rel)
+		} else if v.IsOld {
+			d.Old = jsonColumns(v.OldRow, rel)
+		}
+
+		return d
+	case Delete:
+		d := &JSONDelta{Op: OpDelete, RelationOID: v.RelationOID}
+		if v.IsKey {
+			d.Key = jsonColumns(v.OldRow, rel)
+		} else {
+			d.Old = jsonColumns(v.OldRow, rel)
+		}
+
+		return d
+	case Truncate:
+		return &JSONDelta{Op: OpTruncate, RelationOIDs: v.RelationOIDs, Cascade: v.Cascade, RestartIdentity: v.RestartIdentity}
+	}
+
+	return nil
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// SetCommitInfo adds the xid and the commit timestamp of the transaction to
+// the data-modifying delta
+func (d *JSONDelta) SetCommitInfo(begin Begin) {
+	switch d.Op {
+	case OpInsert, OpUpdate, OpDelete, OpTruncate:
+		d.XID = begin.XID
+		d.CommitTime = timePtr(begin.Timestamp)
+	}
+}
+
+// Message converts the JSON delta back to the message it was created from
+func (d JSONDelta) Message() (Message, error) {
+	var (
+		lsn, endLSN uint64
+		err         error
+	)
+
+	if d.LSN != "" {
+		if lsn, err = pgx.ParseLSN(d.LSN); err != nil {
+			return nil, fmt.Errorf("could not parse lsn: %v", err)
+		}
+	}
+
+	if d.EndLSN != "" {
+		if endLSN, err = pgx.ParseLSN(d.EndLSN); err != nil {
+			return nil, fmt.Errorf("could not parse end lsn: %v", err)
+		}
+	}
+
+	var ts time.Time
+	if d.CommitTime != nil {
+		ts = *d.CommitTime
+	}
+
+	switch d.Op {
+	case OpBegin:
+		return Begin{FinalLSN: lsn, XID: d.XID, Timestamp: ts}, nil
+	case OpCommit:
+		return Commit{LSN: lsn, TransactionLSN: endLSN, Timestamp: ts}, nil
+	case OpRelation:
+		if d.Relation == nil {
+			return nil, fmt.Errorf("relation message without relation")
+		}
+
+		return Relation{
+			Identifier:      Identifier{Namespace: d.Relation.Namespace, Name: d.Relation.Name},
+			OID:             d.Relation.OID,
+			ReplicaIdentity: d.Relation.ReplicaIdentity,
+			Columns:         d.Relation.Columns,
+		}, nil
+	case OpInsert:
+		return Insert{RelationOID: d.RelationOID, IsNew: true, NewRow: jsonTuples(d.Columns)}, nil
+	case OpUpdate:
+		m := Update{RelationOID: d.RelationOID, IsNew: true, NewRow: jsonTuples(d.Columns)}
+		if d.Key != nil {
+			m.IsKey = true
+			m.OldRow = jsonTuples(d.Key)
+		} else if d.Old != nil {
+			m.IsOld = true
+			m.OldRow = jsonTuples(d.Old)
+		}
+
+		return m, nil
+	case OpDelete:
+		m := Delete{RelationOID: d.RelationOID}
+		if d.Key != nil {
+			m.IsKey = true
+			m.OldRow = jsonTuples(d.Key)
+		} else {
+			m.IsOld = true
+			m.OldRow = jsonTuples(d.Old)
+		}
+
+		return m, nil
+	case OpTruncate:
+		return Truncate{
+			Relations:       uint32(len(d.RelationOIDs)),
+			RelationOIDs:    d.RelationOIDs,
+			Cascade:         d.Cascade,
+			RestartIdentity: d.RestartIdentity,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown delta operation %q", d.Op)
+}
+
+// MessagesFilename is the file in the archive dir with the logical decoding
+// messages, one JSONLogicalMessage per line
+const MessagesFilename = "messages.json"
+
+// JSONLogicalMessage is the stored logical decoding message
+type JSONLogicalMessage struct {
+	LSN           string `json:"lsn"`             // of the message record
+	TxLSN         string `json:"txLSN,omitempty"` // final lsn of the transaction of the transactional message
+	Transactional bool   `json:"transactional"`
+	Prefix        string `json:"prefix"`
+	Content       []byte `json:"content"`
+}
+
+// Position returns the lsn the message is ordered by relative to the
+// transactions: the final lsn of its transaction, if transactional
+func (m JSONLogicalMessage) Position() (uint64, error) {
+	if m.TxLSN != "" {
+		return pgx.ParseLSN(m.TxLSN)
+	}
+
+	return pgx.ParseLSN(m.LSN)
+}
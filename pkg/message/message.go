@@ -2,6 +2,7 @@ package message
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -37,10 +38,129 @@ type ReplicaIdentity uint8
 type TupleKind uint8
 
 type DumpInfo struct {
-	StartLSN       string    `json:"LSN"`
-	CreateDate     time.Time `json:"CreateDate"`
-	Relation       Relation  `json:"Relation"`
-	BackupDuration float64   `json:"BackupDuration"`
+	StartLSN       string       `json:"LSN"`
+	CreateDate     time.Time    `json:"CreateDate"`
+	Relation       Relation     `json:"Relation"`
+	BackupDuration float64      `json:"BackupDuration"`
+	Parts          []string     `json:"Parts"`      // files of a parallel dump, relative to the table dir
+	Format         string       `json:"Format"`     // copy or sql; empty means copy
+	Sequences      []Sequence   `json:"Sequences"`  // sequences owned by the table columns
+	InsertOnly     bool         `json:"InsertOnly"` // replica identity nothing: updates and deletes are not in the deltas
+	DDL            *TableDDL    `json:"DDL" yaml:",omitempty"`
+	Operations     []string     `json:"Operations" yaml:",omitempty"`     // the only operations captured in the deltas, all if empty
+	CopyOptions    *CopyOptions `json:"CopyOptions" yaml:",omitempty"`    // of the text and csv dumps, the defaults if not set
+	SnapshotAction string       `json:"SnapshotAction" yaml:",omitempty"` // how the temp slot got the snapshot of the dump; noexport means no dump
+	Footers        bool         `json:"Footers" yaml:",omitempty"`        // the COPY dump files end with the footer, see tablebackup.Footer
+	Hypertable     *Identifier  `json:"Hypertable" yaml:",omitempty"`     // the TimescaleDB hypertable the table is a chunk of
+	ServerVersion  int          `json:"ServerVersion" yaml:",omitempty"`  // server_version_num the base backup was taken from
+	Schema         *TableSchema `json:"Schema" yaml:",omitempty"`         // the table schema at the time of the dump, see embedSchema
+}
+
+// BasebackupPointer is the latest file of the table archive, pointing to the
+// base backup archived most recently, all of its files complete
+type BasebackupPointer struct {
+	StartLSN   string    `yaml:"StartLSN"`
+	CreateDate time.Time `yaml:"CreateDate"`
+	Info       string    `yaml:"Info"`            // the info file, relative to the table dir
+	Files      []string  `yaml:"Files,omitempty"` // the dump files, none for the deltas only backup
+}
+
+// CopyOptions are the options of the COPY command of the base backups in the
+// text and csv formats; the empty ones have the PostgreSQL defaults
+type CopyOptions struct {
+	Delimiter string `yaml:"delimiter,omitempty"`
+	Null      string `yaml:"null,omitempty"`
+	Quote     string `yaml:"quote,omitempty"` // csv only
+	Encoding  string `yaml:"encoding,omitempty"`
+}
+
+// TableDDL is the definition of the table captured with the base backup. The
+// statements are split so that the restore may load the data in between.
+type TableDDL struct {
+	Sequences   []string `yaml:",omitempty"` // create the sequences used by the column defaults
+	CreateTable string
+	Constraints []string `yaml:",omitempty"` // primary key, unique, check and exclusion ones
+	Indexes     []string `yaml:",omitempty"` // the indexes not backing the constraints
+	OwnedBy     []string `yaml:",omitempty"` // tie the sequences to their columns
+	Parent      string   `yaml:",omitempty"` // partitioned table the table is a partition of
+	Partition   string   `yaml:",omitempty"` // attach the table to the parent
+}
+
+// TableSchema is the schema of the table captured with the base backup, for
+// the restore to detect the drift of the target table from it
+type TableSchema struct {
+	Columns     []SchemaColumn
+	Constraints map[string]string `yaml:",omitempty"` // definitions by name
+}
+
+type SchemaColumn struct {
+	Name    string
+	Type    string // format_type with the modifier
+	TypeOID uint32 // differs between the databases for the user-defined types, not compared
+	NotNull bool   `yaml:",omitempty"`
+}
+
+// Diff describes the differences of the target schema from the one of the
+// backup, none if they are the same
+func (s *TableSchema) Diff(target *TableSchema) []string {
+	diffs := make([]string, 0)
+
+	targetColumns := make(map[string]SchemaColumn)
+	for _, c := range target.Columns {
+		targetColumns[c.Name] = c
+	}
+	backupColumns := make(map[string]struct{})
+	for _, c := range s.Columns {
+		backupColumns[c.Name] = struct{}{}
+
+		tc, ok := targetColumns[c.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("column %q is missing", c.Name))
+		case tc.Type != c.Type:
+			diffs = append(diffs, fmt.Sprintf("column %q is of type %s, was %s", c.Name, tc.Type, c.Type))
+		case tc.NotNull && !c.NotNull:
+			diffs = append(diffs, fmt.Sprintf("column %q is not null, was nullable", c.Name))
+		}
+	}
+	for _, c := range target.Columns {
+		if _, ok := backupColumns[c.Name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("column %q is not in the backup", c.Name))
+		}
+	}
+
+	names := make([]string, 0)
+	for name := range s.Constraints {
+		names = append(names, name)
+	}
+	for name := range target.Constraints {
+		if _, ok := s.Constraints[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def, ok := s.Constraints[name]
+		targetDef, targetOk := target.Constraints[name]
+		switch {
+		case !targetOk:
+			diffs = append(diffs, fmt.Sprintf("constraint %q is missing", name))
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("constraint %q is not in the backup: %s", name, targetDef))
+		case def != targetDef:
+			diffs = append(diffs, fmt.Sprintf("constraint %q is %s, was %s", name, targetDef, def))
+		}
+	}
+
+	return diffs
+}
+
+// Sequence is the state of the sequence owned by the table column
+type Sequence struct {
+	Identifier
+	Column    string
+	LastValue int64
+	IsCalled  bool
 }
 
 type Message interface {
@@ -81,6 +201,14 @@ type Column struct {
 	TypeOID       uint32 // OID of the column's data type.
 	Mode          int32  // TypeOID modifier of the column (atttypmod).
 	FormattedType string
+
+	// Known from the catalog only, the relation messages don't carry them
+	IdentityAlways bool `yaml:",omitempty"` // GENERATED ALWAYS AS IDENTITY
+	Generated      bool `yaml:",omitempty"` // GENERATED ALWAYS AS (...) STORED, not replicated
+
+	// Of the unsupported types, see config.UnsupportedColumns
+	Raw     bool `yaml:",omitempty"` // stored as text, cast to FormattedType on restore
+	Skipped bool `yaml:",omitempty"` // not backed up, left to its default on restore
 }
 
 type Tuple struct {
@@ -153,6 +281,16 @@ type Truncate struct {
 	RelationOIDs    []uint32
 }
 
+// LogicalMessage is emitted with pg_logical_emit_message; the transactional
+// ones are only sent if their transaction commits
+type LogicalMessage struct {
+	Raw           []byte
+	Transactional bool
+	LSN           uint64 // of the message record
+	Prefix        string
+	Content       []byte
+}
+
 type Type struct {
 	Raw       []byte
 	ID        uint32 // OID of the data type
@@ -168,29 +306,115 @@ func (Delete) msg()   {}
 func (Commit) msg()   {}
 func (Origin) msg()   {}
 func (Type) msg()     {}
-func (Truncate) msg() {}
 
-func (tr Truncate) SQL() string {
-	//TODO
+func (LogicalMessage) msg() {}
+func (Truncate) msg()       {}
+
+// SQL returns the truncate of the relation, one of the truncated ones
+func (tr Truncate) SQL(rel Relation) string {
+	options := ""
+	if tr.RestartIdentity {
+		options += " restart identity"
+	}
+	if tr.Cascade {
+		options += " cascade"
+	}
+
+	return fmt.Sprintf("truncate table %s%s;", pgx.Identifier{rel.Namespace, rel.Name}.Sanitize(), options)
+}
+
+// SelectColumns returns the select list of the columns stored in the dump:
+// the generated columns can't be loaded and the skipped ones are not backed
+// up, so if there are any, the rest of the columns are listed explicitly
+func (rel Relation) SelectColumns() string {
+	names := make([]string, 0)
+	omitted := false
+	for _, v := range rel.Columns {
+		if v.Generated || v.Skipped {
+			omitted = true
+			continue
+		}
+		names = append(names, pgx.Identifier{v.Name}.Sanitize())
+	}
+
+	if !omitted {
+		return "*"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// CopyColumns returns the column list for the COPY of the table, if needed
+func (rel Relation) CopyColumns() string {
+	if columns := rel.SelectColumns(); columns != "*" {
+		return fmt.Sprintf(" (%s)", columns)
+	}
+
 	return ""
 }
 
+// Replicated returns the relation with the columns sent by the logical replication
+func (rel Relation) Replicated() Relation {
+	columns := make([]Column, 0, len(rel.Columns))
+	for _, v := range rel.Columns {
+		if !v.Generated {
+			columns = append(columns, v)
+		}
+	}
+	rel.Columns = columns
+
+	return rel
+}
+
+// literal returns the sql literal of the text value of the column
+func (c Column) literal(value []byte) string {
+	if c.Raw && c.FormattedType != "" {
+		return fmt.Sprintf("%s::%s", dbutils.QuoteLiteral(string(value)), c.FormattedType)
+	}
+
+	return dbutils.QuoteLiteral(string(value))
+}
+
 func (ins Insert) SQL(rel Relation) string {
-	values := make([]string, 0)
+	return InsertSQL(rel, []Insert{ins})
+}
+
+// InsertSQL returns a single insert statement adding the rows of all inserts,
+// which must be of the same relation
+func InsertSQL(rel Relation, inserts []Insert) string {
 	names := make([]string, 0)
-	for i, v := range rel.Columns {
+	overriding := ""
+	for _, v := range rel.Columns {
+		if v.Skipped {
+			continue
+		}
+		if v.IdentityAlways {
+			overriding = " overriding system value"
+		}
 		names = append(names, pgx.Identifier{v.Name}.Sanitize())
-		if ins.NewRow[i].Kind == TextValue {
-			values = append(values, dbutils.QuoteLiteral(string(ins.NewRow[i].Value)))
-		} else if ins.NewRow[i].Kind == NullValue {
-			values = append(values, "null")
+	}
+
+	rows := make([]string, 0, len(inserts))
+	for _, ins := range inserts {
+		values := make([]string, 0)
+		for i, v := range rel.Columns {
+			if v.Skipped {
+				continue
+			}
+			if ins.NewRow[i].Kind == TextValue {
+				values = append(values, v.literal(ins.NewRow[i].Value))
+			} else if ins.NewRow[i].Kind == NullValue {
+				values = append(values, "null")
+			}
 		}
+		rows = append(rows, fmt.Sprintf("(%s)", strings.Join(values, ", ")))
 	}
 
-	return fmt.Sprintf("insert into %s (%s) values (%s);",
+	return fmt.Sprintf("insert into %s (%s)%s values %s;",
 		pgx.Identifier{rel.Namespace, rel.Name}.Sanitize(),
 		strings.Join(names, ", "),
-		strings.Join(values, ", "))
+		overriding,
+		strings.Join(rows, ", "))
 }
 
 func (upd Update) SQL(rel Relation) string {
@@ -198,19 +422,28 @@ func (upd Update) SQL(rel Relation) string {
 	cond := make([]string, 0)
 
 	for i, v := range rel.Columns {
-		if upd.NewRow[i].Kind == NullValue {
+		if v.Skipped {
+			continue
+		}
+
+		// identity always columns can only be updated to default, the restored value is kept
+		if upd.NewRow[i].Kind == NullValue && !v.IdentityAlways {
 			values = append(values, fmt.Sprintf("%s = null", pgx.Identifier{string(v.Name)}.Sanitize()))
-		} else if upd.NewRow[i].Kind == TextValue {
+		} else if upd.NewRow[i].Kind == TextValue && !v.IdentityAlways {
 			values = append(values, fmt.Sprintf("%s = %s",
 				pgx.Identifier{string(v.Name)}.Sanitize(),
-				dbutils.QuoteLiteral(string(upd.NewRow[i].Value))))
+				v.literal(upd.NewRow[i].Value)))
 		}
 
 		if upd.IsKey || upd.IsOld {
+			// the old key has nulls in place of the columns out of the replica identity
+			if upd.IsKey && !v.IsKey {
+				continue
+			}
 			if upd.OldRow[i].Kind == TextValue {
 				cond = append(cond, fmt.Sprintf("%s = %s",
 					pgx.Identifier{string(v.Name)}.Sanitize(),
-					dbutils.QuoteLiteral(string(upd.OldRow[i].Value))))
+					v.literal(upd.OldRow[i].Value)))
 			} else if upd.OldRow[i].Kind == NullValue {
 				cond = append(cond, fmt.Sprintf("%s is null", pgx.Identifier{string(v.Name)}.Sanitize()))
 			}
@@ -218,7 +451,7 @@ func (upd Update) SQL(rel Relation) string {
 			if upd.NewRow[i].Kind == TextValue && v.IsKey {
 				cond = append(cond, fmt.Sprintf("%s = %s",
 					pgx.Identifier{string(v.Name)}.Sanitize(),
-					dbutils.QuoteLiteral(string(upd.NewRow[i].Value))))
+					v.literal(upd.NewRow[i].Value)))
 			} else if upd.NewRow[i].Kind == NullValue && v.IsKey {
 				cond = append(cond, fmt.Sprintf("%s is null", pgx.Identifier{string(v.Name)}.Sanitize()))
 			}
@@ -234,10 +467,10 @@ func (upd Update) SQL(rel Relation) string {
 func (del Delete) SQL(rel Relation) string {
 	cond := make([]string, 0)
 	for i, v := range rel.Columns {
-		if del.OldRow[i].Kind == TextValue {
+		if del.OldRow[i].Kind == TextValue && !v.Skipped {
 			cond = append(cond, fmt.Sprintf("%s = %s",
 				pgx.Identifier{string(v.Name)}.Sanitize(),
-				dbutils.QuoteLiteral(string(del.OldRow[i].Value))))
+				v.literal(del.OldRow[i].Value)))
 		}
 	}
 
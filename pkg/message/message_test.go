@@ -0,0 +1,178 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func text(s string) Tuple {
+	return Tuple{Kind: TextValue, Value: []byte(s)}
+}
+
+func testRelation(columns ...Column) Relation {
+	return Relation{Identifier: Identifier{Namespace: "public", Name: "test"}, Columns: columns}
+}
+
+func TestInsertSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		rel      Relation
+		inserts  []Insert
+		expected string
+	}{
+		{
+			name:     "plain",
+			rel:      testRelation(Column{Name: "id", IsKey: true}, Column{Name: "val"}),
+			inserts:  []Insert{{NewRow: []Tuple{text("1"), {Kind: NullValue}}}},
+			expected: `insert into "public"."test" ("id", "val") values ('1', null);`,
+		},
+		{
+			name:     "identity always",
+			rel:      testRelation(Column{Name: "id", IsKey: true, IdentityAlways: true}, Column{Name: "val"}),
+			inserts:  []Insert{{NewRow: []Tuple{text("1"), text("a")}}},
+			expected: `insert into "public"."test" ("id", "val") overriding system value values ('1', 'a');`,
+		},
+		{
+			name: "generated column omitted",
+			rel: testRelation(Column{Name: "id", IsKey: true}, Column{Name: "doubled", Generated: true},
+				Column{Name: "val"}).Replicated(),
+			inserts:  []Insert{{NewRow: []Tuple{text("1"), text("a")}}},
+			expected: `insert into "public"."test" ("id", "val") values ('1', 'a');`,
+		},
+		{
+			name: "several rows",
+			rel:  testRelation(Column{Name: "id", IsKey: true}, Column{Name: "val"}),
+			inserts: []Insert{
+				{NewRow: []Tuple{text("1"), text("it's")}},
+				{NewRow: []Tuple{text("2"), text("b")}},
+			},
+			expected: `insert into "public"."test" ("id", "val") values ('1', 'it''s'), ('2', 'b');`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := InsertSQL(tt.rel, tt.inserts); got != tt.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	tests := []struct {
+		name       string
+		columns    []Column
+		selectList string
+		copyList   string
+	}{
+		{
+			name:       "all",
+			columns:    []Column{{Name: "id"}, {Name: "val"}},
+			selectList: "*",
+			copyList:   "",
+		},
+		{
+			name:       "generated",
+			columns:    []Column{{Name: "id"}, {Name: "doubled", Generated: true}, {Name: "Val"}},
+			selectList: `"id", "Val"`,
+			copyList:   ` ("id", "Val")`,
+		},
+		{
+			name:       "skipped",
+			columns:    []Column{{Name: "id"}, {Name: "geom", Skipped: true}},
+			selectList: `"id"`,
+			copyList:   ` ("id")`,
+		},
+	}
+
+	for _, tt := range tests {
+		rel := testRelation(tt.columns...)
+		if got := rel.SelectColumns(); got != tt.selectList {
+			t.Errorf("%s: SelectColumns() = %q, expected %q", tt.name, got, tt.selectList)
+		}
+		if got := rel.CopyColumns(); got != tt.copyList {
+			t.Errorf("%s: CopyColumns() = %q, expected %q", tt.name, got, tt.copyList)
+		}
+	}
+}
+
+func TestUnsupportedColumnsSQL(t *testing.T) {
+	rel := testRelation(
+		Column{Name: "id", IsKey: true, FormattedType: "integer"},
+		Column{Name: "point", Raw: true, FormattedType: "geometry(Point,4326)"},
+		Column{Name: "shape", Skipped: true, FormattedType: "geometry"},
+		// a composite, its text form quoted within the literal
+		Column{Name: "address", Raw: true, FormattedType: "address"},
+		Column{Name: "val", FormattedType: "text"},
+	)
+	newRow := []Tuple{text("1"), text("0101000020E6100000"), text("0103000000"), text(`("O'Brien St",42)`), text("b")}
+	oldRow := []Tuple{text("1"), text("0101000020E6100000"), text("0103000000"), text(`("O'Brien St",42)`), text("a")}
+
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{
+			name:     "insert",
+			sql:      Insert{NewRow: newRow}.SQL(rel),
+			expected: `insert into "public"."test" ("id", "point", "address", "val") values ('1', '0101000020E6100000'::geometry(Point,4326), '("O''Brien St",42)'::address, 'b');`,
+		},
+		{
+			name:     "update by key",
+			sql:      Update{NewRow: newRow}.SQL(rel),
+			expected: `update "public"."test" set "id" = '1', "point" = '0101000020E6100000'::geometry(Point,4326), "address" = '("O''Brien St",42)'::address, "val" = 'b' where "id" = '1';`,
+		},
+		{
+			name: "update with the old row",
+			sql:  Update{IsOld: true, OldRow: oldRow, NewRow: newRow}.SQL(rel),
+			expected: `update "public"."test" set "id" = '1', "point" = '0101000020E6100000'::geometry(Point,4326), "address" = '("O''Brien St",42)'::address, "val" = 'b' ` +
+				`where "id" = '1' and "point" = '0101000020E6100000'::geometry(Point,4326) and "address" = '("O''Brien St",42)'::address and "val" = 'a';`,
+		},
+		{
+			name:     "delete",
+			sql:      Delete{IsOld: true, OldRow: oldRow}.SQL(rel),
+			expected: `delete from "public"."test" where "id" = '1' and "point" = '0101000020E6100000'::geometry(Point,4326) and "address" = '("O''Brien St",42)'::address and "val" = 'a';`,
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.sql != tt.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", tt.name, tt.sql, tt.expected)
+		}
+	}
+}
+
+func TestUpdateByOldKey(t *testing.T) {
+	rel := testRelation(Column{Name: "id", IsKey: true}, Column{Name: "val"})
+
+	// the old key has the nulls of the columns out of the replica identity
+	upd := Update{
+		IsKey:  true,
+		OldRow: []Tuple{text("1"), {Kind: NullValue}},
+		NewRow: []Tuple{text("2"), text("b")},
+	}
+	expected := `update "public"."test" set "id" = '2', "val" = 'b' where "id" = '1';`
+	if got := upd.SQL(rel); got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+}
+
+func TestTruncateJSONRoundTrip(t *testing.T) {
+	tr := Truncate{Relations: 2, RelationOIDs: []uint32{16384, 16390}, Cascade: true, RestartIdentity: true}
+
+	d := NewJSONDelta(tr, Relation{})
+	if d == nil {
+		t.Fatalf("truncate has no json delta")
+	}
+	m, err := d.Message()
+	if err != nil {
+		t.Fatalf("could not convert json delta: %v", err)
+	}
+	if !reflect.DeepEqual(m, tr) {
+		t.Errorf("got %#v, expected %#v", m, tr)
+	}
+
+	if got, expected := tr.SQL(testRelation()), `truncate table "public"."test" restart identity cascade;`; got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histograms
+var LatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Histogram counts the observed values in cumulative buckets, the way
+// prometheus histograms do; it's an expvar.Var, published as json
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // the values less than or equal to the bound
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe adds the value to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds); i++ {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]uint64, len(h.bounds)+1)
+	for i, b := range h.bounds {
+		buckets[strconv.FormatFloat(b, 'g', -1, 64)] = h.buckets[i]
+	}
+	buckets["+Inf"] = h.count
+
+	data, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{buckets, h.count, h.sum})
+
+	return string(data)
+}
@@ -0,0 +1,76 @@
+// Package metrics defines the counters exported by the backup process. They
+// are published with expvar and served at /debug/vars of the status server,
+// and pushed to statsd if configured, see Statsd.
+package metrics
+
+import (
+	"expvar"
+)
+
+var (
+	// TablesDropped counts the tables found dropped upstream, by table name
+	TablesDropped = newMap("tables_dropped", "table")
+
+	// SkippedChanges counts the changes not backed up, filtered out by the
+	// operations setting or as the table has replica identity nothing, by table name
+	SkippedChanges = newMap("skipped_changes", "table")
+
+	// CircuitBreakers is the state of the base backup circuit breaker, by table name
+	CircuitBreakers = newMap("circuit_breakers", "table")
+
+	// DeltaFsyncSeconds is the histogram of the time to fsync the written
+	// deltas, by table name
+	DeltaFsyncSeconds = newMap("delta_fsync_seconds", "table")
+
+	// DeltaBufferedChanges is the number of changes written to the current
+	// delta file and not yet fsynced, by table name
+	DeltaBufferedChanges = newMap("delta_buffered_changes", "table")
+
+	// DeltaBytes is the size of the deltas written since the last base backup
+	// or the start, by table name, see deltaCapMB
+	DeltaBytes = newMap("delta_bytes", "table")
+
+	// DeltaWriteErrors counts the failed writes, fsyncs and rotations of
+	// the delta files, by table name
+	DeltaWriteErrors = newMap("delta_write_errors", "table")
+
+	// BasebackupBytesWritten counts the bytes of the base backup files written,
+	// by the page cache mode, see copyCacheMode
+	BasebackupBytesWritten = newMap("basebackup_bytes_written", "mode")
+
+	// ReplicationDeadConnections is the number of the replication connections
+	// found dead and reconnected, see replicationTimeout
+	ReplicationDeadConnections = newInt("replication_dead_connections")
+
+	// SlotLagBytes is the distance of the confirmed lsn of the replication slot
+	// behind the server wal
+	SlotLagBytes = newInt("slot_lag_bytes")
+
+	// SlotStalledSeconds is the time since the confirmed lsn of the replication
+	// slot last moved while the server writes the wal, 0 if it moves or the
+	// server is idle, see slotStuckWindow
+	SlotStalledSeconds = newInt("slot_stalled_seconds")
+
+	// ReconnectQueueDepth is the number of connection attempts waiting for their turn
+	ReconnectQueueDepth = newInt("reconnect_queue_depth")
+
+	// ArchiveQueueDepth is the number of files waiting to be copied into the
+	// archive dir, see archiveConcurrency
+	ArchiveQueueDepth = newInt("archive_queue_depth")
+)
+
+// published are the names of the metrics above, with the tag naming the keys
+// of the maps
+var published = make(map[string]string)
+
+func newMap(name, tag string) *expvar.Map {
+	published[name] = tag
+
+	return expvar.NewMap(name)
+}
+
+func newInt(name string) *expvar.Int {
+	published[name] = ""
+
+	return expvar.NewInt(name)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxStatsdPacket keeps the datagrams below the usual mtu
+const maxStatsdPacket = 1432
+
+// Statsd pushes the metrics to the statsd endpoint as gauges, their current
+// values, in the DogStatsD format: the keys of the maps become the tags, i.e.
+// table:schema.name, the histograms are sent as their count and sum.
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsd opens the udp socket sending to the statsd endpoint at addr
+func NewStatsd(addr, prefix string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to statsd: %v", err)
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return &Statsd{conn: conn, prefix: prefix}, nil
+}
+
+// Push sends the current values of all metrics
+func (s *Statsd) Push() error {
+	names := make([]string, 0, len(published))
+	for name := range published {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var packet bytes.Buffer
+	send := func(line string) error {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacket {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return fmt.Errorf("could not send metrics: %v", err)
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+
+		return nil
+	}
+
+	for _, name := range names {
+		tag := published[name]
+		switch v := expvar.Get(name).(type) {
+		case *expvar.Map:
+			var err error
+			v.Do(func(kv expvar.KeyValue) {
+				for _, line := range s.lines(name, kv.Value, tag+":"+kv.Key) {
+					if err == nil {
+						err = send(line)
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+		case expvar.Var:
+			for _, line := range s.lines(name, v, "") {
+				if err := send(line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return fmt.Errorf("could not send metrics: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// lines formats the value of the metric, the strings, i.e. the states, are
+// sent as 1 tagged with the state
+func (s *Statsd) lines(name string, v expvar.Var, tags string) []string {
+	gauge := func(name, value, tags string) string {
+		if tags == "" {
+			return fmt.Sprintf("%s%s:%s|g", s.prefix, name, value)
+		}
+
+		return fmt.Sprintf("%s%s:%s|g|#%s", s.prefix, name, value, tags)
+	}
+	withTag := func(tag string) string {
+		if tags == "" {
+			return tag
+		}
+
+		return tags + "," + tag
+	}
+
+	switch v := v.(type) {
+	case *expvar.Int:
+		return []string{gauge(name, strconv.FormatInt(v.Value(), 10), tags)}
+	case *expvar.Float:
+		return []string{gauge(name, strconv.FormatFloat(v.Value(), 'g', -1, 64), tags)}
+	case *expvar.String:
+		return []string{gauge(name, "1", withTag("state:"+v.Value()))}
+	case *Histogram:
+		v.mu.Lock()
+		count, sum := v.count, v.sum
+		v.mu.Unlock()
+
+		return []string{
+			gauge(name+".count", strconv.FormatUint(count, 10), tags),
+			gauge(name+".sum", strconv.FormatFloat(sum, 'g', -1, 64), tags),
+		}
+	}
+
+	return nil
+}
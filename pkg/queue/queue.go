@@ -18,6 +18,21 @@ var (
 	ErrEmptyQueue = errors.New("queue is empty")
 )
 
+// Prioritized items are ordered by their priority, the highest first; the
+// items of the same priority, as well as the other ones, which have priority 0,
+// are kept in the order they were put.
+type Prioritized interface {
+	Priority() int
+}
+
+func priority(val interface{}) int {
+	if p, ok := val.(Prioritized); ok {
+		return p.Priority()
+	}
+
+	return 0
+}
+
 type waiter chan interface{}
 
 func newWaiter() waiter {
@@ -104,7 +119,15 @@ func (q *Queue) get() interface{} {
 }
 
 func (q *Queue) put(val interface{}) {
-	q.items.PushBack(val)
+	p := priority(val)
+	for e := q.items.Back(); e != nil; e = e.Prev() {
+		if priority(e.Value) >= p {
+			q.items.InsertAfter(val, e)
+			return
+		}
+	}
+
+	q.items.PushFront(val)
 }
 
 // Get gets an element from Queue.
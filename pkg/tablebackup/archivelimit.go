@@ -0,0 +1,48 @@
+package tablebackup
+
+import "github.com/ikitiki/logical_backup/pkg/metrics"
+
+// ArchiveLimiter bounds the number of files copied into the archive dir at
+// once across all tables, apart from the concurrency of the base backups: the
+// files of the tables dumped at the same time wait for their turn in the temp
+// dir, see config.ArchiveConcurrency
+type ArchiveLimiter struct {
+	slots chan struct{} // nil if not limited
+}
+
+func NewArchiveLimiter(concurrency int) *ArchiveLimiter {
+	l := &ArchiveLimiter{}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+
+	return l
+}
+
+func (l *ArchiveLimiter) limited() bool {
+	return l != nil && l.slots != nil
+}
+
+// turn returns the channel the send to which takes the turn of the copy, nil
+// if not limited
+func (l *ArchiveLimiter) turn() chan<- struct{} {
+	if !l.limited() {
+		return nil
+	}
+
+	return l.slots
+}
+
+func (l *ArchiveLimiter) release() {
+	if !l.limited() {
+		return
+	}
+
+	<-l.slots
+}
+
+// archive queues the file, relative to the table dir, for the archiver
+func (t *TableBackup) archive(file string) {
+	metrics.ArchiveQueueDepth.Add(1)
+	t.archiveFiles <- file
+}
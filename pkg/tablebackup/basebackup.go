@@ -1,24 +1,39 @@
 package tablebackup
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
 	"gopkg.in/yaml.v2"
 
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
 	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+const (
+	maxConnectBackoff     = 5 * time.Minute
+	maxApplicationNameLen = 63
 )
 
 func (t *TableBackup) Basebackup() error {
+	if t.IsDropped() || t.isStopped() {
+		return nil
+	}
+
 	if !atomic.CompareAndSwapUint32(&t.locker, 0, 1) {
 		log.Printf("Already locked %s; skipping", t)
 		return nil
@@ -27,13 +42,50 @@ func (t *TableBackup) Basebackup() error {
 		atomic.StoreUint32(&t.locker, 0)
 	}()
 
+	if !t.breakerAllows() {
+		t.countBasebackup(t.lastBasebackupTime, nil)
+		return nil
+	}
+
+	prevTime := t.lastBasebackupTime
+	err := t.basebackup()
+	for attempt := 1; isTransientCopyError(err); attempt++ {
+		if attempt > t.cfg.CopyRetries {
+			if t.cfg.CopyRetries > 0 {
+				err = newError(ErrRetriesExhausted, fmt.Sprintf("copy failed after %d attempts", attempt), err)
+			}
+			break
+		}
+
+		log.Printf("base backup of %s failed, retrying from a new consistent point in %v (%d of %d): %v",
+			t, t.cfg.CopyRetryInterval, attempt, t.cfg.CopyRetries, err)
+		select {
+		case <-t.ctx.Done():
+			return context.Canceled
+		case <-time.After(t.cfg.CopyRetryInterval):
+		}
+		err = t.basebackup()
+	}
+	if err != context.Canceled {
+		t.breakerRecord(err)
+		t.countBasebackup(prevTime, err)
+	}
+
+	return err
+}
+
+func (t *TableBackup) basebackup() error {
+	if t.cfg.DeltasOnly {
+		return t.saveDeltasOnlyInfo()
+	}
+
 	log.Printf("Starting base backup of %s", t)
 	tempFilepath := path.Join(t.tableDir, t.infoFilename+".new")
-	if _, err := os.Stat(tempFilepath); os.IsExist(err) {
-		os.Remove(tempFilepath)
+	if err := os.Remove(tempFilepath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove stale temp file: %v", err)
 	}
 
-	infoFp, err := os.OpenFile(tempFilepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	infoFp, err := utils.CreateFile(tempFilepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
 	if err != nil {
 		return fmt.Errorf("could not create info file: %v", err)
 	}
@@ -49,39 +101,111 @@ func (t *TableBackup) Basebackup() error {
 	}
 
 	if err := t.connect(); err != nil {
-		return fmt.Errorf("could not connect: %v", err)
+		t.retryLater()
+		return fmt.Errorf("could not connect: %w", err)
 	}
 	defer t.disconnect()
+	// runs before the disconnect: any failure below may leave the tx behind
+	defer t.endTx()
+	t.connectFailures = 0
 
-	if err := t.txBegin(); err != nil {
-		return fmt.Errorf("could not start transaction: %v", err)
+	if exists, err := t.exists(); err != nil {
+		return fmt.Errorf("could not check if table exists: %v", err)
+	} else if !exists {
+		return t.markDropped()
 	}
 
 	startTime := time.Now()
 
-	if err := t.createTempReplicationSlot(); err != nil { // slot will be dropped on tx finish
-		return fmt.Errorf("could not create replication slot: %v", err)
+	if t.cfg.SlotSnapshotAction == config.SlotSnapshotExport {
+		if err := t.createTempSlot(); err != nil { // slot will be dropped on disconnect
+			return fmt.Errorf("could not create replication slot: %w", err)
+		}
+		defer t.clearSlotSnapshot()
+
+		if err := t.importSlotSnapshot(); err != nil {
+			return fmt.Errorf("could not import slot snapshot: %v", err)
+		}
+	} else {
+		if err := t.txBegin(); err != nil {
+			return fmt.Errorf("could not start transaction: %w", err)
+		}
+
+		if err := t.createTempSlot(); err != nil { // slot will be dropped on tx finish
+			return fmt.Errorf("could not create replication slot: %w", err)
+		}
 	}
 
 	if err := t.lockTable(); err != nil {
-		return fmt.Errorf("could not lock table: %v", err)
+		if errors.Is(err, ErrLockTimeout) {
+			t.retryIn(t.cfg.CopyRetryInterval)
+		}
+		return fmt.Errorf("could not lock table: %w", err)
 	}
 
-	//TODO: check if table is empty before creating logical replication slot
-	if hasRows, err := t.hasRows(); err != nil {
-		return fmt.Errorf("could not check if table has rows: %v", err)
-	} else if !hasRows {
-		log.Printf("table %s seems to have no rows; skipping", t.Identifier)
-		return nil
+	// the empty dump is a valid base backup: the deltas up to its lsn are
+	// skipped on restore like for any other, so it's only skipped if asked
+	if t.cfg.SkipEmptyTables {
+		if hasRows, err := t.hasRows(); err != nil {
+			return fmt.Errorf("could not check if table has rows: %v", err)
+		} else if !hasRows {
+			log.Printf("table %s seems to have no rows; skipping", t.Identifier)
+			return nil
+		}
 	}
 
 	relationInfo, err := FetchRelationInfo(t.tx, t.Identifier)
 	if err != nil {
 		return fmt.Errorf("could not fetch table struct: %v", err)
 	}
+	if err := t.markUnsupportedColumns(&relationInfo); err != nil {
+		return err
+	}
+
+	copyStart := t.deltaPause.begin()
+	parts, err := t.dump(relationInfo)
+	t.setDeltaPause(t.deltaPause.end(copyStart))
+	if err != nil {
+		return fmt.Errorf("could not dump table: %w", err)
+	}
 
-	if err := t.copyDump(); err != nil {
-		return fmt.Errorf("could not dump table: %v", err)
+	var sequences []message.Sequence
+	if t.cfg.BackupSequences {
+		if sequences, err = t.ownedSequences(); err != nil {
+			return fmt.Errorf("could not fetch sequences: %v", err)
+		}
+	}
+
+	var ddl *message.TableDDL
+	if t.cfg.CaptureDDL {
+		if ddl, err = t.tableDDL(); err != nil {
+			return fmt.Errorf("could not fetch table ddl: %v", err)
+		}
+	}
+
+	var schema *message.TableSchema
+	if t.cfg.EmbedSchema {
+		if schema, err = FetchTableSchema(t.tx, t.Identifier); err != nil {
+			return fmt.Errorf("could not fetch table schema: %v", err)
+		}
+	}
+
+	var hypertable *message.Identifier
+	if t.cfg.TimescaleHypertables {
+		if hypertable, err = t.hypertable(); err != nil {
+			return err
+		}
+	}
+
+	serverVersion, err := ServerVersion(t.tx)
+	if err != nil {
+		return err
+	}
+
+	if t.cfg.SnapshotExportWindow > 0 {
+		if err := t.exportSnapshot(); err != nil {
+			return fmt.Errorf("could not export snapshot: %v", err)
+		}
 	}
 
 	if err := t.txCommit(); err != nil {
@@ -94,6 +218,18 @@ func (t *TableBackup) Basebackup() error {
 		CreateDate:     time.Now(),
 		Relation:       relationInfo,
 		BackupDuration: t.lastBackupDuration.Seconds(),
+		Parts:          parts,
+		Format:         t.basebackupFormat(),
+		Footers:        t.basebackupFormat() != config.BasebackupFormatSQL,
+		Sequences:      sequences,
+		InsertOnly:     relationInfo.ReplicaIdentity == message.ReplicaIdentityNothing,
+		DDL:            ddl,
+		Operations:     t.cfg.TableOperations(t.tableName()),
+		CopyOptions:    t.cfg.TableCopyOptions(t.tableName()),
+		SnapshotAction: t.cfg.SlotSnapshotAction,
+		Hypertable:     hypertable,
+		ServerVersion:  serverVersion,
+		Schema:         schema,
 	})
 	if err != nil {
 		return fmt.Errorf("could not save info file: %v", err)
@@ -103,34 +239,48 @@ func (t *TableBackup) Basebackup() error {
 		log.Printf("could not rename: %v", err)
 	}
 
-	t.archiveFiles <- t.infoFilename
+	t.archive(t.infoFilename)
 
 	log.Printf("%s backed up in %v; start lsn: %s",
 		t.String(), t.lastBackupDuration, pgx.FormatLSN(t.basebackupLSN))
 
-	if err := t.RotateOldDeltas(path.Join(t.tableDir, deltasDir), t.lastLSN); err != nil {
+	if err := t.RotateOldDeltas(path.Join(t.tableDir, deltasDir)); err != nil {
 		return fmt.Errorf("could not archive old deltas: %v", err)
 	}
 
 	t.lastBasebackupTime = time.Now()
 	t.deltasSinceBackupCnt = 0
+	t.deltaBytes.Set(0)
+	atomic.StoreUint32(&t.deltaCapReached, 0)
 
 	return nil
 }
 
 // connects to the postgresql instance using replication protocol
 func (t *TableBackup) connect() error {
-	cfg := t.dbCfg.Merge(pgx.ConnConfig{
-		RuntimeParams:        map[string]string{"replication": "database"},
+	dbCfg := t.cfg.Secrets().Apply(t.dbCfg)
+	cfg := dbCfg.Merge(pgx.ConnConfig{
+		RuntimeParams:        map[string]string{"replication": "database", "application_name": t.applicationName()},
 		PreferSimpleProtocol: true,
 	})
-	conn, err := pgx.Connect(cfg)
-
+	var (
+		conn    *pgx.Conn
+		hostCfg pgx.ConnConfig
+	)
+	err := t.reconnector.Connect(t.ctx, func() (err error) {
+		conn, hostCfg, err = dbutils.ConnectTarget(cfg, t.cfg.BasebackupSessionAttrs)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("could not connect: %v", err)
+		return newError(ErrNoConnection, "could not connect", dbutils.RedactPassword(err, cfg))
 	}
+	// the connections importing the snapshot of conn must land on its host
+	t.hostCfg = dbCfg
+	t.hostCfg.Host, t.hostCfg.Port, t.hostCfg.TLSConfig = hostCfg.Host, hostCfg.Port, hostCfg.TLSConfig
 
-	connInfo, err := t.initPostgresql(conn)
+	connInfo, err := t.meta.ConnInfo(t.dbKey, func() (*pgtype.ConnInfo, error) {
+		return t.initPostgresql(conn)
+	})
 	if err != nil {
 		return fmt.Errorf("could not fetch conn info: %v", err)
 	}
@@ -140,6 +290,60 @@ func (t *TableBackup) connect() error {
 	return nil
 }
 
+// tableName is the name of the table in the per-table settings
+func (t *TableBackup) tableName() string {
+	return fmt.Sprintf("%s.%s", t.Namespace, t.Name)
+}
+
+// basebackupFormat returns the base backup format configured for the table
+func (t *TableBackup) basebackupFormat() string {
+	return t.cfg.TableBasebackupFormat(t.tableName())
+}
+
+// applicationName identifies the connections of the table backup in
+// pg_stat_activity, truncated to the maximum name length of postgres
+func (t *TableBackup) applicationName() string {
+	name := fmt.Sprintf("%s/%s.%s", t.cfg.ApplicationName, t.Namespace, t.Name)
+	if len(name) > maxApplicationNameLen {
+		name = name[:maxApplicationNameLen]
+	}
+
+	return name
+}
+
+// retryLater queues the basebackup again after the backoff, which doubles with
+// each consecutive connection failure
+func (t *TableBackup) retryLater() {
+	if t.ctx.Err() != nil {
+		return
+	}
+
+	backoff := maxConnectBackoff
+	if t.connectFailures < 8 {
+		backoff = time.Second << uint(t.connectFailures)
+	}
+	if backoff > maxConnectBackoff {
+		backoff = maxConnectBackoff
+	}
+	t.connectFailures++
+
+	t.retryIn(backoff)
+}
+
+// retryIn queues the basebackup again after the delay
+func (t *TableBackup) retryIn(delay time.Duration) {
+	if t.ctx.Err() != nil {
+		return
+	}
+
+	log.Printf("retrying base backup of %s in %v", t, delay)
+	time.AfterFunc(delay, func() {
+		if t.ctx.Err() == nil {
+			t.basebackupQueue.Put(t)
+		}
+	})
+}
+
 func (t *TableBackup) disconnect() error {
 	if t.conn == nil {
 		return fmt.Errorf("no open connections")
@@ -149,46 +353,121 @@ func (t *TableBackup) disconnect() error {
 }
 
 func (t *TableBackup) tempSlotName() string {
+	if t.tempSlotSuffix > 0 {
+		return fmt.Sprintf("tempslot_%d_%d", t.conn.PID(), t.tempSlotSuffix)
+	}
+
 	return fmt.Sprintf("tempslot_%d", t.conn.PID())
 }
 
-func (t *TableBackup) RotateOldDeltas(deltasDir string, lastLSN uint64) error {
-	fileList, err := ioutil.ReadDir(deltasDir)
+// RotateOldDeltas removes the delta files not archived yet which the restore
+// from the current base backup doesn't need. It runs concurrently with the
+// writer, so the invariant is: a file is only removed if the next one starts
+// at or before basebackupLSN, i.e. all its transactions are in the dump, and
+// it is not the one being written. The writer holds deltaFileMu while
+// switching to the new file, which is then the latest one, so the files
+// created during the rotation are never removed either.
+func (t *TableBackup) RotateOldDeltas(deltasDir string) error {
+	t.deltaFileMu.Lock()
+	defer t.deltaFileMu.Unlock()
+
+	fileList, err := utils.ReadDeltaDir(deltasDir)
 	if err != nil {
 		return fmt.Errorf("could not list directory: %v", err)
 	}
+
+	type delta struct {
+		path         string
+		lsn, postfix uint64
+		modTime      time.Time
+	}
+	files := make([]delta, 0, len(fileList))
 	for _, v := range fileList {
-		filename := v.Name()
-		lsnStr := filename
-		if strings.Contains(filename, ".") {
-			parts := strings.Split(filename, ".")
-			lsnStr = parts[0]
-		}
+		parts := strings.SplitN(v.Name(), ".", 2)
 
-		lsn, err := strconv.ParseUint(lsnStr, 16, 64)
-		if err != nil {
+		f := delta{path: v.Path, modTime: v.ModTime()}
+		if f.lsn, err = strconv.ParseUint(parts[0], 16, 64); err != nil {
 			return fmt.Errorf("could not parse filename: %v", err)
 		}
-		if lastLSN == lsn {
-			continue // skip current file
+		if len(parts) == 2 {
+			if f.postfix, err = strconv.ParseUint(parts[1], 16, 32); err != nil {
+				return fmt.Errorf("could not parse filename: %v", err)
+			}
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].lsn != files[j].lsn {
+			return files[i].lsn < files[j].lsn
 		}
 
-		if lsn < t.basebackupLSN {
-			filename = fmt.Sprintf("%s/%s", deltasDir, filename)
-			if err := os.Remove(filename); err != nil {
-				return fmt.Errorf("could not remove %q file: %v", filename, err)
-			}
+		return files[i].postfix < files[j].postfix
+	})
+
+	n := 0
+	for n < len(files)-1 && files[n+1].lsn <= t.basebackupLSN {
+		n++
+	}
+
+	current := path.Base(t.currentDeltaFilename)
+	retention := utils.DeltaRetention{Period: t.cfg.DeltaRetentionPeriod, Files: t.cfg.DeltaRetentionFiles}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		if path.Base(files[i].path) == current {
+			continue
+		}
+		if !retention.Expired(i, n, files[i].modTime, now) {
+			break
+		}
+
+		filename := path.Join(deltasDir, files[i].path)
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) { // the archiver may have moved it already
+			return fmt.Errorf("could not remove %q file: %v", filename, err)
 		}
 	}
 
 	return nil
 }
 
+// lockQuery returns the statement locking the table for its base backup, none
+// with skipTableLock: the snapshot of the transaction is the one of the slot
+// either way, set by USE_SNAPSHOT or imported; the lock only keeps off the ddl
+func (t *TableBackup) lockQuery() string {
+	if t.cfg.SkipTableLock {
+		return ""
+	}
+
+	return fmt.Sprintf("LOCK TABLE %s IN ACCESS SHARE MODE", t.Identifier.Sanitize())
+}
+
+// lockTable locks the table, waiting no longer than lockTimeout if set, so that
+// the base backup queued behind the ddl gives up the worker and is retried
 func (t *TableBackup) lockTable() error {
-	if _, err := t.tx.Exec(fmt.Sprintf("LOCK TABLE %s IN ACCESS SHARE MODE", t.Identifier.Sanitize())); err != nil {
+	query := t.lockQuery()
+	if query == "" {
+		return nil
+	}
+
+	if t.cfg.LockTimeout > 0 {
+		if _, err := t.tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", t.cfg.LockTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("could not set lock timeout: %v", err)
+		}
+	}
+
+	started := time.Now()
+	if _, err := t.tx.Exec(query); err != nil {
+		if isLockNotAvailable(err) {
+			return newError(ErrLockTimeout, fmt.Sprintf("could not lock the table in %v", time.Since(started).Round(time.Millisecond)), err)
+		}
 		return fmt.Errorf("could not lock the table: %v", err)
 	}
 
+	if t.cfg.LockTimeout > 0 {
+		if _, err := t.tx.Exec("SET LOCAL lock_timeout TO DEFAULT"); err != nil {
+			return fmt.Errorf("could not reset lock timeout: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -197,15 +476,18 @@ func (t *TableBackup) txBegin() error {
 		return fmt.Errorf("there is already a transaction in progress")
 	}
 	if t.conn == nil {
-		return fmt.Errorf("no postgresql connection")
+		return newError(ErrNoConnection, "no postgresql connection", nil)
 	}
 
 	tx, err := t.conn.BeginEx(t.ctx, &pgx.TxOptions{
-		IsoLevel:   pgx.RepeatableRead,
+		IsoLevel:   t.cfg.TxIsoLevel(),
 		AccessMode: pgx.ReadOnly,
 	})
 	if err != nil {
-		return fmt.Errorf("could not begin tx: %v", err)
+		if !t.conn.IsAlive() {
+			return newError(ErrNoConnection, "could not begin tx", err)
+		}
+		return fmt.Errorf("could not begin tx: %w", err)
 	}
 
 	t.tx = tx
@@ -239,74 +521,185 @@ func (t *TableBackup) txRollback() error {
 		return fmt.Errorf("no open connections")
 	}
 
-	if err := t.tx.Rollback(); err != nil {
-		return err
+	// the tx is gone either way, e.g. when the rollback fails on the dead connection
+	err := t.tx.Rollback()
+	t.tx = nil
+
+	return err
+}
+
+// endTx rolls back the transaction left running by the failed base backup, if
+// any, so that the next attempt can begin its own
+func (t *TableBackup) endTx() {
+	if t.tx == nil {
+		return
 	}
 
+	if err := t.tx.Rollback(); err != nil && t.conn != nil && t.conn.IsAlive() {
+		log.Printf("could not rollback tx of %s: %v", t, err)
+	}
 	t.tx = nil
-	return nil
 }
 
-func (t *TableBackup) copyDump() error {
+func (t *TableBackup) copyDump(rel message.Relation) error {
 	if t.tx == nil {
 		return fmt.Errorf("no running transaction")
 	}
 	if t.basebackupLSN == 0 {
-		return fmt.Errorf("no consistent point")
+		return newError(ErrNoConsistentPoint, "no consistent point", nil)
 	}
 
 	tempFilename := path.Join(t.tableDir, t.basebackupFilename+".new")
-	if _, err := os.Stat(tempFilename); os.IsExist(err) {
-		os.Remove(tempFilename)
+	if err := os.Remove(tempFilename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove stale temp file: %v", err)
 	}
 
-	fp, err := os.OpenFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	fp, err := utils.CreateFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
 	if err != nil {
 		return fmt.Errorf("could not open file: %v", err)
 	}
 	defer fp.Close()
 
-	if err := t.tx.CopyToWriter(fp, fmt.Sprintf("copy %s to stdout", t.Identifier.Sanitize())); err != nil {
+	source, err := t.copySource(rel)
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+
+	query := fmt.Sprintf("copy %s to stdout%s", source, config.CopyOptions(t.basebackupFormat(), t.cfg.TableCopyOptions(t.tableName())))
+	w := newDumpWriter(fp, t.cfg)
+	if err := t.tx.CopyToWriter(w, query); err != nil {
 		if err2 := t.txRollback(); err2 != nil {
 			os.Remove(tempFilename)
-			return fmt.Errorf("could not copy and rollback tx: %v, %v", err2, err)
+			return newError(ErrCopyFailed, fmt.Sprintf("could not copy and rollback tx: %v", err2), err)
 		}
 		os.Remove(tempFilename)
-		return fmt.Errorf("could not copy: %v", err)
+		return newError(ErrCopyFailed, "could not copy", err)
+	}
+	if err := w.checkStream(t.basebackupFormat()); err != nil {
+		os.Remove(tempFilename)
+		return newError(ErrCopyFailed, "copy stream is inconsistent", err)
+	}
+	if err := w.writeFooter(t.basebackupFormat() == config.BasebackupFormatBinary); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not write footer: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not write file: %v", err)
 	}
 	if err := os.Rename(tempFilename, path.Join(t.tableDir, t.basebackupFilename)); err != nil {
 		return fmt.Errorf("could not move file: %v", err)
 	}
 
-	t.archiveFiles <- t.basebackupFilename
+	t.archive(t.basebackupFilename)
 
 	return nil
 }
 
+// copySource returns the source of the COPY dumping the table, see
+// copySourceOf
+func (t *TableBackup) copySource(rel message.Relation) (string, error) {
+	var partitioned bool
+
+	row := t.tx.QueryRow(fmt.Sprintf("select relkind = 'p' from pg_catalog.pg_class where oid = %s::regclass",
+		dbutils.QuoteLiteral(t.Identifier.Sanitize())))
+	if err := row.Scan(&partitioned); err != nil {
+		return "", fmt.Errorf("could not fetch relation kind: %v", err)
+	}
+
+	return copySourceOf(t.Identifier, rel, partitioned), nil
+}
+
+// copySourceOf returns the source of the COPY dumping the table: a partitioned
+// table, published via its root, can only be copied with a query, which reads
+// the rows of all of its partitions
+func copySourceOf(table message.Identifier, rel message.Relation, partitioned bool) string {
+	if partitioned {
+		return fmt.Sprintf("(select %s from %s)", rel.SelectColumns(), table.Sanitize())
+	}
+
+	return table.Sanitize() + rel.CopyColumns()
+}
+
+// ownedSequences returns the current state of the sequences owned by the table
+// columns, i.e. the serial and identity ones. Sequences are not transactional,
+// so the values are at least as recent as the snapshot of the dump.
+func (t *TableBackup) ownedSequences() ([]message.Sequence, error) {
+	rows, err := t.tx.Query(fmt.Sprintf(`select n.nspname, s.relname, a.attname
+from pg_catalog.pg_depend d
+join pg_catalog.pg_class s on s.oid = d.objid and s.relkind = 'S'
+join pg_catalog.pg_namespace n on n.oid = s.relnamespace
+join pg_catalog.pg_attribute a on a.attrelid = d.refobjid and a.attnum = d.refobjsubid
+where d.classid = 'pg_catalog.pg_class'::regclass
+	and d.refobjid = %s::regclass
+	and d.deptype in ('a', 'i')
+order by a.attnum`, dbutils.QuoteLiteral(t.Identifier.Sanitize())))
+	if err != nil {
+		return nil, fmt.Errorf("could not query: %v", err)
+	}
+
+	sequences := make([]message.Sequence, 0)
+	for rows.Next() {
+		var seq message.Sequence
+		if err := rows.Scan(&seq.Namespace, &seq.Name, &seq.Column); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+		sequences = append(sequences, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch sequences: %v", err)
+	}
+
+	for i, seq := range sequences {
+		row := t.tx.QueryRow(fmt.Sprintf("select last_value, is_called from %s", seq.Identifier.Sanitize()))
+		if err := row.Scan(&sequences[i].LastValue, &sequences[i].IsCalled); err != nil {
+			return nil, fmt.Errorf("could not read sequence %s: %v", seq.Identifier, err)
+		}
+	}
+
+	return sequences, nil
+}
+
+// createTempReplicationSlot creates the slot giving the consistent point of
+// the base backup. With the use snapshot action it's created in the basebackup
+// transaction, which gets the snapshot of the slot; the export one can only be
+// created outside of a transaction.
 func (t *TableBackup) createTempReplicationSlot() error {
 	var createdSlotName, basebackupLSN, snapshotName, plugin sql.NullString
 
-	if t.tx == nil {
+	action, queryRow := "USE_SNAPSHOT", t.conn.QueryRow
+	if t.cfg.SlotSnapshotAction == config.SlotSnapshotExport {
+		action = "EXPORT_SNAPSHOT"
+	} else if t.tx == nil {
 		return fmt.Errorf("no running transaction")
+	} else {
+		queryRow = t.tx.QueryRow
 	}
 
-	row := t.tx.QueryRow(fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY LOGICAL %s USE_SNAPSHOT",
-		t.tempSlotName(), "pgoutput"))
+	row := queryRow(fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY LOGICAL %s %s",
+		t.tempSlotName(), "pgoutput", action))
 
 	if err := row.Scan(&createdSlotName, &basebackupLSN, &snapshotName, &plugin); err != nil {
-		return fmt.Errorf("could not scan: %v", err)
+		if isDuplicateObject(err) {
+			return newError(ErrSlotExists, "could not scan", err)
+		}
+		return fmt.Errorf("could not scan: %w", err)
 	}
 
 	if !basebackupLSN.Valid {
-		return fmt.Errorf("null consistent point")
+		return newError(ErrNoConsistentPoint, "null consistent point", nil)
 	}
 
 	lsn, err := pgx.ParseLSN(basebackupLSN.String)
 	if err != nil {
-		return fmt.Errorf("could not parse LSN: %v", err)
+		return newError(ErrNoConsistentPoint, "could not parse LSN", err)
 	}
 
 	t.basebackupLSN = lsn
+	t.slotSnapshot = snapshotName.String
 
 	return nil
 }
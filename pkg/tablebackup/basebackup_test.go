@@ -0,0 +1,117 @@
+package tablebackup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+func TestRotateOldDeltasWhileWriting(t *testing.T) {
+	const (
+		files         = 50
+		basebackupLSN = 25
+	)
+
+	cfg := newTestConfig(t, "deltasPerFile: 1\n")
+	tb := newTestTable(t, cfg)
+	tb.basebackupLSN = basebackupLSN
+	deltasPath := path.Join(tb.tableDir, deltasDir)
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := tb.RotateOldDeltas(deltasPath); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// each message starts a new file
+	for lsn := uint64(1); lsn <= files; lsn++ {
+		if _, err := tb.SaveRawMessage([]byte(fmt.Sprintf("message %d", lsn)), lsn); err != nil {
+			t.Fatalf("could not save message: %v", err)
+		}
+		if _, err := os.Stat(path.Join(tb.tableDir, tb.currentDeltaFilename)); err != nil {
+			t.Fatalf("the file being written is gone: %v", err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatalf("could not rotate deltas: %v", err)
+	}
+
+	if err := tb.RotateOldDeltas(deltasPath); err != nil {
+		t.Fatalf("could not rotate deltas: %v", err)
+	}
+
+	// the restore starts with the file holding the base backup lsn
+	fileList, err := utils.ReadDeltaDir(deltasPath)
+	if err != nil {
+		t.Fatalf("could not list deltas: %v", err)
+	}
+	names := make([]string, 0, len(fileList))
+	for _, f := range fileList {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+
+	expected := make([]string, 0)
+	for lsn := basebackupLSN; lsn <= files; lsn++ {
+		expected = append(expected, fmt.Sprintf("%016x", lsn))
+	}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("delta files left are %v, expected %v", names, expected)
+	}
+}
+
+func TestSkipTableLock(t *testing.T) {
+	tb := newTestTable(t, newTestConfig(t, ""))
+	if query := tb.lockQuery(); query != `LOCK TABLE "public"."test" IN ACCESS SHARE MODE` {
+		t.Fatalf("lock query %q", query)
+	}
+
+	tb = newTestTable(t, newTestConfig(t, "skipTableLock: true\nlockTimeout: 5s\n"))
+	if query := tb.lockQuery(); query != "" {
+		t.Fatalf("lock query %q with skipTableLock, expected none", query)
+	}
+	// neither the lock nor its timeout are set: there's no transaction to run them in
+	if err := tb.lockTable(); err != nil {
+		t.Fatalf("could not skip the table lock: %v", err)
+	}
+}
+
+func TestCopySourceOf(t *testing.T) {
+	table := message.Identifier{Namespace: "public", Name: "measurements"}
+	rel := message.Relation{Identifier: table, Columns: []message.Column{
+		{Name: "ts"}, {Name: "value"}, {Name: "value_f", Generated: true},
+	}}
+
+	tests := []struct {
+		name        string
+		partitioned bool
+		expected    string
+	}{
+		{"table", false, `"public"."measurements" ("ts", "value")`},
+		// published via the root: the rows of the partitions are read through it
+		{"partitioned table", true, `(select "ts", "value" from "public"."measurements")`},
+	}
+
+	for _, tt := range tests {
+		if got := copySourceOf(table, rel, tt.partitioned); got != tt.expected {
+			t.Errorf("%s: copy source %s, expected %s", tt.name, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package tablebackup
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+)
+
+const (
+	BreakerClosed   = "closed"    // base backups run as usual
+	BreakerOpen     = "open"      // base backups are skipped until the cooldown passes
+	BreakerHalfOpen = "half-open" // a single base backup is let through to test the recovery
+)
+
+// BreakerStatus is the state of the circuit breaker of the table base backups
+type BreakerStatus struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"` // consecutive failed base backups
+	OpenedAt  time.Time `json:"openedAt,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// breaker stops the base backups of the table after the configured number of
+// consecutive failures, so that a persistently broken table (i.e. with the
+// privileges revoked) doesn't retry forever. After the cooldown one attempt is
+// let through: the breaker closes if it succeeds and opens again otherwise.
+type breaker struct {
+	mu     sync.Mutex
+	status BreakerStatus
+	state  expvar.String // published in metrics.CircuitBreakers
+}
+
+func (t *TableBackup) initBreaker() {
+	t.breaker.status.State = BreakerClosed
+	t.breaker.state.Set(BreakerClosed)
+	metrics.CircuitBreakers.Set(t.String(), &t.breaker.state)
+}
+
+// breakerAllows reports whether the base backup may run now
+func (t *TableBackup) breakerAllows() bool {
+	b := &t.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status.State != BreakerOpen {
+		return true
+	}
+
+	if time.Since(b.status.OpenedAt) < t.cfg.BreakerCooldown {
+		return false
+	}
+
+	log.Printf("circuit breaker of %s is half-open, retrying the base backup", t)
+	b.setState(BreakerHalfOpen)
+
+	return true
+}
+
+// breakerRecord accounts the outcome of the base backup
+func (t *TableBackup) breakerRecord(err error) {
+	b := &t.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.status.State != BreakerClosed {
+			log.Printf("circuit breaker of %s is closed", t)
+		}
+		b.status = BreakerStatus{}
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.status.Failures++
+	b.status.LastError = err.Error()
+	if t.cfg.BreakerFailures <= 0 {
+		return
+	}
+
+	if b.status.State == BreakerHalfOpen || b.status.Failures >= t.cfg.BreakerFailures {
+		log.Printf("circuit breaker of %s is open after %d consecutive failures, next attempt in %v",
+			t, b.status.Failures, t.cfg.BreakerCooldown)
+		b.status.OpenedAt = time.Now()
+		b.setState(BreakerOpen)
+
+		time.AfterFunc(t.cfg.BreakerCooldown, func() {
+			if t.ctx.Err() == nil {
+				t.basebackupQueue.Put(t)
+			}
+		})
+	}
+}
+
+func (b *breaker) setState(state string) {
+	b.status.State = state
+	b.state.Set(state)
+}
+
+func (t *TableBackup) breakerStatus() BreakerStatus {
+	t.breaker.mu.Lock()
+	defer t.breaker.mu.Unlock()
+
+	return t.breaker.status
+}
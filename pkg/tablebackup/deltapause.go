@@ -0,0 +1,71 @@
+package tablebackup
+
+import (
+	"sync"
+	"time"
+)
+
+// DeltaPause holds off the consumption of the deltas while the base backups
+// copy their tables, giving the COPY the bandwidth of the server. The pause
+// lasts until the last of the concurrent copies is over, but no longer than
+// the window: the WAL retained by the slot grows in the meantime.
+type DeltaPause struct {
+	mu     sync.Mutex
+	window time.Duration // 0 disables the pause
+	copies int
+	since  time.Time // the start of the current pause
+}
+
+func NewDeltaPause(window time.Duration) *DeltaPause {
+	return &DeltaPause{window: window}
+}
+
+// Paused reports whether the deltas are not to be consumed now
+func (p *DeltaPause) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.copies > 0 && time.Since(p.since) < p.window
+}
+
+// begin is called at the start of the copy, returning its start time
+func (p *DeltaPause) begin() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.window > 0 {
+		if p.copies == 0 {
+			p.since = now
+		}
+		p.copies++
+	}
+
+	return now
+}
+
+// end is called at the end of the copy started at start, returning for how
+// long the deltas were paused during it
+func (p *DeltaPause) end(start time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.window == 0 {
+		return 0
+	}
+
+	end := time.Now()
+	if deadline := p.since.Add(p.window); end.After(deadline) {
+		end = deadline
+	}
+	p.copies--
+	if p.copies == 0 {
+		p.since = time.Time{}
+	}
+
+	if end.Before(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
@@ -0,0 +1,103 @@
+package tablebackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// saveDeltasOnlyInfo writes the info file of the table backed up without the
+// base backups: it describes the table structure and tells the restore that
+// all deltas should be applied on top of the data restored by other means.
+// The info file of an existing base backup is left intact.
+func (t *TableBackup) saveDeltasOnlyInfo() error {
+	if !t.lastBasebackupTime.IsZero() {
+		return nil
+	}
+
+	if _, err := os.Stat(path.Join(t.archiveDir, t.infoFilename)); err == nil {
+		log.Printf("%s already has a base backup, keeping its info file", t)
+		t.lastBasebackupTime = time.Now()
+		return nil
+	}
+
+	if err := t.connect(); err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+	defer t.disconnect()
+	defer t.endTx()
+
+	if err := t.txBegin(); err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	relationInfo, err := FetchRelationInfo(t.tx, t.Identifier)
+	if err != nil {
+		t.txRollback()
+		return fmt.Errorf("could not fetch table struct: %v", err)
+	}
+	if err := t.markUnsupportedColumns(&relationInfo); err != nil {
+		t.txRollback()
+		return err
+	}
+
+	var ddl *message.TableDDL
+	if t.cfg.CaptureDDL {
+		if ddl, err = t.tableDDL(); err != nil {
+			t.txRollback()
+			return fmt.Errorf("could not fetch table ddl: %v", err)
+		}
+	}
+
+	var hypertable *message.Identifier
+	if t.cfg.TimescaleHypertables {
+		if hypertable, err = t.hypertable(); err != nil {
+			t.txRollback()
+			return err
+		}
+	}
+
+	if err := t.txCommit(); err != nil {
+		return fmt.Errorf("could not commit: %v", err)
+	}
+
+	tempFilepath := path.Join(t.tableDir, t.infoFilename+".new")
+	fp, err := utils.CreateFile(tempFilepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not create info file: %v", err)
+	}
+
+	err = yaml.NewEncoder(fp).Encode(message.DumpInfo{
+		StartLSN:       "0/0",
+		CreateDate:     time.Now(),
+		Relation:       relationInfo,
+		Format:         config.DumpFormatDeltasOnly,
+		DDL:            ddl,
+		Operations:     t.cfg.TableOperations(t.tableName()),
+		SnapshotAction: config.SlotSnapshotNoExport,
+		Hypertable:     hypertable,
+	})
+	fp.Close()
+	if err != nil {
+		os.Remove(tempFilepath)
+		return fmt.Errorf("could not save info file: %v", err)
+	}
+
+	if err := os.Rename(tempFilepath, path.Join(t.tableDir, t.infoFilename)); err != nil {
+		return fmt.Errorf("could not move info file: %v", err)
+	}
+
+	t.archive(t.infoFilename)
+	t.lastBasebackupTime = time.Now()
+	log.Printf("saved deltas-only info of %s", t)
+
+	return nil
+}
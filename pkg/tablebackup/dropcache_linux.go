@@ -0,0 +1,23 @@
+//go:build linux && (amd64 || arm64)
+
+package tablebackup
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	dropCacheSupported = true
+
+	fadvDontNeed = 4 // POSIX_FADV_DONTNEED
+)
+
+func dropCache(fp *os.File, offset, length int64) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, fp.Fd(), uintptr(offset), uintptr(length), fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+
+package tablebackup
+
+import (
+	"os"
+)
+
+const dropCacheSupported = false
+
+func dropCache(fp *os.File, offset, length int64) error {
+	return nil
+}
@@ -0,0 +1,162 @@
+package tablebackup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+)
+
+// dropCacheChunk is the amount of the base backup written between the drops
+// of its pages from the page cache
+const dropCacheChunk = 64 * 1024 * 1024
+
+// dumpWriter buffers the writes of the base backup file. With the dontneed
+// cache mode the written pages are flushed and dropped from the page cache
+// every dropCacheChunk, so that a large base backup doesn't evict the hot data
+// of the host; the platforms without fadvise fall back to the buffered writes.
+type dumpWriter struct {
+	fp      *os.File
+	w       io.Writer
+	buf     *bufio.Writer // nil if unbuffered
+	mode    string
+	written int64
+	dropped int64 // the offset the pages are dropped up to
+	writes  int64
+	crc     hash.Hash32 // of the data written, see writeFooter
+
+	// of the COPY data written since mark, see checkStream
+	streamStart int64
+	head        []byte
+	tail        []byte
+}
+
+var (
+	binarySignature = []byte("PGCOPY\n\377\r\n\000")
+	binaryTrailer   = []byte{0xff, 0xff}
+)
+
+func newDumpWriter(fp *os.File, cfg *config.Config) *dumpWriter {
+	d := &dumpWriter{fp: fp, w: fp, mode: config.CopyCacheBuffered, crc: crc32.New(crcTable)}
+
+	if cfg.CopyBufferKB > 0 {
+		d.buf = bufio.NewWriterSize(fp, cfg.CopyBufferKB*1024)
+		d.w = d.buf
+	}
+
+	if cfg.CopyCacheMode == config.CopyCacheDontNeed && dropCacheSupported {
+		d.mode = config.CopyCacheDontNeed
+	}
+
+	return d
+}
+
+func (d *dumpWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	d.writes++
+	d.crc.Write(p[:n])
+	d.track(p[:n])
+	metrics.BasebackupBytesWritten.Add(d.mode, int64(n))
+	if err != nil {
+		return n, err
+	}
+
+	if d.mode == config.CopyCacheDontNeed && d.written-d.dropped >= dropCacheChunk {
+		if err := d.dropCache(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// mark starts the COPY data at the current offset, after the header of the sql dump
+func (d *dumpWriter) mark() {
+	d.streamStart = d.written
+	d.head, d.tail = d.head[:0], d.tail[:0]
+}
+
+// track keeps the first bytes of the COPY data and the last two
+func (d *dumpWriter) track(p []byte) {
+	if k := len(binarySignature) - len(d.head); k > 0 {
+		if k > len(p) {
+			k = len(p)
+		}
+		d.head = append(d.head, p[:k]...)
+	}
+
+	if len(p) >= len(binaryTrailer) {
+		d.tail = append(d.tail[:0], p[len(p)-len(binaryTrailer):]...)
+	} else {
+		d.tail = append(d.tail, p...)
+		if len(d.tail) > len(binaryTrailer) {
+			d.tail = d.tail[len(d.tail)-len(binaryTrailer):]
+		}
+	}
+}
+
+// checkStream makes sure the COPY data written since mark is complete, so
+// that a stream cut short is not taken for the whole table: the binary format
+// starts with its signature and ends with the trailer, the text and csv ones
+// end with the newline of the last row
+func (d *dumpWriter) checkStream(format string) error {
+	if format == config.BasebackupFormatBinary {
+		if !bytes.Equal(d.head, binarySignature) {
+			return fmt.Errorf("no binary copy signature")
+		}
+		if !bytes.Equal(d.tail, binaryTrailer) {
+			return fmt.Errorf("no binary copy trailer")
+		}
+
+		return nil
+	}
+
+	if d.written > d.streamStart && d.tail[len(d.tail)-1] != '\n' {
+		return fmt.Errorf("the last row is incomplete")
+	}
+
+	return nil
+}
+
+// Flush writes the buffered data to the file
+func (d *dumpWriter) Flush() error {
+	if d.buf != nil {
+		if err := d.buf.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if d.mode == config.CopyCacheDontNeed && d.written > d.dropped {
+		return d.dropCache()
+	}
+
+	return nil
+}
+
+// dropCache flushes the pages written since the previous drop to the disk,
+// as the dirty ones are not dropped, and advises the kernel to drop them
+func (d *dumpWriter) dropCache() error {
+	if d.buf != nil {
+		if err := d.buf.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.fp.Sync(); err != nil {
+		return fmt.Errorf("could not fsync: %v", err)
+	}
+
+	if err := dropCache(d.fp, d.dropped, d.written-d.dropped); err != nil {
+		return fmt.Errorf("could not drop page cache: %v", err)
+	}
+	d.dropped = d.written
+
+	return nil
+}
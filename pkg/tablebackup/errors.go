@@ -0,0 +1,89 @@
+package tablebackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+const (
+	duplicateObjectCode  = "42710"
+	lockNotAvailableCode = "55P03"
+	adminShutdownCode    = "57P01"
+	connectionClass      = "08"
+)
+
+// The kinds of the base backup failures, for the callers to tell them apart
+// with errors.Is
+var (
+	ErrNoConnection      = errors.New("no connection")
+	ErrSlotExists        = errors.New("replication slot already exists")
+	ErrNoConsistentPoint = errors.New("no consistent point")
+	ErrCopyFailed        = errors.New("copy failed")
+	ErrRetriesExhausted  = errors.New("copy retries exhausted")
+	ErrLockTimeout       = errors.New("lock timeout")
+)
+
+// Error is the failure of one of the kinds above, with the message of the
+// failed step and the underlying cause, if any
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+
+	return fmt.Sprintf("%s: %v", e.Msg, e.Err)
+}
+
+// Unwrap returns the cause, i.e. the pgx.PgError of the failed query
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the kind of the error
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func newError(kind error, msg string, err error) error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func isDuplicateObject(err error) bool {
+	var pgErr pgx.PgError
+
+	return errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode
+}
+
+func isLockNotAvailable(err error) bool {
+	var pgErr pgx.PgError
+
+	return errors.As(err, &pgErr) && pgErr.Code == lockNotAvailableCode
+}
+
+// isTransientCopyError reports whether the copy failed for a reason the next
+// attempt may not run into: the connection broke or the server shut down
+func isTransientCopyError(err error) bool {
+	if !errors.Is(err, ErrCopyFailed) {
+		return false
+	}
+
+	var pgErr pgx.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, connectionClass) || pgErr.Code == adminShutdownCode
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) || errors.Is(err, pgx.ErrDeadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,109 @@
+package tablebackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// footerSize is the length of the footer appended to the COPY dumps: the size
+// of the data before it, the number of rows, the crc32c of the data, the
+// version and the magic, all big-endian
+const (
+	footerSize    = 32
+	footerVersion = 1
+)
+
+var (
+	footerMagic = []byte("LBFOOTER")
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Footer describes the COPY data of a base backup file, so that its
+// completeness is checked without reading it all
+type Footer struct {
+	Size     int64
+	Rows     int64
+	Checksum uint32
+}
+
+// writeFooter appends the footer of the data written so far. The server sends
+// every row of the COPY in its own message, hence a write; the binary format
+// sends its trailer in one more.
+func (d *dumpWriter) writeFooter(binaryFormat bool) error {
+	f := Footer{Size: d.written, Rows: d.writes, Checksum: d.crc.Sum32()}
+	if binaryFormat && f.Rows > 0 {
+		f.Rows--
+	}
+
+	buf := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(buf[0:], uint64(f.Size))
+	binary.BigEndian.PutUint64(buf[8:], uint64(f.Rows))
+	binary.BigEndian.PutUint32(buf[16:], f.Checksum)
+	binary.BigEndian.PutUint32(buf[20:], footerVersion)
+	copy(buf[24:], footerMagic)
+
+	_, err := d.Write(buf)
+
+	return err
+}
+
+// ReadFooter reads the footer of the base backup file, failing if the file is
+// truncated
+func ReadFooter(fp *os.File) (Footer, error) {
+	var f Footer
+
+	st, err := fp.Stat()
+	if err != nil {
+		return f, fmt.Errorf("could not stat file: %v", err)
+	}
+	if st.Size() < footerSize {
+		return f, fmt.Errorf("file is truncated: no footer")
+	}
+
+	buf := make([]byte, footerSize)
+	if _, err := fp.ReadAt(buf, st.Size()-footerSize); err != nil {
+		return f, fmt.Errorf("could not read footer: %v", err)
+	}
+	if !bytes.Equal(buf[24:], footerMagic) {
+		return f, fmt.Errorf("file is truncated: no footer")
+	}
+	if v := binary.BigEndian.Uint32(buf[20:]); v != footerVersion {
+		return f, fmt.Errorf("unsupported footer version %d", v)
+	}
+
+	f.Size = int64(binary.BigEndian.Uint64(buf[0:]))
+	f.Rows = int64(binary.BigEndian.Uint64(buf[8:]))
+	f.Checksum = binary.BigEndian.Uint32(buf[16:])
+	if f.Size != st.Size()-footerSize {
+		return f, fmt.Errorf("file has %d bytes of data, the footer expects %d", st.Size()-footerSize, f.Size)
+	}
+
+	return f, nil
+}
+
+// Reader returns the reader of the data before the footer, failing instead of
+// reaching the end if the data doesn't match the checksum
+func (f Footer) Reader(rd io.Reader) io.Reader {
+	return &footerReader{rd: io.LimitReader(rd, f.Size), crc: crc32.New(crcTable), checksum: f.Checksum}
+}
+
+type footerReader struct {
+	rd       io.Reader
+	crc      hash.Hash32
+	checksum uint32
+}
+
+func (r *footerReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && r.crc.Sum32() != r.checksum {
+		return n, fmt.Errorf("checksum mismatch: the data is corrupted")
+	}
+
+	return n, err
+}
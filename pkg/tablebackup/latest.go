@@ -0,0 +1,201 @@
+package tablebackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// LatestFilename is the pointer to the latest complete base backup of the
+// table in its archive dir, see message.BasebackupPointer
+const LatestFilename = "latest"
+
+// PreviousDir keeps the base backup replaced by the latest one in the archive
+// dir of the table, along with its latest pointer, for as long as the deltas
+// it needs are retained, see config.DeltaRetentionPeriod
+const PreviousDir = "previous"
+
+// dumpFiles returns the dump files of the base backup of the info
+func dumpFiles(info message.DumpInfo) []string {
+	switch {
+	case info.Format == config.DumpFormatDeltasOnly:
+		return nil
+	case info.Format == config.BasebackupFormatSQL:
+		return []string{SQLDumpFilename}
+	case len(info.Parts) > 0:
+		return info.Parts
+	}
+
+	return []string{copyFilename}
+}
+
+// invalidateLatest removes the latest pointer before the files of the next
+// base backup start replacing the ones it points to. With the deltas retained
+// the base backup is moved to the previous dir instead.
+func (t *TableBackup) invalidateLatest() {
+	if t.cfg.DeltaRetentionPeriod > 0 || t.cfg.DeltaRetentionFiles > 0 {
+		if err := t.keepPrevious(); err != nil {
+			log.Printf("could not keep the previous base backup of %s: %v", t, err)
+		}
+	}
+
+	if err := os.Remove(path.Join(t.archiveDir, LatestFilename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("could not remove latest pointer of %s: %v", t, err)
+	}
+}
+
+// keepPrevious moves the base backup the latest pointer points to, if any, to
+// the previous dir, replacing the one there. The pointer is moved last, once
+// the files are in place.
+func (t *TableBackup) keepPrevious() error {
+	latest, err := ReadLatest(t.archiveDir)
+	if err != nil || latest == nil {
+		return err
+	}
+
+	prevDir := path.Join(t.archiveDir, PreviousDir)
+	if err := os.RemoveAll(prevDir); err != nil {
+		return fmt.Errorf("could not remove previous base backup: %v", err)
+	}
+	if err := utils.MkdirAll(prevDir, t.cfg.DirMode, t.cfg.FileGID()); err != nil {
+		return fmt.Errorf("could not create previous dir: %v", err)
+	}
+
+	for _, name := range append(append([]string{}, latest.Files...), latest.Info, LatestFilename) {
+		if err := os.Rename(path.Join(t.archiveDir, name), path.Join(prevDir, name)); err != nil {
+			return fmt.Errorf("could not move %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// updateLatest points the latest pointer to the base backup of the info file
+// just archived, once each of its dump files is archived and ends with a valid
+// footer. The dump files are archived before the info file, and the failed
+// copies are removed, so a missing file means the base backup is incomplete.
+func (t *TableBackup) updateLatest() error {
+	data, err := ioutil.ReadFile(path.Join(t.archiveDir, infoFilename))
+	if err != nil {
+		return fmt.Errorf("could not read info file: %v", err)
+	}
+
+	var info message.DumpInfo
+	if err := yaml.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("could not decode info file: %v", err)
+	}
+
+	files := dumpFiles(info)
+	for _, name := range files {
+		filename := path.Join(t.archiveDir, name)
+		if _, err := os.Stat(filename); err != nil {
+			return fmt.Errorf("base backup file %s is not archived: %v", name, err)
+		}
+		if info.Footers {
+			if err := checkFooter(filename); err != nil {
+				return fmt.Errorf("base backup file %s: %v", name, err)
+			}
+		}
+	}
+
+	data, err = yaml.Marshal(message.BasebackupPointer{
+		StartLSN:   info.StartLSN,
+		CreateDate: info.CreateDate,
+		Info:       infoFilename,
+		Files:      files,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode latest pointer: %v", err)
+	}
+
+	tempFilename := path.Join(t.archiveDir, LatestFilename+".new")
+	if err := writeFile(tempFilename, data, t.cfg.FileMode, t.cfg.FileGID()); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not write latest pointer: %v", err)
+	}
+	if err := os.Rename(tempFilename, path.Join(t.archiveDir, LatestFilename)); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not move latest pointer: %v", err)
+	}
+
+	return nil
+}
+
+// ReadLatest returns the latest pointer in the archive dir of the table, nil
+// if there is none: no base backup is completely archived yet, its files are
+// being replaced, or the archive predates the pointers
+func ReadLatest(archiveDir string) (*message.BasebackupPointer, error) {
+	data, err := ioutil.ReadFile(path.Join(archiveDir, LatestFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read latest pointer: %v", err)
+	}
+
+	var latest message.BasebackupPointer
+	if err := yaml.Unmarshal(data, &latest); err != nil {
+		return nil, fmt.Errorf("could not decode latest pointer: %v", err)
+	}
+
+	return &latest, nil
+}
+
+// BasebackupDir returns the dir of the base backup to restore the table from,
+// the one starting at or before lsn, if not 0: the archive dir of the table
+// for the latest base backup, or its previous dir for the one kept with the
+// deltas. The previous one is also taken while the latest one is replaced.
+func BasebackupDir(archiveDir string, lsn uint64) (string, error) {
+	prevDir := path.Join(archiveDir, PreviousDir)
+	prev, err := ReadLatest(prevDir)
+	if err != nil || prev == nil {
+		return archiveDir, err
+	}
+	prevLSN, err := pgx.ParseLSN(prev.StartLSN)
+	if err != nil {
+		return "", fmt.Errorf("could not parse lsn: %v", err)
+	}
+	if lsn != 0 && prevLSN > lsn {
+		return archiveDir, nil
+	}
+
+	latest, err := ReadLatest(archiveDir)
+	if err != nil {
+		return "", err
+	} else if latest == nil {
+		return prevDir, nil
+	}
+	latestLSN, err := pgx.ParseLSN(latest.StartLSN)
+	if err != nil {
+		return "", fmt.Errorf("could not parse lsn: %v", err)
+	}
+	if lsn == 0 || latestLSN <= lsn {
+		return archiveDir, nil
+	}
+
+	return prevDir, nil
+}
+
+// writeFile writes the file like ioutil.WriteFile, creating it with the group
+// gid, unless it's negative
+func writeFile(filename string, data []byte, mode os.FileMode, gid int) error {
+	fp, err := utils.CreateFile(filename, os.O_WRONLY|os.O_TRUNC, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
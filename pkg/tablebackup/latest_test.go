@@ -0,0 +1,103 @@
+package tablebackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// archiveBasebackup archives the base backup of the empty table at startLSN
+// the way the archiver does: the latest pointer invalidated, the dump and then
+// the info file copied, the pointer updated
+func archiveBasebackup(t *testing.T, tb *TableBackup, startLSN uint64) {
+	t.Helper()
+
+	tb.invalidateLatest()
+	if err := ioutil.WriteFile(path.Join(tb.archiveDir, copyFilename), nil, 0600); err != nil {
+		t.Fatalf("could not write dump file: %v", err)
+	}
+	data, err := yaml.Marshal(message.DumpInfo{
+		StartLSN:   pgx.FormatLSN(startLSN),
+		CreateDate: time.Now(),
+		Relation:   message.Relation{Identifier: tb.Identifier},
+	})
+	if err != nil {
+		t.Fatalf("could not encode info file: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tb.archiveDir, infoFilename), data, 0600); err != nil {
+		t.Fatalf("could not write info file: %v", err)
+	}
+	if err := tb.updateLatest(); err != nil {
+		t.Fatalf("could not point latest to the base backup: %v", err)
+	}
+}
+
+func TestKeepPreviousBasebackup(t *testing.T) {
+	tb := newTestTable(t, newTestConfig(t, "deltaRetentionFiles: 10\n"))
+	prevDir := path.Join(tb.archiveDir, PreviousDir)
+
+	archiveBasebackup(t, tb, 100)
+	if _, err := os.Stat(prevDir); !os.IsNotExist(err) {
+		t.Fatalf("previous dir of the first base backup: %v", err)
+	}
+
+	// the next one is being archived
+	tb.invalidateLatest()
+	prev, err := ReadLatest(prevDir)
+	if err != nil || prev == nil || prev.StartLSN != pgx.FormatLSN(100) {
+		t.Fatalf("previous base backup %v, %v, expected the one at %s", prev, err, pgx.FormatLSN(100))
+	}
+	if dir, err := BasebackupDir(tb.archiveDir, 0); err != nil || dir != prevDir {
+		t.Errorf("base backup dir while the latest one is replaced %q, %v, expected %q", dir, err, prevDir)
+	}
+
+	archiveBasebackup(t, tb, 300)
+	tests := []struct {
+		lsn      uint64
+		expected string
+	}{
+		{0, tb.archiveDir},
+		{400, tb.archiveDir},
+		{300, tb.archiveDir},
+		{200, prevDir},
+		{100, prevDir},
+		// neither: the restore refuses it
+		{50, tb.archiveDir},
+	}
+	for _, tt := range tests {
+		if dir, err := BasebackupDir(tb.archiveDir, tt.lsn); err != nil || dir != tt.expected {
+			t.Errorf("base backup dir for %s %q, %v, expected %q", pgx.FormatLSN(tt.lsn), dir, err, tt.expected)
+		}
+	}
+
+	// the one at 300 replaces the one at 100
+	archiveBasebackup(t, tb, 500)
+	if prev, err := ReadLatest(prevDir); err != nil || prev == nil || prev.StartLSN != pgx.FormatLSN(300) {
+		t.Errorf("previous base backup %v, %v, expected the one at %s", prev, err, pgx.FormatLSN(300))
+	}
+	for _, name := range []string{infoFilename, copyFilename} {
+		if _, err := os.Stat(path.Join(prevDir, name)); err != nil {
+			t.Errorf("previous base backup file %s: %v", name, err)
+		}
+	}
+}
+
+func TestNoPreviousBasebackupWithoutRetention(t *testing.T) {
+	tb := newTestTable(t, newTestConfig(t, ""))
+
+	archiveBasebackup(t, tb, 100)
+	archiveBasebackup(t, tb, 300)
+	if _, err := os.Stat(path.Join(tb.archiveDir, PreviousDir)); !os.IsNotExist(err) {
+		t.Errorf("previous dir without the delta retention: %v", err)
+	}
+	if dir, err := BasebackupDir(tb.archiveDir, 200); err != nil || dir != tb.archiveDir {
+		t.Errorf("base backup dir %q, %v, expected %q", dir, err, tb.archiveDir)
+	}
+}
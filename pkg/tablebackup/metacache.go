@@ -0,0 +1,100 @@
+package tablebackup
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+type relationKey struct {
+	db  string
+	oid uint32
+}
+
+// MetaCache holds the catalog metadata shared by all the table backups: the
+// data types of each database, fetched once instead of on every basebackup
+// connection, and the latest relation messages received from the stream.
+type MetaCache struct {
+	mu        sync.RWMutex
+	connInfo  map[string]*pgtype.ConnInfo
+	relations map[relationKey]message.Relation
+}
+
+func NewMetaCache() *MetaCache {
+	return &MetaCache{
+		connInfo:  make(map[string]*pgtype.ConnInfo),
+		relations: make(map[relationKey]message.Relation),
+	}
+}
+
+// DBKey identifies the database of the connection config in the cache
+func DBKey(cfg pgx.ConnConfig) string {
+	return fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.Database)
+}
+
+// ConnInfo returns a copy of the cached data types of the database, calling
+// fetch to populate the cache on the first use or after the invalidation
+func (c *MetaCache) ConnInfo(db string, fetch func() (*pgtype.ConnInfo, error)) (*pgtype.ConnInfo, error) {
+	c.mu.RLock()
+	cinfo, ok := c.connInfo[db]
+	c.mu.RUnlock()
+	if ok {
+		return cinfo.DeepCopy(), nil
+	}
+
+	cinfo, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.connInfo[db] = cinfo
+	c.mu.Unlock()
+
+	return cinfo.DeepCopy(), nil
+}
+
+// SetRelation stores the relation message. The data types of the database are
+// refetched on the next use if the relation has a column of an unknown type,
+// i.e. one created after they were cached.
+func (c *MetaCache) SetRelation(db string, rel message.Relation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.relations[relationKey{db, rel.OID}] = rel
+
+	cinfo, ok := c.connInfo[db]
+	if !ok {
+		return
+	}
+
+	for _, col := range rel.Columns {
+		if _, ok := cinfo.DataTypeForOID(pgtype.OID(col.TypeOID)); !ok {
+			delete(c.connInfo, db)
+			return
+		}
+	}
+}
+
+// Relation returns the latest relation message with the given oid
+func (c *MetaCache) Relation(db string, oid uint32) (message.Relation, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rel, ok := c.relations[relationKey{db, oid}]
+
+	return rel, ok
+}
+
+// DropRelation removes the relation, e.g. once the table is dropped or
+// recreated with a new oid
+func (c *MetaCache) DropRelation(db string, oid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.relations, relationKey{db, oid})
+}
@@ -0,0 +1,172 @@
+package tablebackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// dump writes the contents of the table either with a single COPY or, for the
+// tables big enough, with several COPY jobs sharing the snapshot of the
+// basebackup transaction. Returns the list of part files if the dump was split.
+// The sql dumps are always written with a single COPY.
+func (t *TableBackup) dump(rel message.Relation) ([]string, error) {
+	if t.basebackupFormat() == config.BasebackupFormatSQL {
+		return nil, t.sqlDump(rel)
+	}
+
+	if t.cfg.ParallelCopyJobs < 2 {
+		return nil, t.copyDump(rel)
+	}
+
+	// the ctid ranges are only scanned as such since PostgreSQL 14, each job
+	// would read the whole table before that
+	if version, err := ServerVersion(t.tx); err != nil {
+		return nil, err
+	} else if version < 140000 {
+		log.Printf("dumping %s with a single COPY: parallel COPY jobs need PostgreSQL 14, the server version is %d", t, version)
+		return nil, t.copyDump(rel)
+	}
+
+	pages, blockSize, err := t.relationPages()
+	if err != nil {
+		return nil, fmt.Errorf("could not get relation size: %v", err)
+	}
+
+	if pages*blockSize < int64(t.cfg.ParallelCopyMinSizeMB)*1024*1024 || pages < int64(t.cfg.ParallelCopyJobs) {
+		return nil, t.copyDump(rel)
+	}
+
+	return t.parallelCopyDump(pages, rel)
+}
+
+func (t *TableBackup) relationPages() (int64, int64, error) {
+	var pages, blockSize int64
+
+	row := t.tx.QueryRow(fmt.Sprintf(`select pg_relation_size(%s::regclass) / current_setting('block_size')::int,
+	current_setting('block_size')::int`, dbutils.QuoteLiteral(t.Identifier.Sanitize())))
+	if err := row.Scan(&pages, &blockSize); err != nil {
+		return 0, 0, fmt.Errorf("could not scan: %v", err)
+	}
+
+	return pages, blockSize, nil
+}
+
+// parallelCopyDump exports the snapshot of the basebackup transaction and
+// splits the table into ctid ranges, each dumped by a separate connection
+// importing that snapshot. The basebackup transaction must stay open until
+// all jobs have imported the snapshot, so it's not committed before they finish.
+func (t *TableBackup) parallelCopyDump(pages int64, rel message.Relation) ([]string, error) {
+	var snapshotName string
+
+	if t.tx == nil {
+		return nil, fmt.Errorf("no running transaction")
+	}
+
+	if err := t.tx.QueryRow("select pg_export_snapshot()").Scan(&snapshotName); err != nil {
+		return nil, fmt.Errorf("could not export snapshot: %v", err)
+	}
+
+	jobs := int64(t.cfg.ParallelCopyJobs)
+	pagesPerJob := pages/jobs + 1
+	log.Printf("dumping %s in %d parts of %d pages using snapshot %s", t, jobs, pagesPerJob, snapshotName)
+
+	parts := make([]string, jobs)
+	errs := make([]error, jobs)
+	wg := &sync.WaitGroup{}
+	for i := int64(0); i < jobs; i++ {
+		cond := fmt.Sprintf("ctid >= '(%d,0)'::tid", i*pagesPerJob)
+		if i < jobs-1 {
+			cond += fmt.Sprintf(" and ctid < '(%d,0)'::tid", (i+1)*pagesPerJob)
+		}
+		parts[i] = fmt.Sprintf("%s.%d", t.basebackupFilename, i)
+
+		wg.Add(1)
+		go func(i int64, cond string) {
+			defer wg.Done()
+			errs[i] = t.copyPart(snapshotName, parts[i], cond, rel)
+		}(i, cond)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			for _, part := range parts {
+				os.Remove(path.Join(t.tableDir, part+".new"))
+			}
+
+			return nil, fmt.Errorf("could not copy part %d: %w", i, err)
+		}
+	}
+
+	for _, part := range parts {
+		if err := os.Rename(path.Join(t.tableDir, part+".new"), path.Join(t.tableDir, part)); err != nil {
+			return nil, fmt.Errorf("could not move file: %v", err)
+		}
+
+		t.archive(part)
+	}
+
+	return parts, nil
+}
+
+func (t *TableBackup) copyPart(snapshotName, filename, cond string, rel message.Relation) error {
+	var conn *pgx.Conn
+	cfg := t.hostCfg.Merge(pgx.ConnConfig{
+		RuntimeParams: map[string]string{"application_name": t.applicationName()},
+	})
+	err := t.reconnector.Connect(t.ctx, func() (err error) {
+		conn, err = pgx.Connect(cfg)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, cfg))
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginEx(t.ctx, &pgx.TxOptions{
+		IsoLevel:   t.cfg.TxIsoLevel(),
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("set transaction snapshot %s", dbutils.QuoteLiteral(snapshotName))); err != nil {
+		return fmt.Errorf("could not import snapshot: %v", err)
+	}
+
+	fp, err := utils.CreateFile(path.Join(t.tableDir, filename+".new"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	query := fmt.Sprintf("copy (select %s from %s where %s) to stdout%s",
+		rel.SelectColumns(), t.Identifier.Sanitize(), cond, config.CopyOptions(t.basebackupFormat(), t.cfg.TableCopyOptions(t.tableName())))
+	w := newDumpWriter(fp, t.cfg)
+	if err := tx.CopyToWriter(w, query); err != nil {
+		return newError(ErrCopyFailed, "could not copy", err)
+	}
+	if err := w.checkStream(t.basebackupFormat()); err != nil {
+		return newError(ErrCopyFailed, "copy stream is inconsistent", err)
+	}
+	if err := w.writeFooter(t.basebackupFormat() == config.BasebackupFormatBinary); err != nil {
+		return fmt.Errorf("could not write footer: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write file: %v", err)
+	}
+
+	return nil
+}
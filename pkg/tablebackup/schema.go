@@ -0,0 +1,57 @@
+package tablebackup
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// FetchTableSchema returns the columns and the constraints of the table, as
+// seen by the transaction
+func FetchTableSchema(tx *pgx.Tx, tbl message.Identifier) (*message.TableSchema, error) {
+	schema := &message.TableSchema{Constraints: make(map[string]string)}
+	regclass := dbutils.QuoteLiteral(tbl.Sanitize())
+
+	rows, err := tx.Query(fmt.Sprintf(`select a.attname, format_type(a.atttypid, a.atttypmod), a.atttypid, a.attnotnull
+from pg_catalog.pg_attribute a
+where a.attrelid = %s::regclass and a.attnum > 0 and not a.attisdropped
+order by a.attnum`, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query columns: %v", err)
+	}
+	for rows.Next() {
+		var c message.SchemaColumn
+		if err := rows.Scan(&c.Name, &c.Type, &c.TypeOID, &c.NotNull); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+		schema.Columns = append(schema.Columns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch columns: %v", err)
+	}
+
+	rows, err = tx.Query(fmt.Sprintf(`select conname, pg_get_constraintdef(oid)
+from pg_catalog.pg_constraint
+where conrelid = %s::regclass`, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query constraints: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+		schema.Constraints[name] = def
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch constraints: %v", err)
+	}
+
+	return schema, nil
+}
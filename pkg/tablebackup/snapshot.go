@@ -0,0 +1,133 @@
+package tablebackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// SnapshotFilename is the file with the snapshot exported by the running basebackup
+const SnapshotFilename = "snapshot.yaml"
+
+// ExportedSnapshot is the snapshot of the basebackup transaction available to
+// the external tools with SET TRANSACTION SNAPSHOT
+type ExportedSnapshot struct {
+	Name      string    `json:"name" yaml:"name"`
+	LSN       string    `json:"lsn" yaml:"lsn"` // consistent point of the basebackup
+	ExpiresAt time.Time `json:"expiresAt" yaml:"expiresAt"`
+}
+
+// exportSnapshot keeps the basebackup transaction open for the configured
+// window, publishing its snapshot in the status and in the snapshot file of
+// the table dir, which is removed once the window is over
+func (t *TableBackup) exportSnapshot() error {
+	var snap ExportedSnapshot
+
+	if err := t.tx.QueryRow("select pg_export_snapshot()").Scan(&snap.Name); err != nil {
+		return fmt.Errorf("could not export snapshot: %v", err)
+	}
+	snap.LSN = pgx.FormatLSN(t.basebackupLSN)
+	snap.ExpiresAt = time.Now().Add(t.cfg.SnapshotExportWindow)
+
+	filename := path.Join(t.tableDir, SnapshotFilename)
+	fp, err := utils.CreateFile(filename+".new", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not create snapshot file: %v", err)
+	}
+	if err := yaml.NewEncoder(fp).Encode(snap); err != nil {
+		fp.Close()
+		os.Remove(filename + ".new")
+		return fmt.Errorf("could not save snapshot file: %v", err)
+	}
+	fp.Close()
+	if err := os.Rename(filename+".new", filename); err != nil {
+		return fmt.Errorf("could not move snapshot file: %v", err)
+	}
+
+	t.status.Lock()
+	t.status.Snapshot = &snap
+	t.status.Unlock()
+
+	defer func() {
+		t.status.Lock()
+		t.status.Snapshot = nil
+		t.status.Unlock()
+
+		os.Remove(filename)
+	}()
+
+	log.Printf("exported snapshot %s of %s until %v", snap.Name, t, snap.ExpiresAt.Format(time.RFC3339))
+
+	timer := time.NewTimer(t.cfg.SnapshotExportWindow)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+
+	return nil
+}
+
+// importSlotSnapshot starts the basebackup transaction on a separate
+// connection with the snapshot exported by the temp slot, which stays valid
+// while the replication connection is idle
+func (t *TableBackup) importSlotSnapshot() error {
+	if t.tx != nil {
+		return fmt.Errorf("there is already a transaction in progress")
+	}
+	if t.slotSnapshot == "" {
+		return fmt.Errorf("no snapshot exported by the slot")
+	}
+
+	cfg := t.hostCfg.Merge(pgx.ConnConfig{
+		RuntimeParams: map[string]string{"application_name": t.applicationName()},
+	})
+	err := t.reconnector.Connect(t.ctx, func() (err error) {
+		t.snapshotConn, err = pgx.Connect(cfg)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", dbutils.RedactPassword(err, cfg))
+	}
+
+	tx, err := t.snapshotConn.BeginEx(t.ctx, &pgx.TxOptions{
+		IsoLevel:   t.cfg.TxIsoLevel(),
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("could not begin tx: %v", err)
+	}
+	t.tx = tx
+
+	if _, err := tx.Exec(fmt.Sprintf("set transaction snapshot %s", dbutils.QuoteLiteral(t.slotSnapshot))); err != nil {
+		return fmt.Errorf("could not set snapshot: %v", err)
+	}
+
+	log.Printf("%s: using snapshot %s exported by the slot at %s", t, t.slotSnapshot, pgx.FormatLSN(t.basebackupLSN))
+
+	return nil
+}
+
+// clearSlotSnapshot ends the transaction with the imported slot snapshot, if
+// still running, and closes its connection
+func (t *TableBackup) clearSlotSnapshot() {
+	if t.snapshotConn != nil {
+		if t.tx != nil {
+			t.tx.Rollback()
+			t.tx = nil
+		}
+		t.snapshotConn.Close()
+		t.snapshotConn = nil
+	}
+	t.slotSnapshot = ""
+}
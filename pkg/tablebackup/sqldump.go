@@ -0,0 +1,252 @@
+package tablebackup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// SQLDumpFilename is the name of the basebackup file in the sql format
+const SQLDumpFilename = "basebackup.sql"
+
+// tableDDL returns the statements recreating the table: the create table with
+// the column definitions, followed by the table constraints and indexes, which
+// pg_dump also adds only after the data is loaded.
+func (t *TableBackup) tableDDL() (*message.TableDDL, error) {
+	ddl := &message.TableDDL{}
+	regclass := dbutils.QuoteLiteral(t.Identifier.Sanitize())
+
+	attGenerated, err := attGeneratedColumn(t.tx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.tx.Query(fmt.Sprintf(`select a.attname,
+	format_type(a.atttypid, a.atttypmod),
+	a.attnotnull,
+	coalesce(pg_get_expr(d.adbin, d.adrelid), ''),
+	a.attidentity,
+	%s
+from pg_catalog.pg_attribute a
+left join pg_catalog.pg_attrdef d on d.adrelid = a.attrelid and d.adnum = a.attnum
+where a.attrelid = %s::regclass and a.attnum > 0 and not a.attisdropped
+order by a.attnum`, attGenerated, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query columns: %v", err)
+	}
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var name, typ, def, identity, generated string
+		var notNull bool
+
+		if err := rows.Scan(&name, &typ, &notNull, &def, &identity, &generated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		column := fmt.Sprintf("    %s %s", pgx.Identifier{name}.Sanitize(), typ)
+		switch {
+		case generated == "s":
+			column += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", def)
+		case identity == "a":
+			column += " GENERATED ALWAYS AS IDENTITY"
+		case identity == "d":
+			column += " GENERATED BY DEFAULT AS IDENTITY"
+		case def != "":
+			column += " DEFAULT " + def
+		}
+		if notNull {
+			column += " NOT NULL"
+		}
+		columns = append(columns, column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch columns: %v", err)
+	}
+
+	// partitioned tables have the partition key, partitions the bound and the parent
+	var partKey, parent, bound string
+	row := t.tx.QueryRow(fmt.Sprintf(`select case when c.relkind = 'p' then pg_get_partkeydef(c.oid) else '' end,
+	coalesce((select format('%%I.%%I', pn.nspname, p.relname)
+		from pg_catalog.pg_inherits i
+		join pg_catalog.pg_class p on p.oid = i.inhparent
+		join pg_catalog.pg_namespace pn on pn.oid = p.relnamespace
+		where i.inhrelid = c.oid), ''),
+	coalesce(pg_get_expr(c.relpartbound, c.oid), '')
+from pg_catalog.pg_class c
+where c.oid = %s::regclass`, regclass))
+	if err := row.Scan(&partKey, &parent, &bound); err != nil {
+		return nil, fmt.Errorf("could not fetch partitioning: %v", err)
+	}
+
+	ddl.CreateTable = fmt.Sprintf("CREATE TABLE %s (\n%s\n)", t.Identifier.Sanitize(), strings.Join(columns, ",\n"))
+	if partKey != "" {
+		ddl.CreateTable += " PARTITION BY " + partKey
+	}
+	ddl.CreateTable += ";\n"
+
+	if bound != "" && parent != "" {
+		ddl.Parent = parent
+		ddl.Partition = fmt.Sprintf("ALTER TABLE ONLY %s ATTACH PARTITION %s %s;\n", parent, t.Identifier.Sanitize(), bound)
+	}
+
+	rows, err = t.tx.Query(fmt.Sprintf(`select format('%%I.%%I', n.nspname, s.relname), a.attname
+from pg_catalog.pg_depend d
+join pg_catalog.pg_class s on s.oid = d.objid and s.relkind = 'S'
+join pg_catalog.pg_namespace n on n.oid = s.relnamespace
+join pg_catalog.pg_attribute a on a.attrelid = d.refobjid and a.attnum = d.refobjsubid
+where d.classid = 'pg_catalog.pg_class'::regclass and d.refobjid = %s::regclass and d.deptype = 'a'
+order by a.attnum`, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query sequences: %v", err)
+	}
+
+	for rows.Next() {
+		var seq, column string
+
+		if err := rows.Scan(&seq, &column); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		ddl.Sequences = append(ddl.Sequences, fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s;\n", seq))
+		ddl.OwnedBy = append(ddl.OwnedBy, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s;\n",
+			seq, t.Identifier.Sanitize(), pgx.Identifier{column}.Sanitize()))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch sequences: %v", err)
+	}
+
+	rows, err = t.tx.Query(fmt.Sprintf(`select conname, pg_get_constraintdef(oid)
+from pg_catalog.pg_constraint
+where conrelid = %s::regclass and contype in ('p', 'u', 'c', 'x')
+order by contype = 'p' desc, conname`, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query constraints: %v", err)
+	}
+
+	for rows.Next() {
+		var name, def string
+
+		if err := rows.Scan(&name, &def); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		ddl.Constraints = append(ddl.Constraints, fmt.Sprintf("ALTER TABLE ONLY %s\n    ADD CONSTRAINT %s %s;\n",
+			t.Identifier.Sanitize(), pgx.Identifier{name}.Sanitize(), def))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch constraints: %v", err)
+	}
+
+	// the indexes backing the constraints are created with them
+	rows, err = t.tx.Query(fmt.Sprintf(`select pg_get_indexdef(i.indexrelid)
+from pg_catalog.pg_index i
+join pg_catalog.pg_class c on c.oid = i.indexrelid
+where i.indrelid = %s::regclass
+	and not exists (select 1 from pg_catalog.pg_constraint con where con.conrelid = i.indrelid and con.conindid = i.indexrelid)
+order by c.relname`, regclass))
+	if err != nil {
+		return nil, fmt.Errorf("could not query indexes: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var def string
+
+		if err := rows.Scan(&def); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		ddl.Indexes = append(ddl.Indexes, def+";\n")
+	}
+
+	return ddl, rows.Err()
+}
+
+// sqlDump writes the self-contained sql dump of the table, the same way
+// pg_dump does in the plain format: the ddl and the data in a COPY block,
+// so it's possible to restore the table with psql.
+func (t *TableBackup) sqlDump(rel message.Relation) error {
+	if t.tx == nil {
+		return fmt.Errorf("no running transaction")
+	}
+	if t.basebackupLSN == 0 {
+		return fmt.Errorf("no consistent point")
+	}
+
+	ddl, err := t.tableDDL()
+	if err != nil {
+		return fmt.Errorf("could not fetch table ddl: %v", err)
+	}
+
+	tempFilename := path.Join(t.tableDir, SQLDumpFilename+".new")
+	fp, err := utils.CreateFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	w := newDumpWriter(fp, t.cfg)
+	fmt.Fprintf(w, "--\n-- Dump of %s at lsn %s, taken %s\n--\n\n",
+		t.Identifier, pgx.FormatLSN(t.basebackupLSN), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "SET client_encoding = 'UTF8';\nSET standard_conforming_strings = on;\n\n")
+	for _, seq := range ddl.Sequences {
+		fmt.Fprintf(w, "%s\n", seq)
+	}
+	fmt.Fprintf(w, "%s\n", ddl.CreateTable)
+	fmt.Fprintf(w, "COPY %s%s FROM stdin;\n", t.Identifier.Sanitize(), rel.CopyColumns())
+
+	source, err := t.copySource(rel)
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+
+	w.mark()
+	if err := t.tx.CopyToWriter(w, fmt.Sprintf("copy %s to stdout", source)); err != nil {
+		os.Remove(tempFilename)
+		return newError(ErrCopyFailed, "could not copy", err)
+	}
+	if err := w.checkStream(config.BasebackupFormatSQL); err != nil {
+		os.Remove(tempFilename)
+		return newError(ErrCopyFailed, "copy stream is inconsistent", err)
+	}
+
+	fmt.Fprintf(w, "\\.\n\n")
+	for _, stmts := range [][]string{ddl.Constraints, ddl.Indexes, ddl.OwnedBy} {
+		for _, stmt := range stmts {
+			fmt.Fprintf(w, "%s\n", stmt)
+		}
+	}
+	if ddl.Partition != "" {
+		fmt.Fprintf(w, "%s\n", ddl.Partition)
+	}
+
+	if err := w.Flush(); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("could not write file: %v", err)
+	}
+
+	if err := os.Rename(tempFilename, path.Join(t.tableDir, SQLDumpFilename)); err != nil {
+		return fmt.Errorf("could not move file: %v", err)
+	}
+
+	t.archive(SQLDumpFilename)
+
+	return nil
+}
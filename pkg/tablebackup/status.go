@@ -0,0 +1,121 @@
+package tablebackup
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/dbutils"
+)
+
+// Estimate is the expected size and duration of the table basebackup
+type Estimate struct {
+	Size     int64         `json:"size"`     // heap size in bytes
+	Rows     int64         `json:"rows"`     // planner estimate of the row count
+	Duration time.Duration `json:"duration"` // size divided by the configured COPY throughput
+}
+
+// Status is the state of the table backup exposed via the status API
+type Status struct {
+	Table     string    `json:"table"`
+	Estimate  Estimate  `json:"estimate"`
+	Dropped   bool      `json:"dropped"`
+	DroppedAt time.Time `json:"droppedAt,omitempty"`
+	Removed   bool      `json:"removed"` // from the backup set of the tables query
+	Priority  string    `json:"priority"`
+
+	Snapshot *ExportedSnapshot `json:"snapshot,omitempty"` // set while the basebackup snapshot is exported
+	Breaker  BreakerStatus     `json:"breaker"`
+
+	// counters since the start of the backup
+	LastBasebackup     time.Time     `json:"lastBasebackup,omitempty"`
+	SinceBasebackup    time.Duration `json:"sinceBasebackup,omitempty"` // the recency of the last base backup
+	Basebackups        int           `json:"basebackups"`
+	SkippedBasebackups int           `json:"skippedBasebackups"` // not needed or held off by the circuit breaker
+	FailedBasebackups  int           `json:"failedBasebackups"`
+	ArchivedBytes      int64         `json:"archivedBytes"`            // of all files moved to the archive dir
+	ArchivedDeltas     int           `json:"archivedDeltas"`           // delta files moved to the archive dir
+	LastDeltaPause     time.Duration `json:"lastDeltaPause,omitempty"` // the deltas were not consumed for during the last copy, see DeltaPause
+}
+
+type status struct {
+	sync.Mutex
+	Status
+}
+
+// EstimateBasebackup fetches the table size and row count from the catalog;
+// it doesn't scan the table.
+func (t *TableBackup) EstimateBasebackup(conn *pgx.Conn) (Estimate, error) {
+	var est Estimate
+
+	row := conn.QueryRow(fmt.Sprintf("select pg_relation_size(c.oid), greatest(c.reltuples, 0)::bigint from pg_class c where c.oid = %s::regclass",
+		dbutils.QuoteLiteral(t.Identifier.Sanitize())))
+	if err := row.Scan(&est.Size, &est.Rows); err != nil {
+		return est, fmt.Errorf("could not scan: %v", err)
+	}
+
+	est.Duration = time.Duration(float64(est.Size) / float64(t.cfg.CopyThroughputMB*1024*1024) * float64(time.Second))
+
+	t.status.Lock()
+	t.status.Estimate = est
+	t.status.Unlock()
+
+	return est, nil
+}
+
+// Status returns a copy of the current table backup state
+func (t *TableBackup) Status() Status {
+	t.status.Lock()
+	defer t.status.Unlock()
+
+	st := t.status.Status
+	st.Table = t.String()
+	st.Breaker = t.breakerStatus()
+	st.Priority = t.cfg.TablePriority(t.tableName())
+	if !st.LastBasebackup.IsZero() {
+		st.SinceBasebackup = time.Since(st.LastBasebackup)
+	}
+
+	return st
+}
+
+// countBasebackup accounts the outcome of the base backup attempt; the base
+// backup time only changes if the backup was taken
+func (t *TableBackup) countBasebackup(prevTime time.Time, err error) {
+	t.status.Lock()
+	defer t.status.Unlock()
+
+	switch {
+	case err != nil:
+		t.status.FailedBasebackups++
+	case !t.lastBasebackupTime.Equal(prevTime):
+		t.status.Basebackups++
+		t.status.LastBasebackup = t.lastBasebackupTime
+	default:
+		t.status.SkippedBasebackups++
+	}
+}
+
+func (t *TableBackup) setDeltaPause(d time.Duration) {
+	if d > 0 {
+		log.Printf("consumption of the deltas was paused for %v while copying %s", d, t)
+	}
+
+	t.status.Lock()
+	t.status.LastDeltaPause = d
+	t.status.Unlock()
+}
+
+func (t *TableBackup) countArchived(file string, size int64) {
+	t.status.Lock()
+	defer t.status.Unlock()
+
+	t.status.ArchivedBytes += size
+	if strings.HasPrefix(file, deltasDir+"/") {
+		t.status.ArchivedDeltas++
+	}
+}
@@ -3,11 +3,16 @@ package tablebackup
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -15,15 +20,18 @@ import (
 
 	"github.com/ikitiki/logical_backup/pkg/config"
 	"github.com/ikitiki/logical_backup/pkg/dbutils"
+	"github.com/ikitiki/logical_backup/pkg/decoder"
 	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/metrics"
 	"github.com/ikitiki/logical_backup/pkg/queue"
 	"github.com/ikitiki/logical_backup/pkg/utils"
 )
 
 const (
-	dirPerms       = os.ModePerm
 	archiverBuffer = 100
 	deltasDir      = "deltas"
+	infoFilename   = "info.yaml"
+	copyFilename   = "basebackup.copy"
 )
 
 type TableBackuper interface {
@@ -33,6 +41,12 @@ type TableBackuper interface {
 	Truncate() error
 	String() string
 	CloseOldFiles() error
+	Sync() error
+	Status() Status
+	Stop() error
+	EstimateBasebackup(*pgx.Conn) (Estimate, error)
+	Validate(uint64) Validation
+	HasBasebackup() bool
 }
 
 type TableBackup struct {
@@ -44,10 +58,18 @@ type TableBackup struct {
 	oid uint32
 
 	// Basebackup
-	tx    *pgx.Tx
-	conn  *pgx.Conn
-	cfg   *config.Config
-	dbCfg pgx.ConnConfig
+	tx      *pgx.Tx
+	conn    *pgx.Conn
+	cfg     *config.Config
+	dbCfg   pgx.ConnConfig
+	hostCfg pgx.ConnConfig // dbCfg narrowed to the host of conn, see config.BasebackupSessionAttrs
+	meta    *MetaCache
+	dbKey   string
+
+	scheduler config.Scheduler // when the periodic base backups fire
+
+	reconnector     *dbutils.Reconnector // shared by all tables
+	connectFailures int                  // consecutive failed connection attempts
 
 	// Files
 	tableDir           string
@@ -63,23 +85,40 @@ type TableBackup struct {
 	lastLSN              uint64
 	currentDeltaFp       *os.File
 	currentDeltaFilename string
+	currentDeltaSynced   bool
+	deltaFileMu          sync.Mutex         // held while the current delta file changes, see RotateOldDeltas
+	lastBegin            message.Begin      // the begin of the transaction being written
+	bufferedChanges      expvar.Int         // written since the last fsync, published in metrics.DeltaBufferedChanges
+	deltaBytes           expvar.Int         // written since the last base backup, published in metrics.DeltaBytes
+	deltaCapReached      uint32             // 1 once deltaBytes went over the cap, see checkDeltaCap; accessed atomically
+	fsyncLatency         *metrics.Histogram // published in metrics.DeltaFsyncSeconds
 
 	// Basebackup
 	basebackupLSN       uint64
+	slotSnapshot        string    // exported by the temp slot, see config.SlotSnapshotExport
+	tempSlotSuffix      int       // of the temp slot renamed on the collision, see config.DuplicateTempSlot
+	snapshotConn        *pgx.Conn // the one the exported slot snapshot is imported in
 	lastBasebackupTime  time.Time
 	sleepBetweenBackups time.Duration
 	lastBackupDuration  time.Duration
 	lastWrittenMessage  time.Time
 
-	locker uint32
+	locker  uint32
+	dropped uint32 // set once the table is found dropped upstream
+	stopped uint32 // set once the table is removed from the backup set
 
 	basebackupQueue *queue.Queue
+	deltaPause      *DeltaPause // shared by all tables
+	archiveLimiter  *ArchiveLimiter
 	msgLen          []byte
 
 	archiveFiles chan string // path relative to table dir
+
+	status  status
+	breaker breaker
 }
 
-func New(ctx context.Context, cfg *config.Config, tbl message.Identifier, dbCfg pgx.ConnConfig, basebackupsQueue *queue.Queue) (*TableBackup, error) { //TODO: maybe use oid instead of schema-name pair?
+func New(ctx context.Context, cfg *config.Config, tbl message.Identifier, dbCfg pgx.ConnConfig, meta *MetaCache, reconnector *dbutils.Reconnector, deltaPause *DeltaPause, archiveLimiter *ArchiveLimiter, basebackupsQueue *queue.Queue) (*TableBackup, error) { //TODO: maybe use oid instead of schema-name pair?
 	tableDir := utils.TableDir(tbl)
 
 	tb := TableBackup{
@@ -88,10 +127,15 @@ func New(ctx context.Context, cfg *config.Config, tbl message.Identifier, dbCfg
 		sleepBetweenBackups: time.Second * 3,
 		cfg:                 cfg,
 		dbCfg:               dbCfg,
+		meta:                meta,
+		dbKey:               DBKey(dbCfg),
+		reconnector:         reconnector,
+		deltaPause:          deltaPause,
+		archiveLimiter:      archiveLimiter,
 		tableDir:            path.Join(cfg.TempDir, tableDir),
 		archiveDir:          path.Join(cfg.ArchiveDir, tableDir),
-		basebackupFilename:  "basebackup.copy",
-		infoFilename:        "info.yaml",
+		basebackupFilename:  copyFilename,
+		infoFilename:        infoFilename,
 		msgLen:              make([]byte, 8),
 		archiveFiles:        make(chan string, archiverBuffer),
 	}
@@ -100,7 +144,17 @@ func New(ctx context.Context, cfg *config.Config, tbl message.Identifier, dbCfg
 		return nil, fmt.Errorf("could not create dirs: %v", err)
 	}
 
+	if err := tb.reshardDeltas(); err != nil {
+		return nil, fmt.Errorf("could not move delta files: %v", err)
+	}
+
 	tb.basebackupQueue = basebackupsQueue
+	tb.scheduler = cfg.TableScheduler(tb.tableName())
+	tb.initBreaker()
+	tb.fsyncLatency = metrics.NewHistogram(metrics.LatencyBuckets)
+	metrics.DeltaFsyncSeconds.Set(tb.String(), tb.fsyncLatency)
+	metrics.DeltaBufferedChanges.Set(tb.String(), &tb.bufferedChanges)
+	metrics.DeltaBytes.Set(tb.String(), &tb.deltaBytes)
 
 	go tb.archiver()
 	go tb.periodicBackup()
@@ -108,9 +162,62 @@ func New(ctx context.Context, cfg *config.Config, tbl message.Identifier, dbCfg
 	return &tb, nil
 }
 
+// encodeDelta converts the raw pgoutput message to the configured delta format.
+// Returns nil for the messages that are not stored in that format.
+func (t *TableBackup) encodeDelta(msg []byte) ([]byte, error) {
+	if t.cfg.DeltaFormat != config.DeltaFormatJSON {
+		ln := uint64(len(msg) + 8)
+		binary.BigEndian.PutUint64(t.msgLen, ln)
+
+		return append(t.msgLen, msg...), nil
+	}
+
+	m, err := decoder.Parse(msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse message: %v", err)
+	}
+
+	var relOID uint32
+	switch v := m.(type) {
+	case message.Insert:
+		relOID = v.RelationOID
+	case message.Update:
+		relOID = v.RelationOID
+	case message.Delete:
+		relOID = v.RelationOID
+	}
+	rel, _ := t.meta.Relation(t.dbKey, relOID)
+
+	d := message.NewJSONDelta(m, rel)
+	if d == nil {
+		return nil, nil
+	}
+
+	if begin, ok := m.(message.Begin); ok {
+		t.lastBegin = begin
+	} else if t.cfg.DeltaCommitInfo {
+		d.SetCommitInfo(t.lastBegin)
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode json delta: %v", err)
+	}
+
+	return append(data, '\n'), nil
+}
+
 func (t *TableBackup) SaveRawMessage(msg []byte, lsn uint64) (uint64, error) {
+	data, err := t.encodeDelta(msg)
+	if err != nil {
+		return 0, err
+	} else if data == nil {
+		return 0, nil
+	}
+
 	if t.deltaCnt >= t.cfg.DeltasPerFile || t.currentDeltaFp == nil {
 		if err := t.rotateFile(lsn); err != nil {
+			metrics.DeltaWriteErrors.Add(t.String(), 1)
 			return 0, fmt.Errorf("could not rotate file: %v", err)
 		}
 	}
@@ -123,18 +230,20 @@ func (t *TableBackup) SaveRawMessage(msg []byte, lsn uint64) (uint64, error) {
 	t.deltaCnt++
 	t.deltasSinceBackupCnt++
 
-	ln := uint64(len(msg) + 8)
+	ln := uint64(len(data))
 
-	binary.BigEndian.PutUint64(t.msgLen, ln)
-
-	_, err := t.currentDeltaFp.Write(append(t.msgLen, msg...))
-	if err != nil {
+	if _, err := t.currentDeltaFp.Write(data); err != nil {
+		metrics.DeltaWriteErrors.Add(t.String(), 1)
 		return 0, fmt.Errorf("could not save delta: %v", err)
 	}
 
+	t.currentDeltaSynced = false
+	t.bufferedChanges.Add(1)
+	t.deltaBytes.Add(int64(ln))
+	t.checkDeltaCap()
 	if t.cfg.Fsync {
-		if err := t.currentDeltaFp.Sync(); err != nil {
-			return 0, fmt.Errorf("could not fsync: %v", err)
+		if err := t.Sync(); err != nil {
+			return 0, err
 		}
 	}
 
@@ -143,39 +252,131 @@ func (t *TableBackup) SaveRawMessage(msg []byte, lsn uint64) (uint64, error) {
 	return ln, nil
 }
 
+// checkDeltaCap acts on the deltas of the table growing over the cap before
+// the next base backup, once until the base backup resets the count. The
+// deltas are never removed to make room: the base backup lets the rotation
+// free the old ones.
+func (t *TableBackup) checkDeltaCap() {
+	capMB := t.cfg.TableDeltaCapMB(t.tableName())
+	// reset by the base backup running apart from the writes of the deltas
+	if capMB == 0 || atomic.LoadUint32(&t.deltaCapReached) == 1 || t.deltaBytes.Value() < int64(capMB)<<20 {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&t.deltaCapReached, 0, 1) {
+		return
+	}
+
+	if t.cfg.DeltaCapAction == config.DeltaCapLog {
+		log.Printf("%s has %d bytes of deltas since the last base backup, over the %dMB cap", t, t.deltaBytes.Value(), capMB)
+		return
+	}
+
+	log.Printf("queueing base backup of %s because its deltas reached the %dMB cap", t, capMB)
+	t.basebackupQueue.Put(t)
+}
+
+// archiver copies the queued files into the archive dir. The ones waiting for
+// the turn of the copy are kept aside, so the queue never fills up on the
+// copies of the other tables: the writes of the deltas and base backups only
+// wait for the copy of the file at hand
 func (t *TableBackup) archiver() {
+	var pending []string
 	for {
+		var turn chan<- struct{}
+		if len(pending) > 0 {
+			turn = t.archiveLimiter.turn()
+		}
+
 		select {
 		case file := <-t.archiveFiles:
-			sourceFile := path.Join(t.tableDir, file)
-			destFile := path.Join(t.archiveDir, file)
-
-			if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
-				log.Printf("source file doesn't exist: %q; skipping", sourceFile)
-				break
+			if t.archiveLimiter.limited() {
+				pending = append(pending, file)
+				continue
 			}
+			metrics.ArchiveQueueDepth.Add(-1)
+			t.archiveFile(file)
+		case turn <- struct{}{}:
+			file := pending[0]
+			pending = pending[1:]
+			metrics.ArchiveQueueDepth.Add(-1)
+			t.archiveFile(file)
+			t.archiveLimiter.release()
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
 
-			if st, err := os.Stat(destFile); os.IsExist(err) {
-				if st.Size() == 0 {
-					os.Remove(destFile)
-				} else {
-					log.Printf("destination file is not empty %q; skipping", destFile)
-				}
-			}
+// archiveFile moves the file, relative to the table dir, to the archive dir
+func (t *TableBackup) archiveFile(file string) {
+	sourceFile := path.Join(t.tableDir, file)
+	destFile := path.Join(t.archiveDir, file)
 
-			if _, err := copyFile(sourceFile, destFile); err != nil {
-				os.Remove(destFile)
-				log.Printf("could not move %s -> %s file: %v", sourceFile, destFile, err)
-				break
-			}
+	if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
+		log.Printf("source file doesn't exist: %q; skipping", sourceFile)
+		return
+	}
 
-			if err := os.Remove(sourceFile); err != nil {
-				log.Printf("could not delete old file: %v", err)
-			}
-		case <-t.ctx.Done():
-			return
+	if st, err := os.Stat(destFile); os.IsExist(err) {
+		if st.Size() == 0 {
+			os.Remove(destFile)
+		} else {
+			log.Printf("destination file is not empty %q; skipping", destFile)
+		}
+	}
+
+	// keep the garbage collector off while the file is being copied
+	unlock, err := utils.LockDir(t.archiveDir, false, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		log.Printf("could not lock %s: %v", t.archiveDir, err)
+		return
+	}
+
+	if err := utils.MkdirAll(path.Dir(destFile), t.cfg.DirMode, t.cfg.FileGID()); err != nil {
+		unlock()
+		log.Printf("could not create dir of %s: %v", destFile, err)
+		return
+	}
+	if !strings.HasPrefix(file, deltasDir+"/") {
+		t.invalidateLatest() // a base backup file is being replaced
+	}
+	n, err := copyFile(sourceFile, destFile, t.cfg.FileMode, t.cfg.FileGID())
+	if err == nil && file == t.infoFilename {
+		if err := t.updateLatest(); err != nil {
+			log.Printf("not pointing latest to the base backup of %s: %v", t, err)
 		}
 	}
+	unlock()
+	if err != nil {
+		os.Remove(destFile)
+		log.Printf("could not move %s -> %s file: %v", sourceFile, destFile, err)
+		return
+	}
+	t.countArchived(file, n)
+
+	if err := os.Remove(sourceFile); err != nil {
+		log.Printf("could not delete old file: %v", err)
+	} else if dir := path.Dir(sourceFile); dir != path.Join(t.tableDir, deltasDir) && path.Dir(dir) == path.Join(t.tableDir, deltasDir) {
+		os.Remove(dir) // the shard, once empty
+	}
+}
+
+// Sync makes the deltas written so far durable
+func (t *TableBackup) Sync() error {
+	if t.currentDeltaFp == nil || t.currentDeltaSynced {
+		return nil
+	}
+
+	started := time.Now()
+	if err := t.currentDeltaFp.Sync(); err != nil {
+		metrics.DeltaWriteErrors.Add(t.String(), 1)
+		return fmt.Errorf("could not fsync: %v", err)
+	}
+	t.fsyncLatency.Observe(time.Since(started).Seconds())
+	t.currentDeltaSynced = true
+	t.bufferedChanges.Set(0)
+
+	return nil
 }
 
 func (t *TableBackup) Files() int {
@@ -184,14 +385,18 @@ func (t *TableBackup) Files() int {
 
 func (t *TableBackup) rotateFile(newLSN uint64) error {
 	if t.currentDeltaFp != nil {
+		if err := t.Sync(); err != nil {
+			return err
+		}
+
 		if err := t.currentDeltaFp.Close(); err != nil {
 			return fmt.Errorf("could not close old file: %v", err)
 		}
 
-		t.archiveFiles <- t.currentDeltaFilename //TODO: potential lock
+		t.archive(t.currentDeltaFilename) //TODO: potential lock
 	}
 
-	filename := path.Join(deltasDir, fmt.Sprintf("%016x", newLSN))
+	filename := path.Join(deltasDir, utils.DeltaPath(fmt.Sprintf("%016x", newLSN), t.cfg.DeltaShardPrefix))
 	if _, err := os.Stat(filename); t.lastLSN == newLSN || os.IsExist(err) {
 		t.filenamePostfix++
 	} else {
@@ -202,11 +407,15 @@ func (t *TableBackup) rotateFile(newLSN uint64) error {
 		filename = fmt.Sprintf("%s.%x", filename, t.filenamePostfix)
 	}
 
-	fp, err := os.OpenFile(path.Join(t.tableDir, filename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	t.deltaFileMu.Lock()
+	defer t.deltaFileMu.Unlock()
+
+	fp, err := t.createDeltaFile(filename)
 	if err != nil {
 		return err
 	}
 	t.currentDeltaFp = fp
+	t.currentDeltaSynced = true
 
 	t.currentDeltaFilename = filename
 	t.lastLSN = newLSN
@@ -216,8 +425,21 @@ func (t *TableBackup) rotateFile(newLSN uint64) error {
 	return nil
 }
 
+// nextBackupDelay returns the time until the next periodic base backup of the
+// table according to its scheduler
+func (t *TableBackup) nextBackupDelay() time.Duration {
+	now := time.Now()
+	next := t.scheduler.Next(now)
+	if next.IsZero() {
+		// the schedule ran out, check again in a while
+		return t.cfg.TablePeriodBetweenBackups(t.tableName())
+	}
+
+	return next.Sub(now)
+}
+
 func (t *TableBackup) periodicBackup() {
-	periodicBackup := time.NewTicker(t.cfg.PeriodBetweenBackups)
+	periodicBackup := time.NewTimer(t.nextBackupDelay())
 	heartbeat := time.NewTicker(time.Minute)
 
 	for {
@@ -227,10 +449,14 @@ func (t *TableBackup) periodicBackup() {
 			heartbeat.Stop()
 			return
 		case <-periodicBackup.C:
+			periodicBackup.Reset(t.nextBackupDelay())
+			if t.IsDropped() || t.isStopped() {
+				break
+			}
 			log.Printf("queuing backup of %s", t)
-			//t.basebackupQueue.Put(t)
+			t.basebackupQueue.Put(t)
 		case <-heartbeat.C:
-			if t.lastWrittenMessage.IsZero() || t.cfg.OldDeltaBackupTrigger.Seconds() < 1 {
+			if t.IsDropped() || t.isStopped() || t.lastWrittenMessage.IsZero() || t.cfg.OldDeltaBackupTrigger.Seconds() < 1 {
 				break
 			}
 
@@ -246,6 +472,30 @@ func (t *TableBackup) periodicBackup() {
 	}
 }
 
+// HasBasebackup reports whether the table has been backed up before, i.e. the
+// info file is either archived or waiting for the archiver
+func (t *TableBackup) HasBasebackup() bool {
+	for _, dir := range []string{t.archiveDir, t.tableDir} {
+		if _, err := os.Stat(path.Join(dir, t.infoFilename)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Priority orders the table in the base backup queue
+func (t *TableBackup) Priority() int {
+	switch t.cfg.TablePriority(t.tableName()) {
+	case config.PriorityHigh:
+		return 1
+	case config.PriorityLow:
+		return -1
+	}
+
+	return 0
+}
+
 func (t *TableBackup) String() string {
 	return t.Identifier.String()
 }
@@ -255,13 +505,13 @@ func (t *TableBackup) createDirs() error {
 	archiveDeltasPath := path.Join(t.archiveDir, deltasDir)
 
 	if _, err := os.Stat(deltasPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(deltasPath, dirPerms); err != nil {
+		if err := utils.MkdirAll(deltasPath, t.cfg.DirMode, t.cfg.FileGID()); err != nil {
 			return fmt.Errorf("could not create delta dir: %v", err)
 		}
 	}
 
 	if _, err := os.Stat(archiveDeltasPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(archiveDeltasPath, dirPerms); err != nil {
+		if err := utils.MkdirAll(archiveDeltasPath, t.cfg.DirMode, t.cfg.FileGID()); err != nil {
 			return fmt.Errorf("could not create archive delta dir: %v", err)
 		}
 	}
@@ -269,10 +519,50 @@ func (t *TableBackup) createDirs() error {
 	return nil
 }
 
+// createDeltaFile creates the delta file in its shard; the archiver removes
+// the shard left empty, possibly right before the file is created there
+func (t *TableBackup) createDeltaFile(filename string) (*os.File, error) {
+	filePath := path.Join(t.tableDir, filename)
+	for i := 0; ; i++ {
+		if err := utils.MkdirAll(path.Dir(filePath), t.cfg.DirMode, t.cfg.FileGID()); err != nil {
+			return nil, fmt.Errorf("could not create delta dir: %v", err)
+		}
+
+		fp, err := utils.CreateFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, t.cfg.FileMode, t.cfg.FileGID())
+		if os.IsNotExist(err) && i == 0 {
+			continue
+		}
+
+		return fp, err
+	}
+}
+
+// reshardDeltas moves the delta files written with another deltaShardPrefix
+// to the configured layout
+func (t *TableBackup) reshardDeltas() error {
+	if _, err := utils.ReshardDeltas(path.Join(t.tableDir, deltasDir), t.cfg.DeltaShardPrefix, t.cfg.DirMode, t.cfg.FileGID()); err != nil {
+		return err
+	}
+
+	// keep the garbage collector off while the files are being moved
+	unlock, err := utils.LockDir(t.archiveDir, false, t.cfg.FileMode, t.cfg.FileGID())
+	if err != nil {
+		return fmt.Errorf("could not lock %s: %v", t.archiveDir, err)
+	}
+	defer unlock()
+
+	n, err := utils.ReshardDeltas(path.Join(t.archiveDir, deltasDir), t.cfg.DeltaShardPrefix, t.cfg.DirMode, t.cfg.FileGID())
+	if n > 0 {
+		log.Printf("moved %d archived delta files of %s to the layout of deltaShardPrefix %d", n, t, t.cfg.DeltaShardPrefix)
+	}
+
+	return err
+}
+
 func (t *TableBackup) hasRows() (bool, error) {
 	var hasRows bool
 
-	row := t.conn.QueryRow(fmt.Sprintf("select exists(select 1 from %s)", t.Identifier.Sanitize()))
+	row := t.tx.QueryRow(fmt.Sprintf("select exists(select 1 from %s)", t.Identifier.Sanitize()))
 	err := row.Scan(&hasRows)
 
 	return hasRows, err
@@ -292,21 +582,120 @@ func (t *TableBackup) Truncate() error {
 	t.deltaFilesCnt = 0
 	t.filenamePostfix = 0
 
+	if atomic.CompareAndSwapUint32(&t.dropped, 1, 0) {
+		t.status.Lock()
+		t.status.Dropped = false
+		t.status.DroppedAt = time.Time{}
+		t.status.Unlock()
+	}
+
 	return nil
 }
 
-func (t *TableBackup) CloseOldFiles() error {
-	if t.lastWrittenMessage.IsZero() {
+// IsDropped tells whether the table was found dropped upstream
+func (t *TableBackup) IsDropped() bool {
+	return atomic.LoadUint32(&t.dropped) == 1
+}
+
+func (t *TableBackup) isStopped() bool {
+	return atomic.LoadUint32(&t.stopped) == 1
+}
+
+// Stop ends the backup of the table removed from the backup set, archiving
+// the current delta file; the files of the table are kept. It must be called
+// from the same goroutine as SaveRawMessage.
+func (t *TableBackup) Stop() error {
+	if !atomic.CompareAndSwapUint32(&t.stopped, 0, 1) {
+		return nil
+	}
+
+	log.Printf("table %s has been removed from the backup set; stopping its backup", t)
+
+	t.status.Lock()
+	t.status.Removed = true
+	t.status.Unlock()
+
+	return t.closeDelta()
+}
+
+// closeDelta fsyncs, closes and archives the current delta file; the next
+// change goes to a new file
+func (t *TableBackup) closeDelta() error {
+	if t.currentDeltaFp == nil {
+		return nil
+	}
+
+	if err := t.Sync(); err != nil {
+		return fmt.Errorf("could not sync %q: %v", t.currentDeltaFilename, err)
+	}
+
+	if err := t.currentDeltaFp.Close(); err != nil {
+		return fmt.Errorf("could not close %q: %v", t.currentDeltaFilename, err)
+	}
+	t.currentDeltaFp = nil
+
+	t.archive(t.currentDeltaFilename)
+
+	return nil
+}
+
+// markDropped stops the backup of the table dropped upstream. Depending on
+// the configuration the files of the table are either retained or removed.
+func (t *TableBackup) markDropped() error {
+	if !atomic.CompareAndSwapUint32(&t.dropped, 0, 1) {
+		return nil
+	}
+
+	log.Printf("table %s has been dropped; stopping its backup", t)
+	metrics.TablesDropped.Add(t.String(), 1)
+
+	t.status.Lock()
+	t.status.Dropped = true
+	t.status.DroppedAt = time.Now()
+	t.status.Unlock()
+
+	if t.cfg.DroppedTableAction != config.DroppedTablePurge {
 		return nil
 	}
 
-	if !t.lastWrittenMessage.IsZero() && time.Since(t.lastWrittenMessage) <= time.Hour*3 {
+	log.Printf("purging backup files of the dropped table %s", t)
+	if err := os.RemoveAll(t.tableDir); err != nil {
+		return fmt.Errorf("could not remove table dir: %v", err)
+	}
+
+	if err := os.RemoveAll(t.archiveDir); err != nil {
+		return fmt.Errorf("could not remove archive table dir: %v", err)
+	}
+
+	return nil
+}
+
+func (t *TableBackup) exists() (bool, error) {
+	var exists bool
+
+	row := t.conn.QueryRow(fmt.Sprintf("select to_regclass(%s) is not null", dbutils.QuoteLiteral(t.Identifier.Sanitize())))
+	err := row.Scan(&exists)
+
+	return exists, err
+}
+
+// CloseOldFiles closes the delta file of the table idle for longer than the
+// idleTimeout, so that the idle tables don't hold open files and their changes
+// reach the archive. It must be called from the same goroutine as SaveRawMessage.
+func (t *TableBackup) CloseOldFiles() error {
+	if t.currentDeltaFp == nil || t.cfg.IdleTimeout <= 0 || time.Since(t.lastWrittenMessage) <= t.cfg.IdleTimeout {
 		return nil
 	}
 
-	return t.currentDeltaFp.Close()
+	log.Printf("closing delta file %q of %s, idle since %s", t.currentDeltaFilename, t, t.lastWrittenMessage.Format(time.RFC3339))
+
+	return t.closeDelta()
 }
 
+// FetchRelationInfo returns the relation of the table from the catalog. The key
+// columns are the ones of the replica identity, all of them with FULL, the
+// way the relation messages mark them: the restore falls back to it once the
+// delta file with the relation message is removed.
 func FetchRelationInfo(tx *pgx.Tx, tbl message.Identifier) (message.Relation, error) {
 	var rel message.Relation
 	row := tx.QueryRow(fmt.Sprintf(`SELECT c.oid, c.relreplident 
@@ -323,11 +712,21 @@ func FetchRelationInfo(tx *pgx.Tx, tbl message.Identifier) (message.Relation, er
 		return rel, fmt.Errorf("could not fetch table info: %v", err)
 	}
 
+	attGenerated, err := attGeneratedColumn(tx)
+	if err != nil {
+		return rel, err
+	}
+
 	rows, err := tx.Query(fmt.Sprintf(`SELECT
     a.attname,
     t.oid,
 	a.atttypmod,
-	format_type(t.oid, a.atttypmod)
+	format_type(t.oid, a.atttypmod),
+	a.attidentity = 'a',
+	%s = 's',
+	c.relreplident = 'f' OR EXISTS (SELECT 1 FROM pg_catalog.pg_index i
+		WHERE i.indrelid = c.oid AND a.attnum = ANY(i.indkey)
+		AND (c.relreplident = 'd' AND i.indisprimary OR c.relreplident = 'i' AND i.indisreplident))
 FROM pg_catalog.pg_class c
 LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
 LEFT JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid
@@ -338,6 +737,7 @@ WHERE
     AND a.attisdropped = false
 ORDER BY
     a.attnum`,
+		attGenerated,
 		dbutils.QuoteLiteral(tbl.Namespace),
 		dbutils.QuoteLiteral(tbl.Name)))
 	if err != nil {
@@ -351,16 +751,20 @@ ORDER BY
 			attType    uint32
 			typMod     int32
 			formatType string
+
+			identityAlways, generated, isKey bool
 		)
-		if err := rows.Scan(&name, &attType, &typMod, &formatType); err != nil {
+		if err := rows.Scan(&name, &attType, &typMod, &formatType, &identityAlways, &generated, &isKey); err != nil {
 			return rel, fmt.Errorf("could not scan row: %v", err)
 		}
 		columns = append(columns, message.Column{
-			IsKey:         false,
-			Name:          name,
-			TypeOID:       attType,
-			Mode:          typMod,
-			FormattedType: formatType,
+			IsKey:          isKey,
+			Name:           name,
+			TypeOID:        attType,
+			Mode:           typMod,
+			FormattedType:  formatType,
+			IdentityAlways: identityAlways,
+			Generated:      generated,
 		})
 	}
 
@@ -373,7 +777,33 @@ ORDER BY
 	return rel, nil
 }
 
-func copyFile(src, dst string) (int64, error) {
+// ServerVersion returns the server_version_num of the server
+func ServerVersion(tx *pgx.Tx) (int, error) {
+	var version int
+
+	if err := tx.QueryRow("select current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return 0, fmt.Errorf("could not get server version: %v", err)
+	}
+
+	return version, nil
+}
+
+// attGeneratedColumn returns the expression for the attgenerated column of
+// pg_attribute, which appeared in PostgreSQL 12
+func attGeneratedColumn(tx *pgx.Tx) (string, error) {
+	version, err := ServerVersion(tx)
+	if err != nil {
+		return "", err
+	}
+
+	if version < 120000 {
+		return "''", nil
+	}
+
+	return "a.attgenerated", nil
+}
+
+func copyFile(src, dst string, mode os.FileMode, gid int) (int64, error) {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
 		return 0, err
@@ -389,12 +819,31 @@ func copyFile(src, dst string) (int64, error) {
 	}
 	defer source.Close()
 
-	destination, err := os.Create(dst)
+	destination, err := utils.CreateFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode, gid)
 	if err != nil {
 		return 0, err
 	}
 	defer destination.Close()
 	nBytes, err := io.Copy(destination, source)
+	if err != nil {
+		return nBytes, err
+	}
+
+	// the source is removed once copied, so the copy must survive the crash
+	if err := destination.Sync(); err != nil {
+		return nBytes, err
+	}
+
+	return nBytes, syncDir(path.Dir(dst))
+}
+
+// syncDir makes the entries of the dir, i.e. the file just created, durable
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
 
-	return nBytes, err
+	return fp.Sync()
 }
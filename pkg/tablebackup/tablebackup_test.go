@@ -0,0 +1,158 @@
+package tablebackup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/metrics"
+	"github.com/ikitiki/logical_backup/pkg/queue"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// newTestConfig returns the config with the temp and archive dirs of the
+// test, the settings in yml added
+func newTestConfig(t *testing.T, yml string) *config.Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	filename := path.Join(dir, "config.yaml")
+	data := fmt.Sprintf("tempDir: %s\narchiveDir: %s\ndeltasPerFile: 100\nbackupThreshold: 1000\n%s",
+		path.Join(dir, "temp"), path.Join(dir, "archive"), yml)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	cfg, err := config.New(filename, nil)
+	if err != nil {
+		t.Fatalf("could not read config: %v", err)
+	}
+
+	return cfg
+}
+
+// newTestTable returns the backup of public.test without a database, its
+// archiver not started
+func newTestTable(t *testing.T, cfg *config.Config) *TableBackup {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tbl := message.Identifier{Namespace: "public", Name: "test"}
+	tableDir := utils.TableDir(tbl)
+	tb := &TableBackup{
+		Identifier:         tbl,
+		ctx:                ctx,
+		cfg:                cfg,
+		tableDir:           path.Join(cfg.TempDir, tableDir),
+		archiveDir:         path.Join(cfg.ArchiveDir, tableDir),
+		basebackupFilename: copyFilename,
+		infoFilename:       infoFilename,
+		basebackupQueue:    queue.New(ctx),
+		msgLen:             make([]byte, 8),
+		archiveFiles:       make(chan string, archiverBuffer),
+		fsyncLatency:       metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+	if err := tb.createDirs(); err != nil {
+		t.Fatalf("could not create dirs: %v", err)
+	}
+
+	return tb
+}
+
+// waitArchived waits for the archiver to copy n delta files into the archive dir
+func waitArchived(t *testing.T, tb *TableBackup, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		tb.status.Lock()
+		archived := tb.status.ArchivedDeltas
+		tb.status.Unlock()
+		if archived >= n {
+			return
+		}
+	}
+	t.Fatalf("%d delta files archived, expected %d", tb.status.ArchivedDeltas, n)
+}
+
+// testGroup returns the group other than the one of the process the files
+// can be given to, -1 if none
+func testGroup() int {
+	if os.Getuid() == 0 {
+		return os.Getgid() + 4242
+	}
+
+	groups, _ := os.Getgroups()
+	for _, gid := range groups {
+		if gid != os.Getgid() {
+			return gid
+		}
+	}
+
+	return -1
+}
+
+func TestFileModeAndGroup(t *testing.T) {
+	gid := testGroup()
+	if gid < 0 {
+		t.Skip("the files can only be given to the group of the process")
+	}
+
+	cfg := newTestConfig(t, fmt.Sprintf("fileMode: 0600\ndirMode: 0700\nfileGroup: %d\ndeltaShardPrefix: 2\n", gid))
+	tb := newTestTable(t, cfg)
+	go tb.archiver()
+
+	if _, err := tb.SaveRawMessage([]byte("B"), 0x1000); err != nil {
+		t.Fatalf("could not save message: %v", err)
+	}
+	if err := tb.closeDelta(); err != nil {
+		t.Fatalf("could not close delta file: %v", err)
+	}
+	waitArchived(t, tb, 1)
+
+	if err := writeFile(path.Join(tb.archiveDir, LatestFilename), []byte("{}\n"), cfg.FileMode, cfg.FileGID()); err != nil {
+		t.Fatalf("could not write latest pointer: %v", err)
+	}
+	if err := utils.MkdirAll(path.Join(tb.tableDir, "a", "b"), cfg.DirMode, cfg.FileGID()); err != nil {
+		t.Fatalf("could not create dirs: %v", err)
+	}
+
+	files := 0
+	for _, root := range []string{cfg.TempDir, cfg.ArchiveDir} {
+		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			expected := cfg.FileMode
+			if info.IsDir() {
+				expected = cfg.DirMode | os.ModeDir
+			} else {
+				files++
+			}
+			if info.Mode() != expected {
+				t.Errorf("%s has mode %v, expected %v", p, info.Mode(), expected)
+			}
+			if fileGID := int(info.Sys().(*syscall.Stat_t).Gid); fileGID != gid {
+				t.Errorf("%s has group %d, expected %d", p, fileGID, gid)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("could not walk %s: %v", root, err)
+		}
+	}
+	if files != 3 {
+		t.Fatalf("found %d files, expected the archived delta, the latest pointer and the lock file", files)
+	}
+}
@@ -0,0 +1,114 @@
+package tablebackup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+)
+
+const (
+	tempSlotWaitTimeout  = 30 * time.Second
+	tempSlotPollInterval = time.Second
+)
+
+// createTempSlot creates the temp slot of the base backup. Its name is taken
+// from the pid of the connection, so it collides with the temp slot of the
+// crashed connection of the same pid the server hasn't dropped yet; that is
+// resolved according to config.DuplicateTempSlot.
+func (t *TableBackup) createTempSlot() error {
+	t.tempSlotSuffix = 0
+	deadline := time.Now().Add(tempSlotWaitTimeout)
+
+	for {
+		err := t.createTempReplicationSlot()
+		if !errors.Is(err, ErrSlotExists) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		// the failed command aborted the transaction
+		if t.tx != nil {
+			if err := t.txRollback(); err != nil {
+				return fmt.Errorf("could not rollback tx: %v", err)
+			}
+		}
+
+		if err := t.resolveDuplicateSlot(); err != nil {
+			return err
+		}
+
+		if t.cfg.SlotSnapshotAction != config.SlotSnapshotExport {
+			if err := t.txBegin(); err != nil {
+				return fmt.Errorf("could not start transaction: %w", err)
+			}
+		}
+	}
+}
+
+// resolveDuplicateSlot gets the existing temp slot out of the way of the next
+// attempt to create it
+func (t *TableBackup) resolveDuplicateSlot() error {
+	name := t.tempSlotName()
+
+	switch t.cfg.DuplicateTempSlot {
+	case config.DuplicateTempSlotWait:
+		log.Printf("replication slot %s already exists; waiting for it to be dropped", name)
+		select {
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-time.After(tempSlotPollInterval):
+		}
+	case config.DuplicateTempSlotDrop:
+		exists, alive, err := t.slotBackend(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+		if alive {
+			return newError(ErrSlotExists, fmt.Sprintf("replication slot %s is active in a live backend", name), nil)
+		}
+
+		log.Printf("dropping replication slot %s of a dead backend", name)
+		if _, err := t.conn.Exec(fmt.Sprintf("DROP_REPLICATION_SLOT %s", name)); err != nil {
+			return fmt.Errorf("could not drop replication slot %s: %v", name, err)
+		}
+	default:
+		t.tempSlotSuffix++
+		log.Printf("replication slot %s already exists; creating %s instead", name, t.tempSlotName())
+	}
+
+	return nil
+}
+
+// slotBackend reports whether the slot exists and whether the backend it is
+// active in, if any, is still alive
+func (t *TableBackup) slotBackend(name string) (exists bool, alive bool, err error) {
+	var pid int32
+	err = t.conn.QueryRow(`select coalesce(active_pid, 0)
+		from pg_replication_slots
+		where slot_name = $1`, name).Scan(&pid)
+	if err == pgx.ErrNoRows {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, fmt.Errorf("could not fetch replication slot %s: %v", name, err)
+	}
+	if pid == 0 {
+		return true, false, nil
+	}
+
+	if err := t.conn.QueryRow("select exists(select 1 from pg_stat_activity where pid = $1)", pid).Scan(&alive); err != nil {
+		return true, false, fmt.Errorf("could not check backend %d: %v", pid, err)
+	}
+
+	return true, alive, nil
+}
@@ -0,0 +1,77 @@
+package tablebackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+func TestDuplicateSlotError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"duplicate object", pgx.PgError{Code: duplicateObjectCode}, true},
+		{"wrapped duplicate object", fmt.Errorf("could not scan: %w", pgx.PgError{Code: duplicateObjectCode}), true},
+		{"other error code", pgx.PgError{Code: lockNotAvailableCode}, false},
+		{"not a server error", errors.New("replication slot already exists"), false},
+		{"no error", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isDuplicateObject(tt.err); got != tt.want {
+			t.Errorf("%s: isDuplicateObject(%v) = %t, expected %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	pgErr := pgx.PgError{Code: duplicateObjectCode, Message: `replication slot "tempslot_42" already exists`}
+	err := fmt.Errorf("could not create temp slot: %w", newError(ErrSlotExists, "could not scan", pgErr))
+	if !errors.Is(err, ErrSlotExists) {
+		t.Errorf("%v is not ErrSlotExists", err)
+	}
+	if errors.Is(err, ErrNoConsistentPoint) {
+		t.Errorf("%v is ErrNoConsistentPoint", err)
+	}
+	var cause pgx.PgError
+	if !errors.As(err, &cause) || cause.Code != duplicateObjectCode {
+		t.Errorf("%v does not wrap the server error", err)
+	}
+}
+
+func TestResolveDuplicateSlotRename(t *testing.T) {
+	tb := newTestTable(t, newTestConfig(t, "duplicateTempSlot: rename\n"))
+	tb.conn = &pgx.Conn{}
+
+	if name := tb.tempSlotName(); name != "tempslot_0" {
+		t.Fatalf("temp slot name %q, expected tempslot_0", name)
+	}
+	for _, expected := range []string{"tempslot_0_1", "tempslot_0_2"} {
+		if err := tb.resolveDuplicateSlot(); err != nil {
+			t.Fatalf("could not resolve the duplicate slot: %v", err)
+		}
+		if name := tb.tempSlotName(); name != expected {
+			t.Errorf("temp slot name %q, expected %q", name, expected)
+		}
+	}
+}
+
+func TestResolveDuplicateSlotWait(t *testing.T) {
+	tb := newTestTable(t, newTestConfig(t, "duplicateTempSlot: wait\n"))
+	tb.conn = &pgx.Conn{}
+
+	ctx, cancel := context.WithCancel(tb.ctx)
+	cancel()
+	tb.ctx = ctx
+
+	// the same name is retried, only until the backup is stopped
+	if err := tb.resolveDuplicateSlot(); !errors.Is(err, context.Canceled) {
+		t.Errorf("resolveDuplicateSlot() = %v, expected %v", err, context.Canceled)
+	}
+	if name := tb.tempSlotName(); name != "tempslot_0" {
+		t.Errorf("temp slot name %q, expected tempslot_0", name)
+	}
+}
@@ -0,0 +1,34 @@
+package tablebackup
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// hypertable returns the TimescaleDB hypertable the table is a chunk of, nil
+// if it's not a chunk or the extension is not installed
+func (t *TableBackup) hypertable() (*message.Identifier, error) {
+	var installed bool
+	if err := t.tx.QueryRow("select to_regclass('_timescaledb_catalog.chunk') is not null").Scan(&installed); err != nil {
+		return nil, fmt.Errorf("could not check timescaledb catalog: %v", err)
+	}
+	if !installed {
+		return nil, nil
+	}
+
+	var h message.Identifier
+	err := t.tx.QueryRow(`select h.schema_name::text, h.table_name::text
+from _timescaledb_catalog.chunk c
+join _timescaledb_catalog.hypertable h on h.id = c.hypertable_id
+where c.schema_name = $1 and c.table_name = $2`, t.Namespace, t.Name).Scan(&h.Namespace, &h.Name)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not fetch hypertable: %v", err)
+	}
+
+	return &h, nil
+}
@@ -0,0 +1,104 @@
+package tablebackup
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// markUnsupportedColumns applies the unsupportedColumns setting to the columns
+// of the types missing from the data types of the connection, i.e. the
+// composites, the domains and the types created after those were fetched.
+// Their values are only known as text.
+func (t *TableBackup) markUnsupportedColumns(rel *message.Relation) error {
+	return markColumns(rel, t.cfg.UnsupportedColumns, t.String(), t.supportedType)
+}
+
+// markColumns marks the columns of the types not supported according to the
+// unsupportedColumns policy, failing on them with the fail one
+func markColumns(rel *message.Relation, policy string, table string, supported func(oid uint32) (bool, error)) error {
+	names := make([]string, 0)
+	for i, c := range rel.Columns {
+		if c.Generated {
+			continue
+		}
+		if ok, err := supported(c.TypeOID); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+
+		names = append(names, fmt.Sprintf("%s (%s)", c.Name, c.FormattedType))
+		switch policy {
+		case config.UnsupportedColumnsText:
+			rel.Columns[i].Raw = true
+		case config.UnsupportedColumnsSkip:
+			rel.Columns[i].Skipped = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case config.UnsupportedColumnsFail:
+		return fmt.Errorf("columns of unsupported types: %s", strings.Join(names, ", "))
+	case config.UnsupportedColumnsSkip:
+		log.Printf("not backing up the columns of unsupported types of %s: %s", table, strings.Join(names, ", "))
+	default:
+		log.Printf("storing the columns of unsupported types of %s as text: %s", table, strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// supportedType tells whether the values of the type round-trip through the
+// deltas, see typeSupported
+func (t *TableBackup) supportedType(oid uint32) (bool, error) {
+	return typeSupported(t.conn.ConnInfo, oid, t.baseType)
+}
+
+// typeSupported tells whether the values of the type round-trip through the
+// deltas: the types of the connection, as well as the arrays and the ranges of
+// such types, i.e. the arrays of ranges or the user-defined ranges, which the
+// restore reads from their text form by the type of the column. The nulls
+// within the arrays are part of that form.
+func typeSupported(ci *pgtype.ConnInfo, oid uint32, baseType func(oid uint32) (uint32, error)) (bool, error) {
+	if _, ok := ci.DataTypeForOID(pgtype.OID(oid)); ok {
+		return true, nil
+	}
+
+	base, err := baseType(oid)
+	if err != nil || base == 0 {
+		return false, err
+	}
+
+	return typeSupported(ci, base, baseType)
+}
+
+// baseType returns the element type of the array type or the subtype of the
+// range type, 0 for the other types
+func (t *TableBackup) baseType(oid uint32) (uint32, error) {
+	var elem, subtype uint32
+	row := t.tx.QueryRow(`select t.typelem, coalesce(r.rngsubtype, 0)
+from pg_catalog.pg_type t
+left join pg_catalog.pg_range r on r.rngtypid = t.oid
+where t.oid = $1 and (t.typcategory = 'A' or t.typtype = 'r')`, oid)
+	if err := row.Scan(&elem, &subtype); err == pgx.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("could not fetch type %d: %v", oid, err)
+	}
+
+	if subtype != 0 {
+		return subtype, nil
+	}
+
+	return elem, nil
+}
@@ -0,0 +1,123 @@
+package tablebackup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/pgtype"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+const (
+	addressOID      = 16400 // composite
+	addressArrayOID = 16399
+	emailOID        = 16500 // domain over text
+	addressRangeOID = 16600 // range over the composite
+)
+
+// testTypes returns the data types of the connection and the element types
+// of the arrays and the subtypes of the ranges
+func testTypes() (*pgtype.ConnInfo, func(oid uint32) (uint32, error)) {
+	ci := pgtype.NewConnInfo()
+	ci.RegisterDataType(pgtype.DataType{Value: &pgtype.Int4{}, Name: "int4", OID: pgtype.Int4OID})
+	ci.RegisterDataType(pgtype.DataType{Value: &pgtype.Text{}, Name: "text", OID: pgtype.TextOID})
+
+	base := map[uint32]uint32{
+		pgtype.Int4ArrayOID: pgtype.Int4OID,
+		3904:                pgtype.Int4OID, // int4range, not known by the connection
+		addressArrayOID:     addressOID,
+		addressRangeOID:     addressOID,
+	}
+
+	return ci, func(oid uint32) (uint32, error) { return base[oid], nil }
+}
+
+func TestTypeSupported(t *testing.T) {
+	ci, baseType := testTypes()
+
+	tests := []struct {
+		name     string
+		oid      uint32
+		expected bool
+	}{
+		{"known type", pgtype.Int4OID, true},
+		{"array", pgtype.Int4ArrayOID, true},
+		{"range", 3904, true},
+		{"composite", addressOID, false},
+		{"array of composites", addressArrayOID, false},
+		{"range of composites", addressRangeOID, false},
+		{"domain", emailOID, false},
+	}
+
+	for _, tt := range tests {
+		got, err := typeSupported(ci, tt.oid, baseType)
+		if err != nil {
+			t.Fatalf("%s: could not check type %d: %v", tt.name, tt.oid, err)
+		}
+		if got != tt.expected {
+			t.Errorf("%s: typeSupported(%d) = %t, expected %t", tt.name, tt.oid, got, tt.expected)
+		}
+	}
+}
+
+func TestMarkColumns(t *testing.T) {
+	ci, baseType := testTypes()
+	supported := func(oid uint32) (bool, error) { return typeSupported(ci, oid, baseType) }
+
+	newRel := func() message.Relation {
+		return message.Relation{Columns: []message.Column{
+			{Name: "id", TypeOID: pgtype.Int4OID, FormattedType: "integer"},
+			{Name: "address", TypeOID: addressOID, FormattedType: "address"},
+			{Name: "emails", TypeOID: emailOID, FormattedType: "email"},
+			{Name: "ids", TypeOID: pgtype.Int4ArrayOID, FormattedType: "integer[]"},
+			// never backed up: not marked
+			{Name: "city", TypeOID: addressOID, FormattedType: "address", Generated: true},
+		}}
+	}
+
+	tests := []struct {
+		policy  string
+		raw     []string
+		skipped []string
+		err     string
+	}{
+		{policy: config.UnsupportedColumnsText, raw: []string{"address", "emails"}},
+		{policy: config.UnsupportedColumnsSkip, skipped: []string{"address", "emails"}},
+		{policy: config.UnsupportedColumnsFail, err: "columns of unsupported types: address (address), emails (email)"},
+	}
+
+	for _, tt := range tests {
+		rel := newRel()
+		err := markColumns(&rel, tt.policy, "public.test", supported)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, expected %q", tt.policy, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not mark columns: %v", tt.policy, err)
+		}
+
+		var raw, skipped []string
+		for _, c := range rel.Columns {
+			if c.Raw {
+				raw = append(raw, c.Name)
+			}
+			if c.Skipped {
+				skipped = append(skipped, c.Name)
+			}
+		}
+		if strings.Join(raw, ",") != strings.Join(tt.raw, ",") || strings.Join(skipped, ",") != strings.Join(tt.skipped, ",") {
+			t.Errorf("%s: raw columns %v, skipped %v, expected %v and %v", tt.policy, raw, skipped, tt.raw, tt.skipped)
+		}
+	}
+
+	// only the supported columns: nothing to fail on
+	rel := message.Relation{Columns: newRel().Columns[:1]}
+	if err := markColumns(&rel, config.UnsupportedColumnsFail, "public.test", supported); err != nil {
+		t.Errorf("could not mark the supported columns: %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package tablebackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/config"
+	"github.com/ikitiki/logical_backup/pkg/decoder"
+	"github.com/ikitiki/logical_backup/pkg/message"
+	"github.com/ikitiki/logical_backup/pkg/utils"
+)
+
+// Validation is the outcome of the check of the table backup: whether the
+// deltas stored after the latest base backup form a chain restoring the table
+type Validation struct {
+	Table            string     `json:"table"`
+	BasebackupFormat string     `json:"basebackupFormat,omitempty"`
+	BasebackupTime   *time.Time `json:"basebackupTime,omitempty"`
+	StartLSN         string     `json:"startLSN,omitempty"`   // of the base backup
+	LastLSN          string     `json:"lastLSN,omitempty"`    // of the latest transaction in the deltas
+	LastCommit       *time.Time `json:"lastCommit,omitempty"` // of the latest transaction committed in the deltas
+	Latest           string     `json:"latest,omitempty"`     // the start lsn of the base backup the latest pointer points to
+	Files            int        `json:"files"`                // delta files checked
+	Gap              string     `json:"gap,omitempty"`        // the first gap found
+	Error            string     `json:"error,omitempty"`      // the check itself failed
+}
+
+type validationFile struct {
+	name    string // relative to the deltas dir
+	dir     string // the archive or the temp dir, if not archived yet
+	lsn     uint64
+	postfix uint64
+}
+
+// Validate checks that the deltas since the base backup are all there. The
+// name of every delta file is the lsn of the transaction its first message
+// belongs to, so each file must either start with the begin of that
+// transaction or continue the one left unfinished by the previous file. The
+// base backup must also be taken after slotLSN, the consistent point the
+// replication slot was created at, if known: the changes before it were not
+// streamed. A missing file holding only complete transactions can't be told
+// apart from the period without changes. The archive dir is locked while
+// checking, holding off the archiver of the table.
+func (t *TableBackup) Validate(slotLSN uint64) Validation {
+	v := Validation{Table: t.String()}
+
+	if gap, err := validate(t.archiveDir, t.tableDir, slotLSN, 0, 0, t.cfg, &v); err != nil {
+		v.Error = err.Error()
+	} else {
+		v.Gap = gap
+	}
+
+	return v
+}
+
+// ListBackups validates the backups of all tables found in the archive dir,
+// including the ones not backed up anymore, e.g. dropped. Each table is listed
+// with its latest base backup, restorable up to the lastLSN of the deltas
+// unless there is a gap; the previous one is only checked by ValidateArchive. The deltas not archived yet are not seen here.
+func ListBackups(archiveDir string) ([]Validation, error) {
+	res := make([]Validation, 0)
+
+	err := filepath.Walk(archiveDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == PreviousDir {
+			return filepath.SkipDir // checked along with the latest base backup
+		}
+		if info.IsDir() || info.Name() != infoFilename {
+			return nil
+		}
+
+		var v Validation
+		if gap, err := validate(path.Dir(p), "", 0, 0, 0, nil, &v); err != nil {
+			v.Error = err.Error()
+		} else {
+			v.Gap = gap
+		}
+		if v.Table == "" {
+			v.Table, _ = filepath.Rel(archiveDir, path.Dir(p))
+		}
+		res = append(res, v)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk archive dir: %v", err)
+	}
+
+	return res, nil
+}
+
+// ValidateArchive checks the backup of the table in its archive dir the same
+// way as Validate, up to the transaction at toLSN if not 0, for the restore
+// from the base backup starting at or before basebackupLSN, see BasebackupDir.
+// Nothing is written to the archive dir, which may be read-only.
+func ValidateArchive(archiveDir string, basebackupLSN, toLSN uint64) Validation {
+	var v Validation
+
+	if gap, err := validate(archiveDir, "", 0, basebackupLSN, toLSN, nil, &v); err != nil {
+		v.Error = err.Error()
+	} else {
+		v.Gap = gap
+	}
+
+	return v
+}
+
+// validate checks the backup in archiveDir from the base backup starting at or
+// before basebackupLSN, if set; the deltas not archived yet are looked up in
+// tableDir, if not empty. The transactions past toLSN, if set, are not checked. The backup, given its cfg, locks the archive dir
+// exclusively; without cfg the shared lock is taken instead, only holding off
+// the garbage collector, so that the read-only archive could be checked.
+func validate(archiveDir, tableDir string, slotLSN, basebackupLSN, toLSN uint64, cfg *config.Config, v *Validation) (string, error) {
+	var (
+		unlock func()
+		err    error
+	)
+	if cfg == nil {
+		unlock, err = utils.ReadLockDir(archiveDir)
+	} else {
+		unlock, err = utils.LockDir(archiveDir, true, cfg.FileMode, cfg.FileGID())
+	}
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	basebackupDir, err := BasebackupDir(archiveDir, basebackupLSN)
+	if err != nil {
+		return "", err
+	}
+
+	fp, err := os.Open(path.Join(basebackupDir, infoFilename))
+	if os.IsNotExist(err) {
+		return "no base backup in the archive", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not open info file: %v", err)
+	}
+
+	var info message.DumpInfo
+	err = yaml.NewDecoder(fp).Decode(&info)
+	fp.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not decode info file: %v", err)
+	}
+
+	if v.Table == "" && info.Relation.Name != "" {
+		v.Table = info.Relation.Identifier.String()
+	}
+
+	startLSN, err := pgx.ParseLSN(info.StartLSN)
+	if err != nil {
+		return "", fmt.Errorf("could not parse lsn: %v", err)
+	}
+
+	latest, err := ReadLatest(basebackupDir)
+	if err != nil {
+		return "", err
+	}
+	if latest != nil {
+		v.Latest = latest.StartLSN
+		if latest.StartLSN != info.StartLSN {
+			return fmt.Sprintf("base backup at %s is not completely archived, latest points to %s",
+				info.StartLSN, latest.StartLSN), nil
+		}
+	}
+	deltasOnly := info.Format == config.DumpFormatDeltasOnly
+	if !deltasOnly {
+		v.StartLSN = info.StartLSN
+		v.BasebackupFormat = info.Format
+		if v.BasebackupFormat == "" {
+			v.BasebackupFormat = config.BasebackupFormatCopy
+		}
+		if !info.CreateDate.IsZero() {
+			v.BasebackupTime = &info.CreateDate
+		}
+	}
+
+	if !deltasOnly && info.Footers {
+		dumpFiles := info.Parts
+		if len(dumpFiles) == 0 {
+			dumpFiles = []string{copyFilename}
+		}
+		for _, name := range dumpFiles {
+			if err := checkFooter(path.Join(basebackupDir, name)); err != nil {
+				return fmt.Sprintf("base backup file %s: %v", name, err), nil
+			}
+		}
+	}
+
+	if !deltasOnly && slotLSN != 0 && startLSN < slotLSN {
+		return fmt.Sprintf("base backup at %s predates the replication slot created at %s, the changes in between are missing",
+			info.StartLSN, pgx.FormatLSN(slotLSN)), nil
+	}
+
+	files, err := validationFiles(archiveDir, tableDir)
+	if err != nil {
+		return "", err
+	}
+
+	// the files before the one the base backup falls into are not needed
+	first := 0
+	for first < len(files)-1 && files[first+1].lsn <= startLSN {
+		first++
+	}
+
+	var (
+		txLSN uint64 // of the transaction left unfinished by the previous file
+		inTx  bool
+		done  bool // past toLSN
+	)
+	for i, f := range files[first:] {
+		if toLSN != 0 && f.lsn > toLSN && !inTx {
+			break
+		}
+		last := first+i == len(files)-1
+		filename := path.Join(f.dir, deltasDir, f.name)
+
+		firstMsg := true
+		err := readDeltas(filename, func(m message.Message) error {
+			switch msg := m.(type) {
+			case message.Begin:
+				// the transactions after the last fsync are streamed again after restart
+				if inTx && msg.FinalLSN > txLSN {
+					return fmt.Errorf("%s: transaction %s is incomplete", f.name, pgx.FormatLSN(txLSN))
+				}
+				if firstMsg && msg.FinalLSN != f.lsn {
+					return fmt.Errorf("%s: starts with transaction %s", f.name, pgx.FormatLSN(msg.FinalLSN))
+				}
+				if toLSN != 0 && msg.FinalLSN > toLSN {
+					done = true
+					return errValidated
+				}
+
+				txLSN, inTx = msg.FinalLSN, true
+				v.LastLSN = pgx.FormatLSN(txLSN)
+			case message.Commit:
+				inTx = false
+				ts := msg.Timestamp
+				v.LastCommit = &ts
+			default:
+				// the transaction started in the previous file, which is only
+				// allowed to be missing if the transaction is in the base backup
+				if firstMsg && !(inTx && txLSN == f.lsn) {
+					if i > 0 || f.lsn > startLSN {
+						return fmt.Errorf("%s: starts in the middle of a transaction", f.name)
+					}
+					txLSN = f.lsn
+				}
+				inTx = true
+			}
+			firstMsg = false
+
+			return nil
+		})
+		v.Files++
+
+		// the newest file may be written to while being read
+		if done {
+			break
+		} else if err == io.ErrUnexpectedEOF && last {
+			break
+		} else if _, ok := err.(gapError); ok {
+			return err.Error(), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// checkFooter makes sure the base backup file is complete, without reading
+// the data
+func checkFooter(filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = ReadFooter(fp)
+
+	return err
+}
+
+// gapError is returned by the callback of readDeltas on a gap in the chain
+type gapError struct {
+	error
+}
+
+// errValidated stops readDeltas past the lsn checked up to
+var errValidated = errors.New("validated")
+
+func readDeltas(filename string, fn func(message.Message) error) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	dr, err := decoder.NewDeltaReader(fp)
+	if err != nil {
+		return err
+	}
+
+	for {
+		m, err := dr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("could not read %q: %v", filename, err)
+		}
+
+		if err := fn(m); err != nil {
+			return gapError{err}
+		}
+	}
+}
+
+// validationFiles lists the delta files in the archive dir and the ones in the
+// temp dir not archived yet, ordered by the lsn
+func validationFiles(archiveDir, tableDir string) ([]validationFile, error) {
+	byName := make(map[string]validationFile)
+
+	// the archived copy is complete, while the archiver may still be removing
+	// the temp one
+	for _, dir := range []string{tableDir, archiveDir} {
+		if dir == "" {
+			continue
+		}
+
+		entries, err := utils.ReadDeltaDir(path.Join(dir, deltasDir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read directory: %v", err)
+		}
+
+		for _, e := range entries {
+			parts := strings.SplitN(e.Name(), ".", 2)
+
+			f := validationFile{name: e.Path, dir: dir}
+			if f.lsn, err = strconv.ParseUint(parts[0], 16, 64); err != nil {
+				continue
+			}
+			if len(parts) == 2 {
+				if f.postfix, err = strconv.ParseUint(parts[1], 16, 32); err != nil {
+					continue
+				}
+			}
+
+			byName[e.Name()] = f
+		}
+	}
+
+	files := make([]validationFile, 0, len(byName))
+	for _, f := range byName {
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].lsn != files[j].lsn {
+			return files[i].lsn < files[j].lsn
+		}
+
+		return files[i].postfix < files[j].postfix
+	})
+
+	return files, nil
+}
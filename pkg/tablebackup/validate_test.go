@@ -0,0 +1,112 @@
+package tablebackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ikitiki/logical_backup/pkg/message"
+)
+
+// transaction returns the pgoutput messages of the transaction at lsn
+// inserting one row
+func transaction(lsn uint64) [][]byte {
+	begin := &bytes.Buffer{}
+	begin.WriteByte('B')
+	binary.Write(begin, binary.BigEndian, lsn)
+	binary.Write(begin, binary.BigEndian, uint64(0))
+	binary.Write(begin, binary.BigEndian, uint32(lsn))
+
+	insert := &bytes.Buffer{}
+	insert.WriteByte('I')
+	binary.Write(insert, binary.BigEndian, uint32(1))
+	insert.WriteByte('N')
+	binary.Write(insert, binary.BigEndian, uint16(1))
+	insert.WriteByte('t')
+	binary.Write(insert, binary.BigEndian, uint32(1))
+	insert.WriteString("1")
+
+	commit := &bytes.Buffer{}
+	commit.WriteByte('C')
+	commit.WriteByte(0)
+	binary.Write(commit, binary.BigEndian, lsn)
+	binary.Write(commit, binary.BigEndian, lsn+1)
+	binary.Write(commit, binary.BigEndian, uint64(0))
+
+	return [][]byte{begin.Bytes(), insert.Bytes(), commit.Bytes()}
+}
+
+func TestEmptyBasebackupWithDeltas(t *testing.T) {
+	const startLSN = 100
+
+	for _, footers := range []bool{true, false} {
+		// every transaction gets its own delta file
+		tb := newTestTable(t, newTestConfig(t, "deltasPerFile: 3\n"))
+
+		// the table has no rows: the dump is only the footer, or no bytes at
+		// all in the archives written without footers
+		fp, err := os.Create(path.Join(tb.archiveDir, copyFilename))
+		if err != nil {
+			t.Fatalf("could not create dump file: %v", err)
+		}
+		dw := newDumpWriter(fp, tb.cfg)
+		if footers {
+			if err := dw.writeFooter(false); err != nil {
+				t.Fatalf("could not write footer: %v", err)
+			}
+		}
+		if err := dw.Flush(); err != nil {
+			t.Fatalf("could not flush dump file: %v", err)
+		}
+		fp.Close()
+
+		data, err := yaml.Marshal(message.DumpInfo{
+			StartLSN:   pgx.FormatLSN(startLSN),
+			CreateDate: time.Now(),
+			Relation:   message.Relation{Identifier: tb.Identifier},
+			Footers:    footers,
+		})
+		if err != nil {
+			t.Fatalf("could not encode info file: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(tb.archiveDir, infoFilename), data, 0600); err != nil {
+			t.Fatalf("could not write info file: %v", err)
+		}
+		if err := tb.updateLatest(); err != nil {
+			t.Fatalf("footers %t: could not point latest to the empty base backup: %v", footers, err)
+		}
+
+		// the rows inserted before the base backup, i.e. removed since, and after it
+		for _, lsn := range []uint64{50, 150, 200} {
+			for _, msg := range transaction(lsn) {
+				if _, err := tb.SaveRawMessage(msg, lsn); err != nil {
+					t.Fatalf("could not save message: %v", err)
+				}
+			}
+		}
+		if err := tb.Sync(); err != nil {
+			t.Fatalf("could not sync deltas: %v", err)
+		}
+
+		v := tb.Validate(0)
+		if v.Error != "" || v.Gap != "" {
+			t.Fatalf("footers %t: validation failed: error %q, gap %q", footers, v.Error, v.Gap)
+		}
+		if v.StartLSN != pgx.FormatLSN(startLSN) || v.Latest != v.StartLSN {
+			t.Errorf("footers %t: start lsn %q, latest %q, expected %q", footers, v.StartLSN, v.Latest, pgx.FormatLSN(startLSN))
+		}
+		if v.LastLSN != pgx.FormatLSN(200) {
+			t.Errorf("footers %t: last lsn %q, expected %q", footers, v.LastLSN, pgx.FormatLSN(200))
+		}
+		if v.Files != 3 {
+			t.Errorf("footers %t: %d delta files checked, expected 3", footers, v.Files)
+		}
+	}
+}
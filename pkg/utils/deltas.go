@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// DeltaRetention keeps the delta files the latest base backup doesn't need
+// for a while, for the restore from an earlier copy of the base backup, i.e.
+// the point in time right before the latest one
+type DeltaRetention struct {
+	Period time.Duration // the files modified within the period are kept
+	Files  int           // the number of the latest such files kept
+}
+
+// Expired reports whether the i-th of the n files not needed anymore, ordered
+// by lsn, modified at modTime, is past the retention. The files are removed
+// from the oldest one up to the first one kept, leaving no gaps behind.
+func (r DeltaRetention) Expired(i, n int, modTime, now time.Time) bool {
+	if i >= n-r.Files {
+		return false
+	}
+
+	return r.Period <= 0 || now.Sub(modTime) > r.Period
+}
+
+// DeltaFile is a file of the deltas dir, either in the dir itself or in one of
+// its shards
+type DeltaFile struct {
+	os.FileInfo
+	Path string // relative to the deltas dir
+}
+
+// DeltaPath returns the path of the delta file of the name relative to the
+// deltas dir: in the shard named after the first prefixLen hex digits of the
+// name, so that the files of a range of the wal share a dir; the name itself
+// with no sharding
+func DeltaPath(name string, prefixLen int) string {
+	if prefixLen <= 0 || prefixLen >= len(name) {
+		return name
+	}
+
+	return path.Join(name[:prefixLen], name)
+}
+
+// ReadDeltaDir lists the files in the deltas dir and in its shards; either
+// layout, or a mix of them, may be there
+func ReadDeltaDir(dir string) ([]DeltaFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]DeltaFile, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, DeltaFile{FileInfo: e, Path: e.Name()})
+			continue
+		}
+
+		shard, err := ioutil.ReadDir(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range shard {
+			if !f.IsDir() {
+				files = append(files, DeltaFile{FileInfo: f, Path: path.Join(e.Name(), f.Name())})
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// RemoveEmptyShards removes the shards of the deltas dir left with no files
+func RemoveEmptyShards(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		shard := path.Join(dir, e.Name())
+		if files, err := ioutil.ReadDir(shard); err == nil && len(files) == 0 {
+			if err := os.Remove(shard); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not remove %q: %v", shard, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReshardDeltas moves the files of the deltas dir to their places in the
+// layout of prefixLen, migrating the flat deltas dir to the sharded one and
+// back; the shard dirs are created with the mode and the group gid. It
+// returns the number of files moved.
+func ReshardDeltas(dir string, prefixLen int, mode os.FileMode, gid int) (int, error) {
+	files, err := ReadDeltaDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("could not read directory: %v", err)
+	}
+
+	moved := 0
+	for _, f := range files {
+		target := DeltaPath(f.Name(), prefixLen)
+		if target == f.Path {
+			continue
+		}
+
+		if err := MkdirAll(path.Join(dir, path.Dir(target)), mode, gid); err != nil {
+			return moved, fmt.Errorf("could not create shard dir: %v", err)
+		}
+		if _, err := os.Stat(path.Join(dir, target)); err == nil {
+			continue // already there, the one in the old place is left alone
+		}
+		if err := os.Rename(path.Join(dir, f.Path), path.Join(dir, target)); err != nil {
+			return moved, fmt.Errorf("could not move %q: %v", f.Path, err)
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		if err := RemoveEmptyShards(dir); err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users on the
+// filesystem of the dir
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("could not stat filesystem: %v", err)
+	}
+
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"os"
+	"path"
+)
+
+// SetGroup changes the group of the file to gid, unless it's negative
+func SetGroup(name string, gid int) error {
+	if gid < 0 {
+		return nil
+	}
+
+	return os.Chown(name, -1, gid)
+}
+
+// CreateFile opens the file like os.OpenFile, creating it with the mode and
+// the group gid, unless it's negative
+func CreateFile(name string, flag int, mode os.FileMode, gid int) (*os.File, error) {
+	fp, err := os.OpenFile(name, flag|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid >= 0 {
+		if err := fp.Chown(-1, gid); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+
+	return fp, nil
+}
+
+// MkdirAll creates the dir along with its parents like os.MkdirAll, changing
+// the group of the ones created to gid, unless it's negative
+func MkdirAll(dir string, mode os.FileMode, gid int) error {
+	if gid < 0 {
+		return os.MkdirAll(dir, mode)
+	}
+
+	var created []string
+	for d := path.Clean(dir); ; d = path.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		created = append(created, d)
+		if d == path.Dir(d) {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := os.Chown(d, -1, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// LockFilename is the lock file of the table archive dir, held shared by the
+// archiver while it copies a file and exclusively by the garbage collector
+const LockFilename = "archive.lock"
+
+// LockDir locks the dir, waiting until the lock is available; the lock file is
+// created with the mode and the group gid, unless it's negative
+func LockDir(dir string, exclusive bool, mode os.FileMode, gid int) (func(), error) {
+	fp, err := CreateFile(path.Join(dir, LockFilename), os.O_RDWR, mode, gid)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(fp.Fd()), how); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("could not lock: %v", err)
+	}
+
+	return func() {
+		syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+		fp.Close()
+	}, nil
+}
+
+// ReadLockDir takes the shared lock of the dir without creating the lock file,
+// for the readers of the archive dir, which may be read-only; the dir without
+// the lock file is not locked
+func ReadLockDir(dir string) (func(), error) {
+	fp, err := os.Open(path.Join(dir, LockFilename))
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_SH); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("could not lock: %v", err)
+	}
+
+	return func() {
+		syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+		fp.Close()
+	}, nil
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TempFileSuffix is appended to the name of the files being written, which
+// are renamed once complete
+const TempFileSuffix = ".new"
+
+// RemoveTempFiles removes the incomplete files left in the dir and its
+// subdirs, i.e. by a crash in the middle of a base backup; it must only be
+// called while nothing writes there. It returns the number of files removed.
+func RemoveTempFiles(dir string) (int, error) {
+	removed := 0
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), TempFileSuffix) {
+			return nil
+		}
+
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove %q: %v", p, err)
+		}
+		removed++
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return removed, nil
+	} else if err != nil {
+		return removed, fmt.Errorf("could not walk %q: %v", dir, err)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	tableDir := filepath.Join(dir, "public.test")
+	if err := os.MkdirAll(filepath.Join(tableDir, "deltas"), 0700); err != nil {
+		t.Fatalf("could not create dirs: %v", err)
+	}
+
+	// the files a crash in the middle of a base backup leaves behind
+	stale := []string{
+		filepath.Join(tableDir, "info.yaml.new"),
+		filepath.Join(tableDir, "basebackup.copy.new"),
+		filepath.Join(tableDir, "deltas", "0000000000000001.new"),
+	}
+	kept := []string{
+		filepath.Join(tableDir, "info.yaml"),
+		filepath.Join(tableDir, "basebackup.copy"),
+		filepath.Join(tableDir, "deltas", "0000000000000001"),
+		filepath.Join(tableDir, "new"),
+	}
+	for _, filename := range append(append([]string{}, stale...), kept...) {
+		if err := ioutil.WriteFile(filename, []byte("data"), 0600); err != nil {
+			t.Fatalf("could not write %s: %v", filename, err)
+		}
+	}
+
+	n, err := RemoveTempFiles(dir)
+	if err != nil {
+		t.Fatalf("could not remove temp files: %v", err)
+	}
+	if n != len(stale) {
+		t.Errorf("removed %d files, expected %d", n, len(stale))
+	}
+
+	var left []string
+	if err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			left = append(left, p)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("could not walk %s: %v", dir, err)
+	}
+	sort.Strings(left)
+	sort.Strings(kept)
+	if len(left) != len(kept) {
+		t.Fatalf("files left: %v, expected %v", left, kept)
+	}
+	for i := range kept {
+		if left[i] != kept[i] {
+			t.Fatalf("files left: %v, expected %v", left, kept)
+		}
+	}
+
+	// nothing is left to remove on the next start
+	if n, err := RemoveTempFiles(dir); err != nil || n != 0 {
+		t.Errorf("RemoveTempFiles() again = %d, %v, expected 0, nil", n, err)
+	}
+}
+
+func TestRemoveTempFilesNoDir(t *testing.T) {
+	n, err := RemoveTempFiles(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || n != 0 {
+		t.Errorf("RemoveTempFiles() = %d, %v, expected 0, nil", n, err)
+	}
+}